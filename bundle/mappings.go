@@ -0,0 +1,63 @@
+package bundle
+
+import (
+	"io"
+	"os"
+	"os/user"
+	"strconv"
+)
+
+// RootlessMappings returns the mappings of a rootless container for the current user:
+// the root of the container is the user, and the ids from 1 are its subordinate ids in /etc/subuid and /etc/subgid.
+// The runtime needs newuidmap and newgidmap for the subordinate ids, without them only root is mapped.
+func RootlessMappings() (uids, gids []IDMapping, err error) {
+	uid, gid := os.Geteuid(), os.Getegid()
+	name := ""
+	if u, err := user.LookupId(strconv.Itoa(uid)); err == nil {
+		name = u.Username
+	}
+	if uids, err = subMappings(uint32(uid), name, "/etc/subuid"); err != nil {
+		return nil, nil, err
+	}
+	if gids, err = subMappings(uint32(gid), name, "/etc/subgid"); err != nil {
+		return nil, nil, err
+	}
+	return uids, gids, nil
+}
+
+func subMappings(id uint32, name, file string) ([]IDMapping, error) {
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return mappings(id, name, nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return mappings(id, name, f)
+}
+
+// mappings maps the root of the container to id and the ids from 1 to the first range of name or id in sub,
+// a subuid or subgid file that may be nil
+func mappings(id uint32, name string, sub io.Reader) ([]IDMapping, error) {
+	m := []IDMapping{{ContainerID: 0, HostID: id, Size: 1}}
+	if sub == nil {
+		return m, nil
+	}
+	entries, err := parseIDFile(sub)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if e[0] != name && e[0] != strconv.FormatUint(uint64(id), 10) {
+			continue
+		}
+		start, err1 := strconv.ParseUint(e[1], 10, 32)
+		size, err2 := strconv.ParseUint(e[2], 10, 32)
+		if err1 != nil || err2 != nil || size == 0 {
+			continue
+		}
+		return append(m, IDMapping{ContainerID: 1, HostID: uint32(start), Size: uint32(size)}), nil
+	}
+	return m, nil
+}
@@ -0,0 +1,414 @@
+// Package bundle generates the config.json of an OCI runtime bundle from an image config,
+// following the conversion of the image spec, for runtimes like runc or crun.
+package bundle
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	v1 "github.com/regclient/regclient/types/oci/v1"
+)
+
+const (
+	// Version of the runtime spec
+	Version = "1.0.2"
+
+	defaultPath = "PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+)
+
+var (
+	// ErrUnknownUser is returned for a user or group of the image config that is not in the passwd or group file of the rootfs
+	ErrUnknownUser = errors.New("unknown user")
+)
+
+// DefaultCapabilities are the capabilities of the process, the default set of docker and containerd
+var DefaultCapabilities = []string{
+	"CAP_CHOWN",
+	"CAP_DAC_OVERRIDE",
+	"CAP_FSETID",
+	"CAP_FOWNER",
+	"CAP_MKNOD",
+	"CAP_NET_RAW",
+	"CAP_SETGID",
+	"CAP_SETUID",
+	"CAP_SETFCAP",
+	"CAP_SETPCAP",
+	"CAP_NET_BIND_SERVICE",
+	"CAP_SYS_CHROOT",
+	"CAP_KILL",
+	"CAP_AUDIT_WRITE",
+}
+
+// Options configures the spec
+type Options struct {
+	// Rootless writes a spec for a runtime started by an unprivileged user, like runc spec --rootless:
+	// a user namespace with the mappings, no network namespace, /sys bind mounted and no cgroup settings
+	Rootless bool
+	// UIDMappings and GIDMappings of the user namespace of a rootless container,
+	// default to mapping the root of the container to the current user, see RootlessMappings
+	UIDMappings []IDMapping
+	GIDMappings []IDMapping
+}
+
+// Spec is the part of the runtime spec written to config.json
+type Spec struct {
+	Version     string            `json:"ociVersion"`
+	Process     *Process          `json:"process,omitempty"`
+	Root        *Root             `json:"root,omitempty"`
+	Hostname    string            `json:"hostname,omitempty"`
+	Mounts      []Mount           `json:"mounts,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Linux       *Linux            `json:"linux,omitempty"`
+}
+
+// Process is the container process
+type Process struct {
+	Terminal        bool          `json:"terminal,omitempty"`
+	User            User          `json:"user"`
+	Args            []string      `json:"args,omitempty"`
+	Env             []string      `json:"env,omitempty"`
+	Cwd             string        `json:"cwd"`
+	Capabilities    *Capabilities `json:"capabilities,omitempty"`
+	Rlimits         []Rlimit      `json:"rlimits,omitempty"`
+	NoNewPrivileges bool          `json:"noNewPrivileges,omitempty"`
+}
+
+// User of the process
+type User struct {
+	UID            uint32   `json:"uid"`
+	GID            uint32   `json:"gid"`
+	AdditionalGids []uint32 `json:"additionalGids,omitempty"`
+}
+
+// Capabilities of the process
+type Capabilities struct {
+	Bounding    []string `json:"bounding,omitempty"`
+	Effective   []string `json:"effective,omitempty"`
+	Inheritable []string `json:"inheritable,omitempty"`
+	Permitted   []string `json:"permitted,omitempty"`
+	Ambient     []string `json:"ambient,omitempty"`
+}
+
+// Rlimit of the process
+type Rlimit struct {
+	Type string `json:"type"`
+	Hard uint64 `json:"hard"`
+	Soft uint64 `json:"soft"`
+}
+
+// Root is the root filesystem, relative to the bundle
+type Root struct {
+	Path     string `json:"path"`
+	Readonly bool   `json:"readonly,omitempty"`
+}
+
+// Mount is a mount of the container
+type Mount struct {
+	Destination string   `json:"destination"`
+	Type        string   `json:"type,omitempty"`
+	Source      string   `json:"source,omitempty"`
+	Options     []string `json:"options,omitempty"`
+}
+
+// Linux has the linux specific settings
+type Linux struct {
+	UIDMappings   []IDMapping `json:"uidMappings,omitempty"`
+	GIDMappings   []IDMapping `json:"gidMappings,omitempty"`
+	Resources     *Resources  `json:"resources,omitempty"`
+	Namespaces    []Namespace `json:"namespaces,omitempty"`
+	MaskedPaths   []string    `json:"maskedPaths,omitempty"`
+	ReadonlyPaths []string    `json:"readonlyPaths,omitempty"`
+}
+
+// IDMapping maps Size ids from ContainerID in the container to HostID
+type IDMapping struct {
+	ContainerID uint32 `json:"containerID"`
+	HostID      uint32 `json:"hostID"`
+	Size        uint32 `json:"size"`
+}
+
+// Resources are the cgroup settings
+type Resources struct {
+	Devices []DeviceCgroup `json:"devices,omitempty"`
+}
+
+// DeviceCgroup allows or denies access to devices
+type DeviceCgroup struct {
+	Allow  bool   `json:"allow"`
+	Access string `json:"access,omitempty"`
+}
+
+// Namespace of the container
+type Namespace struct {
+	Type string `json:"type"`
+}
+
+// NewSpec returns the spec of the image config for the root filesystem in rootfs,
+// whose passwd and group files resolve the user of the config
+func NewSpec(conf v1.Image, rootfs string, opts Options) (*Spec, error) {
+	c := conf.Config
+	user, err := resolveUser(c.User, rootfs)
+	if err != nil {
+		return nil, err
+	}
+	env := c.Env
+	if !hasEnv(env, "PATH") {
+		env = append([]string{defaultPath}, env...)
+	}
+	cwd := c.WorkingDir
+	if cwd == "" {
+		cwd = "/"
+	}
+	spec := &Spec{
+		Version: Version,
+		Process: &Process{
+			User: user,
+			Args: append(append([]string{}, c.Entrypoint...), c.Cmd...),
+			Env:  env,
+			Cwd:  cwd,
+			Capabilities: &Capabilities{
+				Bounding:  DefaultCapabilities,
+				Effective: DefaultCapabilities,
+				Permitted: DefaultCapabilities,
+			},
+			Rlimits:         []Rlimit{{Type: "RLIMIT_NOFILE", Hard: 1024, Soft: 1024}},
+			NoNewPrivileges: true,
+		},
+		Root: &Root{Path: "rootfs"},
+		Mounts: []Mount{
+			{Destination: "/proc", Type: "proc", Source: "proc"},
+			{Destination: "/dev", Type: "tmpfs", Source: "tmpfs", Options: []string{"nosuid", "strictatime", "mode=755", "size=65536k"}},
+			{Destination: "/dev/pts", Type: "devpts", Source: "devpts", Options: []string{"nosuid", "noexec", "newinstance", "ptmxmode=0666", "mode=0620", "gid=5"}},
+			{Destination: "/dev/shm", Type: "tmpfs", Source: "shm", Options: []string{"nosuid", "noexec", "nodev", "mode=1777", "size=65536k"}},
+			{Destination: "/dev/mqueue", Type: "mqueue", Source: "mqueue", Options: []string{"nosuid", "noexec", "nodev"}},
+			{Destination: "/sys", Type: "sysfs", Source: "sysfs", Options: []string{"nosuid", "noexec", "nodev", "ro"}},
+			{Destination: "/sys/fs/cgroup", Type: "cgroup", Source: "cgroup", Options: []string{"nosuid", "noexec", "nodev", "relatime", "ro"}},
+		},
+		Annotations: annotations(conf),
+		Linux: &Linux{
+			Resources: &Resources{Devices: []DeviceCgroup{{Allow: false, Access: "rwm"}}},
+			Namespaces: []Namespace{
+				{Type: "pid"}, {Type: "network"}, {Type: "ipc"}, {Type: "uts"}, {Type: "mount"}, {Type: "cgroup"},
+			},
+			MaskedPaths: []string{
+				"/proc/acpi", "/proc/asound", "/proc/kcore", "/proc/keys", "/proc/latency_stats", "/proc/timer_list",
+				"/proc/timer_stats", "/proc/sched_debug", "/sys/firmware", "/proc/scsi",
+			},
+			ReadonlyPaths: []string{
+				"/proc/bus", "/proc/fs", "/proc/irq", "/proc/sys", "/proc/sysrq-trigger",
+			},
+		},
+	}
+	if opts.Rootless {
+		rootless(spec, opts)
+	}
+	return spec, nil
+}
+
+// rootless changes the spec like runc spec --rootless
+func rootless(spec *Spec, opts Options) {
+	spec.Linux.UIDMappings, spec.Linux.GIDMappings = opts.UIDMappings, opts.GIDMappings
+	if len(spec.Linux.UIDMappings) == 0 {
+		spec.Linux.UIDMappings = []IDMapping{{HostID: uint32(os.Geteuid()), Size: 1}}
+	}
+	if len(spec.Linux.GIDMappings) == 0 {
+		spec.Linux.GIDMappings = []IDMapping{{HostID: uint32(os.Getegid()), Size: 1}}
+	}
+	// the network namespace is left out, it has no interfaces without a privileged helper
+	namespaces := []Namespace{}
+	for _, ns := range spec.Linux.Namespaces {
+		if ns.Type != "network" {
+			namespaces = append(namespaces, ns)
+		}
+	}
+	spec.Linux.Namespaces = append(namespaces, Namespace{Type: "user"})
+	mounts := []Mount{}
+	for _, m := range spec.Mounts {
+		switch m.Destination {
+		case "/sys":
+			// sysfs can only be mounted with a network namespace
+			m = Mount{Destination: "/sys", Type: "none", Source: "/sys", Options: []string{"rbind", "nosuid", "noexec", "nodev", "ro"}}
+		case "/sys/fs/cgroup":
+			// part of the /sys bind mount
+			continue
+		}
+		options := []string{}
+		for _, o := range m.Options {
+			// the ids may not be mapped
+			if !strings.HasPrefix(o, "uid=") && !strings.HasPrefix(o, "gid=") {
+				options = append(options, o)
+			}
+		}
+		m.Options = options
+		mounts = append(mounts, m)
+	}
+	spec.Mounts = mounts
+	spec.Linux.Resources = nil
+}
+
+// annotations returns the annotations of the image config conversion
+func annotations(conf v1.Image) map[string]string {
+	a := map[string]string{}
+	for k, v := range conf.Config.Labels {
+		a[k] = v
+	}
+	if conf.OS != "" {
+		a["org.opencontainers.image.os"] = conf.OS
+	}
+	if conf.Architecture != "" {
+		a["org.opencontainers.image.architecture"] = conf.Architecture
+	}
+	if conf.Variant != "" {
+		a["org.opencontainers.image.variant"] = conf.Variant
+	}
+	if conf.Author != "" {
+		a["org.opencontainers.image.author"] = conf.Author
+	}
+	if conf.Created != nil {
+		a["org.opencontainers.image.created"] = conf.Created.UTC().Format(time.RFC3339)
+	}
+	if conf.Config.StopSignal != "" {
+		a["org.opencontainers.image.stopSignal"] = conf.Config.StopSignal
+	}
+	if len(conf.Config.ExposedPorts) > 0 {
+		ports := make([]string, 0, len(conf.Config.ExposedPorts))
+		for p := range conf.Config.ExposedPorts {
+			ports = append(ports, p)
+		}
+		sort.Strings(ports)
+		a["org.opencontainers.image.exposedPorts"] = strings.Join(ports, ",")
+	}
+	if len(a) == 0 {
+		return nil
+	}
+	return a
+}
+
+func hasEnv(env []string, name string) bool {
+	for _, e := range env {
+		if k, _, _ := strings.Cut(e, "="); k == name {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveUser returns the ids of user, a name or id with an optional group name or id,
+// and the supplementary groups of a user name
+func resolveUser(user, rootfs string) (User, error) {
+	u := User{}
+	if user == "" {
+		return u, nil
+	}
+	name, group, hasGroup := strings.Cut(user, ":")
+	passwd, err := readIDFile(filepath.Join(rootfs, "etc", "passwd"))
+	if err != nil {
+		return u, err
+	}
+	if id, err := strconv.ParseUint(name, 10, 32); err == nil {
+		u.UID = uint32(id)
+		name = ""
+		// the primary group of a known id
+		for _, e := range passwd {
+			if e[2] == strconv.FormatUint(id, 10) && len(e) > 3 {
+				gid, _ := strconv.ParseUint(e[3], 10, 32)
+				u.GID, name = uint32(gid), e[0]
+				break
+			}
+		}
+	} else {
+		found := false
+		for _, e := range passwd {
+			if e[0] == name && len(e) > 3 {
+				uid, err1 := strconv.ParseUint(e[2], 10, 32)
+				gid, err2 := strconv.ParseUint(e[3], 10, 32)
+				if err1 != nil || err2 != nil {
+					continue
+				}
+				u.UID, u.GID, found = uint32(uid), uint32(gid), true
+				break
+			}
+		}
+		if !found {
+			return u, fmt.Errorf("%w: %s is not in /etc/passwd of the image", ErrUnknownUser, name)
+		}
+	}
+	groups, err := readIDFile(filepath.Join(rootfs, "etc", "group"))
+	if err != nil {
+		return u, err
+	}
+	if hasGroup {
+		if id, err := strconv.ParseUint(group, 10, 32); err == nil {
+			u.GID = uint32(id)
+		} else {
+			found := false
+			for _, e := range groups {
+				if e[0] == group {
+					gid, err := strconv.ParseUint(e[2], 10, 32)
+					if err != nil {
+						continue
+					}
+					u.GID, found = uint32(gid), true
+					break
+				}
+			}
+			if !found {
+				return u, fmt.Errorf("%w: group %s is not in /etc/group of the image", ErrUnknownUser, group)
+			}
+		}
+	}
+	if name == "" {
+		return u, nil
+	}
+	for _, e := range groups {
+		if len(e) < 4 {
+			continue
+		}
+		for _, member := range strings.Split(e[3], ",") {
+			if member != name {
+				continue
+			}
+			if gid, err := strconv.ParseUint(e[2], 10, 32); err == nil && uint32(gid) != u.GID {
+				u.AdditionalGids = append(u.AdditionalGids, uint32(gid))
+			}
+		}
+	}
+	return u, nil
+}
+
+// readIDFile returns the colon separated fields of the lines of a passwd or group file with at least 3 fields,
+// a missing file or one that is not a regular file, e.g. a symlink out of the rootfs, has no entries
+func readIDFile(file string) ([][]string, error) {
+	if fi, err := os.Lstat(file); err != nil || !fi.Mode().IsRegular() {
+		return nil, nil
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseIDFile(f)
+}
+
+func parseIDFile(r io.Reader) ([][]string, error) {
+	entries := [][]string{}
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if fields := strings.Split(line, ":"); len(fields) >= 3 {
+			entries = append(entries, fields)
+		}
+	}
+	return entries, s.Err()
+}
@@ -0,0 +1,128 @@
+package bundle
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	v1 "github.com/regclient/regclient/types/oci/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func testRootfs(t *testing.T) string {
+	t.Helper()
+	rootfs := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(rootfs, "etc"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(rootfs, "etc", "passwd"), []byte(`root:x:0:0:root:/root:/bin/sh
+# comment
+nginx:x:101:101:nginx:/var/cache/nginx:/sbin/nologin
+broken:x:abc
+`), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(rootfs, "etc", "group"), []byte(`root:x:0:
+www-data:x:33:nginx
+nginx:x:101:
+audio:x:29:other,nginx
+`), 0644))
+	return rootfs
+}
+
+func TestNewSpec(t *testing.T) {
+	rootfs := testRootfs(t)
+	created := time.Date(2023, 5, 3, 8, 0, 0, 0, time.UTC)
+	conf := v1.Image{
+		Created:      &created,
+		Architecture: "amd64",
+		OS:           "linux",
+		Config: v1.ImageConfig{
+			User:         "nginx",
+			Env:          []string{"NGINX_VERSION=1.25"},
+			Entrypoint:   []string{"/docker-entrypoint.sh"},
+			Cmd:          []string{"nginx", "-g", "daemon off;"},
+			WorkingDir:   "/srv",
+			StopSignal:   "SIGQUIT",
+			ExposedPorts: map[string]struct{}{"80/tcp": {}, "443/tcp": {}},
+			Labels:       map[string]string{"maintainer": "nginx"},
+		},
+	}
+	spec, err := NewSpec(conf, rootfs, Options{})
+	require.NoError(t, err)
+	require.Equal(t, Version, spec.Version)
+	require.Equal(t, []string{"/docker-entrypoint.sh", "nginx", "-g", "daemon off;"}, spec.Process.Args)
+	require.Equal(t, []string{defaultPath, "NGINX_VERSION=1.25"}, spec.Process.Env)
+	require.Equal(t, "/srv", spec.Process.Cwd)
+	require.Equal(t, User{UID: 101, GID: 101, AdditionalGids: []uint32{33, 29}}, spec.Process.User)
+	require.Equal(t, DefaultCapabilities, spec.Process.Capabilities.Bounding)
+	require.Equal(t, "rootfs", spec.Root.Path)
+	require.Equal(t, map[string]string{
+		"maintainer":                            "nginx",
+		"org.opencontainers.image.os":           "linux",
+		"org.opencontainers.image.architecture": "amd64",
+		"org.opencontainers.image.created":      "2023-05-03T08:00:00Z",
+		"org.opencontainers.image.stopSignal":   "SIGQUIT",
+		"org.opencontainers.image.exposedPorts": "443/tcp,80/tcp",
+	}, spec.Annotations)
+	require.Contains(t, spec.Linux.Namespaces, Namespace{Type: "network"})
+	require.Empty(t, spec.Linux.UIDMappings)
+	b, err := json.Marshal(spec)
+	require.NoError(t, err)
+	require.Contains(t, string(b), `"ociVersion":"1.0.2"`)
+
+	spec, err = NewSpec(conf, rootfs, Options{Rootless: true, UIDMappings: []IDMapping{{HostID: 1000, Size: 1}, {ContainerID: 1, HostID: 100000, Size: 65536}}})
+	require.NoError(t, err)
+	require.Len(t, spec.Linux.UIDMappings, 2)
+	require.Equal(t, []IDMapping{{HostID: uint32(os.Getegid()), Size: 1}}, spec.Linux.GIDMappings)
+	require.NotContains(t, spec.Linux.Namespaces, Namespace{Type: "network"})
+	require.Contains(t, spec.Linux.Namespaces, Namespace{Type: "user"})
+	require.Nil(t, spec.Linux.Resources)
+	for _, m := range spec.Mounts {
+		require.NotEqual(t, "/sys/fs/cgroup", m.Destination)
+		require.NotContains(t, strings.Join(m.Options, ","), "gid=")
+		if m.Destination == "/sys" {
+			require.Equal(t, "/sys", m.Source)
+			require.Contains(t, m.Options, "rbind")
+		}
+	}
+}
+
+func TestResolveUser(t *testing.T) {
+	rootfs := testRootfs(t)
+	for _, tc := range []struct {
+		user string
+		want User
+	}{
+		{"", User{}},
+		{"root", User{}},
+		{"101", User{UID: 101, GID: 101, AdditionalGids: []uint32{33, 29}}},
+		{"1000", User{UID: 1000}},
+		{"1000:1000", User{UID: 1000, GID: 1000}},
+		{"nginx:www-data", User{UID: 101, GID: 33, AdditionalGids: []uint32{29}}},
+		{"0:audio", User{GID: 29}},
+	} {
+		u, err := resolveUser(tc.user, rootfs)
+		require.NoError(t, err, tc.user)
+		require.Equal(t, tc.want, u, tc.user)
+	}
+	for _, user := range []string{"missing", "nginx:missing", "broken"} {
+		_, err := resolveUser(user, rootfs)
+		require.ErrorIs(t, err, ErrUnknownUser, user)
+	}
+	// without a passwd file only ids work
+	_, err := resolveUser("nginx", t.TempDir())
+	require.ErrorIs(t, err, ErrUnknownUser)
+}
+
+func TestMappings(t *testing.T) {
+	sub := strings.NewReader("other:100000:65536\nme:165536:65536\n1000:300000:10\n")
+	m, err := mappings(1000, "me", sub)
+	require.NoError(t, err)
+	require.Equal(t, []IDMapping{{HostID: 1000, Size: 1}, {ContainerID: 1, HostID: 165536, Size: 65536}}, m)
+	m, err = mappings(1001, "", strings.NewReader("1001:200000:5\n"))
+	require.NoError(t, err)
+	require.Equal(t, []IDMapping{{HostID: 1001, Size: 1}, {ContainerID: 1, HostID: 200000, Size: 5}}, m)
+	m, err = mappings(1000, "me", nil)
+	require.NoError(t, err)
+	require.Equal(t, []IDMapping{{HostID: 1000, Size: 1}}, m)
+}
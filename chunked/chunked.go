@@ -0,0 +1,391 @@
+// Package chunked writes a seekable image layer from tar entries, as eStargz or zstd:chunked,
+// so snapshotters like the stargz snapshotter or containers/storage can fetch the files of a container lazily.
+//
+// Both formats compress the tar in many independent gzip members or zstd frames, a new one starting
+// at the content of each file and every ChunkSize bytes of it, and add a table of contents (TOC)
+// with the offsets and digests of the files and chunks. The layer stays a valid gzip or zstd stream
+// of the tar, so it is pulled like any other layer by runtimes that do not know the format.
+// The TOC is located with the annotations returned by Annotations, which go on the layer descriptor.
+// zstd:chunked layers are written without the tar-split data of newer containers/storage versions,
+// which then pull them in full.
+package chunked
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	// FormatEStargz is a gzip layer with the TOC as the last tar entry, stargz.index.json
+	FormatEStargz = "estargz"
+	// FormatZstdChunked is a zstd layer with the TOC in a skippable frame
+	FormatZstdChunked = "zstd:chunked"
+
+	// DefaultChunkSize is the largest part of a file in one gzip member or zstd frame
+	DefaultChunkSize = 4 << 20
+
+	// AnnotationTOCDigest is the digest of the TOC of an eStargz layer
+	AnnotationTOCDigest = "containerd.io/snapshot/stargz/toc.digest"
+	// AnnotationUncompressedSize is the size of the tar of an eStargz layer
+	AnnotationUncompressedSize = "io.containers.estargz.uncompressed-size"
+	// AnnotationManifestChecksum is the digest of the compressed TOC of a zstd:chunked layer
+	AnnotationManifestChecksum = "io.github.containers.zstd-chunked.manifest-checksum"
+	// AnnotationManifestPosition is the offset, compressed and uncompressed size and type of the TOC of a zstd:chunked layer
+	AnnotationManifestPosition = "io.github.containers.zstd-chunked.manifest-position"
+
+	tocTarName = "stargz.index.json"
+	// footerSize of an eStargz layer, an empty gzip member with the TOC offset in the extra field
+	footerSize = 51
+	// zstdFooterSize is the content of the last skippable frame of a zstd:chunked layer
+	zstdFooterSize = 64
+	// manifestTypeCRFS is the TOC format of zstd:chunked, shared with eStargz
+	manifestTypeCRFS = 1
+)
+
+var (
+	// ErrInvalidOption is returned for an unknown format or a negative chunk size
+	ErrInvalidOption = errors.New("invalid chunked option")
+
+	zstdSkippableMagic = []byte{0x50, 0x2a, 0x4d, 0x18}
+	zstdChunkedMagic   = []byte{0x47, 0x6e, 0x55, 0x6c, 0x49, 0x6e, 0x55, 0x78}
+)
+
+// Options configures the layer
+type Options struct {
+	// Format is FormatEStargz or FormatZstdChunked
+	Format string
+	// ChunkSize splits larger files into chunks of this size, defaults to DefaultChunkSize
+	ChunkSize int64
+}
+
+// toc is the table of contents, the JSON of eStargz and zstd:chunked only differ in the fields each of them ignores
+type toc struct {
+	Version int        `json:"version"`
+	Entries []tocEntry `json:"entries"`
+}
+
+type tocEntry struct {
+	Name        string            `json:"name"`
+	Type        string            `json:"type"`
+	Size        int64             `json:"size,omitempty"`
+	ModTime     string            `json:"modtime,omitempty"`
+	LinkName    string            `json:"linkName,omitempty"`
+	Mode        int64             `json:"mode,omitempty"`
+	UID         int               `json:"uid,omitempty"`
+	GID         int               `json:"gid,omitempty"`
+	Uname       string            `json:"userName,omitempty"`
+	Gname       string            `json:"groupName,omitempty"`
+	Offset      int64             `json:"offset,omitempty"`
+	EndOffset   int64             `json:"endOffset,omitempty"` // zstd:chunked only
+	DevMajor    int64             `json:"devMajor,omitempty"`
+	DevMinor    int64             `json:"devMinor,omitempty"`
+	Xattrs      map[string][]byte `json:"xattrs,omitempty"`
+	Digest      string            `json:"digest,omitempty"`
+	ChunkOffset int64             `json:"chunkOffset,omitempty"`
+	ChunkSize   int64             `json:"chunkSize,omitempty"`
+	ChunkDigest string            `json:"chunkDigest,omitempty"`
+}
+
+var tocTypes = map[byte]string{
+	tar.TypeDir:     "dir",
+	tar.TypeReg:     "reg",
+	tar.TypeSymlink: "symlink",
+	tar.TypeLink:    "hardlink",
+	tar.TypeChar:    "char",
+	tar.TypeBlock:   "block",
+	tar.TypeFifo:    "fifo",
+}
+
+// frameWriter is a gzip member or a zstd frame, Reset starts the next one
+type frameWriter interface {
+	io.WriteCloser
+	Reset(w io.Writer)
+}
+
+// Writer writes a layer from tar entries, in the order they are added
+type Writer struct {
+	opts   Options
+	cw     *countWriter // the compressed layer
+	fw     frameWriter
+	open   bool // a gzip member or zstd frame is started
+	tw     *tar.Writer
+	diffID digest.Digester // of the tar
+	size   int64           // of the tar
+	toc    toc
+	annot  map[string]string
+}
+
+// NewWriter returns a Writer for w, Close must be called to write the TOC
+func NewWriter(w io.Writer, opts Options) (*Writer, error) {
+	if opts.ChunkSize == 0 {
+		opts.ChunkSize = DefaultChunkSize
+	}
+	if opts.ChunkSize < 0 {
+		return nil, fmt.Errorf("%w: chunk size %d", ErrInvalidOption, opts.ChunkSize)
+	}
+	lw := &Writer{
+		opts:   opts,
+		cw:     &countWriter{w: w},
+		diffID: digest.Canonical.Digester(),
+		toc:    toc{Version: 1, Entries: []tocEntry{}},
+	}
+	switch opts.Format {
+	case FormatEStargz:
+		lw.fw = gzip.NewWriter(nil)
+	case FormatZstdChunked:
+		enc, err := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		lw.fw = enc
+	default:
+		return nil, fmt.Errorf("%w: format %q, use %s or %s", ErrInvalidOption, opts.Format, FormatEStargz, FormatZstdChunked)
+	}
+	lw.tw = tar.NewWriter(tarStream{lw})
+	return lw, nil
+}
+
+// Add writes an entry, r is read for regular files
+func (lw *Writer) Add(th *tar.Header, r io.Reader) error {
+	typ, ok := tocTypes[th.Typeflag]
+	if !ok {
+		return nil
+	}
+	name := strings.TrimPrefix(path.Clean("/"+th.Name), "/")
+	ent := tocEntry{
+		Name:     name,
+		Type:     typ,
+		ModTime:  th.ModTime.UTC().Format(time.RFC3339),
+		Mode:     th.Mode,
+		UID:      th.Uid,
+		GID:      th.Gid,
+		Uname:    th.Uname,
+		Gname:    th.Gname,
+		DevMajor: th.Devmajor,
+		DevMinor: th.Devminor,
+	}
+	switch th.Typeflag {
+	case tar.TypeSymlink:
+		ent.LinkName = th.Linkname
+	case tar.TypeLink:
+		ent.LinkName = strings.TrimPrefix(path.Clean("/"+th.Linkname), "/")
+	case tar.TypeReg:
+		ent.Size = th.Size
+	}
+	for k, v := range th.PAXRecords {
+		if x, ok := strings.CutPrefix(k, "SCHILY.xattr."); ok {
+			if ent.Xattrs == nil {
+				ent.Xattrs = map[string][]byte{}
+			}
+			ent.Xattrs[x] = []byte(v)
+		}
+	}
+	if err := lw.tw.WriteHeader(th); err != nil {
+		return err
+	}
+	if th.Typeflag != tar.TypeReg || th.Size == 0 {
+		lw.toc.Entries = append(lw.toc.Entries, ent)
+		return nil
+	}
+
+	// each chunk starts a gzip member or zstd frame, so it can be decompressed on its own
+	file := digest.Canonical.Digester()
+	first := len(lw.toc.Entries)
+	for off := int64(0); off < th.Size; {
+		if err := lw.closeFrame(); err != nil {
+			return err
+		}
+		size := min(lw.opts.ChunkSize, th.Size-off)
+		ent.Offset, ent.ChunkOffset, ent.ChunkSize = lw.cw.n, off, size
+		chunk := digest.Canonical.Digester()
+		if _, err := io.CopyN(lw.tw, io.TeeReader(r, io.MultiWriter(chunk.Hash(), file.Hash())), size); err != nil {
+			return err
+		}
+		ent.ChunkDigest = chunk.Digest().String()
+		lw.toc.Entries = append(lw.toc.Entries, ent)
+		ent = tocEntry{Name: name, Type: "chunk"}
+		off += size
+	}
+	// the padding stays in the frame of the file and the next header starts a new one,
+	// so the TOC of eStargz is at the start of its member
+	if err := lw.tw.Flush(); err != nil {
+		return err
+	}
+	if err := lw.closeFrame(); err != nil {
+		return err
+	}
+	lw.toc.Entries[first].Digest = file.Digest().String()
+	if lw.opts.Format == FormatZstdChunked {
+		lw.toc.Entries[first].EndOffset = lw.cw.n
+	}
+	return nil
+}
+
+// Close writes the end of the tar and the TOC
+func (lw *Writer) Close() error {
+	b, err := json.Marshal(lw.toc)
+	if err != nil {
+		lw.Discard()
+		return err
+	}
+	if lw.opts.Format == FormatEStargz {
+		err = lw.closeEStargz(b)
+	} else {
+		err = lw.closeZstdChunked(b)
+	}
+	if err != nil {
+		lw.Discard()
+	}
+	return err
+}
+
+// closeEStargz writes the TOC as the last tar entry in its own gzip member and the footer with its offset
+func (lw *Writer) closeEStargz(b []byte) error {
+	if err := lw.closeFrame(); err != nil {
+		return err
+	}
+	tocOffset := lw.cw.n
+	if err := lw.tw.WriteHeader(&tar.Header{Name: tocTarName, Typeflag: tar.TypeReg, Mode: 0444, Size: int64(len(b)), ModTime: time.Unix(0, 0)}); err != nil {
+		return err
+	}
+	if _, err := lw.tw.Write(b); err != nil {
+		return err
+	}
+	if err := lw.tw.Close(); err != nil {
+		return err
+	}
+	if err := lw.closeFrame(); err != nil {
+		return err
+	}
+	if _, err := lw.cw.Write(estargzFooter(tocOffset)); err != nil {
+		return err
+	}
+	lw.annot = map[string]string{
+		AnnotationTOCDigest:        digest.FromBytes(b).String(),
+		AnnotationUncompressedSize: strconv.FormatInt(lw.size, 10),
+	}
+	return nil
+}
+
+// estargzFooter returns an empty gzip member with the TOC offset in the extra field.
+// It is built by hand as the stored empty block of compress/flate changed between Go versions.
+func estargzFooter(tocOffset int64) []byte {
+	extra := fmt.Sprintf("%016xSTARGZ", tocOffset)
+	b := []byte{0x1f, 0x8b, 8, 4 /* FEXTRA */, 0, 0, 0, 0, 0, 255}
+	b = binary.LittleEndian.AppendUint16(b, uint16(4+len(extra)))
+	b = binary.LittleEndian.AppendUint16(append(b, 'S', 'G'), uint16(len(extra)))
+	b = append(b, extra...)
+	// a final stored block without data, the crc and the size
+	return append(b, 1, 0, 0, 0xff, 0xff, 0, 0, 0, 0, 0, 0, 0, 0)
+}
+
+// closeZstdChunked writes the end of the tar, the compressed TOC in a skippable frame and the footer with its position
+func (lw *Writer) closeZstdChunked(b []byte) error {
+	if err := lw.tw.Close(); err != nil {
+		return err
+	}
+	if err := lw.closeFrame(); err != nil {
+		return err
+	}
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		return err
+	}
+	manifest := enc.EncodeAll(b, nil)
+	// after the magic and size of the skippable frame
+	offset := lw.cw.n + 8
+	if err := lw.skippableFrame(manifest); err != nil {
+		return err
+	}
+	footer := make([]byte, zstdFooterSize)
+	binary.LittleEndian.PutUint64(footer[0:], uint64(offset))
+	binary.LittleEndian.PutUint64(footer[8:], uint64(len(manifest)))
+	binary.LittleEndian.PutUint64(footer[16:], uint64(len(b)))
+	binary.LittleEndian.PutUint64(footer[24:], manifestTypeCRFS)
+	copy(footer[32:], zstdChunkedMagic)
+	if err := lw.skippableFrame(footer); err != nil {
+		return err
+	}
+	lw.annot = map[string]string{
+		AnnotationManifestChecksum: digest.FromBytes(manifest).String(),
+		AnnotationManifestPosition: fmt.Sprintf("%d:%d:%d:%d", offset, len(manifest), len(b), manifestTypeCRFS),
+	}
+	return nil
+}
+
+// skippableFrame writes data in a zstd frame that decoders skip
+func (lw *Writer) skippableFrame(data []byte) error {
+	frame := binary.LittleEndian.AppendUint32(append([]byte{}, zstdSkippableMagic...), uint32(len(data)))
+	if _, err := lw.cw.Write(append(frame, data...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Discard releases the compressor after an error, the layer is incomplete
+func (lw *Writer) Discard() error {
+	if lw.open {
+		lw.open = false
+		return lw.fw.Close()
+	}
+	return nil
+}
+
+// Annotations returns the annotations of the layer descriptor that locate the TOC, set by Close
+func (lw *Writer) Annotations() map[string]string {
+	return lw.annot
+}
+
+// DiffID returns the digest of the uncompressed tar, valid after Close
+func (lw *Writer) DiffID() digest.Digest {
+	return lw.diffID.Digest()
+}
+
+// closeFrame ends the current gzip member or zstd frame, the next write starts a new one
+func (lw *Writer) closeFrame() error {
+	if !lw.open {
+		return nil
+	}
+	lw.open = false
+	return lw.fw.Close()
+}
+
+// tarStream receives the tar and compresses it into the current frame
+type tarStream struct {
+	lw *Writer
+}
+
+func (ts tarStream) Write(p []byte) (int, error) {
+	lw := ts.lw
+	if !lw.open {
+		lw.fw.Reset(lw.cw)
+		lw.open = true
+	}
+	n, err := lw.fw.Write(p)
+	lw.diffID.Hash().Write(p[:n])
+	lw.size += int64(n)
+	return n, err
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
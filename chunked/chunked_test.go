@@ -0,0 +1,199 @@
+package chunked
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/require"
+)
+
+// testWrite writes a layer with a file of three chunks, a small file and the other entry types
+func testWrite(t *testing.T, format string) (*Writer, []byte) {
+	t.Helper()
+	mtime := time.Date(2023, 5, 3, 8, 0, 0, 0, time.UTC)
+	buf := &bytes.Buffer{}
+	w, err := NewWriter(buf, Options{Format: format, ChunkSize: 1000})
+	require.NoError(t, err)
+	for _, e := range []struct {
+		th      tar.Header
+		content string
+	}{
+		{tar.Header{Name: "usr/", Typeflag: tar.TypeDir, Mode: 0755}, ""},
+		{tar.Header{Name: "usr/bin/app", Typeflag: tar.TypeReg, Mode: 0755, Uid: 1000}, strings.Repeat("0123456789", 250)},
+		{tar.Header{Name: "etc/hosts", Typeflag: tar.TypeReg, Mode: 0644, PAXRecords: map[string]string{"SCHILY.xattr.user.test": "value"}}, "127.0.0.1 localhost\n"},
+		{tar.Header{Name: "etc/empty", Typeflag: tar.TypeReg, Mode: 0644}, ""},
+		{tar.Header{Name: "bin/sh", Typeflag: tar.TypeSymlink, Linkname: "/usr/bin/app"}, ""},
+		{tar.Header{Name: "app", Typeflag: tar.TypeLink, Linkname: "usr/bin/app"}, ""},
+		{tar.Header{Name: "dev/null", Typeflag: tar.TypeChar, Mode: 0666, Devmajor: 1, Devminor: 3}, ""},
+		// padded before the TOC
+		{tar.Header{Name: "etc/motd", Typeflag: tar.TypeReg, Mode: 0644}, "hi\n"},
+	} {
+		e.th.ModTime = mtime
+		e.th.Size = int64(len(e.content))
+		require.NoError(t, w.Add(&e.th, strings.NewReader(e.content)))
+	}
+	require.NoError(t, w.Close())
+	return w, buf.Bytes()
+}
+
+// testTar reads the names and contents of an uncompressed layer and checks its diffID
+func testTar(t *testing.T, r io.Reader, diffID digest.Digest) map[string]string {
+	t.Helper()
+	digester := digest.Canonical.Digester()
+	tr := tar.NewReader(io.TeeReader(r, digester.Hash()))
+	files := map[string]string{}
+	for {
+		th, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		b, err := io.ReadAll(tr)
+		require.NoError(t, err)
+		files[th.Name] = string(b)
+	}
+	// the padding after the trailer
+	io.Copy(io.Discard, tr)
+	_, err := io.Copy(digester.Hash(), r)
+	require.NoError(t, err)
+	require.Equal(t, diffID, digester.Digest())
+	return files
+}
+
+// testChunks checks the TOC against the files and that every chunk decompresses from its offset
+func testChunks(t *testing.T, toc toc, files map[string]string, chunk func(offset, size int64) string) {
+	t.Helper()
+	byName := map[string]tocEntry{}
+	chunks := map[string][]tocEntry{}
+	for _, e := range toc.Entries {
+		if e.Type != "chunk" {
+			byName[e.Name] = e
+		}
+		if e.Type == "reg" && e.Size > 0 || e.Type == "chunk" {
+			chunks[e.Name] = append(chunks[e.Name], e)
+		}
+	}
+	require.Equal(t, "dir", byName["usr"].Type)
+	require.Equal(t, "symlink", byName["bin/sh"].Type)
+	require.Equal(t, "/usr/bin/app", byName["bin/sh"].LinkName)
+	require.Equal(t, "hardlink", byName["app"].Type)
+	require.Equal(t, "usr/bin/app", byName["app"].LinkName)
+	require.Equal(t, "char", byName["dev/null"].Type)
+	require.EqualValues(t, 3, byName["dev/null"].DevMinor)
+	require.Equal(t, []byte("value"), byName["etc/hosts"].Xattrs["user.test"])
+	require.Equal(t, 1000, byName["usr/bin/app"].UID)
+	require.Equal(t, "2023-05-03T08:00:00Z", byName["usr/bin/app"].ModTime)
+	require.Zero(t, byName["etc/empty"].Offset)
+	require.Len(t, chunks["usr/bin/app"], 3)
+
+	for name, cs := range chunks {
+		content := files[name]
+		require.Equal(t, digest.FromString(content).String(), cs[0].Digest, name)
+		for _, c := range cs {
+			want := content[c.ChunkOffset : c.ChunkOffset+c.ChunkSize]
+			require.Equal(t, digest.FromString(want).String(), c.ChunkDigest, name)
+			require.Equal(t, want, chunk(c.Offset, c.ChunkSize), name)
+		}
+	}
+}
+
+func TestEStargz(t *testing.T) {
+	w, b := testWrite(t, FormatEStargz)
+
+	// a plain gzip stream of the tar with the TOC as the last entry
+	zr, err := gzip.NewReader(bytes.NewReader(b))
+	require.NoError(t, err)
+	files := testTar(t, zr, w.DiffID())
+	size, err := strconv.ParseInt(w.Annotations()[AnnotationUncompressedSize], 10, 64)
+	require.NoError(t, err)
+	require.Equal(t, w.size, size)
+
+	// the footer has the offset of the gzip member with the TOC
+	footer := b[len(b)-footerSize:]
+	fr, err := gzip.NewReader(bytes.NewReader(footer))
+	require.NoError(t, err)
+	require.Equal(t, "SG", string(fr.Extra[:2]))
+	tocOffset, err := strconv.ParseInt(string(fr.Extra[4:20]), 16, 64)
+	require.NoError(t, err)
+	require.Equal(t, "STARGZ", string(fr.Extra[20:]))
+	zr, err = gzip.NewReader(bytes.NewReader(b[tocOffset:]))
+	require.NoError(t, err)
+	tr := tar.NewReader(zr)
+	th, err := tr.Next()
+	require.NoError(t, err)
+	require.Equal(t, tocTarName, th.Name)
+	tocJSON, err := io.ReadAll(tr)
+	require.NoError(t, err)
+	require.Equal(t, string(tocJSON), files[tocTarName])
+	require.Equal(t, digest.FromBytes(tocJSON).String(), w.Annotations()[AnnotationTOCDigest])
+	var toc toc
+	require.NoError(t, json.Unmarshal(tocJSON, &toc))
+
+	testChunks(t, toc, files, func(offset, size int64) string {
+		zr, err := gzip.NewReader(bytes.NewReader(b[offset:]))
+		require.NoError(t, err)
+		chunk := make([]byte, size)
+		_, err = io.ReadFull(zr, chunk)
+		require.NoError(t, err)
+		return string(chunk)
+	})
+}
+
+func TestZstdChunked(t *testing.T) {
+	w, b := testWrite(t, FormatZstdChunked)
+
+	// a plain zstd stream of the tar, the TOC is in skippable frames
+	zr, err := zstd.NewReader(bytes.NewReader(b))
+	require.NoError(t, err)
+	defer zr.Close()
+	files := testTar(t, zr, w.DiffID())
+	require.NotContains(t, files, tocTarName)
+
+	// the footer matches the position annotation
+	footer := b[len(b)-zstdFooterSize:]
+	require.Equal(t, zstdSkippableMagic, b[len(b)-zstdFooterSize-8:len(b)-zstdFooterSize-4])
+	require.Equal(t, zstdChunkedMagic, footer[32:40])
+	offset := binary.LittleEndian.Uint64(footer[0:])
+	length := binary.LittleEndian.Uint64(footer[8:])
+	ulength := binary.LittleEndian.Uint64(footer[16:])
+	require.Equal(t, strconv.FormatUint(offset, 10)+":"+strconv.FormatUint(length, 10)+":"+strconv.FormatUint(ulength, 10)+":1", w.Annotations()[AnnotationManifestPosition])
+	manifest := b[offset : offset+length]
+	require.Equal(t, digest.FromBytes(manifest).String(), w.Annotations()[AnnotationManifestChecksum])
+	tocJSON, err := zr.DecodeAll(manifest, nil)
+	require.NoError(t, err)
+	require.Len(t, tocJSON, int(ulength))
+	var toc toc
+	require.NoError(t, json.Unmarshal(tocJSON, &toc))
+	for _, e := range toc.Entries {
+		if e.Type == "reg" && e.Size > 0 {
+			require.Greater(t, e.EndOffset, e.Offset, e.Name)
+		}
+	}
+
+	testChunks(t, toc, files, func(offset, size int64) string {
+		zr, err := zstd.NewReader(bytes.NewReader(b[offset:]))
+		require.NoError(t, err)
+		defer zr.Close()
+		chunk := make([]byte, size)
+		_, err = io.ReadFull(zr, chunk)
+		require.NoError(t, err)
+		return string(chunk)
+	})
+}
+
+func TestOptions(t *testing.T) {
+	_, err := NewWriter(io.Discard, Options{Format: "gzip"})
+	require.ErrorIs(t, err, ErrInvalidOption)
+	_, err = NewWriter(io.Discard, Options{Format: FormatEStargz, ChunkSize: -1})
+	require.ErrorIs(t, err, ErrInvalidOption)
+}
@@ -0,0 +1,320 @@
+// Package cpio writes a cpio archive in the newc format from tar entries, e.g. for an initramfs.
+//
+// Entries are written in the order of a walk, so parent directories come before their content
+// as the kernel expects. Hardlinks share an inode number and the content is stored with the last link,
+// which is understood by the kernel and by GNU cpio. xattrs are not stored, newc has no field for them.
+package cpio
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+const (
+	magic   = "070701"
+	trailer = "TRAILER!!!"
+
+	modeDir     = 0040000
+	modeReg     = 0100000
+	modeSymlink = 0120000
+	modeChar    = 0020000
+	modeBlock   = 0060000
+	modeFifo    = 0010000
+)
+
+var (
+	// ErrInvalidEntry is returned for an entry that cannot be stored, e.g. a hardlink to a missing file
+	ErrInvalidEntry = errors.New("invalid cpio entry")
+)
+
+// Options configures the archive
+type Options struct {
+	// TempDir holds the file content until Close writes the archive, defaults to os.TempDir()
+	TempDir string
+}
+
+// Writer builds an archive from tar entries, it is written to the underlying writer by Close
+type Writer struct {
+	w       io.Writer
+	spool   *os.File // file content in the order it was added
+	size    int64    // bytes in spool
+	root    *node
+	links   []link
+	modTime uint32
+}
+
+type link struct {
+	name, target string
+}
+
+type node struct {
+	mode         uint32 // type and permission bits
+	uid, gid     uint32
+	mtime        uint32
+	nlink        uint32
+	children     map[string]*node
+	offset, size int64 // content in the spool
+	target       string
+	major, minor uint32
+	// implicit directories get the newest mtime of the archive
+	implicit bool
+	// set by Close
+	ino     uint32
+	written uint32 // links written so far
+}
+
+// NewWriter returns a Writer for w, Close must be called to write the archive
+func NewWriter(w io.Writer, opts Options) (*Writer, error) {
+	f, err := os.CreateTemp(opts.TempDir, "cpio")
+	if err != nil {
+		return nil, err
+	}
+	return &Writer{
+		w:     w,
+		spool: f,
+		root:  &node{mode: modeDir | 0755, nlink: 1, children: map[string]*node{}, implicit: true},
+	}, nil
+}
+
+// Add stores an entry, r is read for regular files.
+// Missing parent directories are created, hardlinks are resolved by Close.
+func (w *Writer) Add(th *tar.Header, r io.Reader) error {
+	name := strings.Trim(path.Clean("/"+th.Name), "/")
+	n := &node{
+		mode:  uint32(th.Mode & 07777),
+		uid:   uint32(th.Uid),
+		gid:   uint32(th.Gid),
+		mtime: clampTime(th.ModTime.Unix()),
+		nlink: 1,
+	}
+	if n.mtime > w.modTime {
+		w.modTime = n.mtime
+	}
+	switch th.Typeflag {
+	case tar.TypeDir:
+		n.mode |= modeDir
+		n.children = map[string]*node{}
+	case tar.TypeReg:
+		n.mode |= modeReg
+		n.offset = w.size
+		k, err := io.Copy(w.spool, r)
+		w.size += k
+		if err != nil {
+			return err
+		}
+		n.size = k
+		if n.size > math.MaxUint32 {
+			return fmt.Errorf("%w: %s is larger than 4GiB", ErrInvalidEntry, name)
+		}
+	case tar.TypeSymlink:
+		n.mode |= modeSymlink
+		n.target = th.Linkname
+	case tar.TypeLink:
+		if name == "" {
+			return fmt.Errorf("%w: hardlink to %s as the root", ErrInvalidEntry, th.Linkname)
+		}
+		w.links = append(w.links, link{name: name, target: strings.Trim(path.Clean("/"+th.Linkname), "/")})
+		return nil
+	case tar.TypeChar, tar.TypeBlock:
+		n.mode |= modeChar
+		if th.Typeflag == tar.TypeBlock {
+			n.mode = n.mode&^modeChar | modeBlock
+		}
+		n.major, n.minor = uint32(th.Devmajor), uint32(th.Devminor)
+	case tar.TypeFifo:
+		n.mode |= modeFifo
+	default:
+		// e.g. PAX global headers
+		return nil
+	}
+	if name == "" {
+		if n.children == nil {
+			return fmt.Errorf("%w: the root is not a directory", ErrInvalidEntry)
+		}
+		n.children = w.root.children
+		w.root = n
+		return nil
+	}
+	parent, err := w.dir(path.Dir(name))
+	if err != nil {
+		return err
+	}
+	base := path.Base(name)
+	// a directory that exists keeps its content
+	if prev, ok := parent.children[base]; ok && prev.children != nil && n.children != nil {
+		n.children = prev.children
+	}
+	parent.children[base] = n
+	return nil
+}
+
+// dir returns the directory name, creating it and its parents when they are missing
+func (w *Writer) dir(name string) (*node, error) {
+	d := w.root
+	if name == "." {
+		return d, nil
+	}
+	for _, elem := range strings.Split(name, "/") {
+		c, ok := d.children[elem]
+		if !ok {
+			c = &node{mode: modeDir | 0755, nlink: 1, children: map[string]*node{}, implicit: true}
+			d.children[elem] = c
+		} else if c.children == nil {
+			return nil, fmt.Errorf("%w: parent %s of an entry is not a directory", ErrInvalidEntry, name)
+		}
+		d = c
+	}
+	return d, nil
+}
+
+// lookup returns the node of name
+func (w *Writer) lookup(name string) (*node, error) {
+	n := w.root
+	if name == "" {
+		return n, nil
+	}
+	for _, elem := range strings.Split(name, "/") {
+		c, ok := n.children[elem]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s not found", ErrInvalidEntry, name)
+		}
+		n = c
+	}
+	return n, nil
+}
+
+// Discard removes the spooled content without writing the archive, e.g. after an error
+func (w *Writer) Discard() error {
+	w.spool.Close()
+	return os.Remove(w.spool.Name())
+}
+
+// Close writes the archive and removes the spooled content, the underlying writer is not closed
+func (w *Writer) Close() error {
+	defer w.Discard()
+	for _, l := range w.links {
+		target, err := w.lookup(l.target)
+		if err != nil || target.children != nil {
+			return fmt.Errorf("%w: hardlink %s to %s, which is not a file", ErrInvalidEntry, l.name, l.target)
+		}
+		parent, err := w.dir(path.Dir(l.name))
+		if err != nil {
+			return err
+		}
+		if prev, ok := parent.children[path.Base(l.name)]; ok && prev != target && prev.nlink > 1 {
+			prev.nlink--
+		}
+		parent.children[path.Base(l.name)] = target
+		target.nlink++
+	}
+
+	cw := &countWriter{w: w.w}
+	var ino uint32
+	var walk func(name string, n *node) error
+	walk = func(name string, n *node) error {
+		if n.ino == 0 {
+			ino++
+			n.ino = ino
+		}
+		if n.implicit {
+			n.mtime = w.modTime
+		}
+		if err := w.entry(cw, name, n); err != nil {
+			return err
+		}
+		names := make([]string, 0, len(n.children))
+		for c := range n.children {
+			names = append(names, c)
+		}
+		sort.Strings(names)
+		for _, c := range names {
+			if err := walk(path.Join(name, c), n.children[c]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := walk(".", w.root); err != nil {
+		return err
+	}
+	if err := writeHeader(cw, trailer, &node{nlink: 1}, 0); err != nil {
+		return err
+	}
+	// like GNU cpio, the archive is padded to 512 bytes
+	_, err := cw.Write(make([]byte, (512-cw.n%512)%512))
+	return err
+}
+
+// entry writes the header and the content of n, the content of a file with hardlinks is written with its last link
+func (w *Writer) entry(cw *countWriter, name string, n *node) error {
+	n.written++
+	var size int64
+	switch n.mode &^ 07777 {
+	case modeReg:
+		if n.written == n.nlink {
+			size = n.size
+		}
+	case modeSymlink:
+		size = int64(len(n.target))
+	}
+	if err := writeHeader(cw, name, n, size); err != nil {
+		return err
+	}
+	var err error
+	switch {
+	case n.mode&^07777 == modeSymlink:
+		_, err = io.WriteString(cw, n.target)
+	case size > 0:
+		_, err = io.Copy(cw, io.NewSectionReader(w.spool, n.offset, size))
+	}
+	if err != nil {
+		return err
+	}
+	_, err = cw.Write(make([]byte, pad(size)))
+	return err
+}
+
+// writeHeader writes a newc header with the name and its padding
+func writeHeader(cw *countWriter, name string, n *node, size int64) error {
+	_, err := fmt.Fprintf(cw, "%s%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%s\x00",
+		magic, n.ino, n.mode, n.uid, n.gid, n.nlink, n.mtime, size, 0, 0, n.major, n.minor, len(name)+1, 0, name)
+	if err != nil {
+		return err
+	}
+	// the header is 110 bytes, the name and the content are aligned to 4 bytes
+	_, err = cw.Write(make([]byte, pad(int64(110+len(name)+1))))
+	return err
+}
+
+func pad(n int64) int64 {
+	return (4 - n%4) % 4
+}
+
+// countWriter counts the bytes written for the padding
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+func clampTime(t int64) uint32 {
+	if t < 0 {
+		return 0
+	}
+	if t > math.MaxUint32 {
+		return math.MaxUint32
+	}
+	return uint32(t)
+}
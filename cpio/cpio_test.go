@@ -0,0 +1,150 @@
+package cpio
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type testEntry struct {
+	Name                 string
+	Ino, Mode, Nlink     uint64
+	Uid, Gid, Mtime      uint64
+	RdevMajor, RdevMinor uint64
+	Data                 string
+}
+
+// testRead parses a newc archive up to the trailer
+func testRead(t *testing.T, b []byte) []testEntry {
+	t.Helper()
+	entries := []testEntry{}
+	off := 0
+	field := func(i int) uint64 {
+		v, err := strconv.ParseUint(string(b[off+6+8*i:off+14+8*i]), 16, 32)
+		require.NoError(t, err)
+		return v
+	}
+	align := func(n int) int { return (n + 3) &^ 3 }
+	for {
+		require.Equal(t, magic, string(b[off:off+6]))
+		nameSize, size := int(field(11)), int(field(6))
+		e := testEntry{
+			Name:      string(b[off+110 : off+110+nameSize-1]),
+			Ino:       field(0),
+			Mode:      field(1),
+			Uid:       field(2),
+			Gid:       field(3),
+			Nlink:     field(4),
+			Mtime:     field(5),
+			RdevMajor: field(9),
+			RdevMinor: field(10),
+		}
+		off = align(off + 110 + nameSize)
+		e.Data = string(b[off : off+size])
+		off = align(off + size)
+		if e.Name == trailer {
+			require.Zero(t, len(b)%512)
+			return entries
+		}
+		entries = append(entries, e)
+	}
+}
+
+func TestWriter(t *testing.T) {
+	mtime := time.Date(2023, 5, 3, 8, 0, 0, 0, time.UTC)
+	buf := &bytes.Buffer{}
+	w, err := NewWriter(buf, Options{TempDir: t.TempDir()})
+	require.NoError(t, err)
+	for _, e := range []struct {
+		th      tar.Header
+		content string
+	}{
+		{tar.Header{Name: "usr/bin/app", Typeflag: tar.TypeReg, Mode: 0755, Uid: 1000, Gid: 1000}, "app"},
+		{tar.Header{Name: "bin/sh", Typeflag: tar.TypeSymlink, Linkname: "/usr/bin/app", Mode: 0777}, ""},
+		{tar.Header{Name: "app", Typeflag: tar.TypeLink, Linkname: "usr/bin/app"}, ""},
+		{tar.Header{Name: "dev/console", Typeflag: tar.TypeChar, Mode: 0600, Devmajor: 5, Devminor: 1}, ""},
+		{tar.Header{Name: "dev/sda", Typeflag: tar.TypeBlock, Mode: 0660, Devmajor: 8}, ""},
+		{tar.Header{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0750}, ""},
+		{tar.Header{Name: "etc/fifo", Typeflag: tar.TypeFifo, Mode: 0600}, ""},
+		{tar.Header{Name: "init", Typeflag: tar.TypeReg, Mode: 0755}, "#!/bin/sh\n"},
+	} {
+		e.th.ModTime = mtime
+		e.th.Size = int64(len(e.content))
+		require.NoError(t, w.Add(&e.th, strings.NewReader(e.content)))
+	}
+	require.NoError(t, w.Close())
+
+	entries := testRead(t, buf.Bytes())
+	names := []string{}
+	byName := map[string]testEntry{}
+	for _, e := range entries {
+		names = append(names, e.Name)
+		byName[e.Name] = e
+	}
+	// parents come first, the root is "."
+	require.Equal(t, []string{".", "app", "bin", "bin/sh", "dev", "dev/console", "dev/sda", "etc", "etc/fifo", "init", "usr", "usr/bin", "usr/bin/app"}, names)
+	require.EqualValues(t, modeDir|0755, byName["."].Mode)
+	require.EqualValues(t, mtime.Unix(), byName["usr"].Mtime, "implicit directories get the newest mtime")
+	require.EqualValues(t, modeDir|0750, byName["etc"].Mode)
+	require.EqualValues(t, modeFifo|0600, byName["etc/fifo"].Mode)
+
+	// hardlinks share the inode, the content is stored with the last one
+	app, link := byName["usr/bin/app"], byName["app"]
+	require.Equal(t, app.Ino, link.Ino)
+	require.EqualValues(t, 2, app.Nlink)
+	require.EqualValues(t, 2, link.Nlink)
+	require.Empty(t, link.Data)
+	require.Equal(t, "app", app.Data)
+	require.EqualValues(t, modeReg|0755, link.Mode)
+	require.EqualValues(t, 1000, link.Uid)
+
+	require.EqualValues(t, modeSymlink|0777, byName["bin/sh"].Mode)
+	require.Equal(t, "/usr/bin/app", byName["bin/sh"].Data)
+	require.EqualValues(t, modeChar|0600, byName["dev/console"].Mode)
+	require.EqualValues(t, 5, byName["dev/console"].RdevMajor)
+	require.EqualValues(t, 1, byName["dev/console"].RdevMinor)
+	require.EqualValues(t, modeBlock|0660, byName["dev/sda"].Mode)
+	require.Equal(t, "#!/bin/sh\n", byName["init"].Data)
+
+	testExtract(t, buf.Bytes())
+
+	w, err = NewWriter(io.Discard, Options{TempDir: t.TempDir()})
+	require.NoError(t, err)
+	require.NoError(t, w.Add(&tar.Header{Name: "a", Typeflag: tar.TypeLink, Linkname: "missing"}, nil))
+	require.ErrorIs(t, w.Close(), ErrInvalidEntry)
+}
+
+// testExtract checks the archive with bsdcpio when it is installed
+func testExtract(t *testing.T, b []byte) {
+	t.Helper()
+	bsdcpio, err := exec.LookPath("bsdcpio")
+	if err != nil {
+		return
+	}
+	dir := t.TempDir()
+	cmd := exec.Command(bsdcpio, "-id", "--quiet")
+	cmd.Dir = dir
+	cmd.Stdin = bytes.NewReader(b)
+	out, err := cmd.CombinedOutput()
+	// device nodes need root
+	if os.Geteuid() != 0 {
+		t.Logf("bsdcpio: %v: %s", err, out)
+	} else {
+		require.NoError(t, err, string(out))
+	}
+	content, err := os.ReadFile(filepath.Join(dir, "app"))
+	require.NoError(t, err)
+	require.Equal(t, "app", string(content))
+	target, err := os.Readlink(filepath.Join(dir, "bin/sh"))
+	require.NoError(t, err)
+	require.Equal(t, "/usr/bin/app", target)
+}
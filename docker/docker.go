@@ -1,11 +1,13 @@
 package docker
 
 import (
+	"context"
+
 	"github.com/mheers/docker-image-squash/regctl"
 )
 
 func Export(image, outputTar string) error {
-	if err := regctl.ExportImage(image, outputTar); err != nil {
+	if err := regctl.ExportImage(context.Background(), image, outputTar); err != nil {
 		return err
 	}
 	return nil
@@ -0,0 +1,500 @@
+// Package ext4 writes an ext4 filesystem image from tar entries, without mkfs.ext4 and without root.
+//
+// The image has no journal. All groups keep their metadata at the start of the image,
+// followed by the file content and the directories, so it is written sequentially
+// and can be booted as the root filesystem of a microVM.
+package ext4
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"math"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+const (
+	blockSize      = 4096
+	inodeSize      = 256
+	extraIsize     = 32
+	blocksPerGroup = blockSize * 8
+	inodesPerBlock = blockSize / inodeSize
+	descSize       = 32
+	rootIno        = 2
+	firstIno       = 11
+	// inodeRatio is the bytes per inode of mkfs.ext4 for a fixed size
+	inodeRatio = 16384
+
+	maxExtentLen    = 32768
+	inodeExtents    = 4
+	extentsPerBlock = (blockSize - 12) / 12
+	// fastSymlinkMax is the longest target stored in the inode
+	fastSymlinkMax = 59
+
+	typeReg     = 1
+	typeDir     = 2
+	typeChar    = 3
+	typeBlock   = 4
+	typeFifo    = 5
+	typeSocket  = 6
+	typeSymlink = 7
+)
+
+var (
+	// ErrInvalidOption is returned for a size that is not a multiple of the block size
+	ErrInvalidOption = errors.New("invalid ext4 option")
+	// ErrInvalidEntry is returned for an entry that cannot be stored, e.g. a hardlink to a missing file
+	ErrInvalidEntry = errors.New("invalid ext4 entry")
+	// ErrNoSpace is returned by Close when the content does not fit into Options.Size
+	ErrNoSpace = errors.New("ext4 image too small")
+)
+
+// Options configures the image
+type Options struct {
+	// Size of the image in bytes, 0 sizes it to the content with 20% free blocks and inodes
+	Size int64
+	// TempDir holds the file content until Close writes the image, defaults to os.TempDir()
+	TempDir string
+}
+
+// Writer builds an image from tar entries, it is written to the underlying writer by Close
+type Writer struct {
+	w           io.Writer
+	opts        Options
+	spool       *os.File // file content, it follows the metadata in the image
+	spoolBlocks uint64
+	root        *node
+	links       []link
+	modTime     uint32
+	block       []byte
+	// hash of the content for the uuid, so identical content gives identical images
+	hash hash.Hash
+}
+
+type link struct {
+	name, target string
+}
+
+// node is an inode, a hardlinked file is the node of several directory entries
+type node struct {
+	typ      uint8 // directory entry file type
+	perm     uint16
+	uid, gid uint32
+	mtime    uint32
+	xattrs   map[string]string
+	nlink    uint32
+	children map[string]*node // directories
+	// regular files, extents start at a block of the spool
+	size    uint64
+	extents []extent
+	// symlinks and devices
+	target       string
+	major, minor uint32
+	// implicit directories get the newest mtime of the image
+	implicit bool
+	// set by Close
+	ino    uint32
+	parent uint32 // directories
+	data   []byte // directory or symlink block content
+	leaves uint32 // extent tree leaf blocks
+	xattr  []byte // xattr block, nil when they fit into the inode
+	blocks uint32 // blocks of the inode including its metadata
+	first  uint64 // first block of data, leaves and xattr block
+}
+
+type extent struct {
+	logical uint32
+	length  uint32
+	start   uint64
+}
+
+// NewWriter returns a Writer for w, Close must be called to write the image
+func NewWriter(w io.Writer, opts Options) (*Writer, error) {
+	if opts.Size < 0 || opts.Size%blockSize != 0 {
+		return nil, fmt.Errorf("%w: size %d is not a multiple of %d", ErrInvalidOption, opts.Size, blockSize)
+	}
+	f, err := os.CreateTemp(opts.TempDir, "ext4")
+	if err != nil {
+		return nil, err
+	}
+	return &Writer{
+		w:     w,
+		opts:  opts,
+		spool: f,
+		root:  &node{typ: typeDir, perm: 0755, children: map[string]*node{}, implicit: true},
+		block: make([]byte, blockSize),
+		hash:  sha256.New(),
+	}, nil
+}
+
+// Add stores an entry, r is read for regular files.
+// Missing parent directories are created, hardlinks are resolved by Close.
+// xattrs are read from the SCHILY.xattr PAX records, only the user, trusted and security namespaces are stored.
+func (w *Writer) Add(th *tar.Header, r io.Reader) error {
+	name := strings.Trim(path.Clean("/"+th.Name), "/")
+	fmt.Fprintf(w.hash, "%s\x00%c%o %d %d %d %s\x00", name, th.Typeflag, th.Mode, th.Uid, th.Gid, th.ModTime.Unix(), th.Linkname)
+	n := &node{
+		perm:   uint16(th.Mode & 07777),
+		uid:    uint32(th.Uid),
+		gid:    uint32(th.Gid),
+		mtime:  clampTime(th.ModTime.Unix()),
+		xattrs: xattrs(th),
+		nlink:  1,
+	}
+	if n.mtime > w.modTime {
+		w.modTime = n.mtime
+	}
+	switch th.Typeflag {
+	case tar.TypeDir:
+		n.typ = typeDir
+		n.children = map[string]*node{}
+	case tar.TypeReg:
+		n.typ = typeReg
+		if err := w.data(n, r); err != nil {
+			return err
+		}
+	case tar.TypeSymlink:
+		n.typ = typeSymlink
+		n.target = th.Linkname
+		if len(n.target) >= blockSize {
+			return fmt.Errorf("%w: symlink target of %s is longer than %d bytes", ErrInvalidEntry, name, blockSize-1)
+		}
+	case tar.TypeLink:
+		if name == "" {
+			return fmt.Errorf("%w: hardlink to %s as the root", ErrInvalidEntry, th.Linkname)
+		}
+		w.links = append(w.links, link{name: name, target: strings.Trim(path.Clean("/"+th.Linkname), "/")})
+		return nil
+	case tar.TypeChar, tar.TypeBlock:
+		n.typ = typeChar
+		if th.Typeflag == tar.TypeBlock {
+			n.typ = typeBlock
+		}
+		n.major, n.minor = uint32(th.Devmajor), uint32(th.Devminor)
+	case tar.TypeFifo:
+		n.typ = typeFifo
+	default:
+		// e.g. PAX global headers
+		return nil
+	}
+	if name == "" {
+		if n.typ != typeDir {
+			return fmt.Errorf("%w: the root is not a directory", ErrInvalidEntry)
+		}
+		n.children = w.root.children
+		w.root = n
+		return nil
+	}
+	parent, err := w.dir(path.Dir(name))
+	if err != nil {
+		return err
+	}
+	base := path.Base(name)
+	if len(base) > 255 {
+		return fmt.Errorf("%w: name of %s is longer than 255 bytes", ErrInvalidEntry, name)
+	}
+	// a directory that exists keeps its content
+	if prev, ok := parent.children[base]; ok && prev.typ == typeDir && n.typ == typeDir {
+		n.children = prev.children
+	}
+	parent.children[base] = n
+	return nil
+}
+
+// dir returns the directory name, creating it and its parents when they are missing
+func (w *Writer) dir(name string) (*node, error) {
+	d := w.root
+	if name == "." {
+		return d, nil
+	}
+	for _, elem := range strings.Split(name, "/") {
+		c, ok := d.children[elem]
+		if !ok {
+			c = &node{typ: typeDir, perm: 0755, nlink: 1, children: map[string]*node{}, implicit: true}
+			d.children[elem] = c
+		} else if c.typ != typeDir {
+			return nil, fmt.Errorf("%w: parent %s of an entry is not a directory", ErrInvalidEntry, name)
+		}
+		d = c
+	}
+	return d, nil
+}
+
+// data appends the content of a file to the spool, all-zero blocks are left as holes
+func (w *Writer) data(n *node, r io.Reader) error {
+	for logical := uint64(0); ; logical++ {
+		k, err := io.ReadFull(r, w.block)
+		if k > 0 {
+			n.size += uint64(k)
+			if !isZero(w.block[:k]) {
+				if logical > math.MaxUint32 {
+					return fmt.Errorf("%w: file larger than 16TiB", ErrInvalidEntry)
+				}
+				clear(w.block[k:])
+				if _, err := w.spool.Write(w.block); err != nil {
+					return err
+				}
+				w.hash.Write(w.block)
+				n.addBlock(uint32(logical), w.spoolBlocks)
+				w.spoolBlocks++
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// addBlock maps the logical block of a file to a block, extending the last extent when they are contiguous
+func (n *node) addBlock(logical uint32, start uint64) {
+	if l := len(n.extents); l > 0 {
+		e := &n.extents[l-1]
+		if e.logical+e.length == logical && e.start+uint64(e.length) == start && e.length < maxExtentLen {
+			e.length++
+			return
+		}
+	}
+	n.extents = append(n.extents, extent{logical: logical, length: 1, start: start})
+}
+
+// Discard removes the spooled content without writing the image, e.g. after an error
+func (w *Writer) Discard() error {
+	w.spool.Close()
+	return os.Remove(w.spool.Name())
+}
+
+// Close writes the image and removes the spooled content, the underlying writer is not closed
+func (w *Writer) Close() error {
+	defer w.Discard()
+	for _, l := range w.links {
+		target, err := w.lookup(l.target)
+		if err != nil || target.typ == typeDir {
+			return fmt.Errorf("%w: hardlink %s to %s, which is not a file", ErrInvalidEntry, l.name, l.target)
+		}
+		parent, err := w.dir(path.Dir(l.name))
+		if err != nil {
+			return err
+		}
+		if prev, ok := parent.children[path.Base(l.name)]; ok && prev != target && prev.nlink > 1 {
+			prev.nlink--
+		}
+		parent.children[path.Base(l.name)] = target
+		target.nlink++
+	}
+	// e2fsck expects lost+found in the root
+	if _, ok := w.root.children["lost+found"]; !ok {
+		w.root.children["lost+found"] = &node{typ: typeDir, perm: 0700, nlink: 1, children: map[string]*node{}, implicit: true}
+	}
+
+	// inodes are numbered in the order of a walk, the root has its reserved number
+	nodes := []*node{}
+	w.root.ino, w.root.parent = rootIno, rootIno
+	var number func(d *node)
+	number = func(d *node) {
+		if d.implicit {
+			d.mtime = w.modTime
+		}
+		for _, name := range sortedNames(d) {
+			c := d.children[name]
+			if c.ino != 0 {
+				continue
+			}
+			c.ino, c.parent = uint32(firstIno+len(nodes)), d.ino
+			nodes = append(nodes, c)
+			if c.typ == typeDir {
+				number(c)
+			}
+		}
+	}
+	number(w.root)
+	if len(nodes) > math.MaxUint32-firstIno {
+		return fmt.Errorf("%w: too many entries", ErrInvalidEntry)
+	}
+	all := append([]*node{w.root}, nodes...)
+
+	// blocks besides the spooled content
+	var meta uint64
+	for _, n := range all {
+		if err := n.prepare(); err != nil {
+			return err
+		}
+		meta += uint64(len(n.data)/blockSize) + uint64(n.leaves)
+		if n.xattr != nil {
+			meta++
+		}
+	}
+	lastIno := uint32(firstIno - 1 + len(nodes))
+	g, err := newGeometry(w.spoolBlocks+meta, lastIno, w.opts.Size)
+	if err != nil {
+		return err
+	}
+
+	// the directories, symlinks, extent leaves and xattr blocks follow the content
+	next := g.overhead + w.spoolBlocks
+	for _, n := range all {
+		n.place(g.overhead, &next)
+	}
+	g.used = next
+	return w.writeImage(g, all, lastIno)
+}
+
+// lookup returns the node of name
+func (w *Writer) lookup(name string) (*node, error) {
+	n := w.root
+	if name == "" {
+		return n, nil
+	}
+	for _, elem := range strings.Split(name, "/") {
+		c, ok := n.children[elem]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s not found", ErrInvalidEntry, name)
+		}
+		n = c
+	}
+	return n, nil
+}
+
+// prepare encodes the directory listing, the slow symlink and the xattr block and counts the extent leaves
+func (n *node) prepare() error {
+	switch n.typ {
+	case typeDir:
+		n.data = n.listing()
+		blocks := uint32(len(n.data) / blockSize)
+		n.extents = nil
+		for l := uint32(0); l < blocks; l += maxExtentLen {
+			n.extents = append(n.extents, extent{logical: l, length: min(blocks-l, maxExtentLen)})
+		}
+	case typeSymlink:
+		if len(n.target) > fastSymlinkMax {
+			n.data = make([]byte, blockSize)
+			copy(n.data, n.target)
+			n.extents = []extent{{length: 1}}
+		}
+	}
+	if len(n.extents) > inodeExtents {
+		n.leaves = uint32((len(n.extents) + extentsPerBlock - 1) / extentsPerBlock)
+		if n.leaves > inodeExtents {
+			return fmt.Errorf("%w: inode %d has more than %d extents", ErrInvalidEntry, n.ino, inodeExtents*extentsPerBlock)
+		}
+	}
+	if len(n.xattrs) > 0 && !encodeXattrs(n.xattrs, make([]byte, inodeSize-128-extraIsize), 4, 4) {
+		n.xattr = make([]byte, blockSize)
+		if !encodeXattrs(n.xattrs, n.xattr, 32, 0) {
+			return fmt.Errorf("%w: xattrs of inode %d are larger than a block", ErrInvalidEntry, n.ino)
+		}
+	}
+	return nil
+}
+
+// place assigns the blocks of the inode metadata from next, spooled content starts at data
+func (n *node) place(data uint64, next *uint64) {
+	n.first = *next
+	for i := range n.extents {
+		if n.typ == typeReg {
+			n.extents[i].start += data
+			n.blocks += n.extents[i].length
+		} else {
+			n.extents[i].start = *next + uint64(n.extents[i].logical)
+		}
+	}
+	own := uint64(len(n.data) / blockSize)
+	n.blocks += uint32(own) + n.leaves
+	*next += own + uint64(n.leaves)
+	if n.xattr != nil {
+		n.blocks++
+		*next++
+	}
+}
+
+// listing returns the directory blocks with the entries of d
+func (d *node) listing() []byte {
+	type dirent struct {
+		ino  uint32
+		typ  uint8
+		name string
+	}
+	entries := []dirent{{d.ino, typeDir, "."}, {d.parent, typeDir, ".."}}
+	for _, name := range sortedNames(d) {
+		c := d.children[name]
+		entries = append(entries, dirent{c.ino, c.typ, name})
+	}
+	var out []byte
+	cur := make([]byte, blockSize)
+	off, last := 0, 0 // offset in the current block and of its last entry
+	for _, e := range entries {
+		size := 8 + (len(e.name)+3)&^3
+		if off+size > blockSize {
+			// the last entry of a block covers the rest of it
+			put16(cur, last+4, uint16(blockSize-last))
+			out = append(out, cur...)
+			cur, off = make([]byte, blockSize), 0
+		}
+		put32(cur, off, e.ino)
+		put16(cur, off+4, uint16(size))
+		cur[off+6] = uint8(len(e.name))
+		cur[off+7] = e.typ
+		copy(cur[off+8:], e.name)
+		last, off = off, off+size
+	}
+	put16(cur, last+4, uint16(blockSize-last))
+	return append(out, cur...)
+}
+
+func sortedNames(d *node) []string {
+	names := make([]string, 0, len(d.children))
+	for name := range d.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+var xattrPrefixes = map[string]uint8{"user.": 1, "trusted.": 4, "security.": 6}
+
+// xattrs returns the xattrs of th that ext4 stores with a name index
+func xattrs(th *tar.Header) map[string]string {
+	var x map[string]string
+	for k, v := range th.PAXRecords {
+		name, ok := strings.CutPrefix(k, "SCHILY.xattr.")
+		if !ok {
+			continue
+		}
+		prefix, rest, _ := strings.Cut(name, ".")
+		if _, ok := xattrPrefixes[prefix+"."]; !ok || rest == "" || len(rest) > 255 {
+			continue
+		}
+		if x == nil {
+			x = map[string]string{}
+		}
+		x[name] = v
+	}
+	return x
+}
+
+func clampTime(t int64) uint32 {
+	if t < 0 {
+		return 0
+	}
+	if t > math.MaxUint32 {
+		return math.MaxUint32
+	}
+	return uint32(t)
+}
+
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
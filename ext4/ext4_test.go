@@ -0,0 +1,172 @@
+package ext4
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/binary"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+var testTime = time.Date(2023, 5, 3, 8, 0, 0, 0, time.UTC)
+
+// testImage writes the entries of a small filesystem into an image
+func testImage(t *testing.T, opts Options) []byte {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	opts.TempDir = t.TempDir()
+	w, err := NewWriter(buf, opts)
+	require.NoError(t, err)
+	add := func(th *tar.Header, content string) {
+		th.ModTime = testTime
+		th.Size = int64(len(content))
+		require.NoError(t, w.Add(th, strings.NewReader(content)))
+	}
+	add(&tar.Header{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0750, Gid: 42}, "")
+	add(&tar.Header{Name: "etc/hosts", Typeflag: tar.TypeReg, Mode: 0644, Uid: 1000, Gid: 70000, PAXRecords: map[string]string{
+		"SCHILY.xattr.user.test":        "value",
+		"SCHILY.xattr.system.posix_acl": "skipped",
+	}}, "127.0.0.1 localhost\n")
+	add(&tar.Header{Name: "etc/large-xattr", Typeflag: tar.TypeReg, Mode: 0644, PAXRecords: map[string]string{
+		"SCHILY.xattr.user.large": strings.Repeat("x", 500),
+	}}, "")
+	add(&tar.Header{Name: "usr/bin/app", Typeflag: tar.TypeReg, Mode: 0755}, testBig())
+	add(&tar.Header{Name: "usr/bin/holes", Typeflag: tar.TypeReg, Mode: 0755}, testHoles())
+	add(&tar.Header{Name: "usr/bin/sh", Typeflag: tar.TypeSymlink, Linkname: "app", Mode: 0777}, "")
+	add(&tar.Header{Name: "usr/bin/long", Typeflag: tar.TypeSymlink, Linkname: strings.Repeat("long/", 20), Mode: 0777}, "")
+	add(&tar.Header{Name: "usr/bin/app2", Typeflag: tar.TypeLink, Linkname: "usr/bin/app"}, "")
+	add(&tar.Header{Name: "dev/null", Typeflag: tar.TypeChar, Devmajor: 1, Devminor: 3, Mode: 0666}, "")
+	add(&tar.Header{Name: "dev/nvme0n1", Typeflag: tar.TypeBlock, Devmajor: 259, Devminor: 300, Mode: 0660}, "")
+	add(&tar.Header{Name: "run/fifo", Typeflag: tar.TypeFifo, Mode: 0600}, "")
+	for i := 0; i < 500; i++ {
+		add(&tar.Header{Name: "many/" + strings.Repeat("f", 1+i%200) + string(rune('a'+i/200)), Typeflag: tar.TypeReg, Mode: 0644}, "x")
+	}
+	require.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+func testBig() string {
+	return strings.Repeat("ext4", 300000) + strings.Repeat("\x00", 3*blockSize) + "end"
+}
+
+// testHoles has more extents than the inode holds
+func testHoles() string {
+	return strings.Repeat(strings.Repeat("z", blockSize)+strings.Repeat("\x00", blockSize), 10)
+}
+
+func TestWriter(t *testing.T) {
+	for _, size := range []int64{0, 160 << 20} {
+		img := testImage(t, Options{Size: size})
+		require.Zero(t, len(img)%blockSize)
+		if size != 0 {
+			require.EqualValues(t, size, len(img))
+		}
+		sb := img[1024:2048]
+		require.EqualValues(t, magic, binary.LittleEndian.Uint16(sb[56:]))
+		require.EqualValues(t, len(img)/blockSize, binary.LittleEndian.Uint32(sb[4:]))
+		require.EqualValues(t, testTime.Unix(), binary.LittleEndian.Uint32(sb[48:]))
+
+		file := filepath.Join(t.TempDir(), "image.ext4")
+		require.NoError(t, os.WriteFile(file, img, 0644))
+		testCheck(t, file)
+		testMount(t, file)
+	}
+
+	// the same content gives the same image
+	require.Equal(t, testImage(t, Options{}), testImage(t, Options{}))
+
+	buf := &bytes.Buffer{}
+	w, err := NewWriter(buf, Options{Size: 16 * blockSize, TempDir: t.TempDir()})
+	require.NoError(t, err)
+	require.NoError(t, w.Add(&tar.Header{Name: "big", Typeflag: tar.TypeReg, Size: 1 << 20}, strings.NewReader(strings.Repeat("x", 1<<20))))
+	require.ErrorIs(t, w.Close(), ErrNoSpace)
+
+	_, err = NewWriter(buf, Options{Size: 1000})
+	require.ErrorIs(t, err, ErrInvalidOption)
+
+	w, err = NewWriter(buf, Options{TempDir: t.TempDir()})
+	require.NoError(t, err)
+	require.NoError(t, w.Add(&tar.Header{Name: "a", Typeflag: tar.TypeLink, Linkname: "missing"}, nil))
+	require.ErrorIs(t, w.Close(), ErrInvalidEntry)
+}
+
+// testCheck runs e2fsck on the image when it is installed
+func testCheck(t *testing.T, file string) {
+	t.Helper()
+	e2fsck, err := exec.LookPath("e2fsck")
+	if err != nil {
+		t.Log("skipping the filesystem check, e2fsck is not installed")
+		return
+	}
+	out, err := exec.Command(e2fsck, "-fn", file).CombinedOutput()
+	require.NoError(t, err, string(out))
+}
+
+// testMount checks the content with the ext4 driver of the kernel, it needs root and loop devices
+func testMount(t *testing.T, file string) {
+	t.Helper()
+	if os.Geteuid() != 0 {
+		return
+	}
+	dir := t.TempDir()
+	if out, err := exec.Command("mount", "-t", "ext4", "-o", "loop,ro", file, dir).CombinedOutput(); err != nil {
+		t.Logf("skipping the mount check: %v: %s", err, out)
+		return
+	}
+	defer exec.Command("umount", dir).Run()
+
+	b, err := os.ReadFile(filepath.Join(dir, "usr/bin/app2"))
+	require.NoError(t, err)
+	require.Equal(t, testBig(), string(b))
+	b, err = os.ReadFile(filepath.Join(dir, "usr/bin/holes"))
+	require.NoError(t, err)
+	require.Equal(t, testHoles(), string(b))
+	fi, err := os.Stat(filepath.Join(dir, "usr/bin/app"))
+	require.NoError(t, err)
+	require.EqualValues(t, 2, fi.Sys().(*syscall.Stat_t).Nlink)
+	for name, target := range map[string]string{"sh": "app", "long": strings.Repeat("long/", 20)} {
+		link, err := os.Readlink(filepath.Join(dir, "usr/bin", name))
+		require.NoError(t, err)
+		require.Equal(t, target, link)
+	}
+	fi, err = os.Stat(filepath.Join(dir, "etc"))
+	require.NoError(t, err)
+	require.EqualValues(t, 0750, fi.Mode().Perm())
+	require.EqualValues(t, 42, fi.Sys().(*syscall.Stat_t).Gid)
+	fi, err = os.Stat(filepath.Join(dir, "etc/hosts"))
+	require.NoError(t, err)
+	require.EqualValues(t, 1000, fi.Sys().(*syscall.Stat_t).Uid)
+	require.EqualValues(t, 70000, fi.Sys().(*syscall.Stat_t).Gid)
+	value := make([]byte, 1024)
+	n, err := syscall.Getxattr(filepath.Join(dir, "etc/hosts"), "user.test", value)
+	require.NoError(t, err)
+	require.Equal(t, "value", string(value[:n]))
+	n, err = syscall.Getxattr(filepath.Join(dir, "etc/large-xattr"), "user.large", value)
+	require.NoError(t, err)
+	require.Equal(t, strings.Repeat("x", 500), string(value[:n]))
+	fi, err = os.Stat(filepath.Join(dir, "dev/nvme0n1"))
+	require.NoError(t, err)
+	rdev := fi.Sys().(*syscall.Stat_t).Rdev
+	require.EqualValues(t, 259, (rdev>>8)&0xfff)
+	require.EqualValues(t, 300, rdev&0xff|(rdev>>12)&^0xff)
+	entries, err := os.ReadDir(filepath.Join(dir, "many"))
+	require.NoError(t, err)
+	require.Len(t, entries, 500)
+	require.DirExists(t, filepath.Join(dir, "lost+found"))
+	require.NoError(t, exec.Command("umount", dir).Run())
+}
+
+func TestEncodeXattrs(t *testing.T) {
+	b := make([]byte, 96)
+	require.True(t, encodeXattrs(map[string]string{"user.a": "b", "trusted.b": "c"}, b, 4, 4))
+	require.EqualValues(t, 1, b[4], "name length")
+	require.EqualValues(t, xattrPrefixes["user."], b[5], "user entries come first")
+	require.False(t, encodeXattrs(map[string]string{"user.a": strings.Repeat("b", 100)}, b, 4, 4))
+}
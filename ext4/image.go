@@ -0,0 +1,422 @@
+package ext4
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+	"sort"
+	"strings"
+)
+
+const (
+	magic = 0xEF53
+
+	compatExtAttr     = 0x0008
+	compatSparseSuper = 0x0200 // sparse_super2, no backups of the superblock
+	incompatFiletype  = 0x0002
+	incompatExtents   = 0x0040
+	incompatFlexBG    = 0x0200
+	roCompatLargeFile = 0x0002
+	roCompatHugeFile  = 0x0008
+	roCompatDirNlink  = 0x0020
+	roCompatExtraSize = 0x0040
+
+	extentsFlag  = 0x80000
+	extentMagic  = 0xF30A
+	xattrMagic   = 0xEA020000
+	maxLinkCount = 65000
+)
+
+// geometry is the layout of the image: the superblock, the group descriptors, the bitmaps
+// and the inode tables of all groups, followed by the used blocks and the free ones
+type geometry struct {
+	blocks    uint64
+	groups    uint32
+	ipg       uint32 // inodes per group
+	gdt       uint64 // group descriptor blocks
+	itable    uint64 // inode table blocks per group
+	overhead  uint64 // first block after the inode tables
+	used      uint64 // first free block
+	blockBase uint64 // first block bitmap
+}
+
+// newGeometry returns the layout for used blocks of content and inodes up to lastIno,
+// size 0 adds 20% free blocks and inodes
+func newGeometry(used uint64, lastIno uint32, size int64) (*geometry, error) {
+	g := &geometry{}
+	inodes := uint64(lastIno)
+	if size == 0 {
+		inodes += inodes/5 + 64
+		g.blocks = used + used/5 + 256
+		// the overhead depends on the number of groups, which depends on the blocks
+		for i := 0; i < 10; i++ {
+			g.fit(inodes)
+			want := g.overhead + used + used/5 + 256
+			if want == g.blocks {
+				break
+			}
+			g.blocks = want
+		}
+	} else {
+		g.blocks = uint64(size) / blockSize
+		inodes = max(inodes, g.blocks*blockSize/inodeRatio)
+		g.fit(inodes)
+	}
+	if g.ipg*g.groups < lastIno {
+		return nil, fmt.Errorf("%w: %d inodes do not fit into %d groups", ErrNoSpace, lastIno, g.groups)
+	}
+	if g.overhead+used > g.blocks {
+		return nil, fmt.Errorf("%w: the content needs %d bytes", ErrNoSpace, (g.overhead+used)*blockSize)
+	}
+	if g.blocks > math.MaxUint32 {
+		return nil, fmt.Errorf("%w: images larger than 16TiB are not supported", ErrNoSpace)
+	}
+	return g, nil
+}
+
+// fit computes the groups and the inode tables for the blocks and at least inodes
+func (g *geometry) fit(inodes uint64) {
+	g.groups = uint32((g.blocks + blocksPerGroup - 1) / blocksPerGroup)
+	ipg := (inodes + uint64(g.groups) - 1) / uint64(g.groups)
+	ipg = (ipg + inodesPerBlock - 1) / inodesPerBlock * inodesPerBlock
+	if ipg > blocksPerGroup {
+		// more groups, the inode bitmap of a group has a bit per block
+		ipg = blocksPerGroup
+		g.groups = uint32((inodes + blocksPerGroup - 1) / blocksPerGroup)
+		g.blocks = max(g.blocks, uint64(g.groups-1)*blocksPerGroup+1)
+	}
+	g.ipg = uint32(ipg)
+	g.gdt = (uint64(g.groups)*descSize + blockSize - 1) / blockSize
+	g.itable = ipg / inodesPerBlock
+	g.blockBase = 1 + g.gdt
+	g.overhead = g.blockBase + 2*uint64(g.groups) + uint64(g.groups)*g.itable
+}
+
+// writeImage writes the metadata, the spooled content, the directories and the free blocks
+func (w *Writer) writeImage(g *geometry, all []*node, lastIno uint32) error {
+	uuid := w.hash.Sum(nil)[:16]
+	uuid[6] = uuid[6]&0x0f | 0x40
+	uuid[8] = uuid[8]&0x3f | 0x80
+
+	dirs := make([]uint32, g.groups)
+	for _, n := range all {
+		if n.typ == typeDir {
+			dirs[(n.ino-1)/g.ipg]++
+		}
+	}
+
+	// block 0 has the superblock at 1024
+	b := make([]byte, blockSize)
+	sb := b[1024:2048]
+	put32(sb, 0, g.ipg*g.groups)
+	put32(sb, 4, uint32(g.blocks))
+	put32(sb, 12, uint32(g.blocks-g.used))
+	put32(sb, 16, g.ipg*g.groups-lastIno)
+	put32(sb, 24, 2) // 1024 << 2
+	put32(sb, 28, 2)
+	put32(sb, 32, blocksPerGroup)
+	put32(sb, 36, blocksPerGroup)
+	put32(sb, 40, g.ipg)
+	put32(sb, 48, w.modTime)
+	put16(sb, 54, math.MaxUint16) // no check after a number of mounts
+	put16(sb, 56, magic)
+	put16(sb, 58, 1) // clean
+	put16(sb, 60, 1) // continue on errors
+	put32(sb, 64, w.modTime)
+	put32(sb, 76, 1) // dynamic revision
+	put32(sb, 84, firstIno)
+	put16(sb, 88, inodeSize)
+	put32(sb, 92, compatExtAttr|compatSparseSuper)
+	put32(sb, 96, incompatFiletype|incompatExtents|incompatFlexBG)
+	put32(sb, 100, roCompatLargeFile|roCompatHugeFile|roCompatDirNlink|roCompatExtraSize)
+	copy(sb[104:120], uuid)
+	copy(sb[236:252], w.hash.Sum(nil)[16:32]) // hash seed
+	sb[252] = 1                               // half md4
+	put32(sb, 264, w.modTime)
+	put16(sb, 348, extraIsize)
+	put16(sb, 350, extraIsize)
+	sb[372] = uint8(bits.Len32(g.groups - 1)) // one flex group for all groups
+	if _, err := w.w.Write(b); err != nil {
+		return err
+	}
+
+	gdt := make([]byte, g.gdt*blockSize)
+	for i := uint32(0); i < g.groups; i++ {
+		d := gdt[i*descSize:]
+		first, last := uint64(i)*blocksPerGroup, min(uint64(i+1)*blocksPerGroup, g.blocks)
+		put32(d, 0, uint32(g.blockBase+uint64(i)))
+		put32(d, 4, uint32(g.blockBase+uint64(g.groups+i)))
+		put32(d, 8, uint32(g.blockBase+2*uint64(g.groups)+uint64(i)*g.itable))
+		put16(d, 12, uint16(last-max(first, min(last, g.used))))
+		put16(d, 14, uint16(g.ipg-min(g.ipg, lastIno-min(lastIno, i*g.ipg))))
+		put16(d, 16, uint16(dirs[i]))
+	}
+	if _, err := w.w.Write(gdt); err != nil {
+		return err
+	}
+
+	// the bits past the end of the image and of the inode table are set
+	for i := uint64(0); i < uint64(g.groups); i++ {
+		clear(b)
+		first := i * blocksPerGroup
+		setBits(b, 0, min(g.used-min(g.used, first), blocksPerGroup))
+		setBits(b, min(g.blocks-first, blocksPerGroup), blocksPerGroup)
+		if _, err := w.w.Write(b); err != nil {
+			return err
+		}
+	}
+	for i := uint32(0); i < g.groups; i++ {
+		clear(b)
+		setBits(b, 0, uint64(min(g.ipg, lastIno-min(lastIno, i*g.ipg))))
+		setBits(b, uint64(g.ipg), blocksPerGroup)
+		if _, err := w.w.Write(b); err != nil {
+			return err
+		}
+	}
+
+	byIno := make(map[uint32]*node, len(all))
+	for _, n := range all {
+		byIno[n.ino] = n
+	}
+	for ino := uint32(1); ino <= g.ipg*g.groups; ino += inodesPerBlock {
+		clear(b)
+		if ino <= lastIno {
+			for i := uint32(0); i < inodesPerBlock; i++ {
+				if n, ok := byIno[ino+i]; ok {
+					n.encode(b[i*inodeSize : (i+1)*inodeSize])
+				}
+			}
+		}
+		if _, err := w.w.Write(b); err != nil {
+			return err
+		}
+	}
+
+	if _, err := w.spool.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := io.Copy(w.w, w.spool); err != nil {
+		return err
+	}
+	for _, n := range all {
+		if _, err := w.w.Write(n.data); err != nil {
+			return err
+		}
+		for _, leaf := range n.leafBlocks() {
+			if _, err := w.w.Write(leaf); err != nil {
+				return err
+			}
+		}
+		if n.xattr != nil {
+			if _, err := w.w.Write(n.xattr); err != nil {
+				return err
+			}
+		}
+	}
+	clear(b)
+	for i := g.used; i < g.blocks; i++ {
+		if _, err := w.w.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encode writes the inode of n into b
+func (n *node) encode(b []byte) {
+	mode := uint16(n.perm)
+	links := n.nlink
+	switch n.typ {
+	case typeReg:
+		mode |= 0x8000
+	case typeDir:
+		mode |= 0x4000
+		links = 2
+		for _, c := range n.children {
+			if c.typ == typeDir {
+				links++
+			}
+		}
+		if links > maxLinkCount {
+			// dir_nlink: the count is not tracked
+			links = 1
+		}
+	case typeSymlink:
+		mode |= 0xA000
+	case typeChar:
+		mode |= 0x2000
+	case typeBlock:
+		mode |= 0x6000
+	case typeFifo:
+		mode |= 0x1000
+	case typeSocket:
+		mode |= 0xC000
+	}
+	size := n.size
+	switch n.typ {
+	case typeDir:
+		size = uint64(len(n.data))
+	case typeSymlink:
+		size = uint64(len(n.target))
+	}
+	put16(b, 0, mode)
+	put16(b, 2, uint16(n.uid))
+	put32(b, 4, uint32(size))
+	put32(b, 8, n.mtime)
+	put32(b, 12, n.mtime)
+	put32(b, 16, n.mtime)
+	put16(b, 24, uint16(n.gid))
+	put16(b, 26, uint16(min(links, maxLinkCount)))
+	put32(b, 28, n.blocks*(blockSize/512))
+	put32(b, 108, uint32(size>>32))
+	put16(b, 116+4, uint16(n.uid>>16))
+	put16(b, 116+6, uint16(n.gid>>16))
+	put16(b, 128, extraIsize)
+	put32(b, 144, n.mtime) // creation time
+
+	iblock := b[40:100]
+	switch {
+	case n.typ == typeSymlink && n.data == nil:
+		// a fast symlink keeps the target in the inode
+		copy(iblock, n.target)
+	case n.typ == typeChar || n.typ == typeBlock:
+		if n.major < 256 && n.minor < 256 {
+			put32(iblock, 0, n.major<<8|n.minor)
+		} else {
+			put32(iblock, 4, n.minor&0xff|n.major<<8|(n.minor&^0xff)<<12)
+		}
+	case n.typ == typeReg || n.typ == typeDir || n.typ == typeSymlink:
+		put32(b, 32, extentsFlag)
+		if n.leaves == 0 {
+			putExtents(iblock, n.extents, inodeExtents, 0)
+			break
+		}
+		// the inode indexes the leaf blocks
+		leaf := n.first + uint64(len(n.data)/blockSize)
+		put16(iblock, 0, extentMagic)
+		put16(iblock, 2, uint16(n.leaves))
+		put16(iblock, 4, inodeExtents)
+		put16(iblock, 6, 1)
+		for i := uint32(0); i < n.leaves; i++ {
+			e := iblock[12+i*12:]
+			put32(e, 0, n.extents[i*extentsPerBlock].logical)
+			put32(e, 4, uint32(leaf+uint64(i)))
+			put16(e, 8, uint16((leaf+uint64(i))>>32))
+		}
+	}
+
+	if n.xattr != nil {
+		put32(b, 104, uint32(n.first+uint64(len(n.data)/blockSize)+uint64(n.leaves)))
+	} else if len(n.xattrs) > 0 {
+		ibody := b[128+extraIsize:]
+		put32(ibody, 0, xattrMagic)
+		encodeXattrs(n.xattrs, ibody, 4, 4)
+	}
+}
+
+// leafBlocks returns the extent tree leaves of n
+func (n *node) leafBlocks() [][]byte {
+	var leaves [][]byte
+	for i := uint32(0); i < n.leaves; i++ {
+		b := make([]byte, blockSize)
+		end := min(len(n.extents), int(i+1)*extentsPerBlock)
+		putExtents(b, n.extents[int(i)*extentsPerBlock:end], extentsPerBlock, 0)
+		leaves = append(leaves, b)
+	}
+	return leaves
+}
+
+// putExtents writes an extent tree node with the extents
+func putExtents(b []byte, extents []extent, max int, depth uint16) {
+	put16(b, 0, extentMagic)
+	put16(b, 2, uint16(len(extents)))
+	put16(b, 4, uint16(max))
+	put16(b, 6, depth)
+	for i, e := range extents {
+		p := b[12+i*12:]
+		put32(p, 0, e.logical)
+		put16(p, 4, uint16(e.length))
+		put16(p, 6, uint16(e.start>>32))
+		put32(p, 8, uint32(e.start))
+	}
+}
+
+// encodeXattrs writes the entries from offset start and the values from the end of b,
+// the value offsets are relative to base. It returns false when they do not fit.
+func encodeXattrs(xattrs map[string]string, b []byte, start, base int) bool {
+	type entry struct {
+		index uint8
+		name  string
+		value string
+	}
+	entries := make([]entry, 0, len(xattrs))
+	for k, v := range xattrs {
+		prefix, name, _ := strings.Cut(k, ".")
+		entries = append(entries, entry{xattrPrefixes[prefix+"."], name, v})
+	}
+	// entries of a block are sorted for the lookup of the kernel
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if a.index != b.index {
+			return a.index < b.index
+		}
+		if len(a.name) != len(b.name) {
+			return len(a.name) < len(b.name)
+		}
+		return a.name < b.name
+	})
+	off, end := start, len(b)
+	var blockHash uint32
+	for _, e := range entries {
+		size := 16 + (len(e.name)+3)&^3
+		end -= (len(e.value) + 3) &^ 3
+		// 4 zero bytes end the entries
+		if off+size+4 > end {
+			return false
+		}
+		h := xattrHash(e.name, e.value)
+		blockHash = blockHash<<16 ^ blockHash>>16 ^ h
+		b[off] = uint8(len(e.name))
+		b[off+1] = e.index
+		put16(b, off+2, uint16(end-base))
+		put32(b, off+8, uint32(len(e.value)))
+		put32(b, off+12, h)
+		copy(b[off+16:], e.name)
+		copy(b[end:], e.value)
+		off += size
+	}
+	if start == 32 {
+		// block header
+		put32(b, 0, xattrMagic)
+		put32(b, 4, 1) // reference count
+		put32(b, 8, 1) // blocks
+		put32(b, 12, blockHash)
+	}
+	return true
+}
+
+// xattrHash is the entry hash of e2fsprogs
+func xattrHash(name, value string) uint32 {
+	var h uint32
+	for i := 0; i < len(name); i++ {
+		h = h<<5 ^ h>>27 ^ uint32(int8(name[i]))
+	}
+	v := make([]byte, (len(value)+3)&^3)
+	copy(v, value)
+	for i := 0; i < len(v); i += 4 {
+		h = h<<16 ^ h>>16 ^ binary.LittleEndian.Uint32(v[i:])
+	}
+	return h
+}
+
+// setBits sets the bits of a bitmap from up to to
+func setBits(b []byte, from, to uint64) {
+	for i := from; i < to; i++ {
+		b[i/8] |= 1 << (i % 8)
+	}
+}
+
+func put16(b []byte, off int, v uint16) { binary.LittleEndian.PutUint16(b[off:], v) }
+func put32(b []byte, off int, v uint32) { binary.LittleEndian.PutUint32(b[off:], v) }
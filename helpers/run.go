@@ -3,6 +3,7 @@ package helpers
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"os/exec"
 )
 
@@ -17,17 +18,23 @@ func Run(name string, args ...string) error {
 }
 
 func RunResult(name string, args ...string) (string, string, error) {
+	return RunResultInput(nil, name, args...)
+}
+
+// RunResultInput is RunResult with stdin connected to input, e.g. for docker credential helpers
+func RunResultInput(input io.Reader, name string, args ...string) (string, string, error) {
 	c := exec.Command(name, args...)
 
 	var stdOut bytes.Buffer
 	var stdErr bytes.Buffer
 
+	c.Stdin = input
 	c.Stdout = &stdOut
 	c.Stderr = &stdErr
 
 	err := c.Run()
 	if err != nil {
-		return "", "", fmt.Errorf("%v: %s", err, stdErr.String())
+		return stdOut.String(), "", fmt.Errorf("%v: %s", err, stdErr.String())
 	}
 
 	return stdOut.String(), stdErr.String(), nil
@@ -4,6 +4,7 @@ package helpers
 
 import (
 	"archive/tar"
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -21,8 +22,20 @@ func Tar(src, outputTar string) error {
 	if err != nil {
 		return err
 	}
+	defer f.Close()
+
+	return TarWriter(src, f)
+}
 
-	tw := tar.NewWriter(f)
+// TarWriter writes the regular files below src as a tar stream to w
+func TarWriter(src string, w io.Writer) error {
+	return TarWriterFilter(src, w, nil)
+}
+
+// TarWriterFilter writes the regular files below src for which keep returns true,
+// keep gets the slash separated path relative to src and may be nil to keep every file
+func TarWriterFilter(src string, w io.Writer, keep func(name string) bool) error {
+	tw := tar.NewWriter(w)
 	defer tw.Close()
 
 	return filepath.Walk(src, func(file string, fi os.FileInfo, err error) error {
@@ -40,6 +53,9 @@ func Tar(src, outputTar string) error {
 		}
 
 		header.Name = strings.TrimPrefix(strings.Replace(file, src, "", -1), string(filepath.Separator))
+		if keep != nil && !keep(filepath.ToSlash(header.Name)) {
+			return nil
+		}
 
 		if err := tw.WriteHeader(header); err != nil {
 			return err
@@ -75,7 +91,16 @@ func UntarReader(r io.Reader, outputDir string) error {
 }
 
 func UntarTarReader(tr *tar.Reader, outputDir string) error {
+	return UntarTarReaderCheck(tr, outputDir, nil)
+}
+
+// ErrSkipEntry is returned by the check of UntarTarReaderCheck to skip an entry
+var ErrSkipEntry = errors.New("skip entry")
 
+// UntarTarReaderCheck extracts tr like UntarTarReader, calling check with each header before it is written.
+// check may change the header, e.g. rename the entry, or return ErrSkipEntry to skip it.
+// Any other error from check aborts the extraction.
+func UntarTarReaderCheck(tr *tar.Reader, outputDir string, check func(header *tar.Header) error) error {
 	for {
 		header, err := tr.Next()
 
@@ -91,6 +116,14 @@ func UntarTarReader(tr *tar.Reader, outputDir string) error {
 			continue
 		}
 
+		if check != nil {
+			if err := check(header); errors.Is(err, ErrSkipEntry) {
+				continue
+			} else if err != nil {
+				return err
+			}
+		}
+
 		target := filepath.Join(outputDir, header.Name)
 
 		switch header.Typeflag {
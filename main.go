@@ -1,34 +1,49 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 
-	"github.com/mheers/docker-image-squash/helpers"
 	"github.com/mheers/docker-image-squash/regctl"
 )
 
-func main() {
-	if len(os.Args) != 3 {
-		panic("usage: docker-image-squash <image> <output.tar>")
-	}
-
-	image := os.Args[1]
-	output := os.Args[2]
+// set by ci/go-build.sh
+var (
+	VERSION   = "N/A"
+	BuildTime = "N/A"
+	GitTag    = "N/A"
+	GitBranch = "N/A"
+)
 
-	// create a temporary directory to store the layers
-	tmpDir, err := os.MkdirTemp("", "regctl-squashr")
-	if err != nil {
-		panic(err)
-	}
-	defer os.RemoveAll(tmpDir)
+func main() {
+	os.Exit(run(os.Args[1:]))
+}
 
-	// squash the image
-	if err := regctl.Squash(image, tmpDir); err != nil {
-		panic(err)
-	}
+func run(args []string) int {
+	// the first SIGINT or SIGTERM cancels the command so temporary files are removed, a second one exits immediately
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
 
-	// create the output tarball
-	if err := helpers.Tar(tmpDir, output); err != nil {
-		panic(err)
+	regctl.SetVersion(regctl.Info{
+		Version:   VERSION,
+		BuildTime: BuildTime,
+		GitTag:    GitTag,
+		GitBranch: GitBranch,
+	})
+	if err := regctl.Execute(ctx, args); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		if ctx.Err() != nil {
+			// interrupted, same status as a shell
+			return 130
+		}
+		return 1
 	}
+	return 0
 }
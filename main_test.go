@@ -3,5 +3,13 @@ package main
 import "testing"
 
 func TestMain(t *testing.T) {
-	main()
+	if code := run([]string{"--help"}); code != 0 {
+		t.Errorf("help returned exit code %d", code)
+	}
+	if code := run([]string{"squash"}); code != 1 {
+		t.Errorf("missing args returned exit code %d, expected 1", code)
+	}
+	if code := run([]string{"alpine:latest"}); code != 1 {
+		t.Errorf("shortcut without output returned exit code %d, expected 1", code)
+	}
 }
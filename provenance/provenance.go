@@ -0,0 +1,221 @@
+// Package provenance describes a squash as an in-toto statement with a SLSA provenance predicate,
+// linking the digests of the source image to the digests of the output.
+package provenance
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/mheers/docker-image-squash/squash"
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	// StatementType is the type of an in-toto statement
+	StatementType = "https://in-toto.io/Statement/v1"
+	// PredicateType is the type of a SLSA provenance predicate
+	PredicateType = "https://slsa.dev/provenance/v1"
+	// BuildType identifies a squash, its external parameters are Parameters
+	BuildType = "https://github.com/mheers/docker-image-squash/squash/v1"
+	// BuilderID identifies the tool
+	BuilderID = "https://github.com/mheers/docker-image-squash"
+
+	// MediaType is the media type used when attaching a statement as an OCI artifact
+	MediaType = "application/vnd.in-toto+json"
+	// AnnotationPredicateType holds the predicate type of an attached statement
+	AnnotationPredicateType = "in-toto.io/predicate-type"
+
+	toolName = "docker-image-squash"
+)
+
+// Statement is an in-toto statement about the output of a squash
+type Statement struct {
+	Type          string               `json:"_type"`
+	Subject       []ResourceDescriptor `json:"subject"`
+	PredicateType string               `json:"predicateType"`
+	Predicate     Predicate            `json:"predicate"`
+}
+
+// ResourceDescriptor is an artifact with its digests
+type ResourceDescriptor struct {
+	Name        string            `json:"name,omitempty"`
+	URI         string            `json:"uri,omitempty"`
+	Digest      map[string]string `json:"digest,omitempty"`
+	MediaType   string            `json:"mediaType,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// Predicate is a SLSA provenance predicate
+type Predicate struct {
+	BuildDefinition BuildDefinition `json:"buildDefinition"`
+	RunDetails      RunDetails      `json:"runDetails"`
+}
+
+// BuildDefinition describes the inputs of a squash
+type BuildDefinition struct {
+	BuildType            string               `json:"buildType"`
+	ExternalParameters   Parameters           `json:"externalParameters"`
+	InternalParameters   Resolved             `json:"internalParameters"`
+	ResolvedDependencies []ResourceDescriptor `json:"resolvedDependencies"`
+}
+
+// Parameters are the source and the options of a squash as requested
+type Parameters struct {
+	Source   string `json:"source"`
+	Platform string `json:"platform,omitempty"`
+	// Target is the ref pushed to
+	Target  string  `json:"target,omitempty"`
+	Options Options `json:"options"`
+}
+
+// Options are the options of a squash that change its output
+type Options struct {
+	Format          string   `json:"format,omitempty"`
+	Compression     string   `json:"compression,omitempty"`
+	Include         []string `json:"include,omitempty"`
+	Exclude         []string `json:"exclude,omitempty"`
+	Size            int64    `json:"size,omitempty"`
+	InitShim        bool     `json:"initShim,omitempty"`
+	IncludeExternal bool     `json:"includeExternal,omitempty"`
+	WindowsHives    string   `json:"windowsHives,omitempty"`
+	// Policy is set when the signature of the source was verified
+	Policy bool `json:"policy,omitempty"`
+}
+
+// Resolved are the values a squash resolved from its parameters
+type Resolved struct {
+	// Platform is the platform of the squashed image, e.g. linux/amd64
+	Platform string `json:"platform"`
+	// Endpoint is the location the source was pulled from, e.g. a mirror
+	Endpoint string `json:"endpoint,omitempty"`
+	Spill    string `json:"spill,omitempty"`
+}
+
+// RunDetails describes the tool and the time of a squash
+type RunDetails struct {
+	Builder    Builder              `json:"builder"`
+	Metadata   Metadata             `json:"metadata"`
+	Byproducts []ResourceDescriptor `json:"byproducts,omitempty"`
+}
+
+// Builder is the tool with its version
+type Builder struct {
+	ID      string            `json:"id"`
+	Version map[string]string `json:"version,omitempty"`
+}
+
+// Metadata has the start and end of a squash
+type Metadata struct {
+	StartedOn  *time.Time `json:"startedOn,omitempty"`
+	FinishedOn *time.Time `json:"finishedOn,omitempty"`
+}
+
+// Build describes a squash for New
+type Build struct {
+	// Result of Squash or Push
+	Result *squash.Result
+	// Options passed to Squash or Push
+	Options squash.Options
+	// Output names the file written by Squash, the subject of Push is its target
+	Output string
+	// Version of the tool, e.g. the release
+	Version string
+	// Started and Finished are the time of the squash, zero values are left out
+	Started, Finished time.Time
+}
+
+// New returns the statement for a squash. The subject is the output file of Squash or the manifest
+// pushed by Push with its layer as a byproduct, the dependencies are the digest the source resolved to
+// and the platform manifest selected from an index.
+func New(b Build) Statement {
+	res := b.Result
+	s := Statement{
+		Type:          StatementType,
+		PredicateType: PredicateType,
+		Predicate: Predicate{
+			BuildDefinition: BuildDefinition{
+				BuildType: BuildType,
+				ExternalParameters: Parameters{
+					Source:   res.Ref,
+					Platform: b.Options.Platform,
+					Target:   res.Target,
+					Options: Options{
+						Format:          b.Options.Format,
+						Compression:     b.Options.Compression,
+						Include:         b.Options.Include,
+						Exclude:         b.Options.Exclude,
+						Size:            b.Options.Size,
+						InitShim:        b.Options.InitShim,
+						IncludeExternal: b.Options.IncludeExternal,
+						WindowsHives:    b.Options.WindowsHives,
+						Policy:          b.Options.Policy != nil,
+					},
+				},
+				InternalParameters: Resolved{
+					Platform: platform(res),
+					Spill:    res.Spill,
+				},
+				ResolvedDependencies: []ResourceDescriptor{{Name: res.Ref, Digest: digestSet(res.Digest)}},
+			},
+			RunDetails: RunDetails{
+				Builder: Builder{ID: BuilderID},
+			},
+		},
+	}
+	if res.Endpoint != res.Ref {
+		s.Predicate.BuildDefinition.InternalParameters.Endpoint = res.Endpoint
+	}
+	if res.Manifest != res.Digest {
+		s.Predicate.BuildDefinition.ResolvedDependencies = append(s.Predicate.BuildDefinition.ResolvedDependencies, ResourceDescriptor{
+			Name:        res.Ref,
+			Digest:      digestSet(res.Manifest),
+			Annotations: map[string]string{"platform": res.Platform},
+		})
+	}
+	if b.Version != "" {
+		s.Predicate.RunDetails.Builder.Version = map[string]string{toolName: b.Version}
+	}
+	if !b.Started.IsZero() {
+		t := b.Started.UTC()
+		s.Predicate.RunDetails.Metadata.StartedOn = &t
+	}
+	if !b.Finished.IsZero() {
+		t := b.Finished.UTC()
+		s.Predicate.RunDetails.Metadata.FinishedOn = &t
+	}
+	if res.Target != "" {
+		s.Subject = []ResourceDescriptor{{Name: res.Target, Digest: digestSet(res.Pushed.Digest), MediaType: res.Pushed.MediaType}}
+		s.Predicate.RunDetails.Byproducts = []ResourceDescriptor{{Name: "layer", Digest: digestSet(res.OutputDigest)}}
+	} else {
+		s.Subject = []ResourceDescriptor{{Name: b.Output, Digest: digestSet(res.OutputDigest)}}
+	}
+	return s
+}
+
+// Write writes the statement as indented JSON
+func Write(w io.Writer, s Statement) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(s)
+}
+
+// platform returns the platform selected from an index or else the one in the config
+func platform(res *squash.Result) string {
+	if res.Platform != "" {
+		return res.Platform
+	}
+	p := res.Config.OS + "/" + res.Config.Architecture
+	if res.Config.Variant != "" {
+		p += "/" + res.Config.Variant
+	}
+	return p
+}
+
+// digestSet returns d as the digest set of a resource
+func digestSet(d digest.Digest) map[string]string {
+	if d == "" {
+		return nil
+	}
+	return map[string]string{d.Algorithm().String(): d.Encoded()}
+}
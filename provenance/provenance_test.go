@@ -0,0 +1,85 @@
+package provenance
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/mheers/docker-image-squash/sign"
+	"github.com/mheers/docker-image-squash/squash"
+	"github.com/opencontainers/go-digest"
+	"github.com/regclient/regclient/types"
+	v1 "github.com/regclient/regclient/types/oci/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNew(t *testing.T) {
+	index, image, layer := digest.FromString("index"), digest.FromString("image"), digest.FromString("layer")
+	started := time.Date(2024, 5, 3, 8, 0, 0, 0, time.FixedZone("CEST", 2*60*60))
+	res := &squash.Result{
+		Ref:          "docker.io/library/alpine:3.18",
+		Endpoint:     "mirror.example.com/library/alpine:3.18",
+		Digest:       index,
+		Manifest:     image,
+		Platform:     "linux/arm64/v8",
+		Spill:        squash.SpillMemory,
+		OutputDigest: layer,
+	}
+
+	// the output file of Squash
+	s := New(Build{
+		Result:   res,
+		Options:  squash.Options{Platform: "linux/arm64", Format: squash.FormatSquashfs, Exclude: []string{"usr/share/doc"}, Policy: &sign.Policy{}},
+		Output:   "alpine.sqfs",
+		Version:  "v1.2.3",
+		Started:  started,
+		Finished: started.Add(time.Minute),
+	})
+	buf := &bytes.Buffer{}
+	require.NoError(t, Write(buf, s))
+	var got map[string]interface{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &got))
+	require.Equal(t, StatementType, got["_type"])
+	require.Equal(t, PredicateType, got["predicateType"])
+	require.Equal(t, []interface{}{map[string]interface{}{"name": "alpine.sqfs", "digest": map[string]interface{}{"sha256": layer.Encoded()}}}, got["subject"])
+	pred := got["predicate"].(map[string]interface{})
+	def := pred["buildDefinition"].(map[string]interface{})
+	require.Equal(t, BuildType, def["buildType"])
+	require.Equal(t, map[string]interface{}{
+		"source":   "docker.io/library/alpine:3.18",
+		"platform": "linux/arm64",
+		"options":  map[string]interface{}{"format": "squashfs", "exclude": []interface{}{"usr/share/doc"}, "policy": true},
+	}, def["externalParameters"])
+	require.Equal(t, map[string]interface{}{"platform": "linux/arm64/v8", "endpoint": "mirror.example.com/library/alpine:3.18", "spill": "memory"}, def["internalParameters"])
+	require.Equal(t, []interface{}{
+		map[string]interface{}{"name": res.Ref, "digest": map[string]interface{}{"sha256": index.Encoded()}},
+		map[string]interface{}{"name": res.Ref, "digest": map[string]interface{}{"sha256": image.Encoded()}, "annotations": map[string]interface{}{"platform": "linux/arm64/v8"}},
+	}, def["resolvedDependencies"])
+	run := pred["runDetails"].(map[string]interface{})
+	require.Equal(t, map[string]interface{}{"id": BuilderID, "version": map[string]interface{}{"docker-image-squash": "v1.2.3"}}, run["builder"])
+	require.Equal(t, map[string]interface{}{"startedOn": "2024-05-03T06:00:00Z", "finishedOn": "2024-05-03T06:01:00Z"}, run["metadata"])
+	require.NotContains(t, run, "byproducts")
+
+	// the manifest pushed by Push of a single image
+	pushed := digest.FromString("pushed")
+	res = &squash.Result{
+		Ref:          "registry.example.com/app:latest",
+		Endpoint:     "registry.example.com/app:latest",
+		Digest:       image,
+		Manifest:     image,
+		Config:       v1.Image{OS: "linux", Architecture: "amd64"},
+		OutputDigest: layer,
+		Target:       "registry.example.com/app:squashed",
+		Pushed:       types.Descriptor{MediaType: types.MediaTypeOCI1Manifest, Digest: pushed},
+	}
+	s = New(Build{Result: res, Options: squash.Options{Compression: squash.CompressionZstdChunked}})
+	require.Equal(t, []ResourceDescriptor{{Name: res.Target, Digest: map[string]string{"sha256": pushed.Encoded()}, MediaType: types.MediaTypeOCI1Manifest}}, s.Subject)
+	require.Equal(t, []ResourceDescriptor{{Name: "layer", Digest: map[string]string{"sha256": layer.Encoded()}}}, s.Predicate.RunDetails.Byproducts)
+	require.Equal(t, Resolved{Platform: "linux/amd64"}, s.Predicate.BuildDefinition.InternalParameters)
+	require.Len(t, s.Predicate.BuildDefinition.ResolvedDependencies, 1)
+	require.Equal(t, res.Target, s.Predicate.BuildDefinition.ExternalParameters.Target)
+	require.Equal(t, squash.CompressionZstdChunked, s.Predicate.BuildDefinition.ExternalParameters.Options.Compression)
+	require.Nil(t, s.Predicate.RunDetails.Builder.Version)
+	require.Nil(t, s.Predicate.RunDetails.Metadata.StartedOn)
+}
@@ -0,0 +1,137 @@
+package regctl
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/require"
+)
+
+// testStallRegistry serves the start of the layer and then stops sending data
+func testStallRegistry(layer []byte) http.Handler {
+	reg := testRegistry(layer)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/blobs/"+digest.FromBytes(layer).String()) || r.Method != http.MethodGet {
+			reg.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(layer)))
+		w.WriteHeader(http.StatusOK)
+		w.Write(layer[:len(layer)/2])
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	})
+}
+
+func TestCancel(t *testing.T) {
+	t.Setenv(ConfigEnv, filepath.Join(t.TempDir(), "config.json"))
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+	layer := testGzipLayer(t, map[string]string{"etc/hello": strings.Repeat("hello world\n", 10000)})
+	srv := httptest.NewServer(testStallRegistry(layer))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+	out := filepath.Join(t.TempDir(), "out.tar")
+
+	t.Run("idle timeout", func(t *testing.T) {
+		start := time.Now()
+		_, err := cobraTest(t, "squash", "--insecure-registry", host, "--progress", "none", "--blob-idle-timeout", "200ms", "--retries", "0", host+"/test/app:latest", out)
+		require.ErrorIs(t, err, ErrBlobIdleTimeout)
+		require.Less(t, time.Since(start), 10*time.Second)
+		require.NoFileExists(t, out)
+	})
+	t.Run("timeout", func(t *testing.T) {
+		_, err := cobraTest(t, "squash", "--insecure-registry", host, "--progress", "none", "--blob-idle-timeout", "0", "--timeout", "300ms", host+"/test/app:latest", out)
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+		require.Contains(t, err.Error(), "timeout of 300ms reached")
+		require.NoFileExists(t, out)
+	})
+	t.Run("cancel", func(t *testing.T) {
+		rootOpts.insecureRegistries = []string{host}
+		defer func() { rootOpts.insecureRegistries = []string{} }()
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			time.Sleep(200 * time.Millisecond)
+			cancel()
+		}()
+		err := Squash(ctx, host+"/test/app:latest", t.TempDir())
+		require.True(t, errors.Is(err, context.Canceled), err)
+		// ctx is cancelled now
+		require.ErrorIs(t, ExportImage(ctx, host+"/test/app:latest", out), context.Canceled)
+		require.NoFileExists(t, out)
+	})
+
+	// temporary directories are removed
+	entries, err := os.ReadDir(tmp)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+}
+
+func TestGetFileResume(t *testing.T) {
+	t.Setenv(ConfigEnv, filepath.Join(t.TempDir(), "config.json"))
+	layer := testGzipLayer(t, map[string]string{"etc/hello": strings.Repeat("hello world\n", 10000)})
+	reg := testRegistry(layer)
+	ranges := []string{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/blobs/"+digest.FromBytes(layer).String()) || r.Method != http.MethodGet {
+			reg.ServeHTTP(w, r)
+			return
+		}
+		ranges = append(ranges, r.Header.Get("Range"))
+		if len(ranges) > 1 {
+			reg.ServeHTTP(w, r)
+			return
+		}
+		// the first download stalls halfway
+		w.Header().Set("Content-Length", strconv.Itoa(len(layer)))
+		w.WriteHeader(http.StatusOK)
+		w.Write(layer[:len(layer)/2])
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	out := filepath.Join(t.TempDir(), "hello")
+	_, err := cobraTest(t, "get-file", "--insecure-registry", host, "--blob-idle-timeout", "200ms", "--retry-backoff", "1ms", host+"/test/app:latest", "etc/hello", out)
+	require.NoError(t, err)
+	b, err := os.ReadFile(out)
+	require.NoError(t, err)
+	require.Equal(t, strings.Repeat("hello world\n", 10000), string(b))
+	// the file is written while the layer is read, the stalled download is resumed
+	require.Equal(t, []string{"", "bytes=" + strconv.Itoa(len(layer)/2) + "-"}, ranges)
+}
+
+func TestRetries(t *testing.T) {
+	t.Setenv(ConfigEnv, filepath.Join(t.TempDir(), "config.json"))
+	out := filepath.Join(t.TempDir(), "out.tar")
+
+	// regclient does not retry on its own, every manifest request is one of --retries
+	for _, status := range []int{http.StatusServiceUnavailable, http.StatusGatewayTimeout} {
+		var requests atomic.Int32
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if strings.HasPrefix(r.URL.Path, "/v2/test/app/manifests/") {
+				requests.Add(1)
+			}
+			w.WriteHeader(status)
+		}))
+		host := strings.TrimPrefix(srv.URL, "http://")
+		for _, retries := range []int32{0, 2} {
+			requests.Store(0)
+			_, err := cobraTest(t, "squash", "--insecure-registry", host, "--progress", "none", "--retries", strconv.Itoa(int(retries)), "--retry-backoff", "10ms", host+"/test/app:latest", out)
+			require.Error(t, err)
+			require.Equal(t, retries+1, requests.Load(), "status %d, retries %d", status, retries)
+		}
+		srv.Close()
+	}
+}
@@ -17,13 +17,13 @@ var completionCmd = &cobra.Command{
 
 Bash:
 
-  $ source <(regctl completion bash)
+  $ source <(docker-image-squash completion bash)
 
   # To load completions for each session, execute once:
   # Linux:
-  $ regctl completion bash > /etc/bash_completion.d/regctl
+  $ docker-image-squash completion bash > /etc/bash_completion.d/docker-image-squash
   # macOS:
-  $ regctl completion bash > /usr/local/etc/bash_completion.d/regctl
+  $ docker-image-squash completion bash > /usr/local/etc/bash_completion.d/docker-image-squash
 
 Zsh:
 
@@ -33,23 +33,23 @@ Zsh:
   $ echo "autoload -U compinit; compinit" >> ~/.zshrc
 
   # To load completions for each session, execute once:
-  $ regctl completion zsh > "${fpath[1]}/_regctl"
+  $ docker-image-squash completion zsh > "${fpath[1]}/_docker-image-squash"
 
   # You will need to start a new shell for this setup to take effect.
 
 fish:
 
-  $ regctl completion fish | source
+  $ docker-image-squash completion fish | source
 
   # To load completions for each session, execute once:
-  $ regctl completion fish > ~/.config/fish/completions/regctl.fish
+  $ docker-image-squash completion fish > ~/.config/fish/completions/docker-image-squash.fish
 
 PowerShell:
 
-  PS> regctl completion powershell | Out-String | Invoke-Expression
+  PS> docker-image-squash completion powershell | Out-String | Invoke-Expression
 
   # To load completions for every new session, run:
-  PS> regctl completion powershell > regctl.ps1
+  PS> docker-image-squash completion powershell > docker-image-squash.ps1
   # and source this file from your PowerShell profile.
 `,
 	DisableFlagsInUseLine: true,
@@ -69,6 +69,10 @@ PowerShell:
 	},
 }
 
+func init() {
+	rootCmd.AddCommand(completionCmd)
+}
+
 type completeFunc func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective)
 
 func completeArgNone(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
@@ -118,7 +122,7 @@ func completeArgTag(cmd *cobra.Command, args []string, toComplete string) ([]str
 	if err != nil || r.Digest != "" {
 		return result, cobra.ShellCompDirectiveNoFileComp
 	}
-	rc := newRegClient()
+	rc := newRegClient(r)
 	tl, err := rc.TagList(context.Background(), r)
 	if err != nil {
 		return result, cobra.ShellCompDirectiveNoFileComp
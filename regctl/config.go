@@ -1,13 +1,401 @@
 package regctl
 
-import "github.com/regclient/regclient/config"
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/regclient/regclient/config"
+	"github.com/regclient/regclient/pkg/template"
+	"github.com/spf13/cobra"
+)
+
+var (
+	// ConfigFilename is the default filename to read/write configuration
+	ConfigFilename = "config.json"
+	// ConfigDir is the default directory within the XDG config directory to read/write configuration
+	ConfigDir = "docker-image-squash"
+	// ConfigEnv is the environment variable to override the config filename
+	ConfigEnv = "DOCKER_IMAGE_SQUASH_CONFIG"
+	// ConfigVersion is the highest config file version supported
+	ConfigVersion = 1
+)
 
 // Config struct contains contents loaded from / saved to a config file
 type Config struct {
 	Filename      string                  `json:"-"`                 // filename that was loaded
 	Version       int                     `json:"version,omitempty"` // version the file in case the config file syntax changes in the future
 	Hosts         map[string]*config.Host `json:"hosts"`
+	HostTLS       map[string]*HostTLS     `json:"hostTLS,omitempty"` // file based TLS settings, keyed like Hosts
 	BlobLimit     int64                   `json:"blobLimit,omitempty"`
 	IncDockerCert *bool                   `json:"incDockerCert,omitempty"`
 	IncDockerCred *bool                   `json:"incDockerCred,omitempty"`
 }
+
+var configOpts struct {
+	blobLimit  int64
+	dockerCert bool
+	dockerCred bool
+	format     string
+	host       string
+	hostname   string
+	tls        string
+	mirrors    []string
+	priority   uint
+	credHelper string
+	blobChunk  int64
+	blobMax    int64
+	caFile     string
+	clientCert string
+	clientKey  string
+}
+
+var configCmd = &cobra.Command{
+	Use:   "config <cmd>",
+	Short: "read/set configuration options",
+	Long: `The config file is loaded from --config, $DOCKER_IMAGE_SQUASH_CONFIG, or
+$XDG_CONFIG_HOME/docker-image-squash/config.json (default ~/.config/docker-image-squash/config.json).`,
+}
+
+var configGetCmd = &cobra.Command{
+	Use:   "get",
+	Short: "show the config",
+	Long:  `Displays the configuration. Passwords are not included in the output.`,
+	Args:  cobra.ExactArgs(0),
+	RunE:  runConfigGet,
+}
+
+var configSetCmd = &cobra.Command{
+	Use:   "set",
+	Short: "set a configuration option",
+	Long: `Modifies an option used in future executions.
+Use --host to modify the settings of a single registry.`,
+	Args: cobra.ExactArgs(0),
+	RunE: runConfigSet,
+}
+
+func init() {
+	configGetCmd.Flags().StringVar(&configOpts.format, "format", "{{ printPretty . }}", "format the output with Go template syntax")
+
+	configSetCmd.Flags().Int64Var(&configOpts.blobLimit, "blob-limit", 0, "limit for blob chunks, this is stored in memory")
+	configSetCmd.Flags().BoolVar(&configOpts.dockerCert, "docker-cert", false, "load certificates from docker")
+	configSetCmd.Flags().BoolVar(&configOpts.dockerCred, "docker-cred", false, "load credentials from docker")
+	configSetCmd.Flags().StringVar(&configOpts.host, "host", "", "registry to modify, required for the host specific options")
+	configSetCmd.Flags().StringVar(&configOpts.hostname, "hostname", "", "hostname or ip to connect to the registry")
+	configSetCmd.Flags().StringVar(&configOpts.tls, "tls", "", "tls setting for the registry (enabled, insecure, disabled)")
+	configSetCmd.Flags().StringArrayVar(&configOpts.mirrors, "mirror", []string{}, "registry mirror, repeat for multiple mirrors")
+	configSetCmd.Flags().UintVar(&configOpts.priority, "priority", 0, "priority when the registry is used as a mirror, higher is attempted first")
+	configSetCmd.Flags().StringVar(&configOpts.credHelper, "cred-helper", "", "credential helper command (e.g. docker-credential-pass)")
+	configSetCmd.Flags().Int64Var(&configOpts.blobChunk, "blob-chunk", 0, "size of each chunk when pushing blobs")
+	configSetCmd.Flags().Int64Var(&configOpts.blobMax, "blob-max", 0, "blob size to switch to chunked pushes, -1 to disable")
+	configSetCmd.Flags().StringVar(&configOpts.caFile, "ca-file", "", "PEM CA bundle trusted for the registry, empty to remove")
+	configSetCmd.Flags().StringVar(&configOpts.clientCert, "client-cert", "", "PEM client certificate file for mTLS, empty to remove")
+	configSetCmd.Flags().StringVar(&configOpts.clientKey, "client-key", "", "PEM client key file for mTLS, empty to remove")
+	configSetCmd.RegisterFlagCompletionFunc("tls", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return []string{"enabled", "insecure", "disabled"}, cobra.ShellCompDirectiveNoFileComp
+	})
+
+	configCmd.AddCommand(configGetCmd)
+	configCmd.AddCommand(configSetCmd)
+	rootCmd.AddCommand(configCmd)
+}
+
+func runConfigGet(cmd *cobra.Command, args []string) error {
+	c, err := ConfigLoadDefault()
+	if err != nil {
+		return err
+	}
+	for i := range c.Hosts {
+		c.Hosts[i].Pass = ""
+		c.Hosts[i].Token = ""
+	}
+
+	return template.Writer(cmd.OutOrStdout(), configOpts.format, c)
+}
+
+func runConfigSet(cmd *cobra.Command, args []string) error {
+	c, err := ConfigLoadDefault()
+	if err != nil {
+		return err
+	}
+
+	if flagChanged(cmd, "blob-limit") {
+		c.BlobLimit = configOpts.blobLimit
+	}
+	if flagChanged(cmd, "docker-cert") {
+		if !configOpts.dockerCert {
+			c.IncDockerCert = &configOpts.dockerCert
+		} else {
+			c.IncDockerCert = nil
+		}
+	}
+	if flagChanged(cmd, "docker-cred") {
+		if !configOpts.dockerCred {
+			c.IncDockerCred = &configOpts.dockerCred
+		} else {
+			c.IncDockerCred = nil
+		}
+	}
+
+	hostFlags := []string{"hostname", "tls", "mirror", "priority", "cred-helper", "blob-chunk", "blob-max", "ca-file", "client-cert", "client-key"}
+	for _, name := range hostFlags {
+		if flagChanged(cmd, name) && configOpts.host == "" {
+			return fmt.Errorf("%w: --%s requires --host", ErrMissingInput, name)
+		}
+	}
+	if configOpts.host != "" {
+		h := c.hostGet(configOpts.host)
+		if flagChanged(cmd, "hostname") {
+			h.Hostname = configOpts.hostname
+		}
+		if flagChanged(cmd, "tls") {
+			if err := h.TLS.UnmarshalText([]byte(configOpts.tls)); err != nil {
+				return fmt.Errorf("%w: %v", ErrInvalidInput, err)
+			}
+		}
+		if flagChanged(cmd, "mirror") {
+			h.Mirrors = configOpts.mirrors
+		}
+		if flagChanged(cmd, "priority") {
+			h.Priority = configOpts.priority
+		}
+		if flagChanged(cmd, "cred-helper") {
+			h.CredHelper = configOpts.credHelper
+		}
+		if flagChanged(cmd, "blob-chunk") {
+			h.BlobChunk = configOpts.blobChunk
+		}
+		if flagChanged(cmd, "blob-max") {
+			h.BlobMax = configOpts.blobMax
+		}
+		if flagChanged(cmd, "ca-file") || flagChanged(cmd, "client-cert") || flagChanged(cmd, "client-key") {
+			ht := c.hostTLSGet(configOpts.host)
+			if flagChanged(cmd, "ca-file") {
+				ht.CAFile = configOpts.caFile
+			}
+			if flagChanged(cmd, "client-cert") {
+				ht.ClientCert = configOpts.clientCert
+			}
+			if flagChanged(cmd, "client-key") {
+				ht.ClientKey = configOpts.clientKey
+			}
+			if ht.empty() {
+				delete(c.HostTLS, h.Name)
+			}
+		}
+	}
+
+	if err := c.validate(); err != nil {
+		return err
+	}
+	return c.ConfigSave()
+}
+
+// ConfigNew creates an empty configuration
+func ConfigNew() *Config {
+	c := Config{
+		Hosts:   map[string]*config.Host{},
+		HostTLS: map[string]*HostTLS{},
+	}
+	return &c
+}
+
+// ConfigLoadReader loads the config from an io reader
+func ConfigLoadReader(r io.Reader) (*Config, error) {
+	c := ConfigNew()
+	if err := json.NewDecoder(r).Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	if c.Hosts == nil {
+		c.Hosts = map[string]*config.Host{}
+	}
+	if c.HostTLS == nil {
+		c.HostTLS = map[string]*HostTLS{}
+	}
+	// verify loaded version is not higher than supported version
+	if c.Version > ConfigVersion {
+		return c, fmt.Errorf("%w: version %d, %d is supported", ErrUnsupportedConfigVersion, c.Version, ConfigVersion)
+	}
+	for h := range c.Hosts {
+		if c.Hosts[h] == nil {
+			return c, fmt.Errorf("%w: empty host entry %s", ErrInvalidInput, h)
+		}
+		if c.Hosts[h].Name == "" {
+			c.Hosts[h].Name = h
+		}
+		if c.Hosts[h].Hostname == "" {
+			c.Hosts[h].Hostname = h
+		}
+		if c.Hosts[h].TLS == config.TLSUndefined {
+			c.Hosts[h].TLS = config.TLSEnabled
+		}
+		if h == config.DockerRegistryDNS || h == config.DockerRegistry || h == config.DockerRegistryAuth {
+			// Docker Hub
+			c.Hosts[h].Name = config.DockerRegistry
+			if c.Hosts[h].Hostname == h {
+				c.Hosts[h].Hostname = config.DockerRegistryDNS
+			}
+			if c.Hosts[h].CredHost == h {
+				c.Hosts[h].CredHost = config.DockerRegistryAuth
+			}
+		}
+		// ensure key matches Name
+		if c.Hosts[h].Name != h {
+			c.Hosts[c.Hosts[h].Name] = c.Hosts[h]
+			delete(c.Hosts, h)
+		}
+	}
+	for h, ht := range c.HostTLS {
+		if ht == nil {
+			return c, fmt.Errorf("%w: empty hostTLS entry %s", ErrInvalidInput, h)
+		}
+		name := config.HostNewName(h).Name
+		if name != h {
+			c.HostTLS[name] = ht
+			delete(c.HostTLS, h)
+		}
+		if _, ok := c.Hosts[name]; !ok {
+			c.Hosts[name] = config.HostNewName(name)
+		}
+	}
+	return c, c.validate()
+}
+
+// ConfigLoadFile loads the config from a specified filename
+func ConfigLoadFile(filename string) (*Config, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	c, err := ConfigLoadReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config %s: %w", filename, err)
+	}
+	c.Filename = filename
+	return c, nil
+}
+
+// ConfigLoadDefault loads the config from the (default) filename
+func ConfigLoadDefault() (*Config, error) {
+	filename := configFilename()
+	c, err := ConfigLoadFile(filename)
+	if err != nil && errors.Is(err, fs.ErrNotExist) {
+		// do not error on file not found
+		c := ConfigNew()
+		c.Filename = filename
+		return c, nil
+	}
+	return c, err
+}
+
+// configFilename returns the config file from the flag, environment, or XDG config directory
+func configFilename() string {
+	if rootOpts.config != "" {
+		return rootOpts.config
+	}
+	if env := os.Getenv(ConfigEnv); env != "" {
+		return env
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		// fall back to the working directory when no HOME is set
+		dir = "."
+	}
+	return filepath.Join(dir, ConfigDir, ConfigFilename)
+}
+
+// ConfigSave saves to previously loaded filename.
+// The file is written to a temp file and renamed, so concurrent readers never see a partial config.
+func (c *Config) ConfigSave() error {
+	if c.Filename == "" {
+		return ErrNotFound
+	}
+	if c.Version == 0 {
+		c.Version = ConfigVersion
+	}
+	out, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(c.Filename)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	mode := fs.FileMode(0600)
+	if fi, err := os.Stat(c.Filename); err == nil && fi.Mode().IsRegular() {
+		mode = fi.Mode().Perm()
+	}
+	tmp, err := os.CreateTemp(dir, filepath.Base(c.Filename)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(out); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write config: %w", err)
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), c.Filename)
+}
+
+// hostGet returns the settings for a registry, adding an entry when missing
+func (c *Config) hostGet(name string) *config.Host {
+	if name == config.DockerRegistryDNS || name == config.DockerRegistryAuth {
+		name = config.DockerRegistry
+	}
+	if h, ok := c.Hosts[name]; ok {
+		return h
+	}
+	h := config.HostNewName(name)
+	c.Hosts[name] = h
+	return h
+}
+
+// hostTLSGet returns the file based TLS settings for a registry, adding an entry when missing
+func (c *Config) hostTLSGet(name string) *HostTLS {
+	name = c.hostGet(name).Name
+	if ht, ok := c.HostTLS[name]; ok {
+		return ht
+	}
+	ht := &HostTLS{}
+	c.HostTLS[name] = ht
+	return ht
+}
+
+// validate checks settings that would otherwise fail later with a less helpful error
+func (c *Config) validate() error {
+	if c.BlobLimit < 0 {
+		return fmt.Errorf("%w: blobLimit must not be negative", ErrInvalidInput)
+	}
+	for name, h := range c.Hosts {
+		if h.BlobChunk < 0 {
+			return fmt.Errorf("%w: blobChunk for %s must not be negative", ErrInvalidInput, name)
+		}
+		for _, m := range h.Mirrors {
+			if m == name {
+				return fmt.Errorf("%w: %s cannot be a mirror of itself", ErrInvalidInput, name)
+			}
+		}
+	}
+	for name, ht := range c.HostTLS {
+		if (ht.ClientCert == "") != (ht.ClientKey == "") {
+			return fmt.Errorf("%w: clientCert and clientKey must both be set for %s", ErrInvalidInput, name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package regctl
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/regclient/regclient/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfig(t *testing.T) {
+	t.Setenv(ConfigEnv, filepath.Join(t.TempDir(), "config.json"))
+
+	// test empty config
+	out, err := cobraTest(t, "config", "get", "--format", "{{ json . }}")
+	require.NoError(t, err)
+	require.Equal(t, `{"hosts":{}}`, out)
+
+	// host options without a host, flag values persist between runs so this is checked first
+	_, err = cobraTest(t, "config", "set", "--tls", "disabled")
+	require.ErrorIs(t, err, ErrMissingInput)
+
+	// set options
+	_, err = cobraTest(t, "config", "set", "--blob-limit", "420000000", "--docker-cred=false")
+	require.NoError(t, err)
+	_, err = cobraTest(t, "config", "set", "--host", "registry.corp", "--tls", "insecure", "--mirror", "mirror.corp")
+	require.NoError(t, err)
+	_, err = cobraTest(t, "config", "set", "--host", "registry.corp", "--tls", "bogus")
+	require.ErrorIs(t, err, ErrInvalidInput)
+
+	c, err := ConfigLoadDefault()
+	require.NoError(t, err)
+	require.Equal(t, int64(420000000), c.BlobLimit)
+	require.NotNil(t, c.IncDockerCred)
+	require.False(t, *c.IncDockerCred)
+	require.Equal(t, ConfigVersion, c.Version)
+	require.Contains(t, c.Hosts, "registry.corp")
+	require.Equal(t, config.TLSInsecure, c.Hosts["registry.corp"].TLS)
+	require.Equal(t, []string{"mirror.corp"}, c.Hosts["registry.corp"].Mirrors)
+
+	fi, err := os.Stat(c.Filename)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+}
+
+func TestConfigVersion(t *testing.T) {
+	_, err := ConfigLoadReader(strings.NewReader(`{"version": 2, "hosts": {}}`))
+	require.ErrorIs(t, err, ErrUnsupportedConfigVersion)
+
+	// commands fail instead of using an empty config
+	file := filepath.Join(t.TempDir(), "config.json")
+	t.Setenv(ConfigEnv, file)
+	require.NoError(t, os.WriteFile(file, []byte(`{"version": 2, "hosts": {}}`), 0600))
+	_, err = cobraTest(t, "manifest", "head", "localhost:5000/app:latest")
+	require.ErrorIs(t, err, ErrUnsupportedConfigVersion)
+	require.NoError(t, os.WriteFile(file, []byte(`{"hosts": `), 0600))
+	_, err = cobraTest(t, "manifest", "head", "localhost:5000/app:latest")
+	require.ErrorContains(t, err, file)
+
+	c, err := ConfigLoadReader(strings.NewReader(`{"version": 1, "hosts": {"docker.io": {"user": "me"}}}`))
+	require.NoError(t, err)
+	require.Equal(t, config.DockerRegistryDNS, c.Hosts["docker.io"].Hostname)
+	require.Equal(t, config.TLSEnabled, c.Hosts["docker.io"].TLS)
+}
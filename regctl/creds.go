@@ -0,0 +1,187 @@
+package regctl
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/mheers/docker-image-squash/helpers"
+	"github.com/mheers/docker-image-squash/squash"
+	"github.com/regclient/regclient/config"
+	"github.com/regclient/regclient/types"
+	"github.com/regclient/regclient/types/ref"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// credHelperPrefix is added to helper names that are given without it, e.g. "pass"
+	credHelperPrefix = "docker-credential-"
+	// EnvRegistryHost selects the registry for EnvRegistryUser and EnvRegistryPassword
+	EnvRegistryHost = "REGISTRY_HOST"
+	// EnvRegistryUser is the username, append "_<HOST>" to set it for a single registry
+	EnvRegistryUser = "REGISTRY_USER"
+	// EnvRegistryPassword is the password, append "_<HOST>" to set it for a single registry
+	EnvRegistryPassword = "REGISTRY_PASSWORD"
+)
+
+// credHelperErrs are the failures of the credential helpers by registry
+var credHelperErrs sync.Map
+
+// credHelperCred is the json exchanged with docker credential helpers
+type credHelperCred struct {
+	ServerURL string `json:"ServerURL"`
+	Username  string `json:"Username"`
+	Secret    string `json:"Secret"`
+}
+
+func credHelperName(helper string) string {
+	if !strings.HasPrefix(helper, credHelperPrefix) {
+		return credHelperPrefix + helper
+	}
+	return helper
+}
+
+// credHelperHost returns the name used to store a host in credential helpers
+func credHelperHost(h *config.Host) string {
+	if h.CredHost != "" {
+		return h.CredHost
+	}
+	if h.Name == config.DockerRegistry {
+		return config.DockerRegistryAuth
+	}
+	return h.Name
+}
+
+// credHelperGet requests the credentials for a host from a docker-credential-* helper
+func credHelperGet(helper, host string) (string, string, error) {
+	stdout, _, err := helpers.RunResultInput(strings.NewReader(host), credHelperName(helper), "get")
+	if err != nil {
+		if strings.Contains(stdout, "credentials not found") {
+			return "", "", fmt.Errorf("%w: %s has no entry in %s", ErrCredsNotFound, host, credHelperName(helper))
+		}
+		return "", "", fmt.Errorf("credential helper %s failed for %s: %w", credHelperName(helper), host, err)
+	}
+	cred := credHelperCred{}
+	if err := json.Unmarshal([]byte(stdout), &cred); err != nil {
+		return "", "", fmt.Errorf("credential helper %s returned invalid output for %s: %w", credHelperName(helper), host, err)
+	}
+	return cred.Username, cred.Secret, nil
+}
+
+// credHelperStore saves the credentials for a host in a docker-credential-* helper
+func credHelperStore(helper, host, user, pass string) error {
+	in, err := json.Marshal(credHelperCred{ServerURL: host, Username: user, Secret: pass})
+	if err != nil {
+		return err
+	}
+	_, _, err = helpers.RunResultInput(strings.NewReader(string(in)), credHelperName(helper), "store")
+	if err != nil {
+		return fmt.Errorf("credential helper %s failed to store %s: %w", credHelperName(helper), host, err)
+	}
+	return nil
+}
+
+// credHelperErase removes the credentials for a host from a docker-credential-* helper
+func credHelperErase(helper, host string) error {
+	_, _, err := helpers.RunResultInput(strings.NewReader(host), credHelperName(helper), "erase")
+	if err != nil {
+		return fmt.Errorf("credential helper %s failed to erase %s: %w", credHelperName(helper), host, err)
+	}
+	return nil
+}
+
+// envHostKey converts a registry name to the suffix of the per host environment variables,
+// e.g. registry.corp:5000 is REGISTRY_USER_REGISTRY_CORP_5000
+func envHostKey(host string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		default:
+			return '_'
+		}
+	}, host)
+}
+
+// envCreds returns credentials for a host from the environment, the unsuffixed
+// variables are only used for the registry named in REGISTRY_HOST so they are never sent elsewhere
+func envCreds(host string) (string, string, bool) {
+	key := envHostKey(host)
+	user, userOK := os.LookupEnv(EnvRegistryUser + "_" + key)
+	pass, passOK := os.LookupEnv(EnvRegistryPassword + "_" + key)
+	if userOK && passOK {
+		return user, pass, true
+	}
+	if envHost := os.Getenv(EnvRegistryHost); envHost != "" && config.HostNewName(envHost).Name == host {
+		user, userOK = os.LookupEnv(EnvRegistryUser)
+		pass, passOK = os.LookupEnv(EnvRegistryPassword)
+		if userOK && passOK {
+			return user, pass, true
+		}
+	}
+	return "", "", false
+}
+
+// hostCreds resolves the credentials of a host: environment, then the config file, then the credential helper.
+// The helper is removed from the host afterwards, it has been called through helpers.RunResultInput already.
+func hostCreds(h *config.Host) {
+	if user, pass, ok := envCreds(h.Name); ok {
+		log.WithFields(logrus.Fields{
+			"host": h.Name,
+		}).Debug("Using credentials from environment")
+		h.User, h.Pass, h.Token = user, pass, ""
+		h.CredHelper = ""
+		return
+	}
+	if h.User != "" || h.Token != "" || h.CredHelper == "" {
+		h.CredHelper = ""
+		return
+	}
+	user, pass, err := credHelperGet(h.CredHelper, credHelperHost(h))
+	if err != nil {
+		// anonymous requests may still succeed, credsError reports the failure when they do not
+		if !errors.Is(err, ErrCredsNotFound) {
+			err = fmt.Errorf("%w for %s: %v", ErrCredsNotFound, h.Name, err)
+		}
+		credHelperErrs.Store(h.Name, err)
+		log.WithFields(logrus.Fields{
+			"host": h.Name,
+			"err":  err,
+		}).Warn("Failed to get credentials from helper")
+	} else if user == "<token>" {
+		h.Token = pass
+	} else {
+		h.User, h.Pass = user, pass
+	}
+	if err == nil {
+		credHelperErrs.Delete(h.Name)
+	}
+	h.CredHelper = ""
+}
+
+// credsError names the registry when a request was rejected for missing or invalid credentials,
+// the endpoint of a squash.EndpointError replaces r.
+// When the credential helper of the registry failed, its error is returned for a request that was rejected or not found,
+// registries answer both without credentials.
+func credsError(r ref.Ref, err error) error {
+	if err == nil || errors.Is(err, ErrCredsNotFound) {
+		return err
+	}
+	var ee *squash.EndpointError
+	if errors.As(err, &ee) {
+		r = ee.Endpoint
+	}
+	if helperErr, ok := credHelperErrs.Load(r.Registry); ok && (errors.Is(err, types.ErrHTTPUnauthorized) || errors.Is(err, types.ErrNotFound)) {
+		return fmt.Errorf("%w: %v", helperErr.(error), err)
+	}
+	if !errors.Is(err, types.ErrHTTPUnauthorized) {
+		return err
+	}
+	return fmt.Errorf("%w for %s, use \"docker-image-squash login %s\" or set %s_%s/%s_%s: %v",
+		ErrCredsNotFound, r.Registry, r.Registry, EnvRegistryUser, envHostKey(r.Registry), EnvRegistryPassword, envHostKey(r.Registry), err)
+}
@@ -0,0 +1,168 @@
+package regctl
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mheers/docker-image-squash/squash"
+	"github.com/regclient/regclient/config"
+	"github.com/regclient/regclient/types"
+	"github.com/regclient/regclient/types/ref"
+	"github.com/stretchr/testify/require"
+)
+
+// testCredHelper installs a docker-credential-test helper on the PATH that stores one credential in a file,
+// every get is recorded with the host in the file "calls" next to it
+func testCredHelper(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	store := filepath.Join(dir, "store.json")
+	script := fmt.Sprintf(`#!/bin/sh
+case "$1" in
+get)
+  read host
+  echo "$host" >> %[2]s
+  if [ -f %[1]s ]; then cat %[1]s; exit 0; fi
+  echo "credentials not found in native keychain"; exit 1;;
+store) cat > %[1]s;;
+erase) rm -f %[1]s;;
+esac
+`, store, filepath.Join(dir, "calls"))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "docker-credential-test"), []byte(script), 0755))
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return store
+}
+
+func TestCredHelper(t *testing.T) {
+	store := testCredHelper(t)
+
+	_, _, err := credHelperGet("test", "registry.corp")
+	require.ErrorIs(t, err, ErrCredsNotFound)
+
+	require.NoError(t, credHelperStore("test", "registry.corp", "me", "secret"))
+	user, pass, err := credHelperGet("docker-credential-test", "registry.corp")
+	require.NoError(t, err)
+	require.Equal(t, "me", user)
+	require.Equal(t, "secret", pass)
+
+	require.NoError(t, credHelperErase("test", "registry.corp"))
+	require.NoFileExists(t, store)
+}
+
+func TestEnvCreds(t *testing.T) {
+	t.Setenv("REGISTRY_USER_REGISTRY_CORP_5000", "ci")
+	t.Setenv("REGISTRY_PASSWORD_REGISTRY_CORP_5000", "token")
+	t.Setenv(EnvRegistryUser, "default")
+	t.Setenv(EnvRegistryPassword, "pass")
+
+	user, pass, ok := envCreds("registry.corp:5000")
+	require.True(t, ok)
+	require.Equal(t, "ci", user)
+	require.Equal(t, "token", pass)
+
+	// unsuffixed variables require REGISTRY_HOST
+	_, _, ok = envCreds("other.corp")
+	require.False(t, ok)
+	t.Setenv(EnvRegistryHost, "other.corp")
+	user, _, ok = envCreds("other.corp")
+	require.True(t, ok)
+	require.Equal(t, "default", user)
+
+	h := config.HostNewName("registry.corp:5000")
+	h.CredHelper = "test"
+	hostCreds(h)
+	require.Equal(t, "ci", h.User)
+	require.Empty(t, h.CredHelper)
+}
+
+func TestCredHelperHosts(t *testing.T) {
+	store := testCredHelper(t)
+	calls := filepath.Join(filepath.Dir(store), "calls")
+	t.Setenv(ConfigEnv, filepath.Join(t.TempDir(), "config.json"))
+	layer := testGzipLayer(t, map[string]string{"etc/hello": "hello world\n"})
+	open := httptest.NewServer(testRegistry(layer))
+	defer open.Close()
+	reg := testRegistry(layer)
+	auth := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); !ok || user != "me" || pass != "secret" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		reg.ServeHTTP(w, r)
+	}))
+	defer auth.Close()
+	openHost := strings.TrimPrefix(open.URL, "http://")
+	authHost := strings.TrimPrefix(auth.URL, "http://")
+
+	_, err := cobraTest(t, "login", authHost, "-u", "me", "-p", "secret", "--cred-helper", "test")
+	require.NoError(t, err)
+	require.NoFileExists(t, calls)
+
+	// the helper is not run for a host that is not accessed
+	_, err = cobraTest(t, "manifest", "head", "--insecure-registry", openHost, "--insecure-registry", authHost, openHost+"/test/app:latest")
+	require.NoError(t, err)
+	require.NoFileExists(t, calls)
+
+	// it runs for the registry of the image
+	_, err = cobraTest(t, "manifest", "head", "--insecure-registry", authHost, authHost+"/test/app:latest")
+	require.NoError(t, err)
+	b, err := os.ReadFile(calls)
+	require.NoError(t, err)
+	require.Equal(t, authHost+"\n", string(b))
+
+	// a helper without the credentials names the registry
+	require.NoError(t, credHelperErase("test", authHost))
+	_, err = cobraTest(t, "manifest", "get", "--insecure-registry", authHost, authHost+"/test/app:latest")
+	require.ErrorIs(t, err, ErrCredsNotFound)
+	require.Contains(t, err.Error(), authHost)
+}
+
+func TestLogin(t *testing.T) {
+	testCredHelper(t)
+	t.Setenv(ConfigEnv, filepath.Join(t.TempDir(), "config.json"))
+
+	_, err := cobraTest(t, "login", "registry.corp", "-u", "me", "-p", "secret")
+	require.NoError(t, err)
+	c, err := ConfigLoadDefault()
+	require.NoError(t, err)
+	require.Equal(t, "me", c.Hosts["registry.corp"].User)
+
+	_, err = cobraTest(t, "login", "helper.corp", "-u", "me", "-p", "secret", "--cred-helper", "test")
+	require.NoError(t, err)
+	c, err = ConfigLoadDefault()
+	require.NoError(t, err)
+	require.Empty(t, c.Hosts["helper.corp"].Pass)
+	require.Equal(t, "docker-credential-test", c.Hosts["helper.corp"].CredHelper)
+	hostCreds(c.Hosts["helper.corp"])
+	require.Equal(t, "secret", c.Hosts["helper.corp"].Pass)
+
+	_, err = cobraTest(t, "logout", "helper.corp")
+	require.NoError(t, err)
+	_, _, err = credHelperGet("test", "helper.corp")
+	require.ErrorIs(t, err, ErrCredsNotFound)
+	_, err = cobraTest(t, "logout", "unknown.corp")
+	require.ErrorIs(t, err, ErrCredsNotFound)
+}
+
+func TestCredsError(t *testing.T) {
+	r, err := ref.New("registry.corp/app:1")
+	require.NoError(t, err)
+	err = credsError(r, fmt.Errorf("%w [http 401]", types.ErrHTTPUnauthorized))
+	require.ErrorIs(t, err, ErrCredsNotFound)
+	require.Contains(t, err.Error(), "registry.corp")
+	require.NoError(t, credsError(r, nil))
+
+	// the endpoint that failed is named, not the one passed
+	mirror, err := ref.New("mirror.corp/app:1")
+	require.NoError(t, err)
+	err = credsError(r, &squash.EndpointError{Endpoint: mirror, Err: fmt.Errorf("%w [http 401]", types.ErrHTTPUnauthorized)})
+	require.ErrorIs(t, err, ErrCredsNotFound)
+	require.Contains(t, err.Error(), "mirror.corp")
+	require.NotContains(t, err.Error(), "registry.corp")
+}
@@ -1,8 +1,16 @@
 package regctl
 
-import "errors"
+import (
+	"errors"
+
+	"github.com/mheers/docker-image-squash/squash"
+)
 
 var (
+	// ErrBlobIdleTimeout is returned when a blob download receives no data within the idle timeout
+	ErrBlobIdleTimeout = squash.ErrBlobIdleTimeout
+	// ErrBlocked is returned when the registries config blocks an image
+	ErrBlocked = errors.New("registry blocked")
 	// ErrCredsNotFound returned when creds needed and cannot be found
 	ErrCredsNotFound = errors.New("auth creds not found")
 	// ErrInvalidInput indicates a required field is invalid
@@ -14,6 +22,8 @@ var (
 	// ErrNotImplemented returned when method has not been implemented yet
 	// TODO: Delete when all methods are implemented
 	ErrNotImplemented = errors.New("not implemented")
+	// ErrShortNameAmbiguous is returned when a short name matches multiple search registries in enforcing mode
+	ErrShortNameAmbiguous = errors.New("ambiguous short name")
 	// ErrUnsupportedConfigVersion happens when config file version is greater than this command supports
 	ErrUnsupportedConfigVersion = errors.New("unsupported config version")
 )
@@ -2,13 +2,20 @@ package regctl
 
 import (
 	"archive/tar"
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/opencontainers/go-digest"
 	"github.com/regclient/regclient"
 	"github.com/regclient/regclient/mod"
 	"github.com/regclient/regclient/pkg/template"
@@ -20,6 +27,74 @@ import (
 	"github.com/spf13/cobra"
 )
 
+var imageExportCmd = &cobra.Command{
+	Use:   "export <image_ref> [filename]",
+	Short: "export image",
+	Long: `Exports an image into a tar file that can be later loaded into a docker
+engine with "docker load". The tar file is output to stdout by default.
+Example usage: docker-image-squash export registry:5000/yourimg:v1 >yourimg-v1.tar`,
+	Args:              cobra.RangeArgs(1, 2),
+	ValidArgsFunction: completeArgTag,
+	RunE:              runImageExport,
+}
+
+var imageGetFileCmd = &cobra.Command{
+	Use:     "get-file <image_ref> <path> [out-file]",
+	Aliases: []string{"cat"},
+	Short:   "get a file from an image",
+	Long: `Get a file, directory or glob from the merged filesystem of the image.
+Files deleted or replaced by a later layer are not returned, and symlinks are
+followed without leaving the image root (e.g. /etc/localtime).
+A single file is written to stdout or out-file. Directories and globs are
+written as a tar to stdout, to out-file when it ends with ".tar", or extracted
+into the out-file directory otherwise.`,
+	Args:              cobra.RangeArgs(2, 3),
+	ValidArgsFunction: completeArgList([]completeFunc{completeArgTag, completeArgNone, completeArgDefault}),
+	RunE:              runImageGetFile,
+}
+
+var imageImportCmd = &cobra.Command{
+	Use:   "import <image_ref> <filename>",
+	Short: "import image",
+	Long: `Imports an image from a tar file. This must be either a docker formatted tar
+from "docker save" or an OCI Layout compatible tar. The output from
+"docker-image-squash export" can be used. Stdin is not permitted for the tar file.`,
+	Args:              cobra.ExactArgs(2),
+	ValidArgsFunction: completeArgList([]completeFunc{completeArgTag, completeArgDefault}),
+	RunE:              runImageImport,
+}
+
+var imageInspectCmd = &cobra.Command{
+	Use:     "inspect <image_ref>",
+	Aliases: []string{"config"},
+	Short:   "inspect image",
+	Long: `Shows the config json for an image and is equivalent to pulling the image
+in docker, and inspecting it, but without pulling any of the image layers.`,
+	Args:              cobra.ExactArgs(1),
+	ValidArgsFunction: completeArgTag,
+	RunE:              runImageInspect,
+}
+
+var imageModCmd = &cobra.Command{
+	Use:               "mod <image_ref>",
+	Short:             "modify an image",
+	Long:              `EXPERIMENTAL: Applies requested modifications to an image`, // TODO: remove EXPERIMENTAL when stable
+	Args:              cobra.ExactArgs(1),
+	ValidArgsFunction: completeArgTag,
+	RunE:              runImageMod,
+}
+
+var imageRateLimitCmd = &cobra.Command{
+	Use:   "ratelimit <image_ref>",
+	Short: "show the current rate limit",
+	Long: `Shows the rate limit using an http head request against the image manifest.
+If Set is false, the Remain value was not provided.
+The other values may be 0 if not provided by the registry.`,
+	Args:              cobra.ExactArgs(1),
+	ValidArgsFunction: completeArgTag,
+	RunE:              runImageRateLimit,
+}
+
 var imageOpts struct {
 	checkBaseRef    string
 	checkBaseDigest string
@@ -40,48 +115,427 @@ var imageOpts struct {
 	requireList     bool
 }
 
-func ExportImage(image, outputTar string) error {
-	rc := newRegClient()
-	r, err := ref.New(image)
+func init() {
+	imageOpts.modOpts = []mod.Opts{}
+	imageExportCmd.Flags().StringVar(&imageOpts.exportRef, "name", "", "Name of image to embed for docker load")
+	imageExportCmd.Flags().StringVarP(&imageOpts.platform, "platform", "p", "", "Specify platform (e.g. linux/amd64 or local)")
+	imageExportCmd.RegisterFlagCompletionFunc("platform", completeArgPlatform)
+
+	imageGetFileCmd.Flags().StringVarP(&imageOpts.formatFile, "format", "", "", "Format output with go template syntax")
+	imageGetFileCmd.Flags().StringVarP(&imageOpts.platform, "platform", "p", "", "Specify platform (e.g. linux/amd64 or local)")
+	imageGetFileCmd.RegisterFlagCompletionFunc("platform", completeArgPlatform)
+
+	imageInspectCmd.Flags().StringVarP(&imageOpts.platform, "platform", "p", "", "Specify platform (e.g. linux/amd64 or local)")
+	imageInspectCmd.Flags().StringVarP(&imageOpts.format, "format", "", "{{printPretty .}}", "Format output with go template syntax")
+	imageInspectCmd.RegisterFlagCompletionFunc("platform", completeArgPlatform)
+	imageInspectCmd.RegisterFlagCompletionFunc("format", completeArgNone)
+
+	imageModCmd.Flags().StringVarP(&imageOpts.create, "create", "", "", "Create tag")
+	imageModCmd.Flags().BoolVarP(&imageOpts.replace, "replace", "", false, "Replace tag (ignored when \"create\" is used)")
+	// most image mod flags are order dependent, so they are added using VarP/VarPF to append to modOpts
+	imageModCmd.Flags().VarP(&modFlagFunc{
+		t: "stringArray",
+		f: func(val string) error {
+			vs := strings.SplitN(val, "=", 2)
+			if len(vs) == 2 {
+				imageOpts.modOpts = append(imageOpts.modOpts, mod.WithAnnotation(vs[0], vs[1]))
+			} else if len(vs) == 1 {
+				imageOpts.modOpts = append(imageOpts.modOpts, mod.WithAnnotation(vs[0], ""))
+			} else {
+				return fmt.Errorf("invalid annotation")
+			}
+			return nil
+		},
+	}, "annotation", "", `set an annotation (name=value)`)
+	imageModCmd.Flags().VarP(&modFlagFunc{
+		t: "stringArray",
+		f: func(val string) error {
+			vs := strings.SplitN(val, ",", 2)
+			if len(vs) < 1 {
+				return fmt.Errorf("arg requires an image name and digest")
+			}
+			r, err := ref.New(vs[0])
+			if err != nil {
+				return fmt.Errorf("invalid image reference: %v", err)
+			}
+			d := digest.Digest("")
+			if len(vs) == 1 {
+				// parse ref with digest
+				if r.Tag == "" || r.Digest == "" {
+					return fmt.Errorf("arg requires an image name and digest")
+				}
+				d, err = digest.Parse(r.Digest)
+				if err != nil {
+					return fmt.Errorf("invalid digest: %v", err)
+				}
+				r.Digest = ""
+			} else {
+				// parse separate ref and digest
+				d, err = digest.Parse(vs[1])
+				if err != nil {
+					return fmt.Errorf("invalid digest: %v", err)
+				}
+			}
+			imageOpts.modOpts = append(imageOpts.modOpts, mod.WithAnnotationOCIBase(r, d))
+			return nil
+		},
+	}, "annotation-base", "", `set base image annotations (image/name:tag,sha256:digest)`)
+	imageModCmd.Flags().VarP(&modFlagFunc{
+		t: "string",
+		f: func(val string) error {
+			vs := strings.SplitN(val, "=", 2)
+			if len(vs) != 2 {
+				return fmt.Errorf("arg must be in the format \"name=value\"")
+			}
+			imageOpts.modOpts = append(imageOpts.modOpts,
+				mod.WithBuildArgRm(vs[0], regexp.MustCompile(regexp.QuoteMeta(vs[1]))))
+			return nil
+		},
+	}, "buildarg-rm", "", `delete a build arg`)
+	imageModCmd.Flags().VarP(&modFlagFunc{
+		t: "string",
+		f: func(val string) error {
+			vs := strings.SplitN(val, "=", 2)
+			if len(vs) != 2 {
+				return fmt.Errorf("arg must be in the format \"name=regex\"")
+			}
+			value, err := regexp.Compile(vs[1])
+			if err != nil {
+				return fmt.Errorf("regexp value is invalid: %w", err)
+			}
+			imageOpts.modOpts = append(imageOpts.modOpts,
+				mod.WithBuildArgRm(vs[0], value))
+			return nil
+		},
+	}, "buildarg-rm-regex", "", `delete a build arg with a regex value`)
+	imageModCmd.Flags().VarP(&modFlagFunc{
+		t: "string",
+		f: func(val string) error {
+			t, err := time.Parse(time.RFC3339, val)
+			if err != nil {
+				return fmt.Errorf("time must be formatted %s: %w", time.RFC3339, err)
+			}
+			imageOpts.modOpts = append(imageOpts.modOpts, mod.WithConfigTimestampMax(t))
+			return nil
+		},
+	}, "config-time-max", "", `max timestamp for a config`)
+	imageModCmd.Flags().VarP(&modFlagFunc{
+		t: "stringArray",
+		f: func(val string) error {
+			size, err := strconv.ParseInt(val, 10, 64)
+			if err != nil {
+				return fmt.Errorf("unable to parse layer size %s: %w", val, err)
+			}
+			imageOpts.modOpts = append(imageOpts.modOpts, mod.WithData(size))
+			return nil
+		},
+	}, "data-max", "", `sets or removes descriptor data field (size in bytes)`)
+	imageModCmd.Flags().VarP(&modFlagFunc{
+		t: "stringArray",
+		f: func(val string) error {
+			imageOpts.modOpts = append(imageOpts.modOpts, mod.WithExposeAdd(val))
+			return nil
+		},
+	}, "expose-add", "", `add an exposed port`)
+	imageModCmd.Flags().VarP(&modFlagFunc{
+		t: "stringArray",
+		f: func(val string) error {
+			imageOpts.modOpts = append(imageOpts.modOpts, mod.WithExposeRm(val))
+			return nil
+		},
+	}, "expose-rm", "", `delete an exposed port`)
+	flagExtURLsRm := imageModCmd.Flags().VarPF(&modFlagFunc{
+		t: "bool",
+		f: func(val string) error {
+			b, err := strconv.ParseBool(val)
+			if err != nil {
+				return fmt.Errorf("unable to parse value %s: %w", val, err)
+			}
+			if b {
+				imageOpts.modOpts = append(imageOpts.modOpts, mod.WithExternalURLsRm())
+			}
+			return nil
+		},
+	}, "external-urls-rm", "", `remove external url references from layers (first copy image with "--include-external")`)
+	flagExtURLsRm.NoOptDefVal = "true"
+	imageModCmd.Flags().VarP(&modFlagFunc{
+		t: "stringArray",
+		f: func(val string) error {
+			vs := strings.SplitN(val, ",", 2)
+			if len(vs) != 2 {
+				return fmt.Errorf("filename and timestamp both required, comma separated")
+			}
+			t, err := time.Parse(time.RFC3339, vs[1])
+			if err != nil {
+				return fmt.Errorf("time must be formatted %s: %w", time.RFC3339, err)
+			}
+			imageOpts.modOpts = append(imageOpts.modOpts, mod.WithFileTarTimeMax(vs[0], t))
+			return nil
+		},
+	}, "file-tar-time-max", "", `max timestamp for contents of a tar file within a layer`)
+	imageModCmd.Flags().VarP(&modFlagFunc{
+		t: "stringArray",
+		f: func(val string) error {
+			vs := strings.SplitN(val, "=", 2)
+			if len(vs) == 2 {
+				imageOpts.modOpts = append(imageOpts.modOpts, mod.WithLabel(vs[0], vs[1]))
+			} else if len(vs) == 1 {
+				imageOpts.modOpts = append(imageOpts.modOpts, mod.WithLabel(vs[0], ""))
+			} else {
+				return fmt.Errorf("invalid label")
+			}
+			return nil
+		},
+	}, "label", "", `set an label (name=value)`)
+	flagLabelAnnot := imageModCmd.Flags().VarPF(&modFlagFunc{
+		t: "bool",
+		f: func(val string) error {
+			b, err := strconv.ParseBool(val)
+			if err != nil {
+				return fmt.Errorf("unable to parse value %s: %w", val, err)
+			}
+			if b {
+				imageOpts.modOpts = append(imageOpts.modOpts, mod.WithLabelToAnnotation())
+			}
+			return nil
+		},
+	}, "label-to-annotation", "", `set annotations from labels`)
+	flagLabelAnnot.NoOptDefVal = "true"
+	imageModCmd.Flags().VarP(&modFlagFunc{
+		t: "string",
+		f: func(val string) error {
+			re, err := regexp.Compile(val)
+			if err != nil {
+				return fmt.Errorf("value must be a valid regex: %w", err)
+			}
+			imageOpts.modOpts = append(imageOpts.modOpts,
+				mod.WithLayerRmCreatedBy(*re))
+			return nil
+		},
+	}, "layer-rm-created-by", "", `delete a layer based on history (created by string is a regex)`)
+	imageModCmd.Flags().VarP(&modFlagFunc{
+		t: "uint",
+		f: func(val string) error {
+			i, err := strconv.Atoi(val)
+			if err != nil {
+				return fmt.Errorf("index invalid: %w", err)
+			}
+			imageOpts.modOpts = append(imageOpts.modOpts, mod.WithLayerRmIndex(i))
+			return nil
+		},
+	}, "layer-rm-index", "", `delete a layer from an image (index begins at 0)`)
+	imageModCmd.Flags().VarP(&modFlagFunc{
+		t: "string",
+		f: func(val string) error {
+			imageOpts.modOpts = append(imageOpts.modOpts, mod.WithLayerStripFile(val))
+			return nil
+		},
+	}, "layer-strip-file", "", `delete a file or directory from all layers`)
+	imageModCmd.Flags().VarP(&modFlagFunc{
+		t: "string",
+		f: func(val string) error {
+			t, err := time.Parse(time.RFC3339, val)
+			if err != nil {
+				return fmt.Errorf("time must be formatted %s: %w", time.RFC3339, err)
+			}
+			imageOpts.modOpts = append(imageOpts.modOpts, mod.WithLayerTimestampMax(t))
+			return nil
+		},
+	}, "layer-time-max", "", `max timestamp for a layer`)
+	flagRebase := imageModCmd.Flags().VarPF(&modFlagFunc{
+		t: "bool",
+		f: func(val string) error {
+			b, err := strconv.ParseBool(val)
+			if err != nil {
+				return fmt.Errorf("unable to parse value %s: %w", val, err)
+			}
+			if !b {
+				return nil
+			}
+			// pull the manifest, get the base image annotations
+			imageOpts.modOpts = append(imageOpts.modOpts, mod.WithRebase())
+			return nil
+		},
+	}, "rebase", "", `rebase an image using OCI annotations`)
+	flagRebase.NoOptDefVal = "true"
+	imageModCmd.Flags().VarP(&modFlagFunc{
+		t: "string",
+		f: func(val string) error {
+			vs := strings.SplitN(val, ",", 2)
+			if len(vs) != 2 {
+				return fmt.Errorf("rebase-ref requires two base images (old,new), comma separated")
+			}
+			// parse both refs
+			rOld, err := ref.New(vs[0])
+			if err != nil {
+				return fmt.Errorf("failed parsing old base image ref: %w", err)
+			}
+			rNew, err := ref.New(vs[1])
+			if err != nil {
+				return fmt.Errorf("failed parsing new base image ref: %w", err)
+			}
+			imageOpts.modOpts = append(imageOpts.modOpts, mod.WithRebaseRefs(rOld, rNew))
+			return nil
+		},
+	}, "rebase-ref", "", `rebase an image with base references (base:old,base:new)`)
+	imageModCmd.Flags().VarP(&modFlagFunc{
+		t: "string",
+		f: func(val string) error {
+			t, err := time.Parse(time.RFC3339, val)
+			if err != nil {
+				return fmt.Errorf("time must be formatted %s: %w", time.RFC3339, err)
+			}
+			imageOpts.modOpts = append(imageOpts.modOpts,
+				mod.WithConfigTimestampMax(t),
+				mod.WithLayerTimestampMax(t))
+			return nil
+		},
+	}, "time-max", "", `max timestamp for both the config and layers`)
+	flagDocker := imageModCmd.Flags().VarPF(&modFlagFunc{
+		t: "bool",
+		f: func(val string) error {
+			b, err := strconv.ParseBool(val)
+			if err != nil {
+				return fmt.Errorf("unable to parse value %s: %w", val, err)
+			}
+			if b {
+				imageOpts.modOpts = append(imageOpts.modOpts, mod.WithManifestToDocker())
+			}
+			return nil
+		},
+	}, "to-docker", "", `convert to Docker schema2 media types`)
+	flagDocker.NoOptDefVal = "true"
+	flagOCI := imageModCmd.Flags().VarPF(&modFlagFunc{
+		t: "bool",
+		f: func(val string) error {
+			b, err := strconv.ParseBool(val)
+			if err != nil {
+				return fmt.Errorf("unable to parse value %s: %w", val, err)
+			}
+			if b {
+				imageOpts.modOpts = append(imageOpts.modOpts, mod.WithManifestToOCI())
+			}
+			return nil
+		},
+	}, "to-oci", "", `convert to OCI media types`)
+	flagOCI.NoOptDefVal = "true"
+	flagOCIReferrers := imageModCmd.Flags().VarPF(&modFlagFunc{
+		t: "bool",
+		f: func(val string) error {
+			b, err := strconv.ParseBool(val)
+			if err != nil {
+				return fmt.Errorf("unable to parse value %s: %w", val, err)
+			}
+			if b {
+				imageOpts.modOpts = append(imageOpts.modOpts, mod.WithManifestToOCIReferrers())
+			}
+			return nil
+		},
+	}, "to-oci-referrers", "", `convert to OCI referrers`)
+	flagOCIReferrers.NoOptDefVal = "true"
+	imageModCmd.Flags().VarP(&modFlagFunc{
+		t: "stringArray",
+		f: func(val string) error {
+			imageOpts.modOpts = append(imageOpts.modOpts, mod.WithVolumeAdd(val))
+			return nil
+		},
+	}, "volume-add", "", `add a volume definition`)
+	imageModCmd.Flags().VarP(&modFlagFunc{
+		t: "stringArray",
+		f: func(val string) error {
+			imageOpts.modOpts = append(imageOpts.modOpts, mod.WithVolumeRm(val))
+			return nil
+		},
+	}, "volume-rm", "", `delete a volume definition`)
+
+	imageRateLimitCmd.Flags().StringVarP(&imageOpts.format, "format", "", "{{printPretty .}}", "Format output with go template syntax")
+	imageRateLimitCmd.RegisterFlagCompletionFunc("format", completeArgNone)
+
+	rootCmd.AddCommand(imageExportCmd)
+	rootCmd.AddCommand(imageGetFileCmd)
+	rootCmd.AddCommand(imageImportCmd)
+	rootCmd.AddCommand(imageInspectCmd)
+	rootCmd.AddCommand(imageModCmd)
+	rootCmd.AddCommand(imageRateLimitCmd)
+}
+
+// ExportImage writes image to outputTar in the docker load format, the file is removed on errors
+func ExportImage(ctx context.Context, image, outputTar string) (err error) {
+	img, err := imageSourceNew(image)
 	if err != nil {
 		return err
 	}
-	defer rc.Close(context.Background(), r)
+	rc := img.rc
+	defer rc.Close(ctx, img.ref)
 
+	// the export streams to the file, so the endpoint is selected before writing
+	err = img.try(func(ep ref.Ref) error {
+		_, err := rc.ManifestHead(ctx, ep)
+		return err
+	})
+	if err != nil {
+		return err
+	}
 	f, err := os.Create(outputTar)
 	if err != nil {
 		return err
 	}
-	return rc.ImageExport(context.Background(), r, f)
+	defer func() {
+		f.Close()
+		if err != nil {
+			os.Remove(outputTar)
+		}
+	}()
+	log.WithFields(logrus.Fields{
+		"ref":      img.ref.CommonName(),
+		"endpoint": img.endpoint().CommonName(),
+	}).Info("Image export")
+	if err := rc.ImageExport(ctx, img.endpoint(), f, regclient.ImageWithExportRef(img.resolved())); err != nil {
+		return credsError(img.endpoint(), err)
+	}
+	return f.Close()
 }
 
-func runImageExport(cmd *cobra.Command, args []string) error {
+func runImageExport(cmd *cobra.Command, args []string) (err error) {
 	ctx := cmd.Context()
-	r, err := ref.New(args[0])
+	img, err := imageSourceNew(args[0])
 	if err != nil {
 		return err
 	}
 	var w io.Writer
 	if len(args) == 2 {
-		w, err = os.Create(args[1])
+		f, err := os.Create(args[1])
 		if err != nil {
 			return err
 		}
+		// do not leave a partial export behind, e.g. on Ctrl-C
+		defer func() {
+			f.Close()
+			if err != nil {
+				os.Remove(args[1])
+			}
+		}()
+		w = f
 	} else {
 		w = cmd.OutOrStdout()
 	}
-	rc := newRegClient()
-	defer rc.Close(ctx, r)
-	opts := []regclient.ImageOpts{}
+	rc := img.rc
+	defer rc.Close(ctx, img.ref)
+	var m manifest.Manifest
+	err = img.try(func(ep ref.Ref) (err error) {
+		m, err = rc.ManifestGet(ctx, ep)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	r := img.endpoint()
+	opts := []regclient.ImageOpts{regclient.ImageWithExportRef(img.resolved())}
 	if imageOpts.platform != "" {
 		p, err := platform.Parse(imageOpts.platform)
 		if err != nil {
 			return err
 		}
-		m, err := rc.ManifestGet(ctx, r)
-		if err != nil {
-			return err
-		}
 		if m.IsList() {
 			d, err := manifest.GetPlatformDesc(m, &p)
 			if err != nil {
@@ -98,29 +552,33 @@ func runImageExport(cmd *cobra.Command, args []string) error {
 		opts = append(opts, regclient.ImageWithExportRef(eRef))
 	}
 	log.WithFields(logrus.Fields{
-		"ref": r.CommonName(),
+		"ref":      img.ref.CommonName(),
+		"endpoint": r.CommonName(),
 	}).Debug("Image export")
-	return rc.ImageExport(ctx, r, w, opts...)
+	return credsError(r, rc.ImageExport(ctx, r, w, opts...))
 }
 
 func runImageGetFile(cmd *cobra.Command, args []string) error {
 	ctx := cmd.Context()
-	r, err := ref.New(args[0])
+	img, err := imageSourceNew(args[0])
 	if err != nil {
 		return err
 	}
 	filename := args[1]
-	filename = strings.TrimPrefix(filename, "/")
-	rc := newRegClient()
-	defer rc.Close(ctx, r)
+	rc := img.rc
+	defer rc.Close(ctx, img.ref)
 
 	log.WithFields(logrus.Fields{
-		"ref":      r.CommonName(),
+		"ref":      img.ref.CommonName(),
 		"filename": filename,
 	}).Debug("Get file")
 
 	// make it recursive for index of index scenarios
-	m, err := rc.ManifestGet(ctx, r)
+	var m manifest.Manifest
+	err = img.try(func(ep ref.Ref) (err error) {
+		m, err = rc.ManifestGet(ctx, ep)
+		return err
+	})
 	if err != nil {
 		return err
 	}
@@ -149,12 +607,11 @@ func runImageGetFile(cmd *cobra.Command, args []string) error {
 			}).Warn("Platform could not be found in manifest list")
 			return err
 		}
-		m, err = rc.ManifestGet(ctx, r, regclient.WithManifestDesc(*desc))
+		m, err = rc.ManifestGet(ctx, img.endpoint(), regclient.WithManifestDesc(*desc))
 		if err != nil {
 			return fmt.Errorf("failed to pull platform specific digest: %w", err)
 		}
 	}
-	// go through layers in reverse
 	mi, ok := m.(manifest.Imager)
 	if !ok {
 		return fmt.Errorf("reference is not a known image media type")
@@ -163,23 +620,9 @@ func runImageGetFile(cmd *cobra.Command, args []string) error {
 	if err != nil {
 		return err
 	}
-	for i := len(layers) - 1; i >= 0; i-- {
-		blob, err := rc.BlobGet(ctx, r, layers[i])
-		if err != nil {
-			return fmt.Errorf("failed pulling layer %d: %w", i, err)
-		}
-		btr, err := blob.ToTarReader()
-		if err != nil {
-			return fmt.Errorf("could not convert layer %d to tar reader: %w", i, err)
-		}
-		th, rdr, err := btr.ReadFile(filename)
-		if err != nil {
-			if errors.Is(err, types.ErrFileNotFound) {
-				continue
-			}
-			return fmt.Errorf("failed pulling from layer %d: %w", i, err)
-		}
-		// file found, output
+
+	// a single file is output directly
+	writeFile := func(th *tar.Header, rdr io.Reader) error {
 		if imageOpts.formatFile != "" {
 			data := struct {
 				Header *tar.Header
@@ -194,24 +637,247 @@ func runImageGetFile(cmd *cobra.Command, args []string) error {
 		if len(args) < 3 {
 			w = cmd.OutOrStdout()
 		} else {
-			w, err = os.Create(args[2])
+			f, err := os.Create(args[2])
 			if err != nil {
 				return err
 			}
+			defer f.Close()
+			w = f
 		}
-		_, err = io.Copy(w, rdr)
+		_, err := io.Copy(w, rdr)
+		return err
+	}
+
+	// go through the layers in reverse, the upper layers hide deleted files and replaced directories.
+	// A file is written while its layer is read and the lower layers are not pulled,
+	// directories and globs need every layer.
+	glob := strings.ContainsAny(filename, "*?[")
+	mfs := newMergedFS()
+	written := false
+layers:
+	for i := len(layers) - 1; i >= 0; i-- {
+		err = imageLayerTar(ctx, img, layers[i], i, func(tr *tar.Reader) error {
+			return mfs.addLayer(i, tr, func(th *tar.Header, rdr io.Reader) error {
+				if glob || written || th.Typeflag != tar.TypeReg {
+					return nil
+				}
+				name, err := mfs.resolve(filename)
+				if err != nil || name != cleanPath(th.Name) {
+					return err
+				}
+				written = true
+				out := *th
+				out.Name = name
+				return writeFile(&out, rdr)
+			})
+		})
 		if err != nil {
 			return err
 		}
+		if written {
+			return nil
+		}
+		if glob {
+			continue
+		}
+		name, err := mfs.resolve(filename)
+		if err != nil {
+			return err
+		}
+		e, ok := mfs.entries[name]
+		switch {
+		case ok && e.header.Typeflag == tar.TypeDir, !ok && mfs.isDir(name):
+			// the lower layers add to a directory
+		case ok:
+			// a hard link, or a symlink of this layer to a file of an upper layer, reads that layer again
+			break layers
+		case mfs.hidden(name):
+			return types.ErrNotFound
+		}
+	}
+	names, err := mfs.find(filename)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			// all layers exhausted, not found or deleted
+			return types.ErrNotFound
+		}
+		return err
+	}
+
+	if len(names) == 1 && !mfs.isDir(names[0]) {
+		if e, _, _ := mfs.source(names[0]); e.header.Typeflag != tar.TypeReg {
+			return fmt.Errorf("%w: %s is not a regular file", ErrInvalidInput, filename)
+		}
+		return imageGetFileWalk(ctx, img, layers, mfs, names, writeFile)
+	}
+
+	// directories and globs are written as a tar, or extracted to a local directory
+	if len(args) < 3 || args[2] == "-" || strings.HasSuffix(args[2], ".tar") {
+		var w io.Writer
+		if len(args) < 3 || args[2] == "-" {
+			w = cmd.OutOrStdout()
+		} else {
+			f, err := os.Create(args[2])
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			w = f
+		}
+		tw := tar.NewWriter(w)
+		err = imageGetFileWalk(ctx, img, layers, mfs, names, func(th *tar.Header, rdr io.Reader) error {
+			if err := tw.WriteHeader(th); err != nil {
+				return err
+			}
+			if rdr != nil {
+				_, err := io.Copy(tw, rdr)
+				return err
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return tw.Close()
+	}
+	return imageGetFileWalk(ctx, img, layers, mfs, names, func(th *tar.Header, rdr io.Reader) error {
+		return extractEntry(args[2], th, rdr)
+	})
+}
+
+// imageLayerTar calls fn with a tar reader for the layer, the rest of the blob is read after fn so the digest is always verified.
+// The download is retried and resumed like the layers of a squash.
+func imageLayerTar(ctx context.Context, img *imageSource, layer types.Descriptor, i int, fn func(tr *tar.Reader) error) error {
+	return img.src.Layer(ctx, layer, i, func(r io.Reader) error {
+		return fn(tar.NewReader(r))
+	})
+}
+
+// imageGetFileWalk calls fn for each name with headers relative to the image root.
+// Directories are returned first, then file content grouped by layer, then links and special files.
+// Hard links are returned as regular files since their target may not be selected.
+func imageGetFileWalk(ctx context.Context, img *imageSource, layers []types.Descriptor, mfs *mergedFS, names []string, fn func(th *tar.Header, rdr io.Reader) error) error {
+	// layer -> source path -> output names
+	wants := map[int]map[string][]string{}
+	others := []*tar.Header{}
+	for _, name := range names {
+		e, ok := mfs.entries[name]
+		if !ok {
+			// directory only implied by its content
+			err := fn(&tar.Header{Name: name + "/", Typeflag: tar.TypeDir, Mode: 0755}, nil)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		src, srcName, _ := mfs.source(name)
+		switch src.header.Typeflag {
+		case tar.TypeDir:
+			th := *e.header
+			th.Name = name + "/"
+			if err := fn(&th, nil); err != nil {
+				return err
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			if wants[src.layer] == nil {
+				wants[src.layer] = map[string][]string{}
+			}
+			wants[src.layer][srcName] = append(wants[src.layer][srcName], name)
+		default:
+			th := *src.header
+			th.Name = name
+			others = append(others, &th)
+		}
+	}
+
+	for i := range layers {
+		if len(wants[i]) == 0 {
+			continue
+		}
+		err := imageLayerTar(ctx, img, layers[i], i, func(tr *tar.Reader) error {
+			for {
+				th, err := tr.Next()
+				if err == io.EOF {
+					return nil
+				}
+				if err != nil {
+					return err
+				}
+				outNames := wants[i][cleanPath(th.Name)]
+				if len(outNames) == 0 {
+					continue
+				}
+				var rdr io.Reader = tr
+				var data []byte
+				if len(outNames) > 1 {
+					data, err = io.ReadAll(tr)
+					if err != nil {
+						return err
+					}
+				}
+				for _, name := range outNames {
+					if data != nil {
+						rdr = bytes.NewReader(data)
+					}
+					out := *th
+					out.Name = name
+					out.Typeflag = tar.TypeReg
+					if err := fn(&out, rdr); err != nil {
+						return err
+					}
+				}
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, th := range others {
+		if err := fn(th, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// extractEntry writes a single entry below dir, links are created last by imageGetFileWalk so nothing is written through them
+func extractEntry(dir string, th *tar.Header, rdr io.Reader) error {
+	target := filepath.Join(dir, filepath.FromSlash(cleanPath(th.Name)))
+	switch th.Typeflag {
+	case tar.TypeDir:
+		return os.MkdirAll(target, 0755)
+	case tar.TypeReg:
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.FileMode(th.Mode).Perm())
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(f, rdr)
+		return err
+	case tar.TypeSymlink:
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		if err := os.Remove(target); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return os.Symlink(th.Linkname, target)
+	default:
+		log.WithFields(logrus.Fields{
+			"name": th.Name,
+			"type": string(th.Typeflag),
+		}).Info("Skipping special file")
 		return nil
 	}
-	// all layers exhausted, not found or deleted
-	return types.ErrNotFound
 }
 
 func runImageImport(cmd *cobra.Command, args []string) error {
 	ctx := cmd.Context()
-	r, err := ref.New(args[0])
+	r, err := imageTargetNew(args[0])
 	if err != nil {
 		return err
 	}
@@ -220,23 +886,24 @@ func runImageImport(cmd *cobra.Command, args []string) error {
 		return err
 	}
 	defer rs.Close()
-	rc := newRegClient()
+	rc := newRegClient(r)
 	defer rc.Close(ctx, r)
 	log.WithFields(logrus.Fields{
 		"ref":  r.CommonName(),
 		"file": args[1],
 	}).Debug("Image import")
 
-	return rc.ImageImport(ctx, r, rs)
+	return credsError(r, rc.ImageImport(ctx, r, rs))
 }
 
 func runImageInspect(cmd *cobra.Command, args []string) error {
 	ctx := cmd.Context()
-	r, err := ref.New(args[0])
+	img, err := imageSourceNew(args[0])
 	if err != nil {
 		return err
 	}
-	rc := newRegClient()
+	r := img.ref
+	rc := img.rc
 	defer rc.Close(ctx, r)
 
 	log.WithFields(logrus.Fields{
@@ -251,7 +918,11 @@ func runImageInspect(cmd *cobra.Command, args []string) error {
 		manifestOpts.list = false
 	}
 
-	m, err := getManifest(ctx, rc, r)
+	var m manifest.Manifest
+	err = img.try(func(ep ref.Ref) (err error) {
+		m, err = getManifest(ctx, rc, ep)
+		return err
+	})
 	if err != nil {
 		return err
 	}
@@ -264,7 +935,7 @@ func runImageInspect(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
-	blobConfig, err := rc.BlobGetOCIConfig(ctx, r, cd)
+	blobConfig, err := rc.BlobGetOCIConfig(ctx, img.endpoint(), cd)
 	if err != nil {
 		return err
 	}
@@ -281,14 +952,14 @@ func runImageInspect(cmd *cobra.Command, args []string) error {
 
 func runImageMod(cmd *cobra.Command, args []string) error {
 	ctx := cmd.Context()
-	r, err := ref.New(args[0])
+	r, err := imageTargetNew(args[0])
 	if err != nil {
 		return err
 	}
 	var rNew ref.Ref
 	if imageOpts.create != "" {
 		if strings.ContainsAny(imageOpts.create, "/:") {
-			rNew, err = ref.New((imageOpts.create))
+			rNew, err = imageTargetNew(imageOpts.create)
 			if err != nil {
 				return fmt.Errorf("failed to parse new image name %s: %w", imageOpts.create, err)
 			}
@@ -304,7 +975,7 @@ func runImageMod(cmd *cobra.Command, args []string) error {
 		rNew = r
 		rNew.Digest = ""
 	}
-	rc := newRegClient()
+	rc := newRegClient(r, rNew)
 
 	log.WithFields(logrus.Fields{
 		"ref": r.CommonName(),
@@ -313,7 +984,7 @@ func runImageMod(cmd *cobra.Command, args []string) error {
 	defer rc.Close(ctx, r)
 	rOut, err := mod.Apply(ctx, rc, r, imageOpts.modOpts...)
 	if err != nil {
-		return err
+		return credsError(r, err)
 	}
 	if rNew.Tag != "" {
 		defer rc.Close(ctx, rNew)
@@ -330,11 +1001,12 @@ func runImageMod(cmd *cobra.Command, args []string) error {
 
 func runImageRateLimit(cmd *cobra.Command, args []string) error {
 	ctx := cmd.Context()
-	r, err := ref.New(args[0])
+	img, err := imageSourceNew(args[0])
 	if err != nil {
 		return err
 	}
-	rc := newRegClient()
+	r := img.ref
+	rc := img.rc
 
 	log.WithFields(logrus.Fields{
 		"host": r.Registry,
@@ -343,7 +1015,11 @@ func runImageRateLimit(cmd *cobra.Command, args []string) error {
 	}).Debug("Image rate limit")
 
 	// request only the headers, avoids adding to Docker Hub rate limits
-	m, err := rc.ManifestHead(ctx, r)
+	var m manifest.Manifest
+	err = img.try(func(ep ref.Ref) (err error) {
+		m, err = rc.ManifestHead(ctx, ep)
+		return err
+	})
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,41 @@
+package regctl
+
+import (
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// SetLogger replaces the logger of the package, it is also passed to regclient.
+// Library users call this before Squash or ExportImage to use their own logger.
+// The --verbosity and --log-format flags only configure the default logger.
+func SetLogger(l *logrus.Logger) {
+	log = l
+}
+
+// Logger returns the logger of the package
+func Logger() *logrus.Logger {
+	return log
+}
+
+// logFormatter returns the formatter for --log-format, "--logopt json" is kept for regctl compatibility
+func logFormatter(format string, logopts []string) (logrus.Formatter, error) {
+	for _, opt := range logopts {
+		if opt == logFormatJSON {
+			format = logFormatJSON
+		}
+	}
+	switch format {
+	case "", logFormatText:
+		return new(logrus.TextFormatter), nil
+	case logFormatJSON:
+		return new(logrus.JSONFormatter), nil
+	default:
+		return nil, fmt.Errorf("%w: log format %q, use text or json", ErrInvalidInput, format)
+	}
+}
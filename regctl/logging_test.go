@@ -0,0 +1,71 @@
+package regctl
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogging(t *testing.T) {
+	t.Setenv(ConfigEnv, filepath.Join(t.TempDir(), "config.json"))
+	layer := testGzipLayer(t, map[string]string{"etc/hello": "hello world\n"})
+	srv := httptest.NewServer(testRegistry(layer))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	_, err := cobraTest(t, "version", "--log-format", "xml")
+	require.ErrorIs(t, err, ErrInvalidInput)
+
+	// the cli flags set the level and format of the default logger
+	buf := &bytes.Buffer{}
+	cliOut := cliLog.Out
+	cliLog.Out = buf
+	defer func() {
+		cliLog.Out = cliOut
+		cliLog.SetLevel(logrus.WarnLevel)
+		cliLog.SetFormatter(new(logrus.TextFormatter))
+	}()
+
+	out := filepath.Join(t.TempDir(), "out.tar")
+	_, err = cobraTest(t, "squash", "--insecure-registry", host, "--log-format", "json", "-v", "info", host+"/test/app:latest", out)
+	require.NoError(t, err)
+
+	entries := map[string]map[string]any{}
+	scanner := bufio.NewScanner(buf)
+	for scanner.Scan() {
+		entry := map[string]any{}
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &entry), scanner.Text())
+		entries[entry["msg"].(string)] = entry
+	}
+	require.Contains(t, entries, "Resolved image")
+	require.Contains(t, entries, "Pulled layer")
+	pulled := entries["Pulled layer"]
+	require.Equal(t, host+"/test/app:latest", pulled["ref"])
+	require.Equal(t, float64(0), pulled["layer"])
+	require.Equal(t, digest.FromBytes(layer).String(), pulled["digest"])
+	require.Equal(t, float64(len(layer)), pulled["bytes"])
+	require.Greater(t, pulled["uncompressed"], float64(len("hello world\n")))
+	require.Contains(t, entries, "Squashed image")
+	require.Equal(t, float64(1), entries["Squashed image"]["layers"])
+	require.Contains(t, entries, "Wrote output")
+
+	// an injected logger keeps its own level and format
+	orig := Logger()
+	defer SetLogger(orig)
+	injected := &bytes.Buffer{}
+	l := &logrus.Logger{Out: injected, Formatter: new(logrus.TextFormatter), Hooks: make(logrus.LevelHooks), Level: logrus.WarnLevel}
+	SetLogger(l)
+	_, err = cobraTest(t, "squash", "--insecure-registry", host, "--log-format", "json", "-v", "debug", host+"/test/app:latest", out)
+	require.NoError(t, err)
+	require.Equal(t, logrus.WarnLevel, l.Level)
+	require.IsType(t, new(logrus.TextFormatter), l.Formatter)
+	require.NotContains(t, injected.String(), "Pulled layer")
+}
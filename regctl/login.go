@@ -0,0 +1,161 @@
+package regctl
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/regclient/regclient"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+)
+
+var loginCmd = &cobra.Command{
+	Use:   "login [registry]",
+	Short: "login to a registry",
+	Long: `Store login credentials for a registry in the config file, or in a docker
+credential helper with --cred-helper. This may not be necessary if you have
+already logged in with docker. In CI, credentials can be passed with the
+REGISTRY_USER_<HOST> and REGISTRY_PASSWORD_<HOST> environment variables instead,
+where <HOST> is the registry name in upper case with other characters replaced
+by "_", or with REGISTRY_USER and REGISTRY_PASSWORD for the registry in REGISTRY_HOST.`,
+	Args:              cobra.RangeArgs(0, 1),
+	ValidArgsFunction: completeArgNone,
+	RunE:              runLogin,
+}
+
+var logoutCmd = &cobra.Command{
+	Use:               "logout [registry]",
+	Short:             "logout of a registry",
+	Long:              `Remove registry credentials from the config file and the credential helper.`,
+	Args:              cobra.RangeArgs(0, 1),
+	ValidArgsFunction: completeArgNone,
+	RunE:              runLogout,
+}
+
+var loginOpts struct {
+	user       string
+	pass       string
+	passStdin  bool
+	credHelper string
+}
+
+func init() {
+	loginCmd.Flags().StringVarP(&loginOpts.user, "user", "u", "", "Username")
+	loginCmd.Flags().StringVarP(&loginOpts.pass, "pass", "p", "", "Password")
+	loginCmd.Flags().BoolVarP(&loginOpts.passStdin, "pass-stdin", "", false, "Read password from stdin")
+	loginCmd.Flags().StringVarP(&loginOpts.credHelper, "cred-helper", "", "", "Store the credentials with a docker credential helper (e.g. pass, secretservice, osxkeychain)")
+	loginCmd.RegisterFlagCompletionFunc("user", completeArgNone)
+	loginCmd.RegisterFlagCompletionFunc("pass", completeArgNone)
+
+	rootCmd.AddCommand(loginCmd)
+	rootCmd.AddCommand(logoutCmd)
+}
+
+func runLogin(cmd *cobra.Command, args []string) error {
+	c, err := ConfigLoadDefault()
+	if err != nil {
+		return err
+	}
+	if len(args) < 1 {
+		args = []string{regclient.DockerRegistry}
+	}
+	h := c.hostGet(args[0])
+	user := h.User
+	pass := ""
+	if flagChanged(cmd, "user") {
+		user = loginOpts.user
+	} else if loginOpts.passStdin {
+		return fmt.Errorf("%w: user must be provided to read password from stdin", ErrMissingInput)
+	} else {
+		// prompt for username
+		reader := bufio.NewReader(cmd.InOrStdin())
+		defUser := ""
+		if h.User != "" {
+			defUser = " [" + h.User + "]"
+		}
+		fmt.Fprintf(cmd.ErrOrStderr(), "Enter Username%s: ", defUser)
+		in, _ := reader.ReadString('\n')
+		in = strings.TrimSpace(in)
+		if in != "" {
+			user = in
+		}
+	}
+	if user == "" {
+		return fmt.Errorf("%w: username is required", ErrMissingInput)
+	}
+	if flagChanged(cmd, "pass") {
+		pass = loginOpts.pass
+	} else if loginOpts.passStdin {
+		in, err := io.ReadAll(cmd.InOrStdin())
+		if err != nil {
+			return fmt.Errorf("failed to read password from stdin: %w", err)
+		}
+		pass = strings.TrimRight(string(in), "\r\n")
+	} else {
+		// prompt for a password
+		fmt.Fprint(cmd.ErrOrStderr(), "Enter Password: ")
+		in, err := term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Fprint(cmd.ErrOrStderr(), "\n")
+		if err != nil {
+			return fmt.Errorf("unable to read from tty (resolve by using \"-p\" or \"--pass-stdin\"): %w", err)
+		}
+		pass = strings.TrimRight(string(in), "\r\n")
+	}
+	if pass == "" {
+		return fmt.Errorf("%w: password is required", ErrMissingInput)
+	}
+
+	if loginOpts.credHelper != "" {
+		// only the helper name is saved in the config, the secret stays in the helper
+		if err := credHelperStore(loginOpts.credHelper, credHelperHost(h), user, pass); err != nil {
+			return err
+		}
+		h.CredHelper = credHelperName(loginOpts.credHelper)
+		h.User, h.Pass, h.Token = "", "", ""
+	} else if user == "<token>" {
+		// if username is <token> then process password as an identity token
+		h.User, h.Pass, h.Token = "", "", pass
+	} else {
+		h.User, h.Pass, h.Token = user, pass, ""
+	}
+	if err := c.ConfigSave(); err != nil {
+		return err
+	}
+
+	log.WithFields(logrus.Fields{
+		"registry": h.Name,
+	}).Info("Credentials set")
+	return nil
+}
+
+func runLogout(cmd *cobra.Command, args []string) error {
+	c, err := ConfigLoadDefault()
+	if err != nil {
+		return err
+	}
+	if len(args) < 1 {
+		args = []string{regclient.DockerRegistry}
+	}
+	h, ok := c.Hosts[c.hostGet(args[0]).Name]
+	if !ok || (h.User == "" && h.Pass == "" && h.Token == "" && h.CredHelper == "") {
+		return fmt.Errorf("%w: no credentials stored for %s", ErrCredsNotFound, args[0])
+	}
+	if h.CredHelper != "" {
+		if err := credHelperErase(h.CredHelper, credHelperHost(h)); err != nil {
+			return err
+		}
+	}
+	h.User, h.Pass, h.Token, h.CredHelper = "", "", "", ""
+	if err := c.ConfigSave(); err != nil {
+		return err
+	}
+
+	log.WithFields(logrus.Fields{
+		"registry": h.Name,
+	}).Info("Credentials unset")
+	return nil
+}
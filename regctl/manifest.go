@@ -56,6 +56,28 @@ var manifestOpts struct {
 	requireList   bool
 }
 
+func init() {
+	manifestHeadCmd.Flags().StringVarP(&manifestOpts.formatHead, "format", "", "", "Format output with go template syntax (use \"raw-body\" for the original manifest)")
+	manifestHeadCmd.Flags().BoolVarP(&manifestOpts.list, "list", "", true, "Do not resolve platform from manifest list (enabled by default)")
+	manifestHeadCmd.Flags().StringVarP(&manifestOpts.platform, "platform", "p", "", "Specify platform (e.g. linux/amd64 or local)")
+	manifestHeadCmd.Flags().BoolVarP(&manifestOpts.requireDigest, "require-digest", "", false, "Fallback to get request if digest is not received")
+	manifestHeadCmd.Flags().BoolVarP(&manifestOpts.requireList, "require-list", "", false, "Fail if manifest list is not received")
+	manifestHeadCmd.RegisterFlagCompletionFunc("platform", completeArgPlatform)
+	manifestHeadCmd.Flags().MarkHidden("list")
+
+	manifestGetCmd.Flags().BoolVarP(&manifestOpts.list, "list", "", true, "Output manifest list if available (enabled by default)")
+	manifestGetCmd.Flags().StringVarP(&manifestOpts.platform, "platform", "p", "", "Specify platform (e.g. linux/amd64 or local)")
+	manifestGetCmd.Flags().BoolVarP(&manifestOpts.requireList, "require-list", "", false, "Fail if manifest list is not received")
+	manifestGetCmd.Flags().StringVarP(&manifestOpts.formatGet, "format", "", "{{printPretty .}}", "Format output with go template syntax (use \"raw-body\" for the original manifest)")
+	manifestGetCmd.RegisterFlagCompletionFunc("platform", completeArgPlatform)
+	manifestGetCmd.RegisterFlagCompletionFunc("format", completeArgNone)
+	manifestGetCmd.Flags().MarkHidden("list")
+
+	manifestCmd.AddCommand(manifestHeadCmd)
+	manifestCmd.AddCommand(manifestGetCmd)
+	rootCmd.AddCommand(manifestCmd)
+}
+
 func getManifest(ctx context.Context, rc *regclient.RegClient, r ref.Ref) (manifest.Manifest, error) {
 	m, err := rc.ManifestGet(context.Background(), r)
 	if err != nil {
@@ -140,16 +162,16 @@ func runManifestHead(cmd *cobra.Command, args []string) error {
 		manifestOpts.list = true
 	}
 
-	r, err := ref.New(args[0])
+	img, err := imageSourceNew(args[0])
 	if err != nil {
 		return err
 	}
-	rc := newRegClient()
+	rc := img.rc
 
 	log.WithFields(logrus.Fields{
-		"host": r.Registry,
-		"repo": r.Repository,
-		"tag":  r.Tag,
+		"host": img.ref.Registry,
+		"repo": img.ref.Repository,
+		"tag":  img.ref.Tag,
 	}).Debug("Manifest head")
 
 	mOpts := []regclient.ManifestOpts{}
@@ -158,10 +180,15 @@ func runManifestHead(cmd *cobra.Command, args []string) error {
 	}
 
 	// attempt to request only the headers, avoids Docker Hub rate limits
-	m, err := rc.ManifestHead(ctx, r, mOpts...)
+	var m manifest.Manifest
+	err = img.try(func(ep ref.Ref) (err error) {
+		m, err = rc.ManifestHead(ctx, ep, mOpts...)
+		return err
+	})
 	if err != nil {
 		return err
 	}
+	r := img.endpoint()
 
 	// add warning if not list and list required or platform requested
 	if !m.IsList() && manifestOpts.requireList {
@@ -202,14 +229,18 @@ func runManifestGet(cmd *cobra.Command, args []string) error {
 		manifestOpts.list = true
 	}
 
-	r, err := ref.New(args[0])
+	img, err := imageSourceNew(args[0])
 	if err != nil {
 		return err
 	}
-	rc := newRegClient()
-	defer rc.Close(ctx, r)
+	rc := img.rc
+	defer rc.Close(ctx, img.ref)
 
-	m, err := getManifest(ctx, rc, r)
+	var m manifest.Manifest
+	err = img.try(func(ep ref.Ref) (err error) {
+		m, err = getManifest(ctx, rc, ep)
+		return err
+	})
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,241 @@
+package regctl
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/mheers/docker-image-squash/squash"
+)
+
+const (
+	// maxSymlinks matches the linux limit before ELOOP is returned
+	maxSymlinks = 40
+)
+
+// mergedFS is the union of the tar headers of the layers after applying whiteouts.
+// Layers are added newest first, so an entry is only added when no upper layer replaced or deleted it,
+// and a lookup can stop once the upper layers decide it.
+type mergedFS struct {
+	entries map[string]mergedEntry
+	deleted map[string]bool // whiteouts of the upper layers
+	opaque  map[string]bool // directories that hide the content of the lower layers
+	parents map[string]bool // directories of the upper layers, including implied ones
+}
+
+type mergedEntry struct {
+	header *tar.Header
+	layer  int
+}
+
+func newMergedFS() *mergedFS {
+	return &mergedFS{
+		entries: map[string]mergedEntry{},
+		deleted: map[string]bool{},
+		opaque:  map[string]bool{},
+		parents: map[string]bool{},
+	}
+}
+
+// cleanPath converts a tar or user supplied path to the key used in the index, relative to the image root
+func cleanPath(p string) string {
+	return strings.TrimPrefix(path.Clean("/"+p), "/")
+}
+
+// addLayer indexes the headers of a layer below the layers added before.
+// visit is called with each entry that is added and may read its content from r, it may be nil.
+func (m *mergedFS) addLayer(layer int, tr *tar.Reader, visit func(th *tar.Header, r io.Reader) error) error {
+	deleted, opaque := []string{}, []string{}
+	for {
+		th, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		name := cleanPath(th.Name)
+		if name == "" {
+			continue
+		}
+		// whiteouts only hide the content of the lower layers, they are applied after this layer
+		if target, isOpaque, ok := squash.Whiteout(name); ok {
+			if isOpaque {
+				opaque = append(opaque, target)
+			} else {
+				deleted = append(deleted, target)
+			}
+			m.addParents(name)
+			continue
+		}
+		if _, ok := m.entries[name]; ok || m.hidden(name) {
+			continue
+		}
+		// anything other than a directory is replaced by a directory of an upper layer
+		if th.Typeflag != tar.TypeDir && m.parents[name] {
+			continue
+		}
+		m.entries[name] = mergedEntry{header: th, layer: layer}
+		m.addParents(name)
+		if visit != nil {
+			if err := visit(th, tr); err != nil {
+				return err
+			}
+		}
+	}
+	for _, name := range deleted {
+		m.deleted[name] = true
+	}
+	for _, dir := range opaque {
+		m.opaque[dir] = true
+	}
+	return nil
+}
+
+// addParents records the directories above name
+func (m *mergedFS) addParents(name string) {
+	for dir := path.Dir(name); dir != "." && !m.parents[dir]; dir = path.Dir(dir) {
+		m.parents[dir] = true
+	}
+}
+
+// hidden reports whether the upper layers deleted name or replaced one of its directories,
+// the lower layers cannot add it then
+func (m *mergedFS) hidden(name string) bool {
+	if m.opaque[""] {
+		return true
+	}
+	if m.deleted[name] {
+		return true
+	}
+	for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+		if m.deleted[dir] || m.opaque[dir] {
+			return true
+		}
+		// anything other than a directory replaces the lower directory and its content
+		if e, ok := m.entries[dir]; ok && e.header.Typeflag != tar.TypeDir {
+			return true
+		}
+	}
+	return false
+}
+
+// isDir reports whether name is a directory, either explicitly or implied by its children
+func (m *mergedFS) isDir(name string) bool {
+	if name == "" {
+		return true
+	}
+	if e, ok := m.entries[name]; ok {
+		return e.header.Typeflag == tar.TypeDir
+	}
+	prefix := name + "/"
+	for n := range m.entries {
+		if strings.HasPrefix(n, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolve follows symlinks in every component of p, links never escape the image root
+func (m *mergedFS) resolve(p string) (string, error) {
+	remaining := strings.Split(cleanPath(p), "/")
+	cur := ""
+	hops := 0
+	for len(remaining) > 0 {
+		comp := remaining[0]
+		remaining = remaining[1:]
+		switch comp {
+		case "", ".":
+			continue
+		case "..":
+			// ".." at the root stays at the root, same as the kernel inside a chroot
+			cur = strings.TrimSuffix(path.Dir("/"+cur), "/")
+			cur = strings.TrimPrefix(cur, "/")
+			continue
+		}
+		next := path.Join(cur, comp)
+		e, ok := m.entries[next]
+		if ok && e.header.Typeflag == tar.TypeSymlink {
+			hops++
+			if hops > maxSymlinks {
+				return "", fmt.Errorf("%w: too many levels of symbolic links resolving %s", ErrInvalidInput, p)
+			}
+			target := e.header.Linkname
+			if path.IsAbs(target) {
+				cur = ""
+			}
+			remaining = append(strings.Split(target, "/"), remaining...)
+			continue
+		}
+		cur = next
+	}
+	return cur, nil
+}
+
+// find returns the sorted list of entries selected by a path or glob, directories include their content
+func (m *mergedFS) find(p string) ([]string, error) {
+	roots := []string{}
+	if strings.ContainsAny(p, "*?[") {
+		pattern := cleanPath(p)
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("%w: %s: %v", ErrInvalidInput, p, err)
+		}
+		for name := range m.entries {
+			if ok, _ := path.Match(pattern, name); ok {
+				roots = append(roots, name)
+			}
+		}
+	} else {
+		name, err := m.resolve(p)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := m.entries[name]; ok || m.isDir(name) {
+			roots = append(roots, name)
+		}
+	}
+	if len(roots) == 0 {
+		return nil, ErrNotFound
+	}
+
+	found := map[string]bool{}
+	for _, root := range roots {
+		if _, ok := m.entries[root]; ok {
+			found[root] = true
+		}
+		if !m.isDir(root) {
+			continue
+		}
+		prefix := root + "/"
+		if root == "" {
+			prefix = ""
+		}
+		for name := range m.entries {
+			if strings.HasPrefix(name, prefix) {
+				found[name] = true
+			}
+		}
+	}
+	result := make([]string, 0, len(found))
+	for name := range found {
+		result = append(result, name)
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+// source returns the entry holding the content for name, hard links point to another entry
+func (m *mergedFS) source(name string) (mergedEntry, string, bool) {
+	e, ok := m.entries[name]
+	if ok && e.header.Typeflag == tar.TypeLink {
+		target := cleanPath(e.header.Linkname)
+		if te, ok := m.entries[target]; ok {
+			return te, target, true
+		}
+	}
+	return e, name, ok
+}
@@ -0,0 +1,172 @@
+package regctl
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/regclient/regclient/types"
+	"github.com/stretchr/testify/require"
+)
+
+func testLayer(t *testing.T, headers ...*tar.Header) *tar.Reader {
+	t.Helper()
+	buf := bytes.Buffer{}
+	tw := tar.NewWriter(&buf)
+	for _, th := range headers {
+		if th.Typeflag == 0 {
+			th.Typeflag = tar.TypeReg
+		}
+		require.NoError(t, tw.WriteHeader(th))
+	}
+	require.NoError(t, tw.Close())
+	return tar.NewReader(&buf)
+}
+
+func TestMergedFS(t *testing.T) {
+	mfs := newMergedFS()
+	// the layers are added newest first
+	require.NoError(t, mfs.addLayer(1, testLayer(t,
+		&tar.Header{Name: "etc/.wh.shadow"},
+		&tar.Header{Name: "opt/app/.wh..wh..opq"},
+		&tar.Header{Name: "opt/app/new.txt"},
+		&tar.Header{Name: "var/run", Typeflag: tar.TypeSymlink, Linkname: "../../../run"},
+		&tar.Header{Name: "escape", Typeflag: tar.TypeSymlink, Linkname: "../../../etc/passwd"},
+		&tar.Header{Name: "loop", Typeflag: tar.TypeSymlink, Linkname: "loop"},
+	), nil))
+	require.NoError(t, mfs.addLayer(0, testLayer(t,
+		&tar.Header{Name: "etc/", Typeflag: tar.TypeDir},
+		&tar.Header{Name: "etc/passwd"},
+		&tar.Header{Name: "etc/shadow"},
+		&tar.Header{Name: "etc/ssl/certs/a.pem"},
+		&tar.Header{Name: "usr/share/zoneinfo/UTC"},
+		&tar.Header{Name: "etc/localtime", Typeflag: tar.TypeSymlink, Linkname: "/usr/share/zoneinfo/UTC"},
+		&tar.Header{Name: "opt/app/old.txt"},
+		&tar.Header{Name: "var/run", Typeflag: tar.TypeDir},
+		&tar.Header{Name: "var/run/x.pid"},
+	), nil))
+
+	t.Run("whiteout", func(t *testing.T) {
+		_, err := mfs.find("/etc/shadow")
+		require.ErrorIs(t, err, ErrNotFound)
+	})
+	t.Run("opaque", func(t *testing.T) {
+		names, err := mfs.find("/opt/app")
+		require.NoError(t, err)
+		require.Equal(t, []string{"opt/app/new.txt"}, names)
+	})
+	t.Run("directory replaced", func(t *testing.T) {
+		_, err := mfs.find("/var/run/x.pid")
+		require.ErrorIs(t, err, ErrNotFound)
+	})
+	t.Run("directory", func(t *testing.T) {
+		names, err := mfs.find("/etc/ssl")
+		require.NoError(t, err)
+		require.Equal(t, []string{"etc/ssl/certs/a.pem"}, names)
+	})
+	t.Run("glob", func(t *testing.T) {
+		names, err := mfs.find("/etc/pass*")
+		require.NoError(t, err)
+		require.Equal(t, []string{"etc/passwd"}, names)
+	})
+	t.Run("symlink", func(t *testing.T) {
+		names, err := mfs.find("/etc/localtime")
+		require.NoError(t, err)
+		require.Equal(t, []string{"usr/share/zoneinfo/UTC"}, names)
+	})
+	t.Run("symlink confined to root", func(t *testing.T) {
+		name, err := mfs.resolve("/escape")
+		require.NoError(t, err)
+		require.Equal(t, "etc/passwd", name)
+		name, err = mfs.resolve("/var/run")
+		require.NoError(t, err)
+		require.Equal(t, "run", name)
+	})
+	t.Run("symlink loop", func(t *testing.T) {
+		_, err := mfs.resolve("/loop")
+		require.ErrorIs(t, err, ErrInvalidInput)
+	})
+}
+
+// testGzipEntries creates a gzip compressed layer with the entries in order, the content of a regular file is its Linkname
+func testGzipEntries(t *testing.T, entries ...tar.Header) []byte {
+	t.Helper()
+	buf := bytes.Buffer{}
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for _, th := range entries {
+		content := ""
+		if th.Typeflag == tar.TypeReg {
+			content, th.Linkname = th.Linkname, ""
+			th.Size = int64(len(content))
+		}
+		require.NoError(t, tw.WriteHeader(&th))
+		_, err := tw.Write([]byte(content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, gw.Close())
+	return buf.Bytes()
+}
+
+func TestGetFile(t *testing.T) {
+	t.Setenv(ConfigEnv, filepath.Join(t.TempDir(), "config.json"))
+	layers := [][]byte{
+		testGzipEntries(t,
+			tar.Header{Name: "etc/hostname", Typeflag: tar.TypeReg, Linkname: "base"},
+			tar.Header{Name: "etc/shadow", Typeflag: tar.TypeReg, Linkname: "secret"},
+			tar.Header{Name: "usr/share/zoneinfo/UTC", Typeflag: tar.TypeReg, Linkname: "utc"},
+		),
+		testGzipEntries(t,
+			tar.Header{Name: "etc/.wh.shadow", Typeflag: tar.TypeReg},
+			tar.Header{Name: "etc/localtime", Typeflag: tar.TypeSymlink, Linkname: "/usr/share/zoneinfo/UTC"},
+			tar.Header{Name: "opt/current", Typeflag: tar.TypeSymlink, Linkname: "v2"},
+		),
+		testGzipEntries(t,
+			tar.Header{Name: "etc/hostname", Typeflag: tar.TypeReg, Linkname: "top"},
+			tar.Header{Name: "opt/v2", Typeflag: tar.TypeReg, Linkname: "app v2"},
+		),
+	}
+	reg := testRegistry(layers...)
+	pulls := []int{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i, l := range layers {
+			if r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/blobs/"+digest.FromBytes(l).String()) {
+				pulls = append(pulls, i)
+			}
+		}
+		reg.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	for _, tc := range []struct {
+		name  string
+		want  string
+		pulls []int
+	}{
+		// the lower layers are not pulled once a file is found
+		{"etc/hostname", "top", []int{2}},
+		{"etc/localtime", "utc", []int{2, 1, 0}},
+		// a symlink to a file of an upper layer pulls that layer again
+		{"opt/current", "app v2", []int{2, 1, 2}},
+		// a whiteout ends the search
+		{"etc/shadow", "", []int{2, 1}},
+	} {
+		pulls = pulls[:0]
+		out, err := cobraTest(t, "get-file", "--insecure-registry", host, host+"/test/app:latest", tc.name)
+		if tc.want == "" {
+			require.ErrorIs(t, err, types.ErrNotFound, tc.name)
+		} else {
+			require.NoError(t, err, tc.name)
+			require.Equal(t, tc.want, out, tc.name)
+		}
+		require.Equal(t, tc.pulls, pulls, tc.name)
+	}
+}
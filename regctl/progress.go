@@ -0,0 +1,245 @@
+package regctl
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mheers/docker-image-squash/squash"
+	"golang.org/x/term"
+)
+
+const (
+	progressAuto = "auto"
+	progressBar  = "bar"
+	progressJSON = "json"
+	progressNone = "none"
+
+	progressDownload = squash.PhaseDownload
+	progressExtract  = squash.PhaseExtract
+	progressWrite    = squash.PhaseWrite
+
+	progressBarWidth = 30
+)
+
+// progress reports the bytes of each layer downloaded, extracted, and written.
+// Bars are redrawn every progressFreq on a TTY, otherwise a JSON event stream is written.
+// A nil progress is valid and reports nothing.
+type progress struct {
+	mu    sync.Mutex
+	w     io.Writer
+	mode  string
+	ref   string
+	tasks []*progressTask
+	lines int // bar lines drawn by the previous update
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// progressTask tracks one phase of one layer, layer is -1 for the output
+type progressTask struct {
+	Phase    string `json:"phase"`
+	Layer    int    `json:"layer"`
+	Digest   string `json:"digest,omitempty"`
+	Total    int64  `json:"total,omitempty"`
+	current  atomic.Int64
+	finished atomic.Bool
+	reported int64 // current at the last event, only used by the update goroutine
+	ended    bool
+}
+
+// progressEvent is a line of the JSON event stream
+type progressEvent struct {
+	Time    time.Time `json:"time"`
+	Event   string    `json:"event"` // start, progress, or done
+	Ref     string    `json:"ref"`
+	Phase   string    `json:"phase"`
+	Layer   int       `json:"layer"`
+	Digest  string    `json:"digest,omitempty"`
+	Current int64     `json:"current"`
+	Total   int64     `json:"total,omitempty"`
+}
+
+// progressMode resolves "auto" to bars on a TTY and JSON otherwise
+func progressMode(mode string, w io.Writer) (string, error) {
+	switch mode {
+	case "", progressAuto:
+		if f, ok := w.(*os.File); ok && term.IsTerminal(int(f.Fd())) {
+			return progressBar, nil
+		}
+		return progressJSON, nil
+	case progressBar, progressJSON, progressNone:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("%w: progress %q, use auto, bar, json, or none", ErrInvalidInput, mode)
+	}
+}
+
+// newProgress starts reporting to w, returns nil for the "none" mode
+func newProgress(w io.Writer, mode, ref string) *progress {
+	if mode == progressNone {
+		return nil
+	}
+	p := &progress{
+		w:    w,
+		mode: mode,
+		ref:  ref,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go func() {
+		defer close(p.done)
+		ticker := time.NewTicker(progressFreq)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-p.stop:
+				p.update()
+				return
+			case <-ticker.C:
+				p.update()
+			}
+		}
+	}()
+	return p
+}
+
+// task adds a phase of a layer, total is 0 when unknown
+func (p *progress) task(phase string, layer int, digest string, total int64) *progressTask {
+	if p == nil {
+		return nil
+	}
+	t := &progressTask{Phase: phase, Layer: layer, Digest: digest, Total: total}
+	p.mu.Lock()
+	p.tasks = append(p.tasks, t)
+	p.mu.Unlock()
+	if p.mode == progressJSON {
+		p.event("start", t, 0)
+	}
+	return t
+}
+
+// close stops the updates after reporting the final state
+func (p *progress) close() {
+	if p == nil {
+		return
+	}
+	close(p.stop)
+	<-p.done
+}
+
+// Start adds a task reported by the squash package
+func (p *progress) Start(phase string, layer int, digest string, total int64) squash.ProgressTask {
+	return p.task(phase, layer, digest, total)
+}
+
+// Add counts n bytes
+func (t *progressTask) Add(n int64) {
+	if t != nil {
+		t.current.Add(n)
+	}
+}
+
+// Done marks the task complete, it is reported on the next update
+func (t *progressTask) Done() {
+	if t != nil {
+		t.finished.Store(true)
+	}
+}
+
+func (p *progress) update() {
+	p.mu.Lock()
+	tasks := make([]*progressTask, len(p.tasks))
+	copy(tasks, p.tasks)
+	p.mu.Unlock()
+	switch p.mode {
+	case progressJSON:
+		for _, t := range tasks {
+			if t.ended {
+				continue
+			}
+			// read finished before current so the done event has the final count
+			finished := t.finished.Load()
+			cur := t.current.Load()
+			if finished {
+				t.ended = true
+				p.event("done", t, cur)
+			} else if cur != t.reported {
+				p.event("progress", t, cur)
+			}
+			t.reported = cur
+		}
+	case progressBar:
+		p.draw(tasks)
+	}
+}
+
+func (p *progress) event(event string, t *progressTask, cur int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_ = json.NewEncoder(p.w).Encode(progressEvent{
+		Time:    time.Now().UTC(),
+		Event:   event,
+		Ref:     p.ref,
+		Phase:   t.Phase,
+		Layer:   t.Layer,
+		Digest:  t.Digest,
+		Current: cur,
+		Total:   t.Total,
+	})
+}
+
+// draw redraws a line per task, moving the cursor up over the previous update
+func (p *progress) draw(tasks []*progressTask) {
+	sb := strings.Builder{}
+	if p.lines > 0 {
+		fmt.Fprintf(&sb, "\x1b[%dA", p.lines)
+	}
+	for _, t := range tasks {
+		name := "output"
+		if t.Layer >= 0 {
+			name = fmt.Sprintf("layer %d", t.Layer)
+		}
+		if len(t.Digest) > 19 {
+			name += " " + t.Digest[7:19]
+		}
+		cur := t.current.Load()
+		bar := strings.Repeat(" ", progressBarWidth)
+		size := progressBytes(cur)
+		if t.Total > 0 {
+			filled := int(float64(progressBarWidth) * float64(cur) / float64(t.Total))
+			if filled > progressBarWidth {
+				filled = progressBarWidth
+			}
+			bar = strings.Repeat("=", filled) + strings.Repeat(" ", progressBarWidth-filled)
+			size += "/" + progressBytes(t.Total)
+		}
+		state := ""
+		if t.finished.Load() {
+			state = " done"
+		}
+		fmt.Fprintf(&sb, "\x1b[2K%-26s %-8s [%s] %s%s\n", name, t.Phase, bar, size, state)
+	}
+	p.lines = len(tasks)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, _ = io.WriteString(p.w, sb.String())
+}
+
+func progressBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,67 @@
+package regctl
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestProgressJSON(t *testing.T) {
+	t.Setenv(ConfigEnv, filepath.Join(t.TempDir(), "config.json"))
+	layer := testGzipLayer(t, map[string]string{"etc/hello": strings.Repeat("hello world\n", 1000)})
+	srv := httptest.NewServer(testRegistry(layer))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	out := filepath.Join(t.TempDir(), "out.tar")
+	stream, err := cobraTest(t, "squash", "--insecure-registry", host, "--progress", "json", host+"/test/app:latest", out)
+	require.NoError(t, err)
+
+	done := map[string]progressEvent{}
+	scanner := bufio.NewScanner(strings.NewReader(stream))
+	for scanner.Scan() {
+		ev := progressEvent{}
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &ev), scanner.Text())
+		require.Equal(t, host+"/test/app:latest", ev.Ref)
+		if ev.Event == "done" {
+			done[ev.Phase] = ev
+		}
+	}
+	require.Equal(t, int64(len(layer)), done[progressDownload].Current)
+	require.Equal(t, done[progressDownload].Total, done[progressDownload].Current)
+	require.Equal(t, 0, done[progressDownload].Layer)
+	require.Greater(t, done[progressExtract].Current, int64(12000))
+	fi, err := os.Stat(out)
+	require.NoError(t, err)
+	require.Equal(t, -1, done[progressWrite].Layer)
+	require.Equal(t, fi.Size(), done[progressWrite].Current)
+	require.Equal(t, fi.Size(), done[progressWrite].Total)
+
+	_, err = cobraTest(t, "squash", "--progress", "fancy", host+"/test/app:latest", out)
+	require.ErrorIs(t, err, ErrInvalidInput)
+}
+
+func TestProgressBar(t *testing.T) {
+	buf := &bytes.Buffer{}
+	p := newProgress(buf, progressBar, "test")
+	task := p.task(progressDownload, 0, "sha256:0123456789abcdef0123", 2048)
+	task.Add(1024)
+	task.Done()
+	p.close()
+	require.Contains(t, buf.String(), "layer 0 0123456789ab")
+	require.Contains(t, buf.String(), "[===============               ] 1.0KiB/2.0KiB done")
+
+	// a nil progress is valid
+	var none *progress
+	none.task(progressWrite, -1, "", 0).Done()
+	none.close()
+	require.Nil(t, newProgress(buf, progressNone, "test"))
+	require.Equal(t, "1.5MiB", progressBytes(1536*1024))
+}
@@ -0,0 +1,94 @@
+package regctl
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/regclient/regclient"
+	"github.com/regclient/regclient/types"
+	"github.com/regclient/regclient/types/manifest"
+	v1 "github.com/regclient/regclient/types/oci/v1"
+	"github.com/regclient/regclient/types/ref"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	ociAnnotTitle = "org.opencontainers.image.title"
+)
+
+// AttachSBOM pushes an SBOM file as an OCI referrer of the subject image
+func AttachSBOM(subject, sbomFile, mediaType string) error {
+	ctx := context.Background()
+	r, err := imageTargetNew(subject)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(sbomFile)
+	if err != nil {
+		return err
+	}
+	rc := newRegClient(r)
+	defer rc.Close(ctx, r)
+
+	_, err = artifactPut(ctx, rc, r, mediaType, mediaType, data, map[string]string{
+		ociAnnotTitle: "sbom.json",
+	})
+	return err
+}
+
+// artifactPut pushes data as a single blob artifact with the subject set to r
+func artifactPut(ctx context.Context, rc *regclient.RegClient, r ref.Ref, artifactType, blobMT string, data []byte, annotations map[string]string) (ref.Ref, error) {
+	smh, err := rc.ManifestHead(ctx, r, regclient.WithManifestRequireDigest())
+	if err != nil {
+		return r, fmt.Errorf("unable to find subject manifest: %w", credsError(r, err))
+	}
+	sd := smh.GetDescriptor()
+	subjectDesc := &types.Descriptor{MediaType: sd.MediaType, Digest: sd.Digest, Size: sd.Size}
+
+	// empty json config, the artifact type is carried in the config media type
+	configBytes := []byte("{}")
+	confDesc := types.Descriptor{
+		MediaType: artifactType,
+		Digest:    digest.FromBytes(configBytes),
+		Size:      int64(len(configBytes)),
+	}
+	if _, err := rc.BlobPut(ctx, r, confDesc, bytes.NewReader(configBytes)); err != nil {
+		return r, credsError(r, err)
+	}
+	blobDesc := types.Descriptor{
+		MediaType:   blobMT,
+		Digest:      digest.FromBytes(data),
+		Size:        int64(len(data)),
+		Annotations: annotations,
+	}
+	if _, err := rc.BlobPut(ctx, r, blobDesc, bytes.NewReader(data)); err != nil {
+		return r, err
+	}
+
+	m := v1.Manifest{
+		Versioned: v1.ManifestSchemaVersion,
+		MediaType: types.MediaTypeOCI1Manifest,
+		Config:    confDesc,
+		Layers:    []types.Descriptor{blobDesc},
+		Subject:   subjectDesc,
+	}
+	mm, err := manifest.New(manifest.WithOrig(m))
+	if err != nil {
+		return r, err
+	}
+	rArt := r
+	rArt.Tag = ""
+	rArt.Digest = mm.GetDescriptor().Digest.String()
+	if err := rc.ManifestPut(ctx, rArt, mm); err != nil {
+		return r, err
+	}
+	log.WithFields(logrus.Fields{
+		"subject":      r.CommonName(),
+		"artifact":     rArt.CommonName(),
+		"artifactType": artifactType,
+	}).Info("Attached referrer")
+	return rArt, nil
+}
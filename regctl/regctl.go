@@ -1,48 +1,86 @@
 package regctl
 
 import (
+	"context"
+	"net/http"
 	"os"
 	"time"
 
+	"github.com/mheers/docker-image-squash/squash"
 	"github.com/regclient/regclient"
 	"github.com/regclient/regclient/config"
 	"github.com/regclient/regclient/scheme/reg"
+	"github.com/regclient/regclient/types/ref"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
 
 const (
 	progressFreq = time.Millisecond * 250
-	usageDesc    = `Utility for accessing docker registries
-More details at https://github.com/regclient/regclient`
+	usageDesc    = `Squash all layers of a container image into a single tar file,
+without a docker daemon.
+More details at https://github.com/mheers/docker-image-squash`
 	// UserAgent sets the header on http requests
-	UserAgent = "regclient/regctl"
+	UserAgent = "mheers/docker-image-squash"
 )
 
 var rootOpts struct {
+	config    string
 	verbosity string
 	logopts   []string
+	logFormat string
 	format    string // for Go template formatting of various commands
 	userAgent string
+	// per registry TLS overrides, not saved to the config
+	insecureRegistries []string
+	registryCA         []string
+	registryCert       []string
+	registryKey        []string
+	registriesConf     string
+	shortNameMode      string
+	timeout            time.Duration
+	blobIdleTimeout    time.Duration
+	retries            int
+	retryBackoff       time.Duration
+	retryMaxBackoff    time.Duration
 }
 
 var (
 	log *logrus.Logger
+	// cliLog is the default logger, only it is configured by --verbosity and --log-format
+	cliLog *logrus.Logger
+	// rootCancel releases the --timeout context after the command
+	rootCancel context.CancelFunc
+	// squashShortcut is set when the squash command runs from the deprecated "docker-image-squash <image> <output.tar>"
+	squashShortcut bool
 )
 
 func init() {
-	log = &logrus.Logger{
+	cliLog = &logrus.Logger{
 		Out:       os.Stderr,
 		Formatter: new(logrus.TextFormatter),
 		Hooks:     make(logrus.LevelHooks),
 		Level:     logrus.WarnLevel,
 	}
+	log = cliLog
 }
 
-func newRegClient() *regclient.RegClient {
-	// ConfigNew creates an empty configuration
-	conf := Config{
-		Hosts: map[string]*config.Host{},
+// newRegClient creates a client with the config file settings, refs are the images
+// that will be accessed so credentials from the environment and the credential helpers are added for their registries
+func newRegClient(refs ...ref.Ref) *regclient.RegClient {
+	conf, err := ConfigLoadDefault()
+	if err != nil {
+		// the config is validated in rootPreRun, this is only reached when called outside of the cli
+		log.WithFields(logrus.Fields{
+			"err": err,
+		}).Warn("Failed to load default config")
+		conf = ConfigNew()
+	}
+	if err := tlsFlagsApply(conf); err != nil {
+		// flags are validated in rootPreRun, this is only reached when called outside of the cli
+		log.WithFields(logrus.Fields{
+			"err": err,
+		}).Warn("Failed to apply TLS flags")
 	}
 
 	rcOpts := []regclient.Opt{
@@ -50,13 +88,8 @@ func newRegClient() *regclient.RegClient {
 	}
 	if rootOpts.userAgent != "" {
 		rcOpts = append(rcOpts, regclient.WithUserAgent(rootOpts.userAgent))
-	} else {
-		// info := version.GetInfo()
-		// if info.VCSTag != "" {
-		// 	rcOpts = append(rcOpts, regclient.WithUserAgent(UserAgent+" ("+info.VCSTag+")"))
-		// } else {
-		// 	rcOpts = append(rcOpts, regclient.WithUserAgent(UserAgent+" ("+info.VCSRef+")"))
-		// }
+	} else if versionInfo.Version != "" {
+		rcOpts = append(rcOpts, regclient.WithUserAgent(UserAgent+" ("+versionInfo.Version+")"))
 	}
 	if conf.BlobLimit != 0 {
 		rcOpts = append(rcOpts, regclient.WithRegOpts(reg.WithBlobLimit(conf.BlobLimit)))
@@ -64,13 +97,54 @@ func newRegClient() *regclient.RegClient {
 	if conf.IncDockerCred == nil || *conf.IncDockerCred {
 		rcOpts = append(rcOpts, regclient.WithDockerCreds())
 	}
-	if conf.IncDockerCert == nil || *conf.IncDockerCert {
+	if regConf, err := RegistriesConfLoadDefault(); err != nil {
+		log.WithFields(logrus.Fields{
+			"err": err,
+		}).Warn("Failed to load registries config")
+	} else {
+		regConf.hostsApply(conf)
+	}
+
+	dockerCerts := conf.IncDockerCert == nil || *conf.IncDockerCert
+	if dockerCerts {
 		rcOpts = append(rcOpts, regclient.WithDockerCerts())
 	}
 
+	for _, r := range refs {
+		if _, ok := conf.Hosts[r.Registry]; ok {
+			continue
+		}
+		if _, _, ok := envCreds(r.Registry); ok {
+			conf.Hosts[r.Registry] = config.HostNewName(r.Registry)
+		}
+	}
+
+	// resumed layer downloads request the missing bytes with a Range header,
+	// failed requests are retried by squash with --retries, a limit of 1 stops regclient
+	// after the first failure (0 keeps its default)
+	rcOpts = append(rcOpts,
+		regclient.WithRegOpts(
+			reg.WithHTTPClient(&http.Client{
+				Transport: squash.RangeTransport(tlsTransport(tlsHosts(conf, dockerCerts), dockerCerts)),
+			}),
+			reg.WithRetryLimit(1),
+		),
+		regclient.WithRetryDelay(rootOpts.retryBackoff, rootOpts.retryMaxBackoff),
+	)
+
+	// credential helpers only run for the registries that are accessed
+	used := map[string]bool{}
+	for _, r := range refs {
+		used[r.Registry] = true
+	}
 	rcHosts := []config.Host{}
 	for name, host := range conf.Hosts {
 		host.Name = name
+		if used[name] {
+			hostCreds(host)
+		} else {
+			host.CredHelper = ""
+		}
 		rcHosts = append(rcHosts, *host)
 	}
 	if len(rcHosts) > 0 {
@@ -0,0 +1,119 @@
+package regctl
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/regclient/regclient/types"
+	v1 "github.com/regclient/regclient/types/oci/v1"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/stretchr/testify/require"
+)
+
+func cobraTest(t *testing.T, args ...string) (string, error) {
+	t.Helper()
+
+	buf := new(bytes.Buffer)
+	rootCmd.SetOut(buf)
+	rootCmd.SetErr(buf)
+	cobraReset(rootCmd)
+	// library functions read the flag values too, so they are restored after the test
+	t.Cleanup(func() { cobraReset(rootCmd) })
+
+	err := Execute(context.Background(), args)
+	return strings.TrimSpace(buf.String()), err
+}
+
+// cobraReset restores the defaults of flags changed by a previous run, cobra keeps them between executions
+func cobraReset(cmd *cobra.Command) {
+	cmd.Flags().VisitAll(func(f *pflag.Flag) {
+		if !f.Changed {
+			return
+		}
+		if sv, ok := f.Value.(pflag.SliceValue); ok {
+			sv.Replace([]string{})
+		} else {
+			f.Value.Set(f.DefValue)
+		}
+		f.Changed = false
+	})
+	for _, c := range cmd.Commands() {
+		cobraReset(c)
+	}
+}
+
+// testGzipLayer creates a gzip compressed layer with the files, sorted by name
+func testGzipLayer(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+	names := []string{}
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	buf := bytes.Buffer{}
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for _, name := range names {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(files[name]))}))
+		_, err := tw.Write([]byte(files[name]))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, gw.Close())
+	return buf.Bytes()
+}
+
+// testRegistry is a stand-in registry serving test/app:latest with the layers, each a compressed tar
+func testRegistry(layers ...[]byte) http.Handler {
+	return testRegistryConfig([]byte("{}"), layers...)
+}
+
+// testRegistryConfig serves test/app:latest with the image config conf
+func testRegistryConfig(conf []byte, layers ...[]byte) http.Handler {
+	blobs := map[string][]byte{}
+	blobs[digest.FromBytes(conf).String()] = conf
+	m := v1.Manifest{
+		Versioned: v1.ManifestSchemaVersion,
+		MediaType: types.MediaTypeOCI1Manifest,
+		Config:    types.Descriptor{MediaType: types.MediaTypeOCI1ImageConfig, Digest: digest.FromBytes(conf), Size: int64(len(conf))},
+		Layers:    []types.Descriptor{},
+	}
+	for _, l := range layers {
+		blobs[digest.FromBytes(l).String()] = l
+		m.Layers = append(m.Layers, types.Descriptor{MediaType: types.MediaTypeOCI1LayerGzip, Digest: digest.FromBytes(l), Size: int64(len(l))})
+	}
+	mj, _ := json.Marshal(m)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/", func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/v2/test/app/manifests/latest" || r.URL.Path == "/v2/test/app/manifests/"+digest.FromBytes(mj).String():
+			w.Header().Set("Content-Type", types.MediaTypeOCI1Manifest)
+			w.Header().Set("Docker-Content-Digest", digest.FromBytes(mj).String())
+			if r.Method == http.MethodGet {
+				w.Write(mj)
+			}
+		case strings.HasPrefix(r.URL.Path, "/v2/test/app/blobs/"):
+			b, ok := blobs[strings.TrimPrefix(r.URL.Path, "/v2/test/app/blobs/")]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(b))
+		case r.URL.Path == "/v2/":
+			w.WriteHeader(http.StatusOK)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+	return mux
+}
@@ -0,0 +1,441 @@
+package regctl
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/mheers/docker-image-squash/squash"
+	"github.com/regclient/regclient"
+	"github.com/regclient/regclient/config"
+	"github.com/regclient/regclient/types/ref"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	// RegistriesConfFilename is the default filename of the registries config, within ConfigDir
+	RegistriesConfFilename = "registries.conf"
+	// RegistriesConfEnv is the environment variable to override the registries config filename
+	RegistriesConfEnv = "DOCKER_IMAGE_SQUASH_REGISTRIES_CONF"
+)
+
+const (
+	// shortNameModeEnforcing refuses short names matching more than one search registry
+	shortNameModeEnforcing = "enforcing"
+	// shortNameModePermissive tries each search registry in order
+	shortNameModePermissive = "permissive"
+	// shortNameModeDisabled tries each search registry in order, ignoring the aliases
+	shortNameModeDisabled = "disabled"
+
+	pullFromMirrorAll        = "all"
+	pullFromMirrorDigestOnly = "digest-only"
+	pullFromMirrorTagOnly    = "tag-only"
+)
+
+// RegistriesConf is a subset of the containers registries.conf (version 2) format,
+// https://github.com/containers/image/blob/main/docs/containers-registries.conf.5.md
+type RegistriesConf struct {
+	Filename string `toml:"-"`
+	// UnqualifiedSearchRegistries are tried in order for short names, Docker Hub when empty
+	UnqualifiedSearchRegistries []string `toml:"unqualified-search-registries"`
+	// ShortNameMode is "enforcing", "permissive" (default), or "disabled"
+	ShortNameMode string `toml:"short-name-mode"`
+	// Aliases map short names to fully qualified names, e.g. "myapp" = "registry.corp/team/myapp"
+	Aliases    map[string]string `toml:"aliases"`
+	Registries []RegistryConf    `toml:"registry"`
+}
+
+// RegistryConf rewrites and mirrors the images matching Prefix
+type RegistryConf struct {
+	// Prefix is a registry, a repository path within a registry, or "*.example.com",
+	// a trailing "/*" is accepted, e.g. "docker.io/library/*"
+	Prefix string `toml:"prefix"`
+	// Location replaces Prefix, defaults to Prefix
+	Location string `toml:"location"`
+	// Insecure skips TLS verification of Location
+	Insecure bool `toml:"insecure"`
+	// Blocked refuses pulls from the prefix
+	Blocked bool `toml:"blocked"`
+	// MirrorByDigestOnly only uses the mirrors for images pulled by digest
+	MirrorByDigestOnly bool `toml:"mirror-by-digest-only"`
+	// Mirrors are attempted in order before Location
+	Mirrors []MirrorConf `toml:"mirror"`
+}
+
+// MirrorConf is an alternate location for the images of a RegistryConf
+type MirrorConf struct {
+	Location string `toml:"location"`
+	Insecure bool   `toml:"insecure"`
+	// PullFromMirror is "all" (default), "digest-only", or "tag-only"
+	PullFromMirror string `toml:"pull-from-mirror"`
+}
+
+// registriesConfFilename returns the registries config from the flag, environment, or config directory
+func registriesConfFilename() string {
+	if rootOpts.registriesConf != "" {
+		return rootOpts.registriesConf
+	}
+	if env := os.Getenv(RegistriesConfEnv); env != "" {
+		return env
+	}
+	return filepath.Join(filepath.Dir(configFilename()), RegistriesConfFilename)
+}
+
+// RegistriesConfLoadFile loads and validates a registries config
+func RegistriesConfLoadFile(filename string) (*RegistriesConf, error) {
+	rc := &RegistriesConf{}
+	if _, err := toml.DecodeFile(filename, rc); err != nil {
+		return nil, fmt.Errorf("failed to load registries config %s: %w", filename, err)
+	}
+	rc.Filename = filename
+	if err := rc.validate(); err != nil {
+		return nil, fmt.Errorf("failed to load registries config %s: %w", filename, err)
+	}
+	return rc, nil
+}
+
+// RegistriesConfLoadDefault loads the registries config from the (default) filename,
+// a missing file is an empty config unless it was explicitly requested
+func RegistriesConfLoadDefault() (*RegistriesConf, error) {
+	filename := registriesConfFilename()
+	rc, err := RegistriesConfLoadFile(filename)
+	explicit := rootOpts.registriesConf != "" || os.Getenv(RegistriesConfEnv) != ""
+	if err != nil && errors.Is(err, fs.ErrNotExist) && !explicit {
+		rc = &RegistriesConf{Filename: filename}
+		return rc, rc.validate()
+	}
+	return rc, err
+}
+
+func (rc *RegistriesConf) validate() error {
+	if rootOpts.shortNameMode != "" {
+		rc.ShortNameMode = rootOpts.shortNameMode
+	}
+	switch rc.ShortNameMode {
+	case "", shortNameModeEnforcing, shortNameModePermissive, shortNameModeDisabled:
+	default:
+		return fmt.Errorf("%w: short-name-mode %q", ErrInvalidInput, rc.ShortNameMode)
+	}
+	for short, long := range rc.Aliases {
+		if !isShortName(short) || strings.ContainsAny(short, ":@") {
+			return fmt.Errorf("%w: alias %s must be a short name without a tag or digest", ErrInvalidInput, short)
+		}
+		if isShortName(long) {
+			return fmt.Errorf("%w: alias %s must resolve to a fully qualified name, received %s", ErrInvalidInput, short, long)
+		}
+	}
+	for i := range rc.Registries {
+		reg := &rc.Registries[i]
+		reg.Prefix = strings.TrimSuffix(reg.Prefix, "/*")
+		reg.Location = strings.TrimSuffix(reg.Location, "/*")
+		if reg.Prefix == "" {
+			reg.Prefix = reg.Location
+		}
+		if reg.Prefix == "" {
+			return fmt.Errorf("%w: registry entry %d needs a prefix or location", ErrInvalidInput, i)
+		}
+		if strings.HasPrefix(reg.Prefix, "*.") && reg.Location != "" {
+			return fmt.Errorf("%w: wildcard prefix %s cannot have a location", ErrInvalidInput, reg.Prefix)
+		}
+		for j := range reg.Mirrors {
+			m := &reg.Mirrors[j]
+			m.Location = strings.TrimSuffix(m.Location, "/*")
+			if m.Location == "" {
+				return fmt.Errorf("%w: mirror %d of %s needs a location", ErrInvalidInput, j, reg.Prefix)
+			}
+			switch m.PullFromMirror {
+			case "", pullFromMirrorAll, pullFromMirrorDigestOnly, pullFromMirrorTagOnly:
+			default:
+				return fmt.Errorf("%w: pull-from-mirror %q of %s", ErrInvalidInput, m.PullFromMirror, m.Location)
+			}
+		}
+	}
+	return nil
+}
+
+// isShortName returns true when name does not start with a registry,
+// the first path component is a registry when it contains "." or ":", or is "localhost"
+func isShortName(name string) bool {
+	if strings.Contains(name, "://") {
+		return false
+	}
+	first, _, ok := strings.Cut(name, "/")
+	if !ok {
+		return true
+	}
+	return !strings.ContainsAny(first, ".:") && first != "localhost"
+}
+
+// resolve expands a short name with the aliases and search registries,
+// returning the candidate names in order, fully qualified names are returned unchanged
+func (rc *RegistriesConf) resolve(name string) ([]ref.Ref, error) {
+	if !isShortName(name) {
+		r, err := ref.New(name)
+		if err != nil {
+			return nil, err
+		}
+		return []ref.Ref{r}, nil
+	}
+	// split the tag or digest from the repository
+	repo, suffix := name, ""
+	if i := strings.Index(name, "@"); i >= 0 {
+		repo, suffix = name[:i], name[i:]
+	} else if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		repo, suffix = name[:i], name[i:]
+	}
+	if alias, ok := rc.Aliases[repo]; ok && rc.ShortNameMode != shortNameModeDisabled {
+		r, err := ref.New(alias + suffix)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse alias %s for %s: %w", alias, repo, err)
+		}
+		log.WithFields(logrus.Fields{
+			"name":  name,
+			"alias": r.CommonName(),
+		}).Info("Resolved short name with alias")
+		return []ref.Ref{r}, nil
+	}
+	if len(rc.UnqualifiedSearchRegistries) == 0 {
+		// historic behavior, short names are on Docker Hub
+		r, err := ref.New(name)
+		if err != nil {
+			return nil, err
+		}
+		return []ref.Ref{r}, nil
+	}
+	if len(rc.UnqualifiedSearchRegistries) > 1 && rc.ShortNameMode == shortNameModeEnforcing {
+		return nil, fmt.Errorf("%w: %s matches the search registries %s, use a fully qualified name or add an alias to %s",
+			ErrShortNameAmbiguous, name, strings.Join(rc.UnqualifiedSearchRegistries, ", "), rc.Filename)
+	}
+	result := []ref.Ref{}
+	for _, reg := range rc.UnqualifiedSearchRegistries {
+		r, err := ref.New(reg + "/" + name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve %s with search registry %s: %w", name, reg, err)
+		}
+		result = append(result, r)
+	}
+	log.WithFields(logrus.Fields{
+		"name":       name,
+		"candidates": len(result),
+	}).Info("Resolving short name with search registries")
+	return result, nil
+}
+
+// match returns the length of the prefix matched by name ("registry/repository"), 0 for no match
+func (reg *RegistryConf) match(name string) int {
+	if strings.HasPrefix(reg.Prefix, "*.") {
+		host, _, _ := strings.Cut(name, "/")
+		if strings.HasSuffix(host, reg.Prefix[1:]) {
+			return len(reg.Prefix)
+		}
+		return 0
+	}
+	if name == reg.Prefix || strings.HasPrefix(name, reg.Prefix+"/") {
+		return len(reg.Prefix)
+	}
+	return 0
+}
+
+// find returns the entry with the longest prefix matching r
+func (rc *RegistriesConf) find(r ref.Ref) *RegistryConf {
+	name := r.Registry + "/" + r.Repository
+	var found *RegistryConf
+	best := 0
+	for i := range rc.Registries {
+		if l := rc.Registries[i].match(name); l > best {
+			found, best = &rc.Registries[i], l
+		}
+	}
+	return found
+}
+
+// rewrite replaces the matched prefix of r with location
+func (reg *RegistryConf) rewrite(r ref.Ref, location string) (ref.Ref, error) {
+	if location == "" || strings.HasPrefix(reg.Prefix, "*.") {
+		return r, nil
+	}
+	name := r.Registry + "/" + r.Repository
+	rNew, err := ref.New(location + strings.TrimPrefix(name, reg.Prefix))
+	if err != nil {
+		return r, fmt.Errorf("failed to rewrite %s with %s: %w", name, location, err)
+	}
+	rNew.Tag, rNew.Digest = r.Tag, r.Digest
+	return rNew, nil
+}
+
+// endpoints returns the locations to pull r from in order of preference, mirrors first
+func (rc *RegistriesConf) endpoints(r ref.Ref) ([]ref.Ref, error) {
+	if r.Scheme != "reg" {
+		return []ref.Ref{r}, nil
+	}
+	reg := rc.find(r)
+	if reg == nil {
+		return []ref.Ref{r}, nil
+	}
+	if reg.Blocked {
+		return nil, fmt.Errorf("%w: %s is blocked by %s", ErrBlocked, r.CommonName(), rc.Filename)
+	}
+	eps := []ref.Ref{}
+	for _, m := range reg.Mirrors {
+		if (reg.MirrorByDigestOnly || m.PullFromMirror == pullFromMirrorDigestOnly) && r.Digest == "" {
+			continue
+		}
+		if m.PullFromMirror == pullFromMirrorTagOnly && r.Digest != "" {
+			continue
+		}
+		ep, err := reg.rewrite(r, m.Location)
+		if err != nil {
+			return nil, err
+		}
+		eps = append(eps, ep)
+	}
+	ep, err := reg.rewrite(r, reg.Location)
+	if err != nil {
+		return nil, err
+	}
+	return append(eps, ep), nil
+}
+
+// hostsApply adds the insecure setting of locations and mirrors to hosts missing from the config
+func (rc *RegistriesConf) hostsApply(conf *Config) {
+	set := func(location string, insecure bool) {
+		if !insecure || strings.HasPrefix(location, "*.") {
+			return
+		}
+		name := config.HostNewName(location).Name
+		if _, ok := conf.Hosts[name]; ok {
+			return
+		}
+		h := conf.hostGet(name)
+		h.TLS = config.TLSInsecure
+	}
+	for _, reg := range rc.Registries {
+		if reg.Location != "" {
+			set(reg.Location, reg.Insecure)
+		} else {
+			set(reg.Prefix, reg.Insecure)
+		}
+		for _, m := range reg.Mirrors {
+			set(m.Location, m.Insecure)
+		}
+	}
+}
+
+// imageSource is an image to pull, resolved with the registries config
+type imageSource struct {
+	ref       ref.Ref   // fully qualified name, the first candidate for short names
+	endpoints []ref.Ref // locations in order of preference
+	names     []ref.Ref // fully qualified name of each endpoint
+	rc        *regclient.RegClient
+	src       *squash.Source
+}
+
+// imageSourceNew parses an image name, resolves its endpoints and creates a client for them
+func imageSourceNew(name string) (*imageSource, error) {
+	s, err := imageResolve(name)
+	if err != nil {
+		return nil, err
+	}
+	s.rc = newRegClient(s.endpoints...)
+	if s.src, err = squash.NewSource(s.ref, s.options()); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// imageResolve parses an image name and resolves its endpoints
+func imageResolve(name string) (*imageSource, error) {
+	regConf, err := RegistriesConfLoadDefault()
+	if err != nil {
+		return nil, err
+	}
+	candidates, err := regConf.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	s := &imageSource{ref: candidates[0]}
+	for _, r := range candidates {
+		eps, err := regConf.endpoints(r)
+		if err != nil {
+			return nil, err
+		}
+		for _, ep := range eps {
+			s.endpoints = append(s.endpoints, ep)
+			s.names = append(s.names, r)
+		}
+	}
+	return s, nil
+}
+
+// imageTargetNew parses the name of an image to write, e.g. to push or modify it, and resolves it
+// like imageSourceNew to the location of the first candidate, the mirrors are only pulled from
+func imageTargetNew(name string) (ref.Ref, error) {
+	s, err := imageResolve(name)
+	if err != nil {
+		return ref.Ref{}, err
+	}
+	return s.location(), nil
+}
+
+// options returns the pull settings of the squash package for the flags of the cli
+func (s *imageSource) options() squash.Options {
+	opts := squash.Options{
+		Logger:          log,
+		RegClient:       s.rc,
+		Endpoints:       s.endpoints,
+		BlobIdleTimeout: rootOpts.blobIdleTimeout,
+		Retries:         rootOpts.retries,
+		RetryBackoff:    rootOpts.retryBackoff,
+		RetryMaxBackoff: rootOpts.retryMaxBackoff,
+	}
+	if opts.Retries == 0 {
+		// 0 is the default of the library
+		opts.Retries = -1
+	}
+	return opts
+}
+
+// location returns the rewritten location of the first candidate, which follows its mirrors
+func (s *imageSource) location() ref.Ref {
+	loc := s.endpoints[0]
+	for i, name := range s.names {
+		if name.CommonName() != s.ref.CommonName() {
+			break
+		}
+		loc = s.endpoints[i]
+	}
+	return loc
+}
+
+// resolved returns the fully qualified name of the endpoint that last succeeded
+func (s *imageSource) resolved() ref.Ref {
+	return s.names[s.src.Served()]
+}
+
+// name returns the fully qualified name of the endpoint ep
+func (s *imageSource) name(ep ref.Ref) ref.Ref {
+	for i, e := range s.endpoints {
+		if e.CommonName() == ep.CommonName() {
+			return s.names[i]
+		}
+	}
+	return ep
+}
+
+// endpoint returns the location that last succeeded, the first one before any request
+func (s *imageSource) endpoint() ref.Ref {
+	return s.src.Endpoint()
+}
+
+// try calls fn with each endpoint until one succeeds, starting with the last successful endpoint.
+// The error of the last attempt is returned when all fail.
+func (s *imageSource) try(fn func(ep ref.Ref) error) error {
+	if err := s.src.Try(fn); err != nil {
+		return credsError(s.endpoint(), err)
+	}
+	return nil
+}
@@ -0,0 +1,194 @@
+package regctl
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/regclient/regclient/config"
+	"github.com/regclient/regclient/types/ref"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistriesConfEndpoints(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "registries.conf")
+	require.NoError(t, os.WriteFile(filename, []byte(`
+[[registry]]
+prefix = "docker.io"
+[[registry.mirror]]
+location = "mirror.corp"
+
+[[registry]]
+prefix = "docker.io/library/*"
+location = "mirror.corp/hub/*"
+[[registry.mirror]]
+location = "cache.corp/hub"
+pull-from-mirror = "digest-only"
+
+[[registry]]
+prefix = "*.blocked.example"
+blocked = true
+`), 0600))
+	rc, err := RegistriesConfLoadFile(filename)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name   string
+		expect []string
+		err    error
+	}{
+		{name: "alpine:3", expect: []string{"mirror.corp/hub/alpine:3"}},
+		{name: "alpine@sha256:0000000000000000000000000000000000000000000000000000000000000000", expect: []string{
+			"cache.corp/hub/alpine@sha256:0000000000000000000000000000000000000000000000000000000000000000",
+			"mirror.corp/hub/alpine@sha256:0000000000000000000000000000000000000000000000000000000000000000",
+		}},
+		{name: "mheers/test:latest", expect: []string{"mirror.corp/mheers/test:latest", "docker.io/mheers/test:latest"}},
+		{name: "docker.io/libraryx/test:latest", expect: []string{"mirror.corp/libraryx/test:latest", "docker.io/libraryx/test:latest"}},
+		{name: "registry.corp/app:1", expect: []string{"registry.corp/app:1"}},
+		{name: "registry.blocked.example/app:1", err: ErrBlocked},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := ref.New(tt.name)
+			require.NoError(t, err)
+			eps, err := rc.endpoints(r)
+			if tt.err != nil {
+				require.ErrorIs(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			names := []string{}
+			for _, ep := range eps {
+				names = append(names, ep.CommonName())
+			}
+			require.Equal(t, tt.expect, names)
+		})
+	}
+
+	// images are written to the location, not a mirror
+	t.Setenv(RegistriesConfEnv, filename)
+	for name, expect := range map[string]string{
+		"alpine:3":            "mirror.corp/hub/alpine:3",
+		"mheers/test:latest":  "docker.io/mheers/test:latest",
+		"registry.corp/app:1": "registry.corp/app:1",
+		"ocidir:///srv/app:1": "ocidir:///srv/app:1",
+	} {
+		r, err := imageTargetNew(name)
+		require.NoError(t, err, name)
+		require.Equal(t, expect, r.CommonName(), name)
+	}
+	_, err = imageTargetNew("registry.blocked.example/app:1")
+	require.ErrorIs(t, err, ErrBlocked)
+
+	_, err = RegistriesConfLoadFile(filepath.Join(t.TempDir(), "missing.conf"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+	require.NoError(t, os.WriteFile(filename, []byte("[[registry]]\nprefix = \"*.corp\"\nlocation = \"mirror.corp\"\n"), 0600))
+	_, err = RegistriesConfLoadFile(filename)
+	require.ErrorIs(t, err, ErrInvalidInput)
+}
+
+func TestRegistriesConfMirror(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv(ConfigEnv, filepath.Join(dir, "config.json"))
+	missing := httptest.NewTLSServer(http.NotFoundHandler())
+	defer missing.Close()
+	mirror := httptest.NewTLSServer(testRegistry())
+	defer mirror.Close()
+	missingHost := strings.TrimPrefix(missing.URL, "https://")
+	mirrorHost := strings.TrimPrefix(mirror.URL, "https://")
+
+	// the mirrors are insecure since they use the self signed httptest certificate
+	filename := filepath.Join(dir, "registries.conf")
+	require.NoError(t, os.WriteFile(filename, []byte(`
+[[registry]]
+prefix = "upstream.invalid/team/*"
+location = "upstream.invalid/team/*"
+[[registry.mirror]]
+location = "`+missingHost+`/other"
+insecure = true
+[[registry.mirror]]
+location = "`+mirrorHost+`/test"
+insecure = true
+`), 0600))
+
+	out, err := cobraTest(t, "manifest", "head", "--registries-conf", filename, "upstream.invalid/team/app:latest")
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(out, "sha256:"), out)
+
+	// the other commands reading an image use the mirrors too
+	_, err = cobraTest(t, "ratelimit", "--registries-conf", filename, "upstream.invalid/team/app:latest")
+	require.NoError(t, err)
+
+	// hosts in the config file keep their settings
+	c := ConfigNew()
+	c.hostGet(mirrorHost)
+	rc, err := RegistriesConfLoadFile(filename)
+	require.NoError(t, err)
+	rc.hostsApply(c)
+	require.Equal(t, config.TLSEnabled, c.Hosts[mirrorHost].TLS)
+	require.Equal(t, config.TLSInsecure, c.Hosts[missingHost].TLS)
+
+	_, err = cobraTest(t, "manifest", "head", "--registries-conf", filepath.Join(dir, "missing.conf"), "upstream.invalid/team/app:latest")
+	require.Error(t, err)
+}
+
+func TestRegistriesConfShortNames(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "registries.conf")
+	require.NoError(t, os.WriteFile(filename, []byte(`
+unqualified-search-registries = ["registry.corp", "docker.io"]
+
+[aliases]
+"myapp" = "registry.corp/team/myapp"
+"tools/lint" = "registry.corp/ci/lint"
+`), 0600))
+	rc, err := RegistriesConfLoadFile(filename)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name   string
+		mode   string
+		expect []string
+		err    error
+	}{
+		{name: "myapp", expect: []string{"registry.corp/team/myapp:latest"}},
+		{name: "myapp:1.2", mode: shortNameModeEnforcing, expect: []string{"registry.corp/team/myapp:1.2"}},
+		{name: "tools/lint@sha256:0000000000000000000000000000000000000000000000000000000000000000", expect: []string{"registry.corp/ci/lint@sha256:0000000000000000000000000000000000000000000000000000000000000000"}},
+		{name: "alpine:3", expect: []string{"registry.corp/alpine:3", "docker.io/library/alpine:3"}},
+		{name: "myapp", mode: shortNameModeDisabled, expect: []string{"registry.corp/myapp:latest", "docker.io/library/myapp:latest"}},
+		{name: "alpine:3", mode: shortNameModeEnforcing, err: ErrShortNameAmbiguous},
+		{name: "docker.io/alpine:3", mode: shortNameModeEnforcing, expect: []string{"docker.io/library/alpine:3"}},
+		{name: "localhost/app", mode: shortNameModeEnforcing, expect: []string{"localhost/app:latest"}},
+		{name: "registry.corp:5000/app", mode: shortNameModeEnforcing, expect: []string{"registry.corp:5000/app:latest"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode+" "+tt.name, func(t *testing.T) {
+			rc.ShortNameMode = tt.mode
+			rs, err := rc.resolve(tt.name)
+			if tt.err != nil {
+				require.ErrorIs(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			names := []string{}
+			for _, r := range rs {
+				names = append(names, r.CommonName())
+			}
+			require.Equal(t, tt.expect, names)
+		})
+	}
+
+	// without search registries short names stay on Docker Hub
+	rs, err := (&RegistriesConf{ShortNameMode: shortNameModeEnforcing}).resolve("alpine")
+	require.NoError(t, err)
+	require.Equal(t, "docker.io/library/alpine:latest", rs[0].CommonName())
+
+	// the mode from the flag is validated
+	_, err = cobraTest(t, "manifest", "head", "--short-name-mode", "strict", "registry.corp/app")
+	require.ErrorIs(t, err, ErrInvalidInput)
+	require.NoError(t, os.WriteFile(filename, []byte("[aliases]\n\"myapp\" = \"team/myapp\"\n"), 0600))
+	_, err = RegistriesConfLoadFile(filename)
+	require.ErrorIs(t, err, ErrInvalidInput)
+}
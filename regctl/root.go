@@ -0,0 +1,153 @@
+package regctl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/mheers/docker-image-squash/squash"
+	"github.com/regclient/regclient/pkg/template"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var rootCmd = &cobra.Command{
+	Use:           "docker-image-squash <cmd>",
+	Short:         "Squash all layers of a container image into a single tar file",
+	Long:          usageDesc,
+	SilenceUsage:  true,
+	SilenceErrors: true,
+}
+
+var versionCmd = &cobra.Command{
+	Use:   "version",
+	Short: "Show the version",
+	Long:  `Show the version`,
+	Args:  cobra.ExactArgs(0),
+	RunE:  runVersion,
+}
+
+// Info describes the build of the binary, the main package sets it from linker flags
+type Info struct {
+	Version   string
+	BuildTime string
+	GitTag    string
+	GitBranch string
+}
+
+var versionInfo Info
+
+func init() {
+	rootCmd.PersistentFlags().StringVarP(&rootOpts.config, "config", "", "", "Config file (default $XDG_CONFIG_HOME/docker-image-squash/config.json)")
+	rootCmd.PersistentFlags().StringVarP(&rootOpts.verbosity, "verbosity", "v", logrus.WarnLevel.String(), "Log level (debug, info, warn, error, fatal, panic)")
+	rootCmd.PersistentFlags().StringArrayVar(&rootOpts.logopts, "logopt", []string{}, "Log options")
+	rootCmd.PersistentFlags().StringVarP(&rootOpts.logFormat, "log-format", "", logFormatText, "Log format (text, json)")
+	rootCmd.PersistentFlags().StringVarP(&rootOpts.format, "format", "", "{{printPretty .}}", "Format output with go template syntax")
+	rootCmd.PersistentFlags().StringVarP(&rootOpts.userAgent, "user-agent", "", "", "Override user agent")
+	rootCmd.PersistentFlags().DurationVarP(&rootOpts.timeout, "timeout", "", 0, "Cancel the command after this duration (e.g. 30m), 0 to disable")
+	rootCmd.PersistentFlags().DurationVarP(&rootOpts.blobIdleTimeout, "blob-idle-timeout", "", 5*time.Minute, "Resume a layer download when no data is received for this duration, 0 to disable")
+	rootCmd.PersistentFlags().IntVarP(&rootOpts.retries, "retries", "", squash.DefaultRetries, "Retries of failed manifest requests and layer downloads, 0 to disable")
+	rootCmd.PersistentFlags().DurationVarP(&rootOpts.retryBackoff, "retry-backoff", "", squash.DefaultRetryBackoff, "Delay before the first retry, doubled for each retry")
+	rootCmd.PersistentFlags().DurationVarP(&rootOpts.retryMaxBackoff, "retry-max-backoff", "", squash.DefaultRetryMaxBackoff, "Maximum delay between retries")
+
+	rootCmd.PersistentFlags().StringArrayVar(&rootOpts.insecureRegistries, "insecure-registry", []string{}, "Registry accessed with plain http, repeat for multiple registries")
+	rootCmd.PersistentFlags().StringArrayVar(&rootOpts.registryCA, "registry-ca", []string{}, "CA bundle for a registry as host=file, repeat for multiple registries")
+	rootCmd.PersistentFlags().StringArrayVar(&rootOpts.registryCert, "registry-cert", []string{}, "Client certificate for a registry as host=file")
+	rootCmd.PersistentFlags().StringArrayVar(&rootOpts.registryKey, "registry-key", []string{}, "Client key for a registry as host=file")
+
+	rootCmd.PersistentFlags().StringVarP(&rootOpts.registriesConf, "registries-conf", "", "", "Registries config with mirrors and prefix rewrites (default $XDG_CONFIG_HOME/docker-image-squash/registries.conf)")
+	rootCmd.PersistentFlags().StringVarP(&rootOpts.shortNameMode, "short-name-mode", "", "", "Override the short-name-mode of the registries config (enforcing, permissive, disabled)")
+
+	rootCmd.RegisterFlagCompletionFunc("verbosity", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return []string{"debug", "info", "warn", "error", "fatal", "panic"}, cobra.ShellCompDirectiveNoFileComp
+	})
+	rootCmd.RegisterFlagCompletionFunc("logopt", completeArgNone)
+	rootCmd.RegisterFlagCompletionFunc("log-format", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return []string{logFormatText, logFormatJSON}, cobra.ShellCompDirectiveNoFileComp
+	})
+	rootCmd.RegisterFlagCompletionFunc("short-name-mode", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return []string{"enforcing", "permissive", "disabled"}, cobra.ShellCompDirectiveNoFileComp
+	})
+	rootCmd.RegisterFlagCompletionFunc("format", completeArgNone)
+
+	rootCmd.PersistentPreRunE = rootPreRun
+	rootCmd.AddCommand(versionCmd)
+}
+
+// SetVersion sets the build information shown by the version command and sent in the user agent
+func SetVersion(info Info) {
+	versionInfo = info
+}
+
+// Execute runs the command line with the given arguments, cancelling ctx stops the command
+func Execute(ctx context.Context, args []string) error {
+	// "docker-image-squash <image> <output.tar>" is a deprecated shortcut for the squash command,
+	// it is rewritten so the flags of squash are available
+	rootCmd.InitDefaultHelpCmd()
+	if len(args) > 0 && args[0] != cobra.ShellCompRequestCmd && args[0] != cobra.ShellCompNoDescRequestCmd {
+		if cmd, _, err := rootCmd.Find(args); err != nil && cmd == rootCmd {
+			args = append([]string{squashCmd.Name()}, args...)
+			squashShortcut = true
+			defer func() { squashShortcut = false }()
+		}
+	}
+	rootCmd.SetArgs(args)
+	cmd, err := rootCmd.ExecuteContextC(ctx)
+	if cmd != nil {
+		// cobra only passes the context to commands without one, reset it for the next Execute
+		cmd.SetContext(nil)
+	}
+	if rootCancel != nil {
+		rootCancel()
+		rootCancel = nil
+	}
+	if errors.Is(err, context.DeadlineExceeded) && rootOpts.timeout > 0 {
+		return fmt.Errorf("timeout of %s reached: %w", rootOpts.timeout, err)
+	}
+	return err
+}
+
+func rootPreRun(cmd *cobra.Command, args []string) error {
+	lvl, err := logrus.ParseLevel(rootOpts.verbosity)
+	if err != nil {
+		return err
+	}
+	if rootOpts.timeout > 0 {
+		ctx, cancel := context.WithTimeout(cmd.Context(), rootOpts.timeout)
+		rootCancel = cancel
+		cmd.SetContext(ctx)
+	}
+	formatter, err := logFormatter(rootOpts.logFormat, rootOpts.logopts)
+	if err != nil {
+		return err
+	}
+	// a logger injected with SetLogger keeps its own level and format
+	if log == cliLog {
+		log.SetLevel(lvl)
+		log.SetFormatter(formatter)
+	}
+	if rootOpts.retries < 0 {
+		return fmt.Errorf("%w: --retries must not be negative", ErrInvalidInput)
+	}
+	if _, err := ConfigLoadDefault(); err != nil {
+		return err
+	}
+	if _, err := RegistriesConfLoadDefault(); err != nil {
+		return err
+	}
+	flags, err := tlsFlags()
+	if err != nil {
+		return err
+	}
+	for host, ht := range flags {
+		if (ht.ClientCert == "") != (ht.ClientKey == "") {
+			return fmt.Errorf("%w: --registry-cert and --registry-key must both be set for %s", ErrMissingInput, host)
+		}
+	}
+	return nil
+}
+
+func runVersion(cmd *cobra.Command, args []string) error {
+	return template.Writer(cmd.OutOrStdout(), rootOpts.format, versionInfo)
+}
@@ -0,0 +1,114 @@
+package regctl
+
+import (
+	"crypto"
+	"fmt"
+	"os"
+
+	"github.com/mheers/docker-image-squash/sign"
+	"github.com/regclient/regclient"
+	"github.com/regclient/regclient/types/ref"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+)
+
+// signPasswordEnv is the password of an encrypted signing key, the variable of cosign
+const signPasswordEnv = "COSIGN_PASSWORD"
+
+var verifySignatureCmd = &cobra.Command{
+	Use:   "verify-signature <image_ref>",
+	Short: "verify the cosign signature of an image",
+	Long: `Verifies that the image has a cosign signature of its manifest digest made
+with the private key of one of the --key public keys, in the sha256-<hex>.sig
+tag or as an OCI referrer, like "squash --sign-key" pushes it. The verified
+signatures are listed. Only local keys are supported, there is no transparency
+log or keyless verification.`,
+	Args:              cobra.ExactArgs(1),
+	ValidArgsFunction: completeArgList([]completeFunc{completeArgTag}),
+	RunE:              runVerifySignature,
+}
+
+var verifySignatureOpts struct {
+	keys []string
+}
+
+func init() {
+	verifySignatureCmd.Flags().StringArrayVarP(&verifySignatureOpts.keys, "key", "", nil, "Public key file (e.g. cosign.pub), repeat for several keys")
+	verifySignatureCmd.MarkFlagRequired("key")
+
+	rootCmd.AddCommand(verifySignatureCmd)
+}
+
+func runVerifySignature(cmd *cobra.Command, args []string) error {
+	ctx := cmd.Context()
+	img, err := imageSourceNew(args[0])
+	if err != nil {
+		return err
+	}
+	keys := []crypto.PublicKey{}
+	for _, file := range verifySignatureOpts.keys {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		key, err := sign.LoadPublicKey(b)
+		if err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+		keys = append(keys, key)
+	}
+	rc := img.rc
+	defer rc.Close(ctx, img.ref)
+
+	// the signatures are next to the image at the endpoint it is pulled from,
+	// they sign the name of the image and not the location of a mirror
+	var sigs []sign.Signature
+	err = img.try(func(ep ref.Ref) error {
+		m, err := rc.ManifestHead(ctx, ep, regclient.WithManifestRequireDigest())
+		if err != nil {
+			return err
+		}
+		sigs, err = sign.VerifyMirror(ctx, rc, ep, img.name(ep), m.GetDescriptor().Digest, keys)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	for _, s := range sigs {
+		log.WithFields(logrus.Fields{
+			"signature": s.Ref,
+			"key":       verifySignatureOpts.keys[s.Key],
+		}).Debug("Verified signature")
+		fmt.Fprintf(cmd.OutOrStdout(), "%s@%s signed with %s in %s\n", s.Payload.Critical.Identity.DockerReference,
+			s.Payload.Critical.Image.DockerManifestDigest, verifySignatureOpts.keys[s.Key], s.Ref)
+	}
+	return nil
+}
+
+// loadSignKey reads the private key of --sign-key, the password of an encrypted key
+// is read from COSIGN_PASSWORD or else prompted for
+func loadSignKey(cmd *cobra.Command, file string) (crypto.Signer, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var pass []byte
+	if sign.IsEncrypted(b) {
+		if p, ok := os.LookupEnv(signPasswordEnv); ok {
+			pass = []byte(p)
+		} else {
+			fmt.Fprintf(cmd.ErrOrStderr(), "Enter password for %s: ", file)
+			pass, err = term.ReadPassword(int(os.Stdin.Fd()))
+			fmt.Fprint(cmd.ErrOrStderr(), "\n")
+			if err != nil {
+				return nil, fmt.Errorf("unable to read from tty (resolve by setting %s): %w", signPasswordEnv, err)
+			}
+		}
+	}
+	key, err := sign.LoadPrivateKey(b, pass)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	return key, nil
+}
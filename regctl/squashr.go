@@ -1,92 +1,458 @@
 package regctl
 
 import (
+	"bytes"
 	"context"
+	"crypto"
+	"errors"
 	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
-	"github.com/mheers/docker-image-squash/helpers"
-	"github.com/regclient/regclient"
-	"github.com/regclient/regclient/types/manifest"
-	"github.com/regclient/regclient/types/platform"
+	"github.com/mheers/docker-image-squash/provenance"
+	"github.com/mheers/docker-image-squash/sbom"
+	"github.com/mheers/docker-image-squash/sign"
+	"github.com/mheers/docker-image-squash/squash"
 	"github.com/regclient/regclient/types/ref"
 	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
 )
 
-func Squash(image, outputDir string) error {
-	ctx := context.Background()
-	r, err := ref.New(image)
+var squashCmd = &cobra.Command{
+	Use:   "squash <image_ref> [<output.tar>]",
+	Short: "squash all layers of an image into a single tar file",
+	Long: `Pulls every layer of the image and merges them into a single tar file
+containing the final filesystem. Only registry access is needed, no docker
+daemon and no root privileges.
+
+With --output-format squashfs the filesystem is written as a squashfs image
+instead, including directories, symlinks, hardlinks, devices and xattrs,
+without mksquashfs. --output-format ext4 writes an ext4 image the same way,
+without mkfs.ext4 or a loop mount, sized to the content or to --size.
+--init-shim adds an /sbin/init that runs the Entrypoint and Cmd of the image,
+e.g. to boot it as the root disk of a microVM. --output-format cpio writes a
+newc archive for an initramfs, with such a script as /init.
+--output-format lxc writes the unified tarball of an LXC or Incus image,
+metadata.yaml and templates for the hostname and hosts besides rootfs/,
+for "lxc image import".
+
+--push pushes an image with the squashed filesystem as its single layer and
+the config of the source to a registry instead of writing a file. The layer
+keeps all entry types and is compressed with gzip, zstd, or as estargz or
+zstd:chunked, which snapshotters can pull lazily file by file. --sign-key
+signs the pushed manifest with a local ECDSA or ed25519 key of "cosign
+generate-key-pair", the password of an encrypted key is read from
+COSIGN_PASSWORD or prompted for. The signature is pushed to the
+sha256-<hex>.sig tag of cosign, as an OCI referrer, or both with --sign-mode,
+and checked with "verify-signature".
+
+--policy only squashes a source signed with a trusted key: the policy file
+lists the public keys per registry/repository pattern, e.g.
+
+  rules:
+    - match: registry.example.com/team/*
+      keys: [build.pub]
+
+and the source needs a cosign signature of its digest or of the selected
+platform manifest by a key of the first matching rule, in the .sig tag or as
+a referrer. Other sources are refused before their layers are pulled.
+
+--provenance writes an in-toto statement with SLSA provenance that links the
+source ref and digest, the resolved platform, the options and the version to
+the digest of the output file or of the pushed manifest. With --push it is
+attached to the pushed image as an OCI referrer as well.`,
+	Args:              cobra.RangeArgs(1, 2),
+	ValidArgsFunction: completeArgList([]completeFunc{completeArgTag, completeArgDefault}),
+	RunE:              runSquash,
+}
+
+var squashOpts struct {
+	platform    string
+	format      string
+	compression string
+	size        string
+	initShim    bool
+	sbomFile    string
+	sbomFormat  string
+	sbomAttach  string
+	push        string
+	signKey     string
+	signMode    string
+	policy      string
+	provenance  string
+	progress    string
+	workDir     string
+	spill       string
+	memoryMax   string
+	hives       string
+	limits      struct {
+		size, fileSize string
+		entries        int
+		depth          int
+		ratio          float64
+		noSpaceCheck   bool
+	}
+}
+
+func init() {
+	squashCmd.Flags().StringVarP(&squashOpts.platform, "platform", "p", "", "Specify platform (e.g. linux/amd64 or local)")
+	squashCmd.Flags().StringVarP(&squashOpts.format, "output-format", "", squash.FormatTar, "Output format (tar, squashfs, ext4, cpio, lxc)")
+	squashCmd.Flags().StringVarP(&squashOpts.compression, "compression", "", "", "Output compression, none or gzip for a tar (default none), none, gzip or zstd for squashfs, cpio and lxc (default gzip), none for ext4, gzip (default), zstd, estargz or zstd:chunked for --push")
+	squashCmd.Flags().StringVarP(&squashOpts.size, "size", "", sizeAuto, "Size of an ext4 image (e.g. 2GiB), auto fits the content with 20% free space")
+	squashCmd.Flags().BoolVarP(&squashOpts.initShim, "init-shim", "", false, "Add an /sbin/init to an ext4 image that runs the Entrypoint and Cmd of the image, a cpio archive always has it as /init")
+	squashCmd.Flags().StringVarP(&squashOpts.push, "push", "", "", "Push the squashed image with a single layer to this ref instead of writing an output file")
+	squashCmd.Flags().StringVarP(&squashOpts.signKey, "sign-key", "", "", "Sign the image of --push with this cosign private key file (e.g. cosign.key)")
+	squashCmd.Flags().StringVarP(&squashOpts.signMode, "sign-mode", "", sign.ModeTag, "Where the signature is pushed: tag (sha256-<hex>.sig), referrer, or both")
+	squashCmd.Flags().StringVarP(&squashOpts.policy, "policy", "", "", "Policy file with the public keys trusted per repository, the source must have a valid signature before its layers are pulled")
+	squashCmd.Flags().StringVarP(&squashOpts.provenance, "provenance", "", "", "Write an in-toto SLSA provenance statement of the squash to this file, attached to the image of --push as an OCI referrer")
+	squashCmd.Flags().StringVarP(&squashOpts.sbomFile, "sbom", "", "", "Write an SBOM of the squashed filesystem to this file")
+	squashCmd.Flags().StringVarP(&squashOpts.sbomFormat, "sbom-format", "", sbom.FormatSPDX, "SBOM format (spdx, cyclonedx)")
+	squashCmd.Flags().StringVarP(&squashOpts.sbomAttach, "sbom-attach", "", "", "Attach the SBOM as an OCI referrer to this pushed image, defaults to the image of --push")
+	squashCmd.Flags().StringVarP(&squashOpts.progress, "progress", "", progressAuto, "Progress output on stderr (auto, bar, json, none), auto draws bars on a TTY and writes JSON events otherwise")
+	squashCmd.Flags().StringVarP(&squashOpts.workDir, "work-dir", "", "", "Directory for the extracted layers or the scratch file, defaults to $TMPDIR or /tmp")
+	squashCmd.Flags().StringVarP(&squashOpts.spill, "spill", "", squash.SpillAuto, "Where the merged filesystem is kept: disk (extracted to the work dir), index (files in a scratch file in the work dir, index in memory), memory, or auto (memory for small images, otherwise disk)")
+	squashCmd.Flags().StringVarP(&squashOpts.memoryMax, "spill-memory-max", "", formatSize(squash.DefaultMemoryMax), "Largest estimated image size that --spill auto keeps in memory")
+	squashCmd.Flags().BoolVarP(&imageOpts.includeExternal, "include-external", "", false, "Include external layers, e.g. the base layers of Windows images, pulled from the registry or else from their URLs")
+	squashCmd.Flags().StringVarP(&squashOpts.hives, "windows-hives", "", squash.HivesKeep, "Registry hives of Windows images: keep (fails when layers change the same hive), drop, or reject")
+	squashCmd.Flags().StringVarP(&squashOpts.limits.size, "limit-size", "", formatSize(squash.DefaultLimits.MaxBytes), "Abort when the files of all layers exceed this size (e.g. 500MiB, 2GB), 0 disables the limit")
+	squashCmd.Flags().StringVarP(&squashOpts.limits.fileSize, "limit-file-size", "", formatSize(squash.DefaultLimits.MaxFileSize), "Abort when a single file exceeds this size, 0 disables the limit")
+	squashCmd.Flags().IntVarP(&squashOpts.limits.entries, "limit-entries", "", squash.DefaultLimits.MaxEntries, "Abort when a layer has more entries, 0 disables the limit")
+	squashCmd.Flags().IntVarP(&squashOpts.limits.depth, "limit-depth", "", squash.DefaultLimits.MaxDepth, "Abort when a path has more components, 0 disables the limit")
+	squashCmd.Flags().Float64VarP(&squashOpts.limits.ratio, "limit-ratio", "", squash.DefaultLimits.MaxRatio, "Abort when a layer decompresses to more than this multiple of its size, 0 disables the limit")
+	squashCmd.Flags().BoolVarP(&squashOpts.limits.noSpaceCheck, "no-space-check", "", false, "Skip the check of the free space in the temporary and output directory")
+	squashCmd.RegisterFlagCompletionFunc("platform", completeArgPlatform)
+	squashCmd.RegisterFlagCompletionFunc("progress", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return []string{progressAuto, progressBar, progressJSON, progressNone}, cobra.ShellCompDirectiveNoFileComp
+	})
+	squashCmd.RegisterFlagCompletionFunc("output-format", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return []string{squash.FormatTar, squash.FormatSquashfs, squash.FormatExt4, squash.FormatCpio, squash.FormatLXC}, cobra.ShellCompDirectiveNoFileComp
+	})
+	squashCmd.RegisterFlagCompletionFunc("size", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return []string{sizeAuto}, cobra.ShellCompDirectiveNoFileComp
+	})
+	squashCmd.RegisterFlagCompletionFunc("compression", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return []string{squash.CompressionNone, squash.CompressionGzip, squash.CompressionZstd, squash.CompressionEStargz, squash.CompressionZstdChunked}, cobra.ShellCompDirectiveNoFileComp
+	})
+	squashCmd.RegisterFlagCompletionFunc("sbom-format", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return []string{sbom.FormatSPDX, sbom.FormatCycloneDX}, cobra.ShellCompDirectiveNoFileComp
+	})
+	squashCmd.RegisterFlagCompletionFunc("sbom-attach", completeArgTag)
+	squashCmd.RegisterFlagCompletionFunc("push", completeArgTag)
+	squashCmd.RegisterFlagCompletionFunc("sign-mode", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return []string{sign.ModeTag, sign.ModeReferrer, sign.ModeBoth}, cobra.ShellCompDirectiveNoFileComp
+	})
+	squashCmd.RegisterFlagCompletionFunc("spill", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return []string{squash.SpillAuto, squash.SpillDisk, squash.SpillIndex, squash.SpillMemory}, cobra.ShellCompDirectiveNoFileComp
+	})
+	squashCmd.RegisterFlagCompletionFunc("windows-hives", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return []string{squash.HivesKeep, squash.HivesDrop, squash.HivesReject}, cobra.ShellCompDirectiveNoFileComp
+	})
+	squashCmd.RegisterFlagCompletionFunc("work-dir", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return nil, cobra.ShellCompDirectiveFilterDirs
+	})
+
+	rootCmd.AddCommand(squashCmd)
+}
+
+func runSquash(cmd *cobra.Command, args []string) (err error) {
+	ctx := cmd.Context()
+	if squashShortcut {
+		log.Warn(`"docker-image-squash <image> <output.tar>" is deprecated, use "docker-image-squash squash <image> <output.tar>"`)
+	}
+	image := args[0]
+	output := ""
+	if len(args) > 1 {
+		output = args[1]
+	}
+	switch {
+	case squashOpts.push == "" && output == "":
+		return fmt.Errorf("%w: an output file or --push is needed", ErrInvalidInput)
+	case squashOpts.push != "" && output != "":
+		return fmt.Errorf("%w: --push replaces the output file", ErrInvalidInput)
+	case squashOpts.push != "" && squashOpts.format != squash.FormatTar:
+		return fmt.Errorf("%w: --push writes an image layer, not a %s output", ErrInvalidInput, squashOpts.format)
+	case squashOpts.signKey != "" && squashOpts.push == "":
+		return fmt.Errorf("%w: --sign-key signs the image of --push", ErrInvalidInput)
+	case squashOpts.sbomAttach != "" && squashOpts.sbomFile == "":
+		return fmt.Errorf("%w: --sbom-attach attaches the SBOM of --sbom", ErrInvalidInput)
+	case squashOpts.signMode != sign.ModeTag && squashOpts.signMode != sign.ModeReferrer && squashOpts.signMode != sign.ModeBoth:
+		return fmt.Errorf("%w: --sign-mode %q, use %s, %s or %s", ErrInvalidInput, squashOpts.signMode, sign.ModeTag, sign.ModeReferrer, sign.ModeBoth)
+	}
+	started := time.Now()
+	mode, err := progressMode(squashOpts.progress, cmd.ErrOrStderr())
+	if err != nil {
+		return err
+	}
+	img, err := imageSourceNew(image)
 	if err != nil {
 		return err
 	}
+	opts, err := squashOptions(img)
+	if err != nil {
+		return err
+	}
+	if p := newProgress(cmd.ErrOrStderr(), mode, image); p != nil {
+		defer p.close()
+		opts.Progress = p
+	}
+	// the layer history is gone after squashing, so describe the final filesystem
+	if squashOpts.sbomFile != "" {
+		opts.Inspect = func(ctx context.Context, dir string) error {
+			err := writeSBOM(image, dir, squashOpts.sbomFile, squashOpts.sbomFormat)
+			if err != nil {
+				os.Remove(squashOpts.sbomFile)
+			}
+			return err
+		}
+	}
+	if squashOpts.push != "" {
+		// a wrong password fails before the image is pulled
+		var key crypto.Signer
+		if squashOpts.signKey != "" {
+			if key, err = loadSignKey(cmd, squashOpts.signKey); err != nil {
+				return err
+			}
+		}
+		return pushSquash(ctx, img, opts, key, started)
+	}
 
-	rc := newRegClient()
-	defer rc.Close(ctx, r)
+	// the output is written next to the extracted filesystem
+	opts.SpaceDirs = []string{filepath.Dir(output)}
 
-	// make it recursive for index of index scenarios
-	m, err := rc.ManifestGet(ctx, r)
+	// a partial output is removed, e.g. on errors and cancellation
+	f, err := os.Create(output)
 	if err != nil {
 		return err
 	}
-	if m.IsList() {
-		if imageOpts.platform == "" {
-			imageOpts.platform = "local"
-		}
-		plat, err := platform.Parse(imageOpts.platform)
+	defer func() {
+		f.Close()
 		if err != nil {
-			log.WithFields(logrus.Fields{
-				"platform": imageOpts.platform,
-				"err":      err,
-			}).Warn("Could not parse platform")
+			os.Remove(output)
 		}
-		desc, err := manifest.GetPlatformDesc(m, &plat)
-		if err != nil {
-			pl, _ := manifest.GetPlatformList(m)
-			var ps []string
-			for _, p := range pl {
-				ps = append(ps, p.String())
-			}
-			log.WithFields(logrus.Fields{
-				"platform":  plat,
-				"err":       err,
-				"platforms": strings.Join(ps, ", "),
-			}).Warn("Platform could not be found in manifest list")
-			return err
+	}()
+	res, err := squash.Squash(ctx, img.ref.CommonName(), f, opts)
+	if err != nil {
+		return credsError(img.endpoint(), err)
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if _, err := writeProvenance(res, opts, filepath.Base(output), started); err != nil {
+		return err
+	}
+
+	return attachSBOM(squashOpts.sbomAttach)
+}
+
+// pushSquash pushes the squashed image to the ref of --push, signs it with key if set and attaches the provenance and the SBOM to it
+func pushSquash(ctx context.Context, img *imageSource, opts squash.Options, key crypto.Signer, started time.Time) error {
+	target, err := imageTargetNew(squashOpts.push)
+	if err != nil {
+		return fmt.Errorf("%w: --push %q: %w", ErrInvalidInput, squashOpts.push, err)
+	}
+	// the hosts of the source and the target
+	opts.RegClient = newRegClient(append(append([]ref.Ref{}, img.endpoints...), target)...)
+	res, err := squash.Push(ctx, img.ref.CommonName(), target.CommonName(), opts)
+	if errors.Is(err, squash.ErrPush) {
+		return credsError(target, err)
+	} else if err != nil {
+		return credsError(img.endpoint(), err)
+	}
+	target.Digest = res.Pushed.Digest.String()
+	if key != nil {
+		if err := sign.SignImage(ctx, opts.RegClient, target, key, squashOpts.signMode); err != nil {
+			return credsError(target, err)
 		}
-		m, err = rc.ManifestGet(ctx, r, regclient.WithManifestDesc(*desc))
+		log.WithFields(logrus.Fields{
+			"image": target.CommonName(),
+			"mode":  squashOpts.signMode,
+		}).Info("Signed image")
+	}
+	data, err := writeProvenance(res, opts, "", started)
+	if err != nil {
+		return err
+	}
+	if data != nil {
+		_, err := artifactPut(ctx, opts.RegClient, target, provenance.MediaType, provenance.MediaType, data, map[string]string{
+			ociAnnotTitle:                      filepath.Base(squashOpts.provenance),
+			provenance.AnnotationPredicateType: provenance.PredicateType,
+		})
 		if err != nil {
-			return fmt.Errorf("failed to pull platform specific digest: %w", err)
+			return credsError(target, err)
 		}
 	}
-	// go through layers in reverse
-	mi, ok := m.(manifest.Imager)
-	if !ok {
-		return fmt.Errorf("reference is not a known image media type")
+	subject := squashOpts.sbomAttach
+	if subject == "" {
+		subject = target.CommonName()
 	}
-	layers, err := mi.GetLayers()
+	return attachSBOM(subject)
+}
+
+// writeProvenance writes the provenance of the squash to the file of --provenance and returns it, nil without the flag
+func writeProvenance(res *squash.Result, opts squash.Options, output string, started time.Time) ([]byte, error) {
+	if squashOpts.provenance == "" {
+		return nil, nil
+	}
+	buf := &bytes.Buffer{}
+	err := provenance.Write(buf, provenance.New(provenance.Build{
+		Result:   res,
+		Options:  opts,
+		Output:   output,
+		Version:  versionInfo.Version,
+		Started:  started,
+		Finished: time.Now(),
+	}))
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(squashOpts.provenance, buf.Bytes(), 0644); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// attachSBOM attaches the SBOM of --sbom to the subject, if both are set
+func attachSBOM(subject string) error {
+	if squashOpts.sbomFile == "" || subject == "" {
+		return nil
+	}
+	mt, err := sbom.MediaType(squashOpts.sbomFormat)
 	if err != nil {
 		return err
 	}
+	return AttachSBOM(subject, squashOpts.sbomFile, mt)
+}
 
-	for i, layer := range layers {
-		blob, err := rc.BlobGet(ctx, r, layer)
-		if err != nil {
-			return fmt.Errorf("failed pulling layer %d: %w", i, err)
-		}
-		btr, err := blob.ToTarReader()
-		if err != nil {
-			return fmt.Errorf("could not convert layer %d to tar reader: %w", i, err)
+func writeSBOM(image, rootDir, file, format string) error {
+	pkgs, err := sbom.Scan(rootDir)
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return sbom.Write(f, format, sbom.Document{
+		Name:     image,
+		Packages: pkgs,
+	})
+}
+
+// squashOptions returns the options of the squash package for the flags and config of the cli
+func squashOptions(img *imageSource) (squash.Options, error) {
+	opts := img.options()
+	opts.Platform = squashOpts.platform
+	opts.Format = squashOpts.format
+	opts.Compression = squashOpts.compression
+	opts.InitShim = squashOpts.initShim
+	opts.WorkDir = squashOpts.workDir
+	opts.Spill = squashOpts.spill
+	opts.IncludeExternal = imageOpts.includeExternal
+	opts.WindowsHives = squashOpts.hives
+	memoryMax, err := parseSize(squashOpts.memoryMax)
+	if err != nil {
+		return opts, err
+	}
+	opts.MemoryMax = memoryMax
+	if squashOpts.size != sizeAuto {
+		if opts.Size, err = parseSize(squashOpts.size); err != nil {
+			return opts, err
 		}
-		tr, err := btr.GetTarReader()
-		if err != nil {
-			return fmt.Errorf("could not get tar reader for layer %d: %w", i, err)
+	}
+	limits, err := squashLimits()
+	if err != nil {
+		return opts, err
+	}
+	opts.Limits = limits
+	if squashOpts.policy != "" {
+		if opts.Policy, err = sign.LoadPolicy(squashOpts.policy); err != nil {
+			return opts, err
 		}
+	}
+	return opts, nil
+}
+
+// squashLimits returns the limits of the flags, negative values are rejected
+func squashLimits() (*squash.Limits, error) {
+	l := &squash.Limits{
+		MaxEntries: squashOpts.limits.entries,
+		MaxDepth:   squashOpts.limits.depth,
+		MaxRatio:   squashOpts.limits.ratio,
+		SpaceCheck: !squashOpts.limits.noSpaceCheck,
+	}
+	var err error
+	if l.MaxBytes, err = parseSize(squashOpts.limits.size); err != nil {
+		return nil, err
+	}
+	if l.MaxFileSize, err = parseSize(squashOpts.limits.fileSize); err != nil {
+		return nil, err
+	}
+	if l.MaxEntries < 0 || l.MaxDepth < 0 || l.MaxRatio < 0 {
+		return nil, fmt.Errorf("%w: limits must not be negative", ErrInvalidInput)
+	}
+	return l, nil
+}
+
+// sizeAuto sizes an image to its content
+const sizeAuto = "auto"
+
+var sizeUnits = []struct {
+	suffix string
+	n      int64
+}{
+	// longest suffix first
+	{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30}, {"TiB", 1 << 40},
+	{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"TB", 1e12},
+	{"K", 1 << 10}, {"M", 1 << 20}, {"G", 1 << 30}, {"T", 1 << 40},
+	{"B", 1},
+}
 
-		if err := helpers.UntarTarReader(tr, outputDir); err != nil {
-			return fmt.Errorf("failed squashing layer %d: %w", i, err)
+// parseSize parses a size in bytes with an optional unit, e.g. 512, 100MB or 64GiB
+func parseSize(s string) (int64, error) {
+	num, mult := strings.TrimSpace(s), int64(1)
+	for _, u := range sizeUnits {
+		if strings.HasSuffix(strings.ToUpper(num), strings.ToUpper(u.suffix)) {
+			num, mult = strings.TrimSpace(num[:len(num)-len(u.suffix)]), u.n
+			break
 		}
+	}
+	f, err := strconv.ParseFloat(num, 64)
+	if err != nil || f < 0 || f*float64(mult) > math.MaxInt64 {
+		return 0, fmt.Errorf("%w: size %q, use a number of bytes with an optional unit like 500MiB or 2GB", ErrInvalidInput, s)
+	}
+	return int64(f * float64(mult)), nil
+}
 
+// formatSize returns n with the largest binary unit that divides it
+func formatSize(n int64) string {
+	for i := 3; i >= 0; i-- {
+		u := sizeUnits[i]
+		if n != 0 && n%u.n == 0 {
+			return strconv.FormatInt(n/u.n, 10) + u.suffix
+		}
 	}
+	return strconv.FormatInt(n, 10)
+}
 
+// Squash merges the layers of image into outputDir with the config of the cli, cancelling ctx stops the layer downloads.
+//
+// Deprecated: use squash.SquashDir, it does not depend on the state of this package and is safe for concurrent use.
+func Squash(ctx context.Context, image, outputDir string) error {
+	img, err := imageSourceNew(image)
+	if err != nil {
+		return err
+	}
+	opts, err := squashOptions(img)
+	if err != nil {
+		return err
+	}
+	if _, err := squash.SquashDir(ctx, img.ref.CommonName(), outputDir, opts); err != nil {
+		return credsError(img.endpoint(), err)
+	}
 	return nil
 }
@@ -1,12 +1,343 @@
 package regctl
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
+	"github.com/mheers/docker-image-squash/chunked"
+	"github.com/mheers/docker-image-squash/provenance"
+	"github.com/mheers/docker-image-squash/sign"
+	"github.com/mheers/docker-image-squash/squash"
+	"github.com/opencontainers/go-digest"
+	"github.com/regclient/regclient"
+	"github.com/regclient/regclient/scheme"
+	"github.com/regclient/regclient/types"
+	"github.com/regclient/regclient/types/manifest"
+	"github.com/regclient/regclient/types/ref"
 	"github.com/stretchr/testify/require"
 )
 
 func TestSquash(t *testing.T) {
-	err := Squash("mheers/test", "test.tar")
+	err := Squash(context.Background(), "mheers/test", "test.tar")
 	require.NoError(t, err)
 }
+
+func TestParseSize(t *testing.T) {
+	for s, n := range map[string]int64{"0": 0, "512": 512, "100MB": 100e6, "64GiB": 64 << 30, "1.5k": 1536, "2 gb": 2e9, "10B": 10} {
+		got, err := parseSize(s)
+		require.NoError(t, err, s)
+		require.Equal(t, n, got, s)
+	}
+	for _, s := range []string{"", "-1", "ten", "1PB", "1e30GB"} {
+		_, err := parseSize(s)
+		require.ErrorIs(t, err, ErrInvalidInput, s)
+	}
+	require.Equal(t, "64GiB", formatSize(64<<30))
+	require.Equal(t, "1000", formatSize(1000))
+	require.Equal(t, "0", formatSize(0))
+}
+
+func TestSquashSpill(t *testing.T) {
+	t.Setenv(ConfigEnv, filepath.Join(t.TempDir(), "config.json"))
+	layer := testGzipLayer(t, map[string]string{"etc/hello": "hello world\n"})
+	srv := httptest.NewServer(testRegistry(layer))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	for _, spill := range []string{"disk", "index", "memory", "auto"} {
+		workDir := t.TempDir()
+		out := filepath.Join(t.TempDir(), "out.tar")
+		_, err := cobraTest(t, "squash", "--insecure-registry", host, "--progress", "none", "--work-dir", workDir, "--spill", spill, host+"/test/app:latest", out)
+		require.NoError(t, err, spill)
+		require.FileExists(t, out)
+		entries, err := os.ReadDir(workDir)
+		require.NoError(t, err)
+		require.Empty(t, entries, spill)
+	}
+
+	out := filepath.Join(t.TempDir(), "out.tar")
+	_, err := cobraTest(t, "squash", "--spill", "tmpfs", host+"/test/app:latest", out)
+	require.ErrorIs(t, err, squash.ErrInvalidOption)
+	_, err = cobraTest(t, "squash", "--spill", "disk", "--output-format", "squashfs", host+"/test/app:latest", out)
+	require.ErrorIs(t, err, squash.ErrInvalidOption)
+}
+
+func TestSquashShortcut(t *testing.T) {
+	t.Setenv(ConfigEnv, filepath.Join(t.TempDir(), "config.json"))
+	layer := testGzipLayer(t, map[string]string{"etc/hello": "hello world\n"})
+	srv := httptest.NewServer(testRegistry(layer))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+	buf := new(bytes.Buffer)
+	cliOut := cliLog.Out
+	cliLog.Out = buf
+	defer func() { cliLog.Out = cliOut }()
+
+	// the deprecated form without the squash command still accepts the squash flags
+	out := filepath.Join(t.TempDir(), "out.tar")
+	_, err := cobraTest(t, "--insecure-registry", host, "--progress", "none", "--platform", "linux/amd64", host+"/test/app:latest", out)
+	require.NoError(t, err)
+	require.FileExists(t, out)
+	require.Contains(t, buf.String(), "is deprecated")
+
+	buf.Reset()
+	_, err = cobraTest(t, "squash", "--progress", "none", "--push", "ocidir://"+filepath.Join(t.TempDir(), "app"), host+"/test/app:latest", out)
+	require.ErrorIs(t, err, ErrInvalidInput)
+	_, err = cobraTest(t, "version")
+	require.NoError(t, err)
+	require.NotContains(t, buf.String(), "is deprecated")
+}
+
+func TestSquashOutputFormat(t *testing.T) {
+	t.Setenv(ConfigEnv, filepath.Join(t.TempDir(), "config.json"))
+	layer := testGzipLayer(t, map[string]string{"etc/hello": "hello world\n"})
+	srv := httptest.NewServer(testRegistry(layer))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	for _, compression := range []string{"gzip", "zstd", "none"} {
+		out := filepath.Join(t.TempDir(), "out.sqfs")
+		_, err := cobraTest(t, "squash", "--insecure-registry", host, "--progress", "none", "--output-format", "squashfs", "--compression", compression, host+"/test/app:latest", out)
+		require.NoError(t, err, compression)
+		b, err := os.ReadFile(out)
+		require.NoError(t, err)
+		require.Equal(t, "hsqs", string(b[:4]), compression)
+	}
+
+	for _, size := range []string{"auto", "8MB"} {
+		out := filepath.Join(t.TempDir(), "out.ext4")
+		_, err := cobraTest(t, "squash", "--insecure-registry", host, "--progress", "none", "--output-format", "ext4", "--size", size, host+"/test/app:latest", out)
+		require.NoError(t, err, size)
+		b, err := os.ReadFile(out)
+		require.NoError(t, err)
+		require.Equal(t, []byte{0x53, 0xEF}, b[1024+56:1024+58], size)
+		if size != "auto" {
+			// rounded up to the block size
+			require.Len(t, b, 8000000+4096-8000000%4096)
+		}
+	}
+
+	out := filepath.Join(t.TempDir(), "out.tar.gz")
+	_, err := cobraTest(t, "squash", "--insecure-registry", host, "--progress", "none", "--output-format", "lxc", host+"/test/app:latest", out)
+	require.NoError(t, err)
+	f, err := os.Open(out)
+	require.NoError(t, err)
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	require.NoError(t, err)
+	th, err := tar.NewReader(zr).Next()
+	require.NoError(t, err)
+	require.Equal(t, "metadata.yaml", th.Name)
+
+	out = filepath.Join(t.TempDir(), "out.tar")
+	// the image has no command for the shim
+	_, err = cobraTest(t, "squash", "--insecure-registry", host, "--progress", "none", "--output-format", "ext4", "--init-shim", host+"/test/app:latest", out)
+	require.ErrorIs(t, err, squash.ErrNoCommand)
+	require.NoFileExists(t, out)
+	_, err = cobraTest(t, "squash", "--insecure-registry", host, "--progress", "none", "--output-format", "cpio", host+"/test/app:latest", out)
+	require.ErrorIs(t, err, squash.ErrNoCommand)
+	_, err = cobraTest(t, "squash", "--insecure-registry", host, "--size", "1GiB", host+"/test/app:latest", out)
+	require.ErrorIs(t, err, squash.ErrInvalidOption)
+	_, err = cobraTest(t, "squash", "--insecure-registry", host, "--compression", "zstd", host+"/test/app:latest", out)
+	require.ErrorIs(t, err, squash.ErrInvalidOption)
+	require.NoFileExists(t, out)
+	_, err = cobraTest(t, "squash", "--insecure-registry", host, "--output-format", "iso", host+"/test/app:latest", out)
+	require.ErrorIs(t, err, squash.ErrInvalidOption)
+}
+
+func TestSquashPush(t *testing.T) {
+	t.Setenv(ConfigEnv, filepath.Join(t.TempDir(), "config.json"))
+	layer := testGzipLayer(t, map[string]string{"etc/hello": "hello world\n"})
+	srv := httptest.NewServer(testRegistry(layer))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+	ctx := context.Background()
+
+	target := "ocidir://" + filepath.Join(t.TempDir(), "out") + ":squashed"
+	_, err := cobraTest(t, "squash", "--insecure-registry", host, "--progress", "none", "--push", target, "--compression", "zstd:chunked", host+"/test/app:latest")
+	require.NoError(t, err)
+	r, err := ref.New(target)
+	require.NoError(t, err)
+	rc := regclient.New()
+	m, err := rc.ManifestGet(ctx, r)
+	require.NoError(t, err)
+	layers, err := m.(manifest.Imager).GetLayers()
+	require.NoError(t, err)
+	require.Len(t, layers, 1)
+	require.Equal(t, types.MediaTypeOCI1LayerZstd, layers[0].MediaType)
+	require.Contains(t, layers[0].Annotations, chunked.AnnotationManifestPosition)
+
+	out := filepath.Join(t.TempDir(), "out.tar")
+	_, err = cobraTest(t, "squash", "--insecure-registry", host, host+"/test/app:latest")
+	require.ErrorIs(t, err, ErrInvalidInput)
+	_, err = cobraTest(t, "squash", "--insecure-registry", host, "--push", target, host+"/test/app:latest", out)
+	require.ErrorIs(t, err, ErrInvalidInput)
+	_, err = cobraTest(t, "squash", "--insecure-registry", host, "--push", target, "--output-format", "ext4", host+"/test/app:latest")
+	require.ErrorIs(t, err, ErrInvalidInput)
+	_, err = cobraTest(t, "squash", "--insecure-registry", host, "--push", target, "--compression", "none", host+"/test/app:latest")
+	require.ErrorIs(t, err, squash.ErrInvalidOption)
+	// the SBOM to attach is the one of --sbom
+	_, err = cobraTest(t, "squash", "--insecure-registry", host, "--push", target, "--sbom-attach", target, host+"/test/app:latest")
+	require.ErrorIs(t, err, ErrInvalidInput)
+}
+
+func TestSquashSign(t *testing.T) {
+	t.Setenv(ConfigEnv, filepath.Join(t.TempDir(), "config.json"))
+	layer := testGzipLayer(t, map[string]string{"etc/hello": "hello world\n"})
+	srv := httptest.NewServer(testRegistry(layer))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	dir := t.TempDir()
+	keyFile, pubFile, otherFile := filepath.Join(dir, "cosign.key"), filepath.Join(dir, "cosign.pub"), filepath.Join(dir, "other.pub")
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600))
+	der, err = x509.MarshalPKIXPublicKey(key.Public())
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(pubFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644))
+	other, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	der, err = x509.MarshalPKIXPublicKey(other)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(otherFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644))
+
+	target := "ocidir://" + filepath.Join(t.TempDir(), "out") + ":squashed"
+	_, err = cobraTest(t, "verify-signature", "--insecure-registry", host, "--key", pubFile, host+"/test/app:latest")
+	require.ErrorIs(t, err, sign.ErrNoSignature)
+	_, err = cobraTest(t, "squash", "--insecure-registry", host, "--progress", "none", "--push", target, "--sign-key", keyFile, "--sign-mode", "both", host+"/test/app:latest")
+	require.NoError(t, err)
+	out, err := cobraTest(t, "verify-signature", "--key", otherFile, "--key", pubFile, target)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	require.Len(t, lines, 2)
+	for _, l := range lines {
+		require.Contains(t, l, "signed with "+pubFile)
+	}
+	_, err = cobraTest(t, "verify-signature", "--key", otherFile, target)
+	require.ErrorIs(t, err, sign.ErrNoSignature)
+
+	_, err = cobraTest(t, "squash", "--insecure-registry", host, "--sign-key", keyFile, host+"/test/app:latest", filepath.Join(dir, "out.tar"))
+	require.ErrorIs(t, err, ErrInvalidInput)
+	_, err = cobraTest(t, "squash", "--insecure-registry", host, "--push", target, "--sign-key", keyFile, "--sign-mode", "rekor", host+"/test/app:latest")
+	require.ErrorIs(t, err, ErrInvalidInput)
+	_, err = cobraTest(t, "squash", "--insecure-registry", host, "--push", target, "--sign-key", pubFile, host+"/test/app:latest")
+	require.ErrorIs(t, err, sign.ErrInvalidKey)
+}
+
+func TestSquashPolicy(t *testing.T) {
+	t.Setenv(ConfigEnv, filepath.Join(t.TempDir(), "config.json"))
+	layer := testGzipLayer(t, map[string]string{"etc/hello": "hello world\n"})
+	srv := httptest.NewServer(testRegistry(layer))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	dir := t.TempDir()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "cosign.key"), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600))
+	der, err = x509.MarshalPKIXPublicKey(key.Public())
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "cosign.pub"), pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644))
+	images := t.TempDir()
+	policy := filepath.Join(dir, "policy.yaml")
+	require.NoError(t, os.WriteFile(policy, []byte("rules:\n  - match: "+host+"\n    keys: [cosign.pub]\n  - match: "+images+"/*\n    keys: [cosign.pub]\n"), 0644))
+
+	// the source of the registry is not signed
+	out := filepath.Join(t.TempDir(), "out.tar")
+	_, err = cobraTest(t, "squash", "--insecure-registry", host, "--progress", "none", "--retries", "0", "--policy", policy, host+"/test/app:latest", out)
+	require.ErrorIs(t, err, sign.ErrNoSignature)
+	require.NoFileExists(t, out)
+
+	// a signed copy in an ocidir is squashed
+	signed := "ocidir://" + filepath.Join(images, "app") + ":squashed"
+	unsigned := "ocidir://" + filepath.Join(images, "app") + ":unsigned"
+	_, err = cobraTest(t, "squash", "--insecure-registry", host, "--progress", "none", "--push", signed, "--sign-key", filepath.Join(dir, "cosign.key"), host+"/test/app:latest")
+	require.NoError(t, err)
+	_, err = cobraTest(t, "squash", "--insecure-registry", host, "--progress", "none", "--push", unsigned, "--compression", "zstd", host+"/test/app:latest")
+	require.NoError(t, err)
+	_, err = cobraTest(t, "squash", "--progress", "none", "--policy", policy, signed, out)
+	require.NoError(t, err)
+	require.FileExists(t, out)
+	_, err = cobraTest(t, "unpack", "--progress", "none", "--policy", policy, unsigned, filepath.Join(t.TempDir(), "bundle"))
+	require.ErrorIs(t, err, sign.ErrNoSignature)
+	_, err = cobraTest(t, "squash", "--progress", "none", "--policy", policy, "ocidir://"+filepath.Join(t.TempDir(), "app")+":latest", out)
+	require.ErrorIs(t, err, sign.ErrUntrusted)
+}
+
+func TestSquashProvenance(t *testing.T) {
+	t.Setenv(ConfigEnv, filepath.Join(t.TempDir(), "config.json"))
+	layer := testGzipLayer(t, map[string]string{"etc/hello": "hello world\n"})
+	srv := httptest.NewServer(testRegistry(layer))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	// the digest of the output file
+	out, file := filepath.Join(dir, "out.tar"), filepath.Join(dir, "provenance.json")
+	_, err := cobraTest(t, "squash", "--insecure-registry", host, "--progress", "none", "--provenance", file, host+"/test/app:latest", out)
+	require.NoError(t, err)
+	b, err := os.ReadFile(file)
+	require.NoError(t, err)
+	var s provenance.Statement
+	require.NoError(t, json.Unmarshal(b, &s))
+	tb, err := os.ReadFile(out)
+	require.NoError(t, err)
+	require.Equal(t, []provenance.ResourceDescriptor{{Name: "out.tar", Digest: map[string]string{"sha256": digest.FromBytes(tb).Encoded()}}}, s.Subject)
+	require.Equal(t, host+"/test/app:latest", s.Predicate.BuildDefinition.ExternalParameters.Source)
+	require.Equal(t, squash.FormatTar, s.Predicate.BuildDefinition.ExternalParameters.Options.Format)
+	require.NotEmpty(t, s.Predicate.BuildDefinition.InternalParameters.Platform)
+	require.Len(t, s.Predicate.BuildDefinition.ResolvedDependencies, 1)
+
+	// the pushed manifest, with the statement attached
+	target := "ocidir://" + filepath.Join(dir, "out") + ":squashed"
+	_, err = cobraTest(t, "squash", "--insecure-registry", host, "--progress", "none", "--push", target, "--provenance", file, host+"/test/app:latest")
+	require.NoError(t, err)
+	r, err := ref.New(target)
+	require.NoError(t, err)
+	rc := regclient.New()
+	m, err := rc.ManifestHead(ctx, r)
+	require.NoError(t, err)
+	b, err = os.ReadFile(file)
+	require.NoError(t, err)
+	s = provenance.Statement{}
+	require.NoError(t, json.Unmarshal(b, &s))
+	require.Len(t, s.Subject, 1)
+	require.Equal(t, r.CommonName(), s.Subject[0].Name)
+	require.Equal(t, m.GetDescriptor().Digest.Encoded(), s.Subject[0].Digest["sha256"])
+	require.Len(t, s.Predicate.RunDetails.Byproducts, 1)
+
+	r.Tag, r.Digest = "", m.GetDescriptor().Digest.String()
+	rl, err := rc.ReferrerList(ctx, r, scheme.WithReferrerAT(provenance.MediaType))
+	require.NoError(t, err)
+	require.Len(t, rl.Descriptors, 1)
+	ra := r
+	ra.Digest = rl.Descriptors[0].Digest.String()
+	am, err := rc.ManifestGet(ctx, ra)
+	require.NoError(t, err)
+	layers, err := am.(manifest.Imager).GetLayers()
+	require.NoError(t, err)
+	require.Len(t, layers, 1)
+	require.Equal(t, provenance.MediaType, layers[0].MediaType)
+	require.Equal(t, provenance.PredicateType, layers[0].Annotations[provenance.AnnotationPredicateType])
+	require.Equal(t, digest.FromBytes(b), layers[0].Digest)
+}
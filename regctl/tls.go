@@ -0,0 +1,265 @@
+package regctl
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/regclient/regclient/config"
+	"github.com/sirupsen/logrus"
+)
+
+// dockerCertDir is searched for <host>/*.crt CA files and <host>/*.cert + *.key client pairs, like docker does
+var dockerCertDir = "/etc/docker/certs.d"
+
+// HostTLS contains file based TLS settings of a registry.
+// regclient only accepts PEM content for the CA and ignores client certificates,
+// so these are loaded here and applied by the transport from tlsTransport.
+type HostTLS struct {
+	CAFile     string `json:"caFile,omitempty"`     // PEM CA bundle trusted in addition to the system roots
+	ClientCert string `json:"clientCert,omitempty"` // PEM client certificate for mTLS
+	ClientKey  string `json:"clientKey,omitempty"`  // PEM client key for mTLS
+}
+
+func (ht *HostTLS) empty() bool {
+	return ht.CAFile == "" && ht.ClientCert == "" && ht.ClientKey == ""
+}
+
+// tlsHost is the loaded TLS configuration for a single registry address
+type tlsHost struct {
+	err      error // load failure, returned when dialing so the host never silently falls back to defaults
+	insecure bool
+	rootCAs  *x509.CertPool
+	certs    []tls.Certificate
+}
+
+// tlsHostLoad combines the regclient host settings with the file based settings
+func tlsHostLoad(h *config.Host, ht *HostTLS, dockerCerts bool) (*tlsHost, error) {
+	th := &tlsHost{
+		insecure: h.TLS == config.TLSInsecure,
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	th.rootCAs = pool
+	if h.RegCert != "" && !pool.AppendCertsFromPEM([]byte(h.RegCert)) {
+		return nil, fmt.Errorf("%w: regcert for %s is not a valid PEM certificate", ErrInvalidInput, h.Name)
+	}
+	if ht != nil && ht.CAFile != "" {
+		ca, err := os.ReadFile(ht.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA bundle for %s: %w", h.Name, err)
+		}
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("%w: CA bundle %s for %s contains no PEM certificates", ErrInvalidInput, ht.CAFile, h.Name)
+		}
+	}
+	if ht != nil && (ht.ClientCert != "" || ht.ClientKey != "") {
+		if ht.ClientCert == "" || ht.ClientKey == "" {
+			return nil, fmt.Errorf("%w: client certificate and key must both be set for %s", ErrMissingInput, h.Name)
+		}
+		cert, err := tls.LoadX509KeyPair(ht.ClientCert, ht.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate for %s: %w", h.Name, err)
+		}
+		th.certs = append(th.certs, cert)
+	} else if h.ClientCert != "" && h.ClientKey != "" {
+		cert, err := tls.X509KeyPair([]byte(h.ClientCert), []byte(h.ClientKey))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse client certificate for %s: %w", h.Name, err)
+		}
+		th.certs = append(th.certs, cert)
+	}
+	if dockerCerts {
+		if err := th.loadCertDir(filepath.Join(dockerCertDir, h.Hostname)); err != nil {
+			return nil, err
+		}
+	}
+	return th, nil
+}
+
+func (th *tlsHost) loadCertDir(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, e := range entries {
+		name := filepath.Join(dir, e.Name())
+		switch {
+		case strings.HasSuffix(e.Name(), ".crt"):
+			ca, err := os.ReadFile(name)
+			if err != nil {
+				return err
+			}
+			th.rootCAs.AppendCertsFromPEM(ca)
+		case strings.HasSuffix(e.Name(), ".cert"):
+			key := strings.TrimSuffix(name, ".cert") + ".key"
+			cert, err := tls.LoadX509KeyPair(name, key)
+			if err != nil {
+				return fmt.Errorf("failed to load client certificate %s: %w", name, err)
+			}
+			th.certs = append(th.certs, cert)
+		}
+	}
+	return nil
+}
+
+func (th *tlsHost) dial(ctx context.Context, dialer *net.Dialer, network, addr string) (net.Conn, error) {
+	if th.err != nil {
+		return nil, th.err
+	}
+	serverName, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	td := tls.Dialer{NetDialer: dialer, Config: th.config(serverName)}
+	return td.DialContext(ctx, network, addr)
+}
+
+func (th *tlsHost) config(serverName string) *tls.Config {
+	return &tls.Config{
+		ServerName:         serverName,
+		RootCAs:            th.rootCAs,
+		Certificates:       th.certs,
+		InsecureSkipVerify: th.insecure,
+		MinVersion:         tls.VersionTLS12,
+	}
+}
+
+// tlsTransport returns a transport that selects the TLS settings by the dialed address,
+// hosts are keyed by "hostname:port" and hostnames without a port use 443
+func tlsTransport(hosts map[string]*tlsHost, dockerCerts bool) *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	t.DialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		th, ok := hosts[addr]
+		if !ok {
+			// unconfigured registries still get the docker certs.d directory
+			var err error
+			th, err = tlsHostLoad(config.HostNewName(tlsAddrHost(addr)), nil, dockerCerts)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return th.dial(ctx, dialer, network, addr)
+	}
+	return t
+}
+
+// tlsHostAddr returns the address dialed for a hostname
+func tlsHostAddr(hostname string) string {
+	if _, _, err := net.SplitHostPort(hostname); err == nil {
+		return hostname
+	}
+	return net.JoinHostPort(hostname, "443")
+}
+
+// tlsAddrHost is the inverse of tlsHostAddr
+func tlsAddrHost(addr string) string {
+	if host, port, err := net.SplitHostPort(addr); err == nil && port == "443" {
+		return host
+	}
+	return addr
+}
+
+// tlsHosts loads the TLS settings of every configured host.
+// The transport from tlsTransport applies all TLS settings since regclient cannot modify a wrapped transport.
+func tlsHosts(conf *Config, dockerCerts bool) map[string]*tlsHost {
+	result := map[string]*tlsHost{}
+	for name, h := range conf.Hosts {
+		if h.TLS == config.TLSDisabled {
+			continue
+		}
+		th, err := tlsHostLoad(h, conf.HostTLS[name], dockerCerts)
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"host": name,
+				"err":  err,
+			}).Warn("Failed to load TLS settings")
+			th = &tlsHost{err: err}
+		}
+		hostname := h.Hostname
+		if hostname == "" {
+			hostname = name
+		}
+		result[tlsHostAddr(hostname)] = th
+	}
+	return result
+}
+
+// tlsFlags parses the --registry-ca, --registry-cert, and --registry-key flags, each is "host=file"
+func tlsFlags() (map[string]*HostTLS, error) {
+	result := map[string]*HostTLS{}
+	get := func(flag, val string) (*HostTLS, string, error) {
+		host, file, ok := strings.Cut(val, "=")
+		if !ok || host == "" || file == "" {
+			return nil, "", fmt.Errorf("%w: --%s must be host=file, received %s", ErrInvalidInput, flag, val)
+		}
+		host = config.HostNewName(host).Name
+		if result[host] == nil {
+			result[host] = &HostTLS{}
+		}
+		return result[host], file, nil
+	}
+	for _, val := range rootOpts.registryCA {
+		ht, file, err := get("registry-ca", val)
+		if err != nil {
+			return nil, err
+		}
+		ht.CAFile = file
+	}
+	for _, val := range rootOpts.registryCert {
+		ht, file, err := get("registry-cert", val)
+		if err != nil {
+			return nil, err
+		}
+		ht.ClientCert = file
+	}
+	for _, val := range rootOpts.registryKey {
+		ht, file, err := get("registry-key", val)
+		if err != nil {
+			return nil, err
+		}
+		ht.ClientKey = file
+	}
+	return result, nil
+}
+
+// tlsFlagsApply overrides the config with the TLS flags, the changes are not saved
+func tlsFlagsApply(conf *Config) error {
+	for _, host := range rootOpts.insecureRegistries {
+		conf.hostGet(host).TLS = config.TLSDisabled
+	}
+	flags, err := tlsFlags()
+	if err != nil {
+		return err
+	}
+	for host, ft := range flags {
+		conf.hostGet(host)
+		ht := conf.hostTLSGet(host)
+		if ft.CAFile != "" {
+			ht.CAFile = ft.CAFile
+		}
+		if ft.ClientCert != "" {
+			ht.ClientCert = ft.ClientCert
+		}
+		if ft.ClientKey != "" {
+			ht.ClientKey = ft.ClientKey
+		}
+	}
+	return nil
+}
@@ -0,0 +1,166 @@
+package regctl
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testCert creates a certificate signed by parent, or self signed when parent is nil
+func testCert(t *testing.T, cn string, parent *tls.Certificate, isCA bool) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := tmpl, any(key)
+	if parent != nil {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	require.NoError(t, err)
+	leaf, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// testPEM writes the certificate and key of c to dir, returning the filenames
+func testPEM(t *testing.T, dir, name string, c tls.Certificate) (string, string) {
+	t.Helper()
+	certFile := filepath.Join(dir, name+".pem")
+	keyFile := filepath.Join(dir, name+"-key.pem")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Certificate[0]}), 0600))
+	keyDER, err := x509.MarshalPKCS8PrivateKey(c.PrivateKey)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600))
+	return certFile, keyFile
+}
+
+func TestTLS(t *testing.T) {
+	t.Setenv(ConfigEnv, filepath.Join(t.TempDir(), "config.json"))
+	dir := t.TempDir()
+	dockerCertDir = t.TempDir()
+
+	// server with a self signed certificate
+	srv := httptest.NewTLSServer(testRegistry())
+	defer srv.Close()
+	srvHost := strings.TrimPrefix(srv.URL, "https://")
+	caFile := filepath.Join(dir, "ca.pem")
+	require.NoError(t, os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0600))
+
+	// server requiring a client certificate signed by clientCA
+	clientCA := testCert(t, "client ca", nil, true)
+	client := testCert(t, "client", &clientCA, false)
+	clientCertFile, clientKeyFile := testPEM(t, dir, "client", client)
+	clientPool := x509.NewCertPool()
+	clientPool.AddCert(clientCA.Leaf)
+	mtls := httptest.NewUnstartedServer(testRegistry())
+	mtls.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientPool}
+	mtls.StartTLS()
+	defer mtls.Close()
+	mtlsHost := strings.TrimPrefix(mtls.URL, "https://")
+	mtlsCAFile := filepath.Join(dir, "mtls-ca.pem")
+	require.NoError(t, os.WriteFile(mtlsCAFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: mtls.Certificate().Raw}), 0600))
+
+	// plain http server
+	plain := httptest.NewServer(testRegistry())
+	defer plain.Close()
+	plainHost := strings.TrimPrefix(plain.URL, "http://")
+
+	t.Run("CA flag", func(t *testing.T) {
+		out, err := cobraTest(t, "manifest", "head", "--registry-ca", srvHost+"="+caFile, srvHost+"/test/app:latest")
+		require.NoError(t, err)
+		require.True(t, strings.HasPrefix(out, "sha256:"), out)
+	})
+	t.Run("CA config", func(t *testing.T) {
+		_, err := cobraTest(t, "config", "set", "--host", srvHost, "--ca-file", caFile)
+		require.NoError(t, err)
+		out, err := cobraTest(t, "manifest", "head", srvHost+"/test/app:latest")
+		require.NoError(t, err)
+		require.True(t, strings.HasPrefix(out, "sha256:"), out)
+		_, err = cobraTest(t, "config", "set", "--host", srvHost, "--ca-file", "")
+		require.NoError(t, err)
+		c, err := ConfigLoadDefault()
+		require.NoError(t, err)
+		require.NotContains(t, c.HostTLS, srvHost)
+	})
+	t.Run("client cert", func(t *testing.T) {
+		out, err := cobraTest(t, "manifest", "head",
+			"--registry-ca", mtlsHost+"="+mtlsCAFile,
+			"--registry-cert", mtlsHost+"="+clientCertFile,
+			"--registry-key", mtlsHost+"="+clientKeyFile,
+			mtlsHost+"/test/app:latest")
+		require.NoError(t, err)
+		require.True(t, strings.HasPrefix(out, "sha256:"), out)
+	})
+	t.Run("client cert without key", func(t *testing.T) {
+		_, err := cobraTest(t, "manifest", "head",
+			"--registry-cert", mtlsHost+"="+clientCertFile,
+			mtlsHost+"/test/app:latest")
+		require.ErrorIs(t, err, ErrMissingInput)
+	})
+	t.Run("insecure registry", func(t *testing.T) {
+		out, err := cobraTest(t, "manifest", "head", "--insecure-registry", plainHost, plainHost+"/test/app:latest")
+		require.NoError(t, err)
+		require.True(t, strings.HasPrefix(out, "sha256:"), out)
+	})
+	t.Run("invalid flag", func(t *testing.T) {
+		_, err := cobraTest(t, "manifest", "head", "--registry-ca", srvHost, srvHost+"/test/app:latest")
+		require.ErrorIs(t, err, ErrInvalidInput)
+	})
+}
+
+// TestTLSDial checks the transport directly, the regclient retries make failed requests slow
+func TestTLSDial(t *testing.T) {
+	dockerCertDir = t.TempDir()
+	clientCA := testCert(t, "client ca", nil, true)
+	client := testCert(t, "client", &clientCA, false)
+	clientPool := x509.NewCertPool()
+	clientPool.AddCert(clientCA.Leaf)
+	mtls := httptest.NewUnstartedServer(testRegistry())
+	mtls.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientPool}
+	mtls.StartTLS()
+	defer mtls.Close()
+	addr := strings.TrimPrefix(mtls.URL, "https://")
+	serverPool := x509.NewCertPool()
+	serverPool.AddCert(mtls.Certificate())
+
+	get := func(hosts map[string]*tlsHost) error {
+		c := &http.Client{Transport: tlsTransport(hosts, true)}
+		resp, err := c.Get(mtls.URL + "/v2/")
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+	// unknown CA
+	require.Error(t, get(nil))
+	// trusted but missing the client certificate
+	require.Error(t, get(map[string]*tlsHost{addr: {rootCAs: serverPool}}))
+	require.NoError(t, get(map[string]*tlsHost{addr: {rootCAs: serverPool, certs: []tls.Certificate{client}}}))
+	// a host that failed to load never falls back to the defaults
+	require.ErrorIs(t, get(map[string]*tlsHost{addr: {err: ErrInvalidInput}}), ErrInvalidInput)
+}
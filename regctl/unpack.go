@@ -0,0 +1,92 @@
+package regctl
+
+import (
+	"os"
+
+	"github.com/mheers/docker-image-squash/bundle"
+	"github.com/mheers/docker-image-squash/squash"
+	"github.com/spf13/cobra"
+)
+
+var unpackCmd = &cobra.Command{
+	Use:   "unpack <image_ref> <dir>",
+	Short: "unpack an image into an OCI runtime bundle",
+	Long: `Pulls every layer of the image and writes the final filesystem to
+<dir>/rootfs along with a config.json generated from the image config, the
+Entrypoint, Cmd, Env, WorkingDir and User with the default mounts and
+capabilities of Docker. The directory is a bundle for "runc run" or "crun run".
+<dir>/rootfs must not exist yet.
+
+Owners are kept and device nodes created when running as root only. With
+--rootless, the default for other users, the config has a user namespace that
+maps root of the container to the current user and the ids from 1 to the
+subordinate ids in /etc/subuid and /etc/subgid, which the runtime sets up with
+newuidmap and newgidmap.`,
+	Args:              cobra.ExactArgs(2),
+	ValidArgsFunction: completeArgList([]completeFunc{completeArgTag, completeArgDefault}),
+	RunE:              runUnpack,
+}
+
+var unpackOpts struct {
+	rootless bool
+}
+
+func init() {
+	unpackCmd.Flags().StringVarP(&squashOpts.platform, "platform", "p", "", "Specify platform (e.g. linux/amd64 or local)")
+	unpackCmd.Flags().BoolVarP(&unpackOpts.rootless, "rootless", "", os.Geteuid() != 0, "Generate the config of a rootless container with uid and gid mappings")
+	unpackCmd.Flags().StringVarP(&squashOpts.policy, "policy", "", "", "Policy file with the public keys trusted per repository, the source must have a valid signature before its layers are pulled")
+	unpackCmd.Flags().StringVarP(&squashOpts.progress, "progress", "", progressAuto, "Progress output on stderr (auto, bar, json, none), auto draws bars on a TTY and writes JSON events otherwise")
+	unpackCmd.Flags().StringVarP(&squashOpts.workDir, "work-dir", "", "", "Directory for the scratch file, defaults to $TMPDIR or /tmp")
+	unpackCmd.Flags().StringVarP(&squashOpts.spill, "spill", "", squash.SpillAuto, "Where the merged filesystem is kept: index (files in a scratch file in the work dir, index in memory), memory, or auto (memory for small images, otherwise index)")
+	unpackCmd.Flags().StringVarP(&squashOpts.memoryMax, "spill-memory-max", "", formatSize(squash.DefaultMemoryMax), "Largest estimated image size that --spill auto keeps in memory")
+	unpackCmd.Flags().StringVarP(&squashOpts.limits.size, "limit-size", "", formatSize(squash.DefaultLimits.MaxBytes), "Abort when the files of all layers exceed this size (e.g. 500MiB, 2GB), 0 disables the limit")
+	unpackCmd.Flags().StringVarP(&squashOpts.limits.fileSize, "limit-file-size", "", formatSize(squash.DefaultLimits.MaxFileSize), "Abort when a single file exceeds this size, 0 disables the limit")
+	unpackCmd.Flags().IntVarP(&squashOpts.limits.entries, "limit-entries", "", squash.DefaultLimits.MaxEntries, "Abort when a layer has more entries, 0 disables the limit")
+	unpackCmd.Flags().IntVarP(&squashOpts.limits.depth, "limit-depth", "", squash.DefaultLimits.MaxDepth, "Abort when a path has more components, 0 disables the limit")
+	unpackCmd.Flags().Float64VarP(&squashOpts.limits.ratio, "limit-ratio", "", squash.DefaultLimits.MaxRatio, "Abort when a layer decompresses to more than this multiple of its size, 0 disables the limit")
+	unpackCmd.Flags().BoolVarP(&squashOpts.limits.noSpaceCheck, "no-space-check", "", false, "Skip the check of the free space in the temporary and bundle directory")
+	unpackCmd.RegisterFlagCompletionFunc("platform", completeArgPlatform)
+	unpackCmd.RegisterFlagCompletionFunc("progress", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return []string{progressAuto, progressBar, progressJSON, progressNone}, cobra.ShellCompDirectiveNoFileComp
+	})
+	unpackCmd.RegisterFlagCompletionFunc("spill", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return []string{squash.SpillAuto, squash.SpillIndex, squash.SpillMemory}, cobra.ShellCompDirectiveNoFileComp
+	})
+	unpackCmd.RegisterFlagCompletionFunc("work-dir", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return nil, cobra.ShellCompDirectiveFilterDirs
+	})
+
+	rootCmd.AddCommand(unpackCmd)
+}
+
+func runUnpack(cmd *cobra.Command, args []string) error {
+	ctx := cmd.Context()
+	image := args[0]
+	dir := args[1]
+	mode, err := progressMode(squashOpts.progress, cmd.ErrOrStderr())
+	if err != nil {
+		return err
+	}
+	img, err := imageSourceNew(image)
+	if err != nil {
+		return err
+	}
+	opts, err := squashOptions(img)
+	if err != nil {
+		return err
+	}
+	opts.Bundle.Rootless = unpackOpts.rootless
+	if unpackOpts.rootless {
+		if opts.Bundle.UIDMappings, opts.Bundle.GIDMappings, err = bundle.RootlessMappings(); err != nil {
+			return err
+		}
+	}
+	if p := newProgress(cmd.ErrOrStderr(), mode, image); p != nil {
+		defer p.close()
+		opts.Progress = p
+	}
+	if _, err := squash.Unpack(ctx, img.ref.CommonName(), dir, opts); err != nil {
+		return credsError(img.endpoint(), err)
+	}
+	return nil
+}
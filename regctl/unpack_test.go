@@ -0,0 +1,51 @@
+package regctl
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mheers/docker-image-squash/bundle"
+	"github.com/mheers/docker-image-squash/squash"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnpack(t *testing.T) {
+	t.Setenv(ConfigEnv, filepath.Join(t.TempDir(), "config.json"))
+	layer := testGzipLayer(t, map[string]string{"etc/hello": "hello world\n"})
+	conf := []byte(`{"architecture":"amd64","os":"linux","config":{"Env":["A=b"],"Cmd":["/bin/hello"],"WorkingDir":"/etc"}}`)
+	srv := httptest.NewServer(testRegistryConfig(conf, layer))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	dir := filepath.Join(t.TempDir(), "bundle")
+	_, err := cobraTest(t, "unpack", "--insecure-registry", host, "--progress", "none", "--rootless", host+"/test/app:latest", dir)
+	require.NoError(t, err)
+	b, err := os.ReadFile(filepath.Join(dir, "rootfs/etc/hello"))
+	require.NoError(t, err)
+	require.Equal(t, "hello world\n", string(b))
+	var spec bundle.Spec
+	b, err = os.ReadFile(filepath.Join(dir, "config.json"))
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(b, &spec))
+	require.Equal(t, []string{"/bin/hello"}, spec.Process.Args)
+	require.Equal(t, "/etc", spec.Process.Cwd)
+	require.Contains(t, spec.Process.Env, "A=b")
+	require.EqualValues(t, os.Geteuid(), spec.Linux.UIDMappings[0].HostID)
+
+	// the rootfs exists now
+	_, err = cobraTest(t, "unpack", "--insecure-registry", host, "--progress", "none", host+"/test/app:latest", dir)
+	require.ErrorIs(t, err, squash.ErrInvalidOption)
+
+	// the squash test registry has no command
+	srv2 := httptest.NewServer(testRegistry(layer))
+	defer srv2.Close()
+	host2 := strings.TrimPrefix(srv2.URL, "http://")
+	dir = filepath.Join(t.TempDir(), "bundle")
+	_, err = cobraTest(t, "unpack", "--insecure-registry", host2, "--progress", "none", host2+"/test/app:latest", dir)
+	require.ErrorIs(t, err, squash.ErrNoCommand)
+	require.NoDirExists(t, filepath.Join(dir, "rootfs"))
+}
@@ -0,0 +1,100 @@
+package sbom
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+)
+
+type cdxDocument struct {
+	BOMFormat    string         `json:"bomFormat"`
+	SpecVersion  string         `json:"specVersion"`
+	SerialNumber string         `json:"serialNumber"`
+	Version      int            `json:"version"`
+	Metadata     cdxMetadata    `json:"metadata"`
+	Components   []cdxComponent `json:"components"`
+}
+
+type cdxMetadata struct {
+	Timestamp string       `json:"timestamp"`
+	Tools     []cdxTool    `json:"tools"`
+	Component cdxComponent `json:"component"`
+}
+
+type cdxTool struct {
+	Name string `json:"name"`
+}
+
+type cdxComponent struct {
+	BOMRef     string        `json:"bom-ref,omitempty"`
+	Type       string        `json:"type"`
+	Name       string        `json:"name"`
+	Version    string        `json:"version,omitempty"`
+	PURL       string        `json:"purl,omitempty"`
+	Licenses   []cdxLicense  `json:"licenses,omitempty"`
+	Properties []cdxProperty `json:"properties,omitempty"`
+}
+
+type cdxLicense struct {
+	License struct {
+		Name string `json:"name"`
+	} `json:"license"`
+}
+
+type cdxProperty struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// WriteCycloneDX encodes the document as CycloneDX 1.5 JSON
+func WriteCycloneDX(w io.Writer, doc Document) error {
+	created := doc.Created
+	if created.IsZero() {
+		created = time.Now()
+	}
+	id := docID(doc, created)
+	out := cdxDocument{
+		BOMFormat:    "CycloneDX",
+		SpecVersion:  "1.5",
+		SerialNumber: "urn:uuid:" + id[0:8] + "-" + id[8:12] + "-" + id[12:16] + "-" + id[16:20] + "-" + id[20:32],
+		Version:      1,
+		Metadata: cdxMetadata{
+			Timestamp: created.UTC().Format(time.RFC3339),
+			Tools:     []cdxTool{{Name: toolName}},
+			Component: cdxComponent{
+				Type: "container",
+				Name: doc.Name,
+			},
+		},
+		Components: []cdxComponent{},
+	}
+	seen := map[string]bool{}
+	for _, p := range doc.Packages {
+		c := cdxComponent{
+			Type:    "library",
+			Name:    p.Name,
+			Version: p.Version,
+			PURL:    p.PURL,
+			Properties: []cdxProperty{
+				{Name: toolName + ":package:type", Value: p.Type},
+				{Name: toolName + ":location", Value: p.Location},
+			},
+		}
+		// bom-ref values must be unique within the document
+		ref := p.PURL
+		if ref == "" || seen[ref] {
+			ref = p.PURL + "#" + p.Location
+		}
+		seen[ref] = true
+		c.BOMRef = ref
+		if p.License != "" {
+			l := cdxLicense{}
+			l.License.Name = p.License
+			c.Licenses = []cdxLicense{l}
+		}
+		out.Components = append(out.Components, c)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(out)
+}
@@ -0,0 +1,310 @@
+package sbom
+
+import (
+	"bufio"
+	"debug/buildinfo"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	dpkgStatus    = "var/lib/dpkg/status"
+	dpkgStatusDir = "var/lib/dpkg/status.d"
+	apkInstalled  = "lib/apk/db/installed"
+)
+
+// scanDpkg parses the dpkg status file, and the per package files used by distroless images
+func scanDpkg(root, distro string) ([]Package, error) {
+	files := []string{dpkgStatus}
+	entries, err := os.ReadDir(filepath.Join(root, dpkgStatusDir))
+	if err == nil {
+		for _, e := range entries {
+			if !e.IsDir() && !strings.HasSuffix(e.Name(), ".md5sums") {
+				files = append(files, filepath.Join(dpkgStatusDir, e.Name()))
+			}
+		}
+	}
+	if distro == "" {
+		distro = "debian"
+	}
+
+	pkgs := []Package{}
+	for _, name := range files {
+		paragraphs, err := readControlFile(filepath.Join(root, name))
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			return nil, err
+		}
+		for _, p := range paragraphs {
+			if p["Package"] == "" {
+				continue
+			}
+			// only report packages that are actually installed
+			if status, ok := p["Status"]; ok && !strings.HasSuffix(status, " installed") {
+				continue
+			}
+			pkg := Package{
+				Name:     p["Package"],
+				Version:  p["Version"],
+				Type:     "deb",
+				Arch:     p["Architecture"],
+				Location: "/" + name,
+			}
+			pkg.PURL = purl("deb", distro, pkg.Name, pkg.Version, pkg.Arch)
+			pkgs = append(pkgs, pkg)
+		}
+	}
+	return pkgs, nil
+}
+
+// readControlFile splits a debian control style file into paragraphs of key/value pairs
+func readControlFile(file string) ([]map[string]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	result := []map[string]string{}
+	cur := map[string]string{}
+	s := bufio.NewScanner(f)
+	s.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for s.Scan() {
+		line := s.Text()
+		if strings.TrimSpace(line) == "" {
+			if len(cur) > 0 {
+				result = append(result, cur)
+				cur = map[string]string{}
+			}
+			continue
+		}
+		// continuation lines belong to multi-line fields we do not need
+		if line[0] == ' ' || line[0] == '\t' {
+			continue
+		}
+		k, v, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		cur[k] = strings.TrimSpace(v)
+	}
+	if len(cur) > 0 {
+		result = append(result, cur)
+	}
+	return result, s.Err()
+}
+
+// scanApk parses the alpine installed database
+func scanApk(root, distro string) ([]Package, error) {
+	f, err := os.Open(filepath.Join(root, apkInstalled))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	if distro == "" {
+		distro = "alpine"
+	}
+
+	pkgs := []Package{}
+	cur := Package{}
+	flush := func() {
+		if cur.Name != "" {
+			cur.Type = "apk"
+			cur.Location = "/" + apkInstalled
+			cur.PURL = purl("apk", distro, cur.Name, cur.Version, cur.Arch)
+			pkgs = append(pkgs, cur)
+		}
+		cur = Package{}
+	}
+	s := bufio.NewScanner(f)
+	s.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for s.Scan() {
+		line := s.Text()
+		if line == "" {
+			flush()
+			continue
+		}
+		if len(line) < 2 || line[1] != ':' {
+			continue
+		}
+		switch line[0] {
+		case 'P':
+			cur.Name = line[2:]
+		case 'V':
+			cur.Version = line[2:]
+		case 'A':
+			cur.Arch = line[2:]
+		case 'L':
+			cur.License = line[2:]
+		}
+	}
+	flush()
+	return pkgs, s.Err()
+}
+
+// parseDistInfo reads the METADATA file of an installed python distribution
+func parseDistInfo(dir, rel string) (*Package, error) {
+	paragraphs, err := readControlFile(filepath.Join(dir, "METADATA"))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if len(paragraphs) == 0 || paragraphs[0]["Name"] == "" {
+		return nil, nil
+	}
+	meta := paragraphs[0]
+	pkg := Package{
+		Name:     meta["Name"],
+		Version:  meta["Version"],
+		Type:     "pypi",
+		License:  meta["License"],
+		Location: rel,
+	}
+	// pypi names are case insensitive and treat - and _ the same
+	name := strings.ToLower(strings.ReplaceAll(pkg.Name, "_", "-"))
+	pkg.PURL = purl("pypi", "", name, pkg.Version, "")
+	return &pkg, nil
+}
+
+// parseGoBinary reports the main module and dependencies of a Go binary, non-Go files are ignored
+func parseGoBinary(file, rel string) []Package {
+	bi, err := buildinfo.ReadFile(file)
+	if err != nil {
+		return nil
+	}
+	pkgs := []Package{}
+	if bi.Main.Path != "" {
+		pkgs = append(pkgs, goPackage(bi.Main.Path, bi.Main.Version, rel))
+	}
+	for _, dep := range bi.Deps {
+		if dep.Replace != nil {
+			dep = dep.Replace
+		}
+		pkgs = append(pkgs, goPackage(dep.Path, dep.Version, rel))
+	}
+	return pkgs
+}
+
+func goPackage(path, version, rel string) Package {
+	if version == "(devel)" {
+		version = ""
+	}
+	return Package{
+		Name:     path,
+		Version:  version,
+		Type:     "golang",
+		Location: rel,
+		PURL:     purl("golang", "", path, version, ""),
+	}
+}
+
+type npmLock struct {
+	LockfileVersion int `json:"lockfileVersion"`
+	Packages        map[string]struct {
+		Name    string `json:"name"`
+		Version string `json:"version"`
+		License string `json:"license"`
+		Link    bool   `json:"link"`
+	} `json:"packages"`
+	Dependencies map[string]npmLockDep `json:"dependencies"`
+}
+
+type npmLockDep struct {
+	Version      string                `json:"version"`
+	Dependencies map[string]npmLockDep `json:"dependencies"`
+}
+
+// parseNpmLock reads all locked dependencies, lockfile v2/v3 use "packages", v1 uses "dependencies"
+func parseNpmLock(file, rel string) ([]Package, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	lock := npmLock{}
+	if err := json.Unmarshal(b, &lock); err != nil {
+		return nil, err
+	}
+	pkgs := []Package{}
+	add := func(name, version, license string) {
+		if name == "" || version == "" {
+			return
+		}
+		pkgs = append(pkgs, Package{
+			Name:     name,
+			Version:  version,
+			Type:     "npm",
+			License:  license,
+			Location: rel,
+			PURL:     purl("npm", "", name, version, ""),
+		})
+	}
+	if len(lock.Packages) > 0 {
+		for key, p := range lock.Packages {
+			// the root project is stored under the empty key
+			if key == "" || p.Link {
+				continue
+			}
+			name := p.Name
+			if name == "" {
+				i := strings.LastIndex(key, "node_modules/")
+				name = key[i+len("node_modules/"):]
+			}
+			add(name, p.Version, p.License)
+		}
+		return pkgs, nil
+	}
+	var walk func(deps map[string]npmLockDep)
+	walk = func(deps map[string]npmLockDep) {
+		for name, d := range deps {
+			add(name, d.Version, "")
+			walk(d.Dependencies)
+		}
+	}
+	walk(lock.Dependencies)
+	return pkgs, nil
+}
+
+// purl builds a package url, see https://github.com/package-url/purl-spec
+func purl(typ, namespace, name, version, arch string) string {
+	var sb strings.Builder
+	sb.WriteString("pkg:" + typ + "/")
+	if namespace != "" {
+		sb.WriteString(url.PathEscape(namespace) + "/")
+	}
+	switch typ {
+	case "golang":
+		// go module paths keep their slashes as namespace segments
+		parts := strings.Split(name, "/")
+		for i := range parts {
+			parts[i] = url.PathEscape(parts[i])
+		}
+		sb.WriteString(strings.Join(parts, "/"))
+	case "npm":
+		if scope, pkg, ok := strings.Cut(name, "/"); ok && strings.HasPrefix(scope, "@") {
+			sb.WriteString("%40" + url.PathEscape(scope[1:]) + "/" + url.PathEscape(pkg))
+		} else {
+			sb.WriteString(url.PathEscape(name))
+		}
+	default:
+		sb.WriteString(url.PathEscape(name))
+	}
+	if version != "" {
+		sb.WriteString("@" + url.PathEscape(version))
+	}
+	if arch != "" {
+		sb.WriteString("?arch=" + url.QueryEscape(arch))
+	}
+	return sb.String()
+}
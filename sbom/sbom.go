@@ -0,0 +1,160 @@
+// Package sbom builds a software bill of materials from a squashed root filesystem.
+package sbom
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// FormatSPDX selects SPDX 2.3 JSON output
+	FormatSPDX = "spdx"
+	// FormatCycloneDX selects CycloneDX 1.5 JSON output
+	FormatCycloneDX = "cyclonedx"
+
+	// MediaTypeSPDX is the media type used when attaching an SPDX document as an OCI artifact
+	MediaTypeSPDX = "application/spdx+json"
+	// MediaTypeCycloneDX is the media type used when attaching a CycloneDX document as an OCI artifact
+	MediaTypeCycloneDX = "application/vnd.cyclonedx+json"
+
+	toolName = "docker-image-squash"
+)
+
+// Package is a single component found in the filesystem
+type Package struct {
+	Name     string
+	Version  string
+	Type     string // deb, apk, pypi, golang, npm
+	Arch     string
+	License  string
+	PURL     string
+	Location string // path inside the image where the package was found
+}
+
+// Document describes the image the packages were found in
+type Document struct {
+	Name     string
+	Created  time.Time
+	Packages []Package
+}
+
+// Scan walks root and parses all supported package databases
+func Scan(root string) ([]Package, error) {
+	distro := osReleaseID(root)
+	pkgs := []Package{}
+
+	dpkg, err := scanDpkg(root, distro)
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing dpkg database: %w", err)
+	}
+	pkgs = append(pkgs, dpkg...)
+
+	apk, err := scanApk(root, distro)
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing apk database: %w", err)
+	}
+	pkgs = append(pkgs, apk...)
+
+	err = filepath.WalkDir(root, func(file string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, file)
+		if err != nil {
+			return err
+		}
+		rel = "/" + filepath.ToSlash(rel)
+		if d.IsDir() {
+			if strings.HasSuffix(d.Name(), ".dist-info") {
+				p, err := parseDistInfo(file, rel)
+				if err != nil {
+					return err
+				}
+				if p != nil {
+					pkgs = append(pkgs, *p)
+				}
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		if d.Name() == "package-lock.json" {
+			npm, err := parseNpmLock(file, rel)
+			if err != nil {
+				return fmt.Errorf("failed parsing %s: %w", rel, err)
+			}
+			pkgs = append(pkgs, npm...)
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if fi.Mode().Perm()&0111 != 0 {
+			pkgs = append(pkgs, parseGoBinary(file, rel)...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(pkgs, func(i, j int) bool {
+		if pkgs[i].Type != pkgs[j].Type {
+			return pkgs[i].Type < pkgs[j].Type
+		}
+		if pkgs[i].Name != pkgs[j].Name {
+			return pkgs[i].Name < pkgs[j].Name
+		}
+		return pkgs[i].Location < pkgs[j].Location
+	})
+	return pkgs, nil
+}
+
+// Write encodes the document in the requested format
+func Write(w io.Writer, format string, doc Document) error {
+	switch strings.ToLower(format) {
+	case "", FormatSPDX:
+		return WriteSPDX(w, doc)
+	case FormatCycloneDX:
+		return WriteCycloneDX(w, doc)
+	default:
+		return fmt.Errorf("unknown sbom format %q", format)
+	}
+}
+
+// MediaType returns the artifact media type for a format
+func MediaType(format string) (string, error) {
+	switch strings.ToLower(format) {
+	case "", FormatSPDX:
+		return MediaTypeSPDX, nil
+	case FormatCycloneDX:
+		return MediaTypeCycloneDX, nil
+	default:
+		return "", fmt.Errorf("unknown sbom format %q", format)
+	}
+}
+
+// osReleaseID returns the ID field from /etc/os-release, used as the purl namespace
+func osReleaseID(root string) string {
+	for _, name := range []string{"etc/os-release", "usr/lib/os-release"} {
+		b, err := os.ReadFile(filepath.Join(root, name))
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(string(b), "\n") {
+			if v, ok := strings.CutPrefix(line, "ID="); ok {
+				return strings.Trim(strings.TrimSpace(v), `"'`)
+			}
+		}
+	}
+	return ""
+}
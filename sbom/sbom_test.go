@@ -0,0 +1,79 @@
+package sbom
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func writeFile(t *testing.T, root, name, content string) {
+	t.Helper()
+	file := filepath.Join(root, name)
+	require.NoError(t, os.MkdirAll(filepath.Dir(file), 0755))
+	require.NoError(t, os.WriteFile(file, []byte(content), 0644))
+}
+
+func TestScan(t *testing.T) {
+	root := t.TempDir()
+	writeFile(t, root, "etc/os-release", "NAME=\"Debian GNU/Linux\"\nID=debian\n")
+	writeFile(t, root, "var/lib/dpkg/status", `Package: libc6
+Status: install ok installed
+Architecture: amd64
+Version: 2.36-9
+Description: GNU C Library
+ continuation line
+
+Package: removed
+Status: deinstall ok config-files
+Version: 1.0
+`)
+	writeFile(t, root, "lib/apk/db/installed", "P:musl\nV:1.2.4-r1\nA:x86_64\nL:MIT\n\nP:busybox\nV:1.36.1-r2\nA:x86_64\n")
+	writeFile(t, root, "usr/lib/python3/site-packages/Requests_Toolbelt-1.0.dist-info/METADATA", "Metadata-Version: 2.1\nName: Requests_Toolbelt\nVersion: 1.0.0\nLicense: Apache 2.0\n")
+	writeFile(t, root, "app/package-lock.json", `{"lockfileVersion":3,"packages":{"":{"name":"app"},"node_modules/@types/node":{"version":"20.1.0","license":"MIT"}}}`)
+
+	pkgs, err := Scan(root)
+	require.NoError(t, err)
+
+	purls := []string{}
+	for _, p := range pkgs {
+		purls = append(purls, p.PURL)
+	}
+	require.ElementsMatch(t, []string{
+		"pkg:deb/debian/libc6@2.36-9?arch=amd64",
+		"pkg:apk/debian/musl@1.2.4-r1?arch=x86_64",
+		"pkg:apk/debian/busybox@1.36.1-r2?arch=x86_64",
+		"pkg:pypi/requests-toolbelt@1.0.0",
+		"pkg:npm/%40types/node@20.1.0",
+	}, purls)
+}
+
+func TestWrite(t *testing.T) {
+	doc := Document{
+		Name:    "alpine:latest",
+		Created: time.Date(2023, 5, 3, 8, 0, 0, 0, time.UTC),
+		Packages: []Package{
+			{Name: "musl", Version: "1.2.4-r1", Type: "apk", License: "MIT", PURL: "pkg:apk/alpine/musl@1.2.4-r1", Location: "/lib/apk/db/installed"},
+		},
+	}
+
+	buf := bytes.Buffer{}
+	require.NoError(t, Write(&buf, FormatSPDX, doc))
+	spdx := map[string]interface{}{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &spdx))
+	require.Equal(t, "SPDX-2.3", spdx["spdxVersion"])
+	require.Len(t, spdx["packages"], 2)
+
+	buf.Reset()
+	require.NoError(t, Write(&buf, FormatCycloneDX, doc))
+	cdx := map[string]interface{}{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &cdx))
+	require.Equal(t, "CycloneDX", cdx["bomFormat"])
+	require.Len(t, cdx["components"], 1)
+
+	require.Error(t, Write(&buf, "unknown", doc))
+}
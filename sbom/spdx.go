@@ -0,0 +1,130 @@
+package sbom
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"time"
+)
+
+type spdxDocument struct {
+	SPDXVersion       string             `json:"spdxVersion"`
+	DataLicense       string             `json:"dataLicense"`
+	SPDXID            string             `json:"SPDXID"`
+	Name              string             `json:"name"`
+	DocumentNamespace string             `json:"documentNamespace"`
+	CreationInfo      spdxCreationInfo   `json:"creationInfo"`
+	Packages          []spdxPackage      `json:"packages"`
+	Relationships     []spdxRelationship `json:"relationships"`
+}
+
+type spdxCreationInfo struct {
+	Created  string   `json:"created"`
+	Creators []string `json:"creators"`
+}
+
+type spdxPackage struct {
+	Name             string            `json:"name"`
+	SPDXID           string            `json:"SPDXID"`
+	VersionInfo      string            `json:"versionInfo,omitempty"`
+	DownloadLocation string            `json:"downloadLocation"`
+	FilesAnalyzed    bool              `json:"filesAnalyzed"`
+	LicenseConcluded string            `json:"licenseConcluded"`
+	LicenseDeclared  string            `json:"licenseDeclared"`
+	PrimaryPurpose   string            `json:"primaryPackagePurpose,omitempty"`
+	SourceInfo       string            `json:"sourceInfo,omitempty"`
+	ExternalRefs     []spdxExternalRef `json:"externalRefs,omitempty"`
+}
+
+type spdxExternalRef struct {
+	ReferenceCategory string `json:"referenceCategory"`
+	ReferenceType     string `json:"referenceType"`
+	ReferenceLocator  string `json:"referenceLocator"`
+}
+
+type spdxRelationship struct {
+	SPDXElementID      string `json:"spdxElementId"`
+	RelationshipType   string `json:"relationshipType"`
+	RelatedSPDXElement string `json:"relatedSpdxElement"`
+}
+
+var spdxIDInvalid = regexp.MustCompile(`[^a-zA-Z0-9.-]+`)
+
+// WriteSPDX encodes the document as SPDX 2.3 JSON
+func WriteSPDX(w io.Writer, doc Document) error {
+	created := doc.Created
+	if created.IsZero() {
+		created = time.Now()
+	}
+	out := spdxDocument{
+		SPDXVersion:       "SPDX-2.3",
+		DataLicense:       "CC0-1.0",
+		SPDXID:            "SPDXRef-DOCUMENT",
+		Name:              doc.Name,
+		DocumentNamespace: "https://spdx.org/spdxdocs/" + toolName + "/" + docID(doc, created),
+		CreationInfo: spdxCreationInfo{
+			Created:  created.UTC().Format(time.RFC3339),
+			Creators: []string{"Tool: " + toolName},
+		},
+	}
+	imageID := "SPDXRef-Image"
+	out.Packages = append(out.Packages, spdxPackage{
+		Name:             doc.Name,
+		SPDXID:           imageID,
+		DownloadLocation: "NOASSERTION",
+		LicenseConcluded: "NOASSERTION",
+		LicenseDeclared:  "NOASSERTION",
+		PrimaryPurpose:   "CONTAINER",
+	})
+	out.Relationships = append(out.Relationships, spdxRelationship{
+		SPDXElementID:      "SPDXRef-DOCUMENT",
+		RelationshipType:   "DESCRIBES",
+		RelatedSPDXElement: imageID,
+	})
+	for i, p := range doc.Packages {
+		id := fmt.Sprintf("SPDXRef-Package-%s-%s-%d", p.Type, spdxIDInvalid.ReplaceAllString(p.Name, "-"), i)
+		license := "NOASSERTION"
+		if p.License != "" {
+			// free form license strings are not guaranteed to be valid SPDX expressions
+			license = "LicenseRef-" + spdxIDInvalid.ReplaceAllString(p.License, "-")
+		}
+		sp := spdxPackage{
+			Name:             p.Name,
+			SPDXID:           id,
+			VersionInfo:      p.Version,
+			DownloadLocation: "NOASSERTION",
+			LicenseConcluded: "NOASSERTION",
+			LicenseDeclared:  license,
+			SourceInfo:       "found in " + p.Location,
+		}
+		if p.PURL != "" {
+			sp.ExternalRefs = []spdxExternalRef{{
+				ReferenceCategory: "PACKAGE-MANAGER",
+				ReferenceType:     "purl",
+				ReferenceLocator:  p.PURL,
+			}}
+		}
+		out.Packages = append(out.Packages, sp)
+		out.Relationships = append(out.Relationships, spdxRelationship{
+			SPDXElementID:      imageID,
+			RelationshipType:   "CONTAINS",
+			RelatedSPDXElement: id,
+		})
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(out)
+}
+
+// docID derives a stable unique identifier from the document content
+func docID(doc Document, created time.Time) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s\n", doc.Name, created.UTC().Format(time.RFC3339Nano))
+	for _, p := range doc.Packages {
+		fmt.Fprintf(h, "%s\n", p.PURL)
+	}
+	return hex.EncodeToString(h.Sum(nil))[:32]
+}
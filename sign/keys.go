@@ -0,0 +1,125 @@
+package sign
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	pemEncryptedSigstore = "ENCRYPTED SIGSTORE PRIVATE KEY"
+	pemEncryptedCosign   = "ENCRYPTED COSIGN PRIVATE KEY"
+	pemPKCS8             = "PRIVATE KEY"
+	pemEC                = "EC PRIVATE KEY"
+	pemPublic            = "PUBLIC KEY"
+)
+
+// encryptedKey is the JSON in the PEM block of an encrypted key of "cosign generate-key-pair"
+type encryptedKey struct {
+	KDF struct {
+		Name   string `json:"name"`
+		Params struct {
+			N int `json:"N"`
+			R int `json:"r"`
+			P int `json:"p"`
+		} `json:"params"`
+		Salt []byte `json:"salt"`
+	} `json:"kdf"`
+	Cipher struct {
+		Name  string `json:"name"`
+		Nonce []byte `json:"nonce"`
+	} `json:"cipher"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// LoadPrivateKey reads an ECDSA or ed25519 private key from PEM, either encrypted with password
+// by "cosign generate-key-pair" or unencrypted in PKCS #8 or SEC 1 form
+func LoadPrivateKey(b []byte, password []byte) (crypto.Signer, error) {
+	p, _ := pem.Decode(b)
+	if p == nil {
+		return nil, fmt.Errorf("%w: no PEM block", ErrInvalidKey)
+	}
+	var key interface{}
+	var err error
+	switch p.Type {
+	case pemEncryptedSigstore, pemEncryptedCosign:
+		var der []byte
+		der, err = decrypt(p.Bytes, password)
+		if err != nil {
+			return nil, err
+		}
+		key, err = x509.ParsePKCS8PrivateKey(der)
+	case pemPKCS8:
+		key, err = x509.ParsePKCS8PrivateKey(p.Bytes)
+	case pemEC:
+		key, err = x509.ParseECPrivateKey(p.Bytes)
+	default:
+		return nil, fmt.Errorf("%w: PEM type %q", ErrInvalidKey, p.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidKey, err)
+	}
+	switch k := key.(type) {
+	case *ecdsa.PrivateKey:
+		return k, nil
+	case ed25519.PrivateKey:
+		return k, nil
+	}
+	return nil, fmt.Errorf("%w: %T keys are not supported, use ECDSA or ed25519", ErrInvalidKey, key)
+}
+
+// IsEncrypted returns if the PEM key b needs a password
+func IsEncrypted(b []byte) bool {
+	p, _ := pem.Decode(b)
+	return p != nil && (p.Type == pemEncryptedSigstore || p.Type == pemEncryptedCosign)
+}
+
+// LoadPublicKey reads an ECDSA or ed25519 public key from PEM like cosign.pub
+func LoadPublicKey(b []byte) (crypto.PublicKey, error) {
+	p, _ := pem.Decode(b)
+	if p == nil || p.Type != pemPublic {
+		return nil, fmt.Errorf("%w: no %s PEM block", ErrInvalidKey, pemPublic)
+	}
+	key, err := x509.ParsePKIXPublicKey(p.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidKey, err)
+	}
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		return k, nil
+	case ed25519.PublicKey:
+		return k, nil
+	}
+	return nil, fmt.Errorf("%w: %T keys are not supported, use ECDSA or ed25519", ErrInvalidKey, key)
+}
+
+// decrypt opens the secretbox of an encrypted key with the scrypt key of password
+func decrypt(b []byte, password []byte) ([]byte, error) {
+	var ek encryptedKey
+	if err := json.Unmarshal(b, &ek); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidKey, err)
+	}
+	if ek.KDF.Name != "scrypt" || ek.Cipher.Name != "nacl/secretbox" || len(ek.Cipher.Nonce) != 24 {
+		return nil, fmt.Errorf("%w: encryption %s with %s", ErrInvalidKey, ek.Cipher.Name, ek.KDF.Name)
+	}
+	k, err := scrypt.Key(password, ek.KDF.Salt, ek.KDF.Params.N, ek.KDF.Params.R, ek.KDF.Params.P, 32)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidKey, err)
+	}
+	var key [32]byte
+	var nonce [24]byte
+	copy(key[:], k)
+	copy(nonce[:], ek.Cipher.Nonce)
+	der, ok := secretbox.Open(nil, ek.Ciphertext, &nonce, &key)
+	if !ok {
+		return nil, fmt.Errorf("%w: wrong password", ErrInvalidKey)
+	}
+	return der, nil
+}
@@ -0,0 +1,89 @@
+package sign
+
+import (
+	"crypto"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/regclient/regclient/types/ref"
+	"gopkg.in/yaml.v3"
+)
+
+// ErrUntrusted is returned for an image that matches no rule of a policy
+var ErrUntrusted = errors.New("no trusted keys")
+
+// Policy lists the public keys trusted to sign the images of repositories, e.g.
+//
+//	rules:
+//	  - match: registry.example.com/team/*
+//	    keys: [build.pub]
+//
+// The first rule matching an image applies and images matching no rule are untrusted.
+type Policy struct {
+	Rules []Rule `yaml:"rules"`
+}
+
+// Rule trusts keys for the repositories matching a pattern
+type Rule struct {
+	// Match is a pattern (path.Match syntax) of the Identity of a repository, registry/repository or
+	// the path of an ocidir. A pattern matching a parent also matches the repositories below it,
+	// e.g. "registry.example.com" matches every repository of the registry.
+	Match string `yaml:"match"`
+	// Keys are the files of the public keys, relative to the policy file
+	Keys []string `yaml:"keys"`
+	// PublicKeys are trusted, LoadPolicy reads them from Keys
+	PublicKeys []crypto.PublicKey `yaml:"-"`
+}
+
+// LoadPolicy reads a policy in YAML or JSON and its keys
+func LoadPolicy(file string) (*Policy, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var p Policy
+	if err := yaml.Unmarshal(b, &p); err != nil {
+		return nil, fmt.Errorf("%w: policy %s: %v", ErrInvalidOption, file, err)
+	}
+	dir := filepath.Dir(file)
+	for i, rule := range p.Rules {
+		if _, err := path.Match(rule.Match, ""); err != nil || rule.Match == "" {
+			return nil, fmt.Errorf("%w: policy %s: match %q", ErrInvalidOption, file, rule.Match)
+		}
+		if len(rule.Keys) == 0 {
+			return nil, fmt.Errorf("%w: policy %s: %s has no keys", ErrInvalidOption, file, rule.Match)
+		}
+		for _, k := range rule.Keys {
+			if !filepath.IsAbs(k) {
+				k = filepath.Join(dir, k)
+			}
+			b, err := os.ReadFile(k)
+			if err != nil {
+				return nil, err
+			}
+			key, err := LoadPublicKey(b)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", k, err)
+			}
+			p.Rules[i].PublicKeys = append(p.Rules[i].PublicKeys, key)
+		}
+	}
+	return &p, nil
+}
+
+// Keys returns the keys of the first rule matching the repository of r, ErrUntrusted when none does
+func (p *Policy) Keys(r ref.Ref) ([]crypto.PublicKey, error) {
+	name := Identity(r)
+	for _, rule := range p.Rules {
+		for n := name; n != "." && n != "/" && n != ""; n = path.Dir(n) {
+			if ok, _ := path.Match(strings.TrimSuffix(rule.Match, "/"), n); ok {
+				return rule.PublicKeys, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("%w: no policy rule matches %s", ErrUntrusted, name)
+}
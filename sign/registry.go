@@ -0,0 +1,263 @@
+package sign
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/regclient/regclient"
+	"github.com/regclient/regclient/scheme"
+	"github.com/regclient/regclient/types"
+	"github.com/regclient/regclient/types/manifest"
+	v1 "github.com/regclient/regclient/types/oci/v1"
+	"github.com/regclient/regclient/types/ref"
+)
+
+// maxPayload limits the size of a payload read from a registry
+const maxPayload = 1 << 20
+
+// Signature is a verified signature of an image
+type Signature struct {
+	// Ref is the signature manifest, the .sig tag or the referrer by digest
+	Ref string
+	// Payload is the signed payload
+	Payload Payload
+	// Key is the index of the key that verified the signature
+	Key int
+}
+
+// Tag returns the tag of the signatures of the manifest d, sha256-<hex>.sig
+func Tag(d digest.Digest) string {
+	return d.Algorithm().String() + "-" + d.Encoded() + ".sig"
+}
+
+// SignImage signs the manifest of r, which must have a digest, with key and pushes the signature
+// to the .sig tag, as a referrer or both depending on mode, the tag mode when empty.
+// A signature tag of the manifest keeps its signatures and gets a layer with the new one.
+func SignImage(ctx context.Context, rc *regclient.RegClient, r ref.Ref, key crypto.Signer, mode string) error {
+	if mode == "" {
+		mode = ModeTag
+	}
+	if mode != ModeTag && mode != ModeReferrer && mode != ModeBoth {
+		return fmt.Errorf("%w: mode %q, use %s, %s or %s", ErrInvalidOption, mode, ModeTag, ModeReferrer, ModeBoth)
+	}
+	d, err := digest.Parse(r.Digest)
+	if err != nil {
+		return fmt.Errorf("%w: %s needs a digest: %v", ErrInvalidOption, r.CommonName(), err)
+	}
+	payload, err := NewPayload(r, d)
+	if err != nil {
+		return err
+	}
+	sig, err := Sign(key, payload)
+	if err != nil {
+		return err
+	}
+	layer := types.Descriptor{
+		MediaType:   MediaTypePayload,
+		Digest:      digest.FromBytes(payload),
+		Size:        int64(len(payload)),
+		Annotations: map[string]string{AnnotationSignature: base64.StdEncoding.EncodeToString(sig)},
+	}
+	if _, err := rc.BlobPut(ctx, r, layer, bytes.NewReader(payload)); err != nil {
+		return err
+	}
+	if mode == ModeTag || mode == ModeBoth {
+		if err := putTag(ctx, rc, r, d, layer); err != nil {
+			return err
+		}
+	}
+	if mode == ModeReferrer || mode == ModeBoth {
+		if err := putReferrer(ctx, rc, r, layer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// putTag adds layer to the signature image in the .sig tag of d
+func putTag(ctx context.Context, rc *regclient.RegClient, r ref.Ref, d digest.Digest, layer types.Descriptor) error {
+	rt := r
+	rt.Digest, rt.Tag = "", Tag(d)
+	var layers []types.Descriptor
+	m, err := rc.ManifestGet(ctx, rt)
+	switch {
+	case err == nil:
+		mi, ok := m.(manifest.Imager)
+		if !ok {
+			return fmt.Errorf("%s is not an image: %w", rt.CommonName(), types.ErrUnsupportedMediaType)
+		}
+		if layers, err = mi.GetLayers(); err != nil {
+			return err
+		}
+	case !errors.Is(err, types.ErrNotFound):
+		return err
+	}
+	for _, l := range layers {
+		if l.Digest == layer.Digest && l.Annotations[AnnotationSignature] == layer.Annotations[AnnotationSignature] {
+			return nil
+		}
+	}
+	layers = append(layers, layer)
+
+	// the payloads are not compressed, their digests are the diff_ids
+	conf := v1.Image{RootFS: v1.RootFS{Type: "layers"}}
+	for _, l := range layers {
+		conf.RootFS.DiffIDs = append(conf.RootFS.DiffIDs, l.Digest)
+	}
+	cb, err := json.Marshal(conf)
+	if err != nil {
+		return err
+	}
+	confDesc := types.Descriptor{MediaType: types.MediaTypeOCI1ImageConfig, Digest: digest.FromBytes(cb), Size: int64(len(cb))}
+	if _, err := rc.BlobPut(ctx, rt, confDesc, bytes.NewReader(cb)); err != nil {
+		return err
+	}
+	m, err = manifest.New(manifest.WithOrig(v1.Manifest{
+		Versioned: v1.ManifestSchemaVersion,
+		MediaType: types.MediaTypeOCI1Manifest,
+		Config:    confDesc,
+		Layers:    layers,
+	}))
+	if err != nil {
+		return err
+	}
+	return rc.ManifestPut(ctx, rt, m)
+}
+
+// putReferrer pushes a signature artifact with the subject r
+func putReferrer(ctx context.Context, rc *regclient.RegClient, r ref.Ref, layer types.Descriptor) error {
+	sm, err := rc.ManifestHead(ctx, r, regclient.WithManifestRequireDigest())
+	if err != nil {
+		return err
+	}
+	sd := sm.GetDescriptor()
+	// empty json config, the artifact type is carried in the config media type
+	cb := []byte("{}")
+	confDesc := types.Descriptor{MediaType: ArtifactType, Digest: digest.FromBytes(cb), Size: int64(len(cb))}
+	if _, err := rc.BlobPut(ctx, r, confDesc, bytes.NewReader(cb)); err != nil {
+		return err
+	}
+	m, err := manifest.New(manifest.WithOrig(v1.Manifest{
+		Versioned: v1.ManifestSchemaVersion,
+		MediaType: types.MediaTypeOCI1Manifest,
+		Config:    confDesc,
+		Layers:    []types.Descriptor{layer},
+		Subject:   &types.Descriptor{MediaType: sd.MediaType, Digest: sd.Digest, Size: sd.Size},
+	}))
+	if err != nil {
+		return err
+	}
+	ra := r
+	ra.Tag, ra.Digest = "", m.GetDescriptor().Digest.String()
+	return rc.ManifestPut(ctx, ra, m)
+}
+
+// VerifyImage returns the signatures of the manifest of r, in the .sig tag and the referrers,
+// that verify with one of keys and sign its digest. ErrNoSignature is returned when there are none.
+func VerifyImage(ctx context.Context, rc *regclient.RegClient, r ref.Ref, keys []crypto.PublicKey) ([]Signature, error) {
+	m, err := rc.ManifestHead(ctx, r, regclient.WithManifestRequireDigest())
+	if err != nil {
+		return nil, err
+	}
+	return VerifyDigest(ctx, rc, r, m.GetDescriptor().Digest, keys)
+}
+
+// VerifyDigest returns the signatures of the manifest d in the repository of r like VerifyImage
+func VerifyDigest(ctx context.Context, rc *regclient.RegClient, r ref.Ref, d digest.Digest, keys []crypto.PublicKey) ([]Signature, error) {
+	return VerifyMirror(ctx, rc, r, r, d, keys)
+}
+
+// VerifyMirror returns the signatures of the manifest d of the repository of r like VerifyDigest,
+// but reads them from mirror, a mirror or rewritten location of r. The payloads must sign the identity of r.
+func VerifyMirror(ctx context.Context, rc *regclient.RegClient, mirror, r ref.Ref, d digest.Digest, keys []crypto.PublicKey) ([]Signature, error) {
+	mirror.Tag, mirror.Digest = "", d.String()
+
+	sigRefs := []ref.Ref{}
+	rt := mirror
+	rt.Digest, rt.Tag = "", Tag(d)
+	if _, err := rc.ManifestHead(ctx, rt); err == nil {
+		sigRefs = append(sigRefs, rt)
+	} else if !errors.Is(err, types.ErrNotFound) {
+		return nil, err
+	}
+	// a failed referrers request does not hide a signature in the tag, e.g. of a registry without the API
+	if rl, err := rc.ReferrerList(ctx, mirror, scheme.WithReferrerAT(ArtifactType)); err == nil {
+		for _, desc := range rl.Descriptors {
+			ra := mirror
+			ra.Digest = desc.Digest.String()
+			sigRefs = append(sigRefs, ra)
+		}
+	} else if len(sigRefs) == 0 {
+		return nil, err
+	}
+
+	sigs := []Signature{}
+	for _, sr := range sigRefs {
+		found, err := verifyManifest(ctx, rc, sr, Identity(r), d, keys)
+		if err != nil {
+			return nil, err
+		}
+		sigs = append(sigs, found...)
+	}
+	if len(sigs) == 0 {
+		return nil, fmt.Errorf("%w for %s", ErrNoSignature, r.CommonName())
+	}
+	return sigs, nil
+}
+
+// verifyManifest checks the payload layers of the signature manifest sr, they must sign
+// the manifest d of the repository identity
+func verifyManifest(ctx context.Context, rc *regclient.RegClient, sr ref.Ref, identity string, d digest.Digest, keys []crypto.PublicKey) ([]Signature, error) {
+	m, err := rc.ManifestGet(ctx, sr)
+	if err != nil {
+		return nil, err
+	}
+	mi, ok := m.(manifest.Imager)
+	if !ok {
+		return nil, nil
+	}
+	layers, err := mi.GetLayers()
+	if err != nil {
+		return nil, err
+	}
+	sigs := []Signature{}
+	for _, l := range layers {
+		sig, err := base64.StdEncoding.DecodeString(l.Annotations[AnnotationSignature])
+		if l.MediaType != MediaTypePayload || len(sig) == 0 || err != nil || l.Size > maxPayload {
+			continue
+		}
+		payload, err := readBlob(ctx, rc, sr, l)
+		if err != nil {
+			return nil, err
+		}
+		var p Payload
+		if l.Digest != digest.FromBytes(payload) || json.Unmarshal(payload, &p) != nil ||
+			p.Critical.Type != payloadType || p.Critical.Image.DockerManifestDigest != d.String() ||
+			p.Critical.Identity.DockerReference != identity {
+			continue
+		}
+		for i, key := range keys {
+			if Verify(key, payload, sig) {
+				sigs = append(sigs, Signature{Ref: sr.CommonName(), Payload: p, Key: i})
+				break
+			}
+		}
+	}
+	return sigs, nil
+}
+
+func readBlob(ctx context.Context, rc *regclient.RegClient, r ref.Ref, d types.Descriptor) ([]byte, error) {
+	br, err := rc.BlobGet(ctx, r, d)
+	if err != nil {
+		return nil, err
+	}
+	defer br.Close()
+	return io.ReadAll(io.LimitReader(br, maxPayload))
+}
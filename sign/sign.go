@@ -0,0 +1,104 @@
+// Package sign signs images with local keys in the format of cosign and verifies their signatures.
+//
+// A signature is a simple signing payload naming the repository and the manifest digest, signed with
+// an ECDSA key over its SHA-256 hash or with an ed25519 key. It is stored as a layer of a signature image,
+// the signature in base64 in an annotation, either as the sha256-<hex>.sig tag that cosign uses by default,
+// as an OCI referrer of the signed manifest, or both. There is no transparency log and no certificate,
+// so "cosign verify" needs --insecure-ignore-tlog with the public key.
+package sign
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/regclient/regclient/types/ref"
+)
+
+const (
+	// MediaTypePayload is the media type of the layer with the simple signing payload
+	MediaTypePayload = "application/vnd.dev.cosign.simplesigning.v1+json"
+	// ArtifactType is the artifact type of a signature pushed as a referrer
+	ArtifactType = "application/vnd.dev.cosign.artifact.sig.v1+json"
+	// AnnotationSignature holds the base64 signature of the payload on its layer
+	AnnotationSignature = "dev.cosignproject.cosign/signature"
+
+	// ModeTag stores the signature in the sha256-<hex>.sig tag next to the image
+	ModeTag = "tag"
+	// ModeReferrer stores the signature as an OCI referrer of the image
+	ModeReferrer = "referrer"
+	// ModeBoth stores the signature in both places
+	ModeBoth = "both"
+
+	payloadType = "cosign container image signature"
+)
+
+var (
+	// ErrInvalidKey is returned for a key file that cannot be read, e.g. with a wrong password
+	ErrInvalidKey = errors.New("invalid key")
+	// ErrInvalidOption is returned for an unknown mode
+	ErrInvalidOption = errors.New("invalid option")
+	// ErrNoSignature is returned when an image has no signature that verifies with the keys
+	ErrNoSignature = errors.New("no valid signature")
+)
+
+// Payload is the simple signing payload of cosign
+type Payload struct {
+	Critical struct {
+		Identity struct {
+			DockerReference string `json:"docker-reference"`
+		} `json:"identity"`
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+	Optional map[string]interface{} `json:"optional"`
+}
+
+// NewPayload returns the payload that signs the manifest d in the repository of r
+func NewPayload(r ref.Ref, d digest.Digest) ([]byte, error) {
+	var p Payload
+	p.Critical.Identity.DockerReference = Identity(r)
+	p.Critical.Image.DockerManifestDigest = d.String()
+	p.Critical.Type = payloadType
+	return json.Marshal(p)
+}
+
+// Identity returns the name of the repository of r, registry/repository or the path of an ocidir
+func Identity(r ref.Ref) string {
+	if r.Scheme == "ocidir" {
+		return r.Path
+	}
+	return r.Registry + "/" + r.Repository
+}
+
+// Sign signs payload with key, ECDSA keys sign its SHA-256 hash like cosign
+func Sign(key crypto.Signer, payload []byte) ([]byte, error) {
+	switch key.(type) {
+	case *ecdsa.PrivateKey:
+		h := sha256.Sum256(payload)
+		return key.Sign(rand.Reader, h[:], crypto.SHA256)
+	case ed25519.PrivateKey:
+		return key.Sign(rand.Reader, payload, crypto.Hash(0))
+	}
+	return nil, fmt.Errorf("%w: %T keys are not supported, use ECDSA or ed25519", ErrInvalidKey, key)
+}
+
+// Verify checks the signature of payload with key
+func Verify(key crypto.PublicKey, payload, sig []byte) bool {
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		h := sha256.Sum256(payload)
+		return ecdsa.VerifyASN1(k, h[:], sig)
+	case ed25519.PublicKey:
+		return ed25519.Verify(k, payload, sig)
+	}
+	return false
+}
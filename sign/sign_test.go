@@ -0,0 +1,293 @@
+package sign
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/regclient/regclient"
+	"github.com/regclient/regclient/scheme"
+	"github.com/regclient/regclient/types"
+	"github.com/regclient/regclient/types/manifest"
+	v1 "github.com/regclient/regclient/types/oci/v1"
+	"github.com/regclient/regclient/types/ref"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+)
+
+// testEncrypt returns key as an encrypted PEM of "cosign generate-key-pair"
+func testEncrypt(t *testing.T, key crypto.Signer, password string) []byte {
+	t.Helper()
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+	var ek encryptedKey
+	ek.KDF.Name = "scrypt"
+	ek.KDF.Params.N, ek.KDF.Params.R, ek.KDF.Params.P = 1<<10, 8, 1
+	ek.KDF.Salt = make([]byte, 32)
+	ek.Cipher.Name = "nacl/secretbox"
+	ek.Cipher.Nonce = make([]byte, 24)
+	rand.Read(ek.KDF.Salt)
+	rand.Read(ek.Cipher.Nonce)
+	k, err := scrypt.Key([]byte(password), ek.KDF.Salt, ek.KDF.Params.N, ek.KDF.Params.R, ek.KDF.Params.P, 32)
+	require.NoError(t, err)
+	var sk [32]byte
+	var nonce [24]byte
+	copy(sk[:], k)
+	copy(nonce[:], ek.Cipher.Nonce)
+	ek.Ciphertext = secretbox.Seal(nil, der, &nonce, &sk)
+	b, err := json.Marshal(ek)
+	require.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: pemEncryptedSigstore, Bytes: b})
+}
+
+func testPublic(t *testing.T, key crypto.Signer) []byte {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(key.Public())
+	require.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: pemPublic, Bytes: der})
+}
+
+func TestKeys(t *testing.T) {
+	ec, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	_, ed, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	require.NoError(t, err)
+	payload := []byte("payload")
+
+	for _, key := range []crypto.Signer{ec, ed} {
+		// encrypted, PKCS #8 and for ECDSA SEC 1
+		pems := [][]byte{testEncrypt(t, key, "secret")}
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		require.NoError(t, err)
+		pems = append(pems, pem.EncodeToMemory(&pem.Block{Type: pemPKCS8, Bytes: der}))
+		if ec, ok := key.(*ecdsa.PrivateKey); ok {
+			der, err := x509.MarshalECPrivateKey(ec)
+			require.NoError(t, err)
+			pems = append(pems, pem.EncodeToMemory(&pem.Block{Type: pemEC, Bytes: der}))
+		}
+		pub, err := LoadPublicKey(testPublic(t, key))
+		require.NoError(t, err)
+		for _, b := range pems {
+			k, err := LoadPrivateKey(b, []byte("secret"))
+			require.NoError(t, err)
+			sig, err := Sign(k, payload)
+			require.NoError(t, err)
+			require.True(t, Verify(pub, payload, sig))
+			require.False(t, Verify(pub, []byte("other"), sig))
+		}
+	}
+
+	_, err = LoadPrivateKey(testEncrypt(t, ec, "secret"), []byte("wrong"))
+	require.ErrorIs(t, err, ErrInvalidKey)
+	der, err := x509.MarshalPKCS8PrivateKey(rsaKey)
+	require.NoError(t, err)
+	_, err = LoadPrivateKey(pem.EncodeToMemory(&pem.Block{Type: pemPKCS8, Bytes: der}), nil)
+	require.ErrorIs(t, err, ErrInvalidKey)
+	_, err = LoadPublicKey(testPublic(t, rsaKey))
+	require.ErrorIs(t, err, ErrInvalidKey)
+	_, err = LoadPrivateKey([]byte("not a key"), nil)
+	require.ErrorIs(t, err, ErrInvalidKey)
+}
+
+// testImage pushes an image with an empty config to r and returns it by digest
+func testImage(t *testing.T, ctx context.Context, rc *regclient.RegClient, r ref.Ref) ref.Ref {
+	t.Helper()
+	cb := []byte(`{"architecture":"amd64","os":"linux","rootfs":{"type":"layers","diff_ids":[]}}`)
+	conf := types.Descriptor{MediaType: types.MediaTypeOCI1ImageConfig, Digest: digest.FromBytes(cb), Size: int64(len(cb))}
+	_, err := rc.BlobPut(ctx, r, conf, bytes.NewReader(cb))
+	require.NoError(t, err)
+	m, err := manifest.New(manifest.WithOrig(v1.Manifest{
+		Versioned: v1.ManifestSchemaVersion,
+		MediaType: types.MediaTypeOCI1Manifest,
+		Config:    conf,
+		Layers:    []types.Descriptor{},
+	}))
+	require.NoError(t, err)
+	require.NoError(t, rc.ManifestPut(ctx, r, m))
+	r.Digest = m.GetDescriptor().Digest.String()
+	return r
+}
+
+func TestSignImage(t *testing.T) {
+	ctx := context.Background()
+	rc := regclient.New()
+	ec, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	pub, other, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	ecPub, err := LoadPublicKey(testPublic(t, ec))
+	require.NoError(t, err)
+
+	for _, mode := range []string{"", ModeTag, ModeReferrer, ModeBoth} {
+		r, err := ref.New("ocidir://" + filepath.Join(t.TempDir(), "repo") + ":latest")
+		require.NoError(t, err)
+		r = testImage(t, ctx, rc, r)
+
+		_, err = VerifyImage(ctx, rc, r, []crypto.PublicKey{ecPub})
+		require.ErrorIs(t, err, ErrNoSignature, mode)
+
+		require.NoError(t, SignImage(ctx, rc, r, ec, mode), mode)
+		// a second signature is added next to the first
+		require.NoError(t, SignImage(ctx, rc, r, other, mode), mode)
+
+		d, _ := digest.Parse(r.Digest)
+		rt := r
+		rt.Digest, rt.Tag = "", Tag(d)
+		_, err = rc.ManifestHead(ctx, rt)
+		if mode == ModeReferrer {
+			require.ErrorIs(t, err, types.ErrNotFound, mode)
+		} else {
+			require.NoError(t, err, mode)
+		}
+		rl, err := rc.ReferrerList(ctx, r, scheme.WithReferrerAT(ArtifactType))
+		require.NoError(t, err)
+		if mode == ModeReferrer || mode == ModeBoth {
+			require.Len(t, rl.Descriptors, 2, mode)
+		} else {
+			require.Empty(t, rl.Descriptors, mode)
+		}
+
+		// the image ref by tag resolves to the digest
+		rTag := r
+		rTag.Digest = ""
+		sigs, err := VerifyImage(ctx, rc, rTag, []crypto.PublicKey{pub, ecPub})
+		require.NoError(t, err, mode)
+		want := 2
+		if mode == ModeBoth {
+			want = 4
+		}
+		require.Len(t, sigs, want, mode)
+		keys := map[int]int{}
+		for _, s := range sigs {
+			require.Equal(t, r.Digest, s.Payload.Critical.Image.DockerManifestDigest)
+			require.Equal(t, r.Path, s.Payload.Critical.Identity.DockerReference)
+			keys[s.Key]++
+		}
+		require.Equal(t, map[int]int{0: want / 2, 1: want / 2}, keys, mode)
+
+		// another key
+		_, third, err := ed25519.GenerateKey(rand.Reader)
+		require.NoError(t, err)
+		_, err = VerifyImage(ctx, rc, r, []crypto.PublicKey{third.Public()})
+		require.ErrorIs(t, err, ErrNoSignature, mode)
+	}
+
+	r, err := ref.New("ocidir://" + filepath.Join(t.TempDir(), "repo") + ":latest")
+	require.NoError(t, err)
+	require.ErrorIs(t, SignImage(ctx, rc, r, ec, ModeTag), ErrInvalidOption)
+	r = testImage(t, ctx, rc, r)
+	require.ErrorIs(t, SignImage(ctx, rc, r, ec, "rekor"), ErrInvalidOption)
+}
+
+func TestVerifyMirror(t *testing.T) {
+	ctx := context.Background()
+	rc := regclient.New()
+	ec, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	keys := []crypto.PublicKey{ec.Public()}
+	r, err := ref.New("ocidir://" + filepath.Join(t.TempDir(), "repo") + ":latest")
+	require.NoError(t, err)
+	r = testImage(t, ctx, rc, r)
+	require.NoError(t, SignImage(ctx, rc, r, ec, ModeBoth))
+	d, _ := digest.Parse(r.Digest)
+
+	// a copy with the signatures signs the identity of the original repository
+	mirror, err := ref.New("ocidir://" + filepath.Join(t.TempDir(), "mirror") + ":latest")
+	require.NoError(t, err)
+	require.NoError(t, rc.ImageCopy(ctx, r, mirror, regclient.ImageWithDigestTags(), regclient.ImageWithReferrers()))
+	_, err = VerifyDigest(ctx, rc, mirror, d, keys)
+	require.ErrorIs(t, err, ErrNoSignature)
+	sigs, err := VerifyMirror(ctx, rc, mirror, r, d, keys)
+	require.NoError(t, err)
+	require.Len(t, sigs, 2)
+
+	// the signature tag is kept when the referrers fail
+	m, err := rc.ManifestGet(ctx, r)
+	require.NoError(t, err)
+	rf := r
+	rf.Digest, rf.Tag = "", d.Algorithm().String()+"-"+d.Encoded()
+	require.NoError(t, rc.ManifestPut(ctx, rf, m))
+	_, err = rc.ReferrerList(ctx, r, scheme.WithReferrerAT(ArtifactType))
+	require.Error(t, err)
+	sigs, err = VerifyDigest(ctx, rc, r, d, keys)
+	require.NoError(t, err)
+	require.Len(t, sigs, 1)
+	require.Equal(t, "ocidir://"+r.Path+":"+Tag(d), sigs[0].Ref)
+	rt := r
+	rt.Digest, rt.Tag = "", Tag(d)
+	require.NoError(t, rc.TagDelete(ctx, rt))
+	_, err = VerifyDigest(ctx, rc, r, d, keys)
+	require.Error(t, err)
+	require.NotErrorIs(t, err, ErrNoSignature)
+}
+
+func TestPolicy(t *testing.T) {
+	dir := t.TempDir()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "build.pub"), testPublic(t, key), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "other.pub"), testPublic(t, key), 0644))
+	file := filepath.Join(dir, "policy.yaml")
+	require.NoError(t, os.WriteFile(file, []byte(`rules:
+  - match: registry.example.com/team/app
+    keys: [build.pub, other.pub]
+  - match: registry.example.com/team/*
+    keys: [build.pub]
+  - match: localhost:5000
+    keys: [`+filepath.Join(dir, "other.pub")+`]
+  - match: /srv/images/*
+    keys: [build.pub]
+`), 0644))
+	p, err := LoadPolicy(file)
+	require.NoError(t, err)
+
+	for name, n := range map[string]int{
+		"registry.example.com/team/app:latest":                      2,
+		"registry.example.com/team/base/alpine:3.18":                1,
+		"registry.example.com/team":                                 0,
+		"registry.example.com/other/app":                            0,
+		"localhost:5000/app":                                        1,
+		"localhost:5000/team/app@sha256:" + strings.Repeat("0", 64): 1,
+		"docker.io/library/alpine":                                  0,
+		"ocidir:///srv/images/app:v1":                               1,
+		"ocidir:///srv/app:v1":                                      0,
+	} {
+		r, err := ref.New(name)
+		require.NoError(t, err, name)
+		keys, err := p.Keys(r)
+		if n == 0 {
+			require.ErrorIs(t, err, ErrUntrusted, name)
+			continue
+		}
+		require.NoError(t, err, name)
+		require.Len(t, keys, n, name)
+	}
+
+	for _, policy := range []string{
+		"rules: [",
+		"rules:\n  - match: '['\n    keys: [build.pub]\n",
+		"rules:\n  - match: registry.example.com\n",
+		"rules:\n  - match: registry.example.com\n    keys: [missing.pub]\n",
+		"rules:\n  - match: registry.example.com\n    keys: [policy.yaml]\n",
+	} {
+		require.NoError(t, os.WriteFile(file, []byte(policy), 0644))
+		_, err := LoadPolicy(file)
+		require.Error(t, err, policy)
+	}
+}
@@ -0,0 +1,79 @@
+package squash
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/regclient/regclient"
+	"github.com/regclient/regclient/config"
+	"github.com/stretchr/testify/require"
+)
+
+// testCpioFiles returns the content of each entry of a newc archive
+func testCpioFiles(t *testing.T, b []byte) map[string]string {
+	t.Helper()
+	files := map[string]string{}
+	for off := 0; ; {
+		require.Equal(t, "070701", string(b[off:off+6]))
+		field := func(i int) int {
+			v, err := strconv.ParseUint(string(b[off+6+8*i:off+14+8*i]), 16, 32)
+			require.NoError(t, err)
+			return int(v)
+		}
+		size, nameSize := field(6), field(11)
+		name := string(b[off+110 : off+110+nameSize-1])
+		off = (off + 110 + nameSize + 3) &^ 3
+		if name == "TRAILER!!!" {
+			return files
+		}
+		files[name] = string(b[off : off+size])
+		off = (off + size + 3) &^ 3
+	}
+}
+
+func TestCpio(t *testing.T) {
+	srv := httptest.NewServer(testRegistry(map[string][][]byte{"linux/amd64": testSquashfsLayers(t)}))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+	source := host + "/test/app:latest"
+	rc := regclient.New(regclient.WithConfigHost(config.Host{Name: host, TLS: config.TLSDisabled}))
+
+	for _, compression := range []string{"", CompressionZstd, CompressionNone} {
+		buf := &bytes.Buffer{}
+		res, err := Squash(context.Background(), source, buf, Options{
+			Platform:    "linux/amd64",
+			RegClient:   rc,
+			Format:      FormatCpio,
+			Compression: compression,
+			WorkDir:     t.TempDir(),
+		})
+		require.NoError(t, err, compression)
+		require.EqualValues(t, buf.Len(), res.OutputSize)
+		var r io.Reader = buf
+		switch compression {
+		case "":
+			r, err = gzip.NewReader(buf)
+			require.NoError(t, err)
+		case CompressionZstd:
+			zr, err := zstd.NewReader(buf)
+			require.NoError(t, err)
+			defer zr.Close()
+			r = zr
+		}
+		b, err := io.ReadAll(r)
+		require.NoError(t, err)
+		files := testCpioFiles(t, b)
+		require.Equal(t, "v2", files["usr/bin/app"]+files["usr/bin/app2"], compression)
+		require.Equal(t, "app", files["usr/bin/sh"])
+		require.Contains(t, files, "dev/null")
+		require.NotContains(t, files, "usr/bin/gone")
+		require.Contains(t, files["init"], "exec '/usr/bin/app' '--name' 'it'\\''s'\n")
+	}
+}
@@ -0,0 +1,22 @@
+package squash
+
+import "errors"
+
+var (
+	// ErrBlobIdleTimeout is returned when a layer download receives no data within the idle timeout
+	ErrBlobIdleTimeout = errors.New("blob idle timeout")
+	// ErrInvalidOption is returned for an unknown platform, format, compression or filter
+	ErrInvalidOption = errors.New("invalid option")
+	// ErrInsufficientSpace is returned when the free space is below the estimated size of the squashed filesystem
+	ErrInsufficientSpace = errors.New("insufficient disk space")
+	// ErrLimitExceeded is matched by a LimitError
+	ErrLimitExceeded = errors.New("limit exceeded")
+	// ErrWindowsHives is returned for registry hives of a Windows image that are rejected or cannot be merged
+	ErrWindowsHives = errors.New("windows registry hives not supported")
+	// ErrNoCommand is returned for an init shim of an image without Entrypoint and Cmd
+	ErrNoCommand = errors.New("image has no command")
+	// ErrPush is returned when Push fails to upload the squashed image to the target
+	ErrPush = errors.New("push failed")
+	// ErrNotImage is returned when the source is not an image or an index of images
+	ErrNotImage = errors.New("reference is not a known image media type")
+)
@@ -0,0 +1,118 @@
+package squash
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/regclient/regclient"
+	"github.com/regclient/regclient/config"
+	v1 "github.com/regclient/regclient/types/oci/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExt4(t *testing.T) {
+	srv := httptest.NewServer(testRegistry(map[string][][]byte{"linux/amd64": testSquashfsLayers(t)}))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+	source := host + "/test/app:latest"
+	rc := regclient.New(regclient.WithConfigHost(config.Host{Name: host, TLS: config.TLSDisabled}))
+
+	for _, tc := range []struct {
+		spill string
+		size  int64
+	}{
+		{SpillAuto, 0},
+		{SpillIndex, 10<<20 + 1},
+	} {
+		buf := &bytes.Buffer{}
+		res, err := Squash(context.Background(), source, buf, Options{
+			Platform:  "linux/amd64",
+			RegClient: rc,
+			Format:    FormatExt4,
+			Size:      tc.size,
+			Spill:     tc.spill,
+			InitShim:  true,
+			WorkDir:   t.TempDir(),
+		})
+		require.NoError(t, err, tc.spill)
+		require.Equal(t, []string{"/usr/bin/app"}, res.Config.Config.Entrypoint)
+		require.EqualValues(t, buf.Len(), res.OutputSize)
+		if tc.size != 0 {
+			require.EqualValues(t, 10<<20+4096, buf.Len())
+		}
+		require.EqualValues(t, 0xEF53, binary.LittleEndian.Uint16(buf.Bytes()[1024+56:]))
+		testMountExt4(t, buf.Bytes())
+	}
+
+	_, err := Squash(context.Background(), source, &bytes.Buffer{}, Options{RegClient: rc, Format: FormatExt4, Compression: CompressionGzip})
+	require.ErrorIs(t, err, ErrInvalidOption)
+	_, err = Squash(context.Background(), source, &bytes.Buffer{}, Options{RegClient: rc, Size: 4096})
+	require.ErrorIs(t, err, ErrInvalidOption)
+	_, err = Squash(context.Background(), source, &bytes.Buffer{}, Options{RegClient: rc, Format: FormatSquashfs, InitShim: true})
+	require.ErrorIs(t, err, ErrInvalidOption)
+}
+
+// testMountExt4 checks the content of the image with the ext4 driver of the kernel when it can be mounted
+func testMountExt4(t *testing.T, img []byte) {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "image.ext4")
+	require.NoError(t, os.WriteFile(file, img, 0644))
+	if e2fsck, err := exec.LookPath("e2fsck"); err == nil {
+		out, err := exec.Command(e2fsck, "-fn", file).CombinedOutput()
+		require.NoError(t, err, string(out))
+	}
+	if os.Geteuid() != 0 {
+		return
+	}
+	dir := t.TempDir()
+	if out, err := exec.Command("mount", "-t", "ext4", "-o", "loop,ro", file, dir).CombinedOutput(); err != nil {
+		t.Logf("skipping mount check: %v: %s", err, out)
+		return
+	}
+	defer exec.Command("umount", dir).Run()
+
+	b, err := os.ReadFile(filepath.Join(dir, "usr/bin/app2"))
+	require.NoError(t, err)
+	require.Equal(t, "v2", string(b))
+	target, err := os.Readlink(filepath.Join(dir, "usr/bin/sh"))
+	require.NoError(t, err)
+	require.Equal(t, "app", target)
+	require.NoFileExists(t, filepath.Join(dir, "usr/bin/gone"))
+	fi, err := os.Stat(filepath.Join(dir, "sbin/init"))
+	require.NoError(t, err)
+	require.EqualValues(t, 0755, fi.Mode().Perm())
+	b, err = os.ReadFile(filepath.Join(dir, "sbin/init"))
+	require.NoError(t, err)
+	require.Contains(t, string(b), "exec '/usr/bin/app' '--name' 'it'\\''s'\n")
+	require.NoError(t, exec.Command("umount", dir).Run())
+}
+
+func TestInitShim(t *testing.T) {
+	script, err := initShim(v1.ImageConfig{
+		Env:        []string{"PATH=/usr/local/bin:/usr/bin", "EMPTY=", "invalid"},
+		Entrypoint: []string{"/docker-entrypoint.sh"},
+		Cmd:        []string{"nginx", "-g", "daemon off;"},
+		WorkingDir: "/srv/my app",
+	})
+	require.NoError(t, err)
+	require.Equal(t, `#!/bin/sh
+mount -t proc proc /proc 2>/dev/null
+mount -t sysfs sysfs /sys 2>/dev/null
+mount -t devtmpfs devtmpfs /dev 2>/dev/null
+mkdir -p /dev/pts && mount -t devpts devpts /dev/pts 2>/dev/null
+export 'PATH=/usr/local/bin:/usr/bin'
+export 'EMPTY='
+cd '/srv/my app' || exit 1
+exec '/docker-entrypoint.sh' 'nginx' '-g' 'daemon off;'
+`, string(script))
+
+	_, err = initShim(v1.ImageConfig{Env: []string{"PATH=/bin"}})
+	require.ErrorIs(t, err, ErrNoCommand)
+}
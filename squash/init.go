@@ -0,0 +1,49 @@
+package squash
+
+import (
+	"fmt"
+	"strings"
+
+	v1 "github.com/regclient/regclient/types/oci/v1"
+)
+
+const (
+	// initShimPath is where the shim is added, below the target of a /sbin symlink of a merged /usr
+	initShimPath = "sbin/init"
+	// initramfsShimPath is the program the kernel runs from an initramfs
+	initramfsShimPath = "init"
+)
+
+// initShim returns the /sbin/init script that sets up the kernel filesystems and runs the command of the image as pid 1.
+// Mount failures are ignored, e.g. for a /dev already mounted by the kernel.
+func initShim(conf v1.ImageConfig) ([]byte, error) {
+	args := append(append([]string{}, conf.Entrypoint...), conf.Cmd...)
+	if len(args) == 0 {
+		return nil, ErrNoCommand
+	}
+	var b strings.Builder
+	b.WriteString("#!/bin/sh\n")
+	b.WriteString("mount -t proc proc /proc 2>/dev/null\n")
+	b.WriteString("mount -t sysfs sysfs /sys 2>/dev/null\n")
+	b.WriteString("mount -t devtmpfs devtmpfs /dev 2>/dev/null\n")
+	b.WriteString("mkdir -p /dev/pts && mount -t devpts devpts /dev/pts 2>/dev/null\n")
+	for _, env := range conf.Env {
+		if name, _, ok := strings.Cut(env, "="); ok && name != "" {
+			fmt.Fprintf(&b, "export %s\n", shellQuote(env))
+		}
+	}
+	if conf.WorkingDir != "" {
+		fmt.Fprintf(&b, "cd %s || exit 1\n", shellQuote(conf.WorkingDir))
+	}
+	b.WriteString("exec")
+	for _, a := range args {
+		b.WriteString(" " + shellQuote(a))
+	}
+	b.WriteString("\n")
+	return []byte(b.String()), nil
+}
+
+// shellQuote returns s in single quotes for /bin/sh
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,191 @@
+package squash
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/regclient/regclient/types"
+)
+
+const (
+	// LimitBytes is the total size of the files extracted from all layers
+	LimitBytes = "bytes"
+	// LimitEntries is the number of entries in a layer
+	LimitEntries = "entries"
+	// LimitFileSize is the size of a single file
+	LimitFileSize = "file size"
+	// LimitDepth is the number of path components of an entry
+	LimitDepth = "depth"
+	// LimitRatio is the uncompressed size of a layer divided by its compressed size
+	LimitRatio = "ratio"
+
+	// ratioMinBytes is extracted before the ratio is checked, small layers of e.g. empty files compress well
+	ratioMinBytes = 1 << 20
+	// estimatedRatio is assumed for compressed layers when checking the free space
+	estimatedRatio = 3
+)
+
+// Limits protects against decompression bombs and full disks, a zero field disables that limit
+type Limits struct {
+	MaxBytes    int64   // total size of the files extracted from all layers
+	MaxEntries  int     // entries per layer
+	MaxFileSize int64   // size of a single file
+	MaxDepth    int     // path components of an entry
+	MaxRatio    float64 // uncompressed size of a layer divided by its compressed size
+	// SpaceCheck compares the free space with the estimated uncompressed size before extracting
+	SpaceCheck bool
+}
+
+// DefaultLimits are used when Options.Limits is nil
+var DefaultLimits = Limits{
+	MaxBytes:    64 << 30,
+	MaxEntries:  1000000,
+	MaxFileSize: 16 << 30,
+	MaxDepth:    128,
+	MaxRatio:    1000,
+	SpaceCheck:  true,
+}
+
+// LimitError is returned when a layer exceeds one of the Limits, it matches ErrLimitExceeded
+type LimitError struct {
+	Layer  int
+	Digest digest.Digest
+	Limit  string // LimitBytes, LimitEntries, LimitFileSize, LimitDepth, or LimitRatio
+	Max    float64
+	Path   string // entry that exceeded the limit, empty for LimitRatio
+}
+
+func (e *LimitError) Error() string {
+	msg := fmt.Sprintf("layer %d (%s) exceeds the %s limit of %s", e.Layer, e.Digest, e.Limit, strconv.FormatFloat(e.Max, 'f', -1, 64))
+	if e.Path != "" {
+		msg += " at " + e.Path
+	}
+	return msg
+}
+
+// Is matches ErrLimitExceeded
+func (e *LimitError) Is(target error) bool {
+	return target == ErrLimitExceeded
+}
+
+// guard enforces the limits while a layer is extracted
+type guard struct {
+	limits  *Limits
+	layer   int
+	digest  digest.Digest
+	total   *int64 // file bytes extracted from all layers
+	entries int
+}
+
+func (g *guard) err(limit string, max float64, path string) error {
+	return &LimitError{Layer: g.layer, Digest: g.digest, Limit: limit, Max: max, Path: path}
+}
+
+// check is called with each header before it is extracted
+func (g *guard) check(th *tar.Header) error {
+	l := g.limits
+	g.entries++
+	if l.MaxEntries > 0 && g.entries > l.MaxEntries {
+		return g.err(LimitEntries, float64(l.MaxEntries), th.Name)
+	}
+	if name := strings.Trim(path.Clean("/"+th.Name), "/"); l.MaxDepth > 0 && name != "" && strings.Count(name, "/")+1 > l.MaxDepth {
+		return g.err(LimitDepth, float64(l.MaxDepth), th.Name)
+	}
+	if th.Typeflag != tar.TypeReg && th.Typeflag != tar.TypeRegA {
+		return nil
+	}
+	if l.MaxFileSize > 0 && th.Size > l.MaxFileSize {
+		return g.err(LimitFileSize, float64(l.MaxFileSize), th.Name)
+	}
+	*g.total += th.Size
+	if l.MaxBytes > 0 && *g.total > l.MaxBytes {
+		return g.err(LimitBytes, float64(l.MaxBytes), th.Name)
+	}
+	return nil
+}
+
+// reader enforces the compression ratio of the uncompressed stream r
+func (g *guard) reader(r io.Reader, compressed *readCounter) io.Reader {
+	if g.limits.MaxRatio <= 0 {
+		return r
+	}
+	return &ratioReader{r: r, g: g, compressed: compressed}
+}
+
+type ratioReader struct {
+	r          io.Reader
+	g          *guard
+	compressed *readCounter
+	n          int64
+}
+
+func (rr *ratioReader) Read(p []byte) (int, error) {
+	n, err := rr.r.Read(p)
+	rr.n += int64(n)
+	if max := rr.g.limits.MaxRatio; rr.n > ratioMinBytes && float64(rr.n) > max*float64(rr.compressed.n) {
+		return n, rr.g.err(LimitRatio, max, "")
+	}
+	return n, err
+}
+
+// estimateSize returns the expected uncompressed size of the layers,
+// the compressed size multiplied by estimatedRatio unless the layer is not compressed
+func estimateSize(layers []types.Descriptor, limits *Limits) int64 {
+	var size int64
+	for _, l := range layers {
+		switch l.MediaType {
+		case types.MediaTypeOCI1Layer, types.MediaTypeOCI1ForeignLayer:
+			size += l.Size
+		default:
+			size += l.Size * estimatedRatio
+		}
+	}
+	if limits.MaxBytes > 0 && size > limits.MaxBytes {
+		size = limits.MaxBytes
+	}
+	return size
+}
+
+// checkSpace returns ErrInsufficientSpace when one of dirs has less than need bytes available,
+// dirs on the same filesystem need the space for each of them
+func checkSpace(dirs []string, need int64) error {
+	type fsNeed struct {
+		dirs  []string
+		avail uint64
+		need  uint64
+	}
+	filesystems := map[string]*fsNeed{}
+	var order []string
+	for _, dir := range dirs {
+		avail, fsid, err := freeSpace(dir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		if fsid == "" {
+			// unknown on this platform
+			continue
+		}
+		if filesystems[fsid] == nil {
+			filesystems[fsid] = &fsNeed{avail: avail}
+			order = append(order, fsid)
+		}
+		filesystems[fsid].dirs = append(filesystems[fsid].dirs, dir)
+		filesystems[fsid].need += uint64(need)
+	}
+	for _, fsid := range order {
+		fs := filesystems[fsid]
+		if fs.need > fs.avail {
+			return fmt.Errorf("%w: need about %d bytes in %s, %d available", ErrInsufficientSpace, fs.need, strings.Join(fs.dirs, " and "), fs.avail)
+		}
+	}
+	return nil
+}
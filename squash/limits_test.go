@@ -0,0 +1,87 @@
+package squash
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/regclient/regclient"
+	"github.com/regclient/regclient/config"
+	"github.com/regclient/regclient/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLimits(t *testing.T) {
+	many := map[string]string{}
+	for i := 0; i < 20; i++ {
+		many[fmt.Sprintf("etc/file%d", i)] = "x"
+	}
+	deep := strings.Repeat("d/", 20) + "file"
+	base := testGzipLayer(t, map[string]string{"etc/os-release": "test\n"})
+
+	for _, tc := range []struct {
+		name   string
+		layer  []byte
+		limits Limits
+		limit  string
+		path   string
+	}{
+		{"bytes", testGzipLayer(t, map[string]string{"a": strings.Repeat("a", 600), "b": strings.Repeat("b", 600)}), Limits{MaxBytes: 1000}, LimitBytes, "b"},
+		{"entries", testGzipLayer(t, many), Limits{MaxEntries: 10}, LimitEntries, ""},
+		{"file size", testGzipLayer(t, map[string]string{"big": strings.Repeat("x", 2000)}), Limits{MaxFileSize: 1000}, LimitFileSize, "big"},
+		{"depth", testGzipLayer(t, map[string]string{deep: "x"}), Limits{MaxDepth: 10}, LimitDepth, deep},
+		{"ratio", testGzipLayer(t, map[string]string{"zeros": string(make([]byte, 4<<20))}), Limits{MaxRatio: 100}, LimitRatio, ""},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			srv := httptest.NewServer(testRegistry(map[string][][]byte{"linux/amd64": {base, tc.layer}}))
+			defer srv.Close()
+			host := strings.TrimPrefix(srv.URL, "http://")
+			rc := regclient.New(regclient.WithConfigHost(config.Host{Name: host, TLS: config.TLSDisabled}))
+			_, err := SquashDir(context.Background(), host+"/test/app:latest", t.TempDir(), Options{Platform: "linux/amd64", RegClient: rc, Limits: &tc.limits})
+			require.ErrorIs(t, err, ErrLimitExceeded)
+			var le *LimitError
+			require.True(t, errors.As(err, &le), err)
+			require.Equal(t, 1, le.Layer)
+			require.Equal(t, digest.FromBytes(tc.layer), le.Digest)
+			require.Equal(t, tc.limit, le.Limit)
+			if tc.path != "" {
+				require.Equal(t, tc.path, le.Path)
+			}
+			require.Contains(t, err.Error(), "layer 1 ")
+
+			// the same layer passes without limits
+			_, err = SquashDir(context.Background(), host+"/test/app:latest", t.TempDir(), Options{Platform: "linux/amd64", RegClient: rc, Limits: &Limits{}})
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestSpace(t *testing.T) {
+	layers := []types.Descriptor{
+		{MediaType: types.MediaTypeOCI1LayerGzip, Size: 100},
+		{MediaType: types.MediaTypeOCI1Layer, Size: 100},
+	}
+	require.Equal(t, int64(400), estimateSize(layers, &Limits{}))
+	require.Equal(t, int64(250), estimateSize(layers, &Limits{MaxBytes: 250}))
+
+	dir := t.TempDir()
+	require.NoError(t, checkSpace([]string{dir, dir}, 1))
+	require.NoError(t, checkSpace([]string{dir + "/missing"}, 1<<62))
+	avail, fsid, err := freeSpace(dir)
+	require.NoError(t, err)
+	if fsid == "" {
+		t.Skip("free space is unknown on this platform")
+	}
+	err = checkSpace([]string{dir}, 1<<62)
+	require.ErrorIs(t, err, ErrInsufficientSpace)
+	require.Contains(t, err.Error(), dir)
+	// the same filesystem needs the space twice
+	if avail > 2 {
+		require.ErrorIs(t, checkSpace([]string{dir, dir}, int64(avail/2+1)), ErrInsufficientSpace)
+	}
+}
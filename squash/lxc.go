@@ -0,0 +1,160 @@
+package squash
+
+import (
+	"archive/tar"
+	"io"
+	"time"
+
+	"github.com/regclient/regclient/types/platform"
+	"gopkg.in/yaml.v3"
+)
+
+// lxcArchitectures maps the architectures of OCI platforms to the names of LXC, others are passed through
+var lxcArchitectures = map[string]string{
+	"amd64":    "x86_64",
+	"386":      "i686",
+	"arm64":    "aarch64",
+	"arm/v7":   "armv7l",
+	"arm/v6":   "armv6l",
+	"arm/v5":   "armv5tel",
+	"mips64le": "mips64el",
+	"loong64":  "loongarch64",
+}
+
+// lxcTemplates are rendered by LXC when an instance is created or copied
+var lxcTemplates = []struct{ path, file, content string }{
+	{"/etc/hostname", "hostname.tpl", "{{ container.name }}\n"},
+	{"/etc/hosts", "hosts.tpl", `127.0.0.1	localhost
+127.0.1.1	{{ container.name }}
+::1	localhost ip6-localhost ip6-loopback
+ff02::1	ip6-allnodes
+ff02::2	ip6-allrouters
+`},
+}
+
+type lxcMetadata struct {
+	Architecture string                 `yaml:"architecture"`
+	CreationDate int64                  `yaml:"creation_date"`
+	Properties   map[string]string      `yaml:"properties"`
+	Templates    map[string]lxcTemplate `yaml:"templates"`
+}
+
+type lxcTemplate struct {
+	When     []string `yaml:"when"`
+	Template string   `yaml:"template"`
+}
+
+// lxcArchitecture returns the LXC name of the architecture of the platform selected from an index or else of the config
+func lxcArchitecture(res *Result) string {
+	arch := res.Config.Architecture
+	if res.Config.Variant != "" {
+		arch += "/" + res.Config.Variant
+	}
+	if p, err := platform.Parse(res.Platform); res.Platform != "" && err == nil {
+		arch = p.Architecture
+		if p.Variant != "" {
+			arch += "/" + p.Variant
+		}
+	}
+	if a, ok := lxcArchitectures[arch]; ok {
+		return a
+	}
+	if arch == "arm" {
+		return lxcArchitectures["arm/v7"]
+	}
+	return arch
+}
+
+// lxcWriter writes the unified tarball of an LXC image, metadata.yaml and the templates followed by the filesystem below rootfs/
+type lxcWriter struct {
+	tw *tar.Writer
+	c  io.WriteCloser
+}
+
+func newLXCWriter(w io.Writer, opts Options, res *Result) (*lxcWriter, error) {
+	c, err := compressor(w, opts.Compression)
+	if err != nil {
+		return nil, err
+	}
+	lw := &lxcWriter{tw: tar.NewWriter(c), c: c}
+	created := time.Unix(0, 0)
+	if res.Config.Created != nil {
+		created = *res.Config.Created
+	}
+	meta := lxcMetadata{
+		Architecture: lxcArchitecture(res),
+		CreationDate: created.Unix(),
+		Properties: map[string]string{
+			"description": res.Ref,
+			"os":          res.OS,
+		},
+		Templates: map[string]lxcTemplate{},
+	}
+	for _, t := range lxcTemplates {
+		meta.Templates[t.path] = lxcTemplate{When: []string{"create", "copy"}, Template: t.file}
+	}
+	b, err := yaml.Marshal(meta)
+	if err != nil {
+		lw.Discard()
+		return nil, err
+	}
+	err = lw.file(&tar.Header{Name: "metadata.yaml", Typeflag: tar.TypeReg, Mode: 0644, ModTime: created}, string(b))
+	if err == nil {
+		err = lw.file(&tar.Header{Name: "templates/", Typeflag: tar.TypeDir, Mode: 0755, ModTime: created}, "")
+	}
+	for _, t := range lxcTemplates {
+		if err == nil {
+			err = lw.file(&tar.Header{Name: "templates/" + t.file, Typeflag: tar.TypeReg, Mode: 0644, ModTime: created}, t.content)
+		}
+	}
+	if err != nil {
+		lw.Discard()
+		return nil, err
+	}
+	return lw, nil
+}
+
+// file writes an entry of the image besides the filesystem
+func (lw *lxcWriter) file(th *tar.Header, content string) error {
+	th.Size = int64(len(content))
+	if err := lw.tw.WriteHeader(th); err != nil {
+		return err
+	}
+	_, err := io.WriteString(lw.tw, content)
+	return err
+}
+
+// Add writes an entry of the filesystem below rootfs/
+func (lw *lxcWriter) Add(th *tar.Header, r io.Reader) error {
+	h := *th
+	h.Name = "rootfs/" + th.Name
+	if th.Typeflag == tar.TypeDir {
+		h.Name += "/"
+		if th.Name == "" {
+			h.Name = "rootfs/"
+		}
+	}
+	if th.Typeflag == tar.TypeLink {
+		h.Linkname = "rootfs/" + th.Linkname
+	}
+	if err := lw.tw.WriteHeader(&h); err != nil {
+		return err
+	}
+	if th.Typeflag != tar.TypeReg {
+		return nil
+	}
+	_, err := io.Copy(lw.tw, r)
+	return err
+}
+
+func (lw *lxcWriter) Close() error {
+	if err := lw.tw.Close(); err != nil {
+		lw.c.Close()
+		return err
+	}
+	return lw.c.Close()
+}
+
+func (lw *lxcWriter) Discard() error {
+	return lw.c.Close()
+}
@@ -0,0 +1,83 @@
+package squash
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/regclient/regclient"
+	"github.com/regclient/regclient/config"
+	v1 "github.com/regclient/regclient/types/oci/v1"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+func TestLXC(t *testing.T) {
+	srv := httptest.NewServer(testRegistry(map[string][][]byte{"linux/arm64": testSquashfsLayers(t)}))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+	rc := regclient.New(regclient.WithConfigHost(config.Host{Name: host, TLS: config.TLSDisabled}))
+
+	buf := &bytes.Buffer{}
+	_, err := Squash(context.Background(), host+"/test/app:latest", buf, Options{
+		Platform:  "linux/arm64",
+		RegClient: rc,
+		Format:    FormatLXC,
+		WorkDir:   t.TempDir(),
+	})
+	require.NoError(t, err)
+	zr, err := gzip.NewReader(buf)
+	require.NoError(t, err)
+	tr := tar.NewReader(zr)
+	headers := map[string]*tar.Header{}
+	contents := map[string]string{}
+	names := []string{}
+	for {
+		th, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		b, err := io.ReadAll(tr)
+		require.NoError(t, err)
+		headers[th.Name], contents[th.Name] = th, string(b)
+		names = append(names, th.Name)
+	}
+	require.Equal(t, []string{"metadata.yaml", "templates/", "templates/hostname.tpl", "templates/hosts.tpl"}, names[:4])
+
+	var meta lxcMetadata
+	require.NoError(t, yaml.Unmarshal([]byte(contents["metadata.yaml"]), &meta))
+	require.Equal(t, "aarch64", meta.Architecture)
+	require.Equal(t, "hostname.tpl", meta.Templates["/etc/hostname"].Template)
+	require.Equal(t, []string{"create", "copy"}, meta.Templates["/etc/hosts"].When)
+	require.Contains(t, contents["templates/hosts.tpl"], "{{ container.name }}")
+
+	require.Equal(t, "v2", contents["rootfs/usr/bin/app"])
+	require.EqualValues(t, tar.TypeLink, headers["rootfs/usr/bin/app2"].Typeflag)
+	require.Equal(t, "rootfs/usr/bin/app", headers["rootfs/usr/bin/app2"].Linkname)
+	require.EqualValues(t, tar.TypeDir, headers["rootfs/"].Typeflag)
+	require.EqualValues(t, 0750, headers["rootfs/etc/"].Mode)
+	require.EqualValues(t, tar.TypeChar, headers["rootfs/dev/null"].Typeflag)
+	require.Equal(t, "value", headers["rootfs/etc/hosts"].PAXRecords["SCHILY.xattr.user.test"])
+	require.NotContains(t, headers, "rootfs/usr/bin/gone")
+}
+
+func TestLXCArchitecture(t *testing.T) {
+	for _, tc := range []struct {
+		res  Result
+		want string
+	}{
+		{Result{Platform: "linux/amd64"}, "x86_64"},
+		{Result{Platform: "linux/arm/v7"}, "armv7l"},
+		{Result{Config: v1.Image{Architecture: "arm", Variant: "v6"}}, "armv6l"},
+		{Result{Config: v1.Image{Architecture: "arm"}}, "armv7l"},
+		{Result{Config: v1.Image{Architecture: "s390x"}}, "s390x"},
+	} {
+		require.Equal(t, tc.want, lxcArchitecture(&tc.res), tc.res)
+	}
+}
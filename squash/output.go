@@ -0,0 +1,292 @@
+package squash
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/mheers/docker-image-squash/cpio"
+	"github.com/mheers/docker-image-squash/ext4"
+	"github.com/mheers/docker-image-squash/squashfs"
+	"github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
+)
+
+// filter selects the paths written to the output
+type filter struct {
+	include []string
+	exclude []string
+}
+
+func newFilter(include, exclude []string) (*filter, error) {
+	f := &filter{}
+	for _, list := range []struct {
+		patterns []string
+		dst      *[]string
+	}{{include, &f.include}, {exclude, &f.exclude}} {
+		for _, p := range list.patterns {
+			p = strings.Trim(path.Clean("/"+p), "/")
+			if _, err := path.Match(p, ""); err != nil {
+				return nil, fmt.Errorf("%w: filter %q: %v", ErrInvalidOption, p, err)
+			}
+			*list.dst = append(*list.dst, p)
+		}
+	}
+	return f, nil
+}
+
+// keep returns true for a path that is included and not excluded
+func (f *filter) keep(name string) bool {
+	return (len(f.include) == 0 || f.match(f.include, name)) && !f.match(f.exclude, name)
+}
+
+// match returns true when name or one of its parent directories matches a pattern
+func (f *filter) match(patterns []string, name string) bool {
+	for _, p := range patterns {
+		for n := name; n != "." && n != "/"; n = path.Dir(n) {
+			if ok, _ := path.Match(p, n); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// write packs the files of st into w with the output options and records the digest and size in res
+func write(ctx context.Context, st store, w io.Writer, opts Options, res *Result) error {
+	f, err := newFilter(opts.Include, opts.Exclude)
+	if err != nil {
+		return err
+	}
+	// tar size: a 512 byte header per file, content padded to 512 bytes, and the 1024 byte trailer
+	total := int64(1024)
+	files := map[string]bool{}
+	sbin := ""
+	err = st.walk(func(th *tar.Header, _ func() (io.ReadCloser, error)) error {
+		if th.Typeflag == tar.TypeReg && f.keep(th.Name) {
+			total += 512 + (th.Size+511)/512*512
+			files[th.Name] = true
+		}
+		if th.Name == path.Dir(initShimPath) && th.Typeflag == tar.TypeSymlink {
+			sbin = th.Linkname
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	digester := digest.Canonical.Digester()
+	counter := &writeCounter{w: io.MultiWriter(ctxWriter{ctx: ctx, w: w}, digester.Hash()), t: noProgress{}}
+	if opts.fullTree() {
+		// the size of the image is only known once it is written
+		t := startTask(opts.Progress, PhaseWrite, -1, "", 0)
+		iw, err := newImageWriter(&writeCounter{w: counter, t: t}, opts, res)
+		if err != nil {
+			return err
+		}
+		var shim *tar.Header
+		var script []byte
+		if opts.InitShim {
+			if script, err = initShim(res.Config.Config); err != nil {
+				iw.Discard()
+				return err
+			}
+			shim = &tar.Header{Name: initShimPath, Typeflag: tar.TypeReg, Mode: 0755, Size: int64(len(script)), ModTime: time.Unix(0, 0)}
+			if opts.Format == FormatCpio {
+				shim.Name = initramfsShimPath
+			} else if sbin != "" {
+				// e.g. /sbin -> usr/sbin of a merged /usr
+				shim.Name = path.Join(strings.Trim(path.Clean("/"+sbin), "/"), path.Base(initShimPath))
+			}
+			if res.Config.Created != nil {
+				shim.ModTime = *res.Config.Created
+			}
+			delete(files, shim.Name)
+		}
+		if err := writeImage(st, iw, opts, f, files, shim, script); err != nil {
+			return err
+		}
+		t.Done()
+		res.OutputDigest = digester.Digest()
+		res.OutputSize = counter.n
+		return nil
+	}
+	out, err := compressor(counter, opts.Compression)
+	if err != nil {
+		return err
+	}
+	t := startTask(opts.Progress, PhaseWrite, -1, "", total)
+	tw := tar.NewWriter(&writeCounter{w: out, t: t})
+	err = st.walk(func(th *tar.Header, open func() (io.ReadCloser, error)) error {
+		// the tar output has the regular files only
+		if !files[th.Name] {
+			return nil
+		}
+		if err := tw.WriteHeader(th); err != nil {
+			return err
+		}
+		r, err := open()
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		_, err = io.Copy(tw, r)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	t.Done()
+	res.OutputDigest = digester.Digest()
+	res.OutputSize = counter.n
+	return nil
+}
+
+// imageWriter writes a filesystem image from tar entries
+type imageWriter interface {
+	Add(th *tar.Header, r io.Reader) error
+	Close() error
+	Discard() error
+}
+
+func newImageWriter(w io.Writer, opts Options, res *Result) (imageWriter, error) {
+	var iw imageWriter
+	var err error
+	switch opts.Format {
+	case FormatExt4:
+		iw, err = ext4.NewWriter(w, ext4.Options{Size: opts.Size, TempDir: opts.WorkDir})
+	case FormatCpio:
+		c, err := compressor(w, opts.Compression)
+		if err != nil {
+			return nil, err
+		}
+		cw, err := cpio.NewWriter(c, cpio.Options{TempDir: opts.WorkDir})
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		return compressedWriter{imageWriter: cw, c: c}, nil
+	case FormatLXC:
+		return newLXCWriter(w, opts, res)
+	default:
+		iw, err = squashfs.NewWriter(w, squashfs.Options{Compression: opts.Compression, TempDir: opts.WorkDir})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidOption, err)
+	}
+	return iw, nil
+}
+
+// compressedWriter closes the compression of the output after the image writer
+type compressedWriter struct {
+	imageWriter
+	c io.WriteCloser
+}
+
+func (cw compressedWriter) Close() error {
+	if err := cw.imageWriter.Close(); err != nil {
+		cw.c.Close()
+		return err
+	}
+	return cw.c.Close()
+}
+
+func (cw compressedWriter) Discard() error {
+	cw.c.Close()
+	return cw.imageWriter.Discard()
+}
+
+// compressor returns a writer that compresses to w, the compression is finished by Close
+func compressor(w io.Writer, compression string) (io.WriteCloser, error) {
+	switch compression {
+	case CompressionGzip:
+		return gzip.NewWriter(w), nil
+	case CompressionZstd:
+		return zstd.NewWriter(w)
+	}
+	return nopCloser{w}, nil
+}
+
+// writeImage writes the entries of st and the init shim, if not nil, with iw.
+// A hardlink is left out when its target is not a regular file of the output, an entry at the path of the shim is replaced.
+func writeImage(st store, iw imageWriter, opts Options, f *filter, files map[string]bool, shim *tar.Header, script []byte) error {
+	err := st.walk(func(th *tar.Header, open func() (io.ReadCloser, error)) error {
+		if th.Name != "" && !f.keep(th.Name) {
+			return nil
+		}
+		if shim != nil && th.Name == shim.Name {
+			return nil
+		}
+		if th.Typeflag == tar.TypeLink && !files[th.Linkname] {
+			opts.Logger.WithFields(logrus.Fields{
+				"path":   th.Name,
+				"target": th.Linkname,
+			}).Debug("Skipping hardlink without target")
+			return nil
+		}
+		if th.Typeflag != tar.TypeReg {
+			return iw.Add(th, nil)
+		}
+		r, err := open()
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		return iw.Add(th, r)
+	})
+	if err == nil && shim != nil {
+		err = iw.Add(shim, bytes.NewReader(script))
+	}
+	if err != nil {
+		iw.Discard()
+		return err
+	}
+	return iw.Close()
+}
+
+// writeCounter counts the bytes written for the result and the progress
+type writeCounter struct {
+	w io.Writer
+	t ProgressTask
+	n int64
+}
+
+func (wc *writeCounter) Write(p []byte) (int, error) {
+	n, err := wc.w.Write(p)
+	wc.n += int64(n)
+	wc.t.Add(int64(n))
+	return n, err
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
+
+// ctxWriter stops writing once ctx is done, for local copies that do not read from the network
+type ctxWriter struct {
+	ctx context.Context
+	w   io.Writer
+}
+
+func (cw ctxWriter) Write(p []byte) (int, error) {
+	if err := cw.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cw.w.Write(p)
+}
@@ -0,0 +1,275 @@
+package squash
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/mheers/docker-image-squash/chunked"
+	"github.com/opencontainers/go-digest"
+	"github.com/regclient/regclient/types"
+	"github.com/regclient/regclient/types/manifest"
+	v1 "github.com/regclient/regclient/types/oci/v1"
+	"github.com/regclient/regclient/types/ref"
+	"github.com/sirupsen/logrus"
+)
+
+// formatLayer is the format of Push, a tar with all entry types
+const formatLayer = "layer"
+
+// Push pulls source, squashes it into a single layer and pushes an image with that layer and the config of source to target.
+// Compression encodes the layer with CompressionGzip (default), CompressionZstd, CompressionEStargz or CompressionZstdChunked,
+// the last two can be pulled lazily. The layer keeps all entry types, so SpillDisk is rejected.
+// It is spooled in WorkDir for its digest before it is uploaded and OutputDigest and OutputSize of the result describe it.
+// The other output options are ignored.
+func Push(ctx context.Context, source, target string, opts Options) (*Result, error) {
+	compression := opts.Compression
+	opts.Format, opts.Compression = "", ""
+	opts, err := opts.defaults()
+	if err != nil {
+		return nil, err
+	}
+	switch compression {
+	case "":
+		compression = CompressionGzip
+	case CompressionGzip, CompressionZstd, CompressionEStargz, CompressionZstdChunked:
+	default:
+		return nil, fmt.Errorf("%w: layer compression %q, use %s, %s, %s or %s", ErrInvalidOption, compression, CompressionGzip, CompressionZstd, CompressionEStargz, CompressionZstdChunked)
+	}
+	if opts.Spill == SpillDisk {
+		return nil, fmt.Errorf("%w: the layer keeps all entry types, which needs the %s or %s spill strategy", ErrInvalidOption, SpillIndex, SpillMemory)
+	}
+	opts.Format, opts.Compression = formatLayer, compression
+	tr, err := ref.New(target)
+	if err != nil {
+		return nil, fmt.Errorf("%w: target %q: %v", ErrInvalidOption, target, err)
+	}
+	if _, err := newFilter(opts.Include, opts.Exclude); err != nil {
+		return nil, err
+	}
+	var st store
+	res, err := squashStore(ctx, source, opts, func(need int64, res *Result) (store, error) {
+		s, err := opts.newStore(need, res)
+		st = s
+		return s, err
+	})
+	if st != nil {
+		defer st.close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if opts.Inspect != nil {
+		if err := opts.inspect(ctx, st); err != nil {
+			return nil, err
+		}
+	}
+
+	f, err := os.CreateTemp(opts.WorkDir, "layer")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		f.Close()
+		os.Remove(f.Name())
+	}()
+	layer, diffID, err := writeLayer(ctx, st, f, opts, res)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	// the config of source with the squashed layer
+	conf := res.Config
+	conf.RootFS = v1.RootFS{Type: "layers", DiffIDs: []digest.Digest{diffID}}
+	conf.History = []v1.History{{Created: conf.Created, CreatedBy: "squash " + res.Ref + "@" + res.Manifest.String()}}
+	cb, err := json.Marshal(conf)
+	if err != nil {
+		return nil, err
+	}
+	confDesc := types.Descriptor{MediaType: types.MediaTypeOCI1ImageConfig, Digest: digest.FromBytes(cb), Size: int64(len(cb))}
+
+	t := startTask(opts.Progress, PhaseUpload, -1, layer.Digest.String(), layer.Size)
+	if _, err := opts.RegClient.BlobPut(ctx, tr, layer, &readCounter{r: f, t: t}); err != nil {
+		return nil, fmt.Errorf("%w: layer: %w", ErrPush, err)
+	}
+	t.Done()
+	if _, err := opts.RegClient.BlobPut(ctx, tr, confDesc, bytes.NewReader(cb)); err != nil {
+		return nil, fmt.Errorf("%w: config: %w", ErrPush, err)
+	}
+	m, err := manifest.New(manifest.WithOrig(v1.Manifest{
+		Versioned: v1.ManifestSchemaVersion,
+		MediaType: types.MediaTypeOCI1Manifest,
+		Config:    confDesc,
+		Layers:    []types.Descriptor{layer},
+	}))
+	if err != nil {
+		return nil, err
+	}
+	if err := opts.RegClient.ManifestPut(ctx, tr, m); err != nil {
+		return nil, fmt.Errorf("%w: manifest: %w", ErrPush, err)
+	}
+	res.Target = tr.CommonName()
+	res.Pushed = m.GetDescriptor()
+	opts.Logger.WithFields(logrus.Fields{
+		"ref":         res.Ref,
+		"target":      res.Target,
+		"digest":      res.Pushed.Digest.String(),
+		"layer":       layer.Digest.String(),
+		"compression": compression,
+	}).Info("Pushed image")
+	return res, nil
+}
+
+// writeLayer writes the layer of Push to w and returns its descriptor and the digest of its tar
+func writeLayer(ctx context.Context, st store, w io.Writer, opts Options, res *Result) (types.Descriptor, digest.Digest, error) {
+	f, err := newFilter(opts.Include, opts.Exclude)
+	if err != nil {
+		return types.Descriptor{}, "", err
+	}
+	files := map[string]bool{}
+	err = st.walk(func(th *tar.Header, _ func() (io.ReadCloser, error)) error {
+		if th.Typeflag == tar.TypeReg && f.keep(th.Name) {
+			files[th.Name] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return types.Descriptor{}, "", err
+	}
+
+	digester := digest.Canonical.Digester()
+	t := startTask(opts.Progress, PhaseWrite, -1, "", 0)
+	counter := &writeCounter{w: io.MultiWriter(ctxWriter{ctx: ctx, w: w}, digester.Hash()), t: t}
+	desc := types.Descriptor{MediaType: types.MediaTypeOCI1LayerGzip}
+	var enc layerEncoder
+	switch opts.Compression {
+	case CompressionEStargz, CompressionZstdChunked:
+		format := chunked.FormatEStargz
+		if opts.Compression == CompressionZstdChunked {
+			format = chunked.FormatZstdChunked
+			desc.MediaType = types.MediaTypeOCI1LayerZstd
+		}
+		enc, err = chunked.NewWriter(counter, chunked.Options{Format: format})
+	default:
+		if opts.Compression == CompressionZstd {
+			desc.MediaType = types.MediaTypeOCI1LayerZstd
+		}
+		enc, err = newTarLayer(counter, opts.Compression)
+	}
+	if err != nil {
+		return types.Descriptor{}, "", err
+	}
+	if err := writeImage(st, &layerWriter{enc: enc}, opts, f, files, nil, nil); err != nil {
+		return types.Descriptor{}, "", err
+	}
+	t.Done()
+	res.OutputDigest = digester.Digest()
+	res.OutputSize = counter.n
+	desc.Digest, desc.Size, desc.Annotations = res.OutputDigest, res.OutputSize, enc.Annotations()
+	opts.Logger.WithFields(logrus.Fields{
+		"ref":    res.Ref,
+		"digest": desc.Digest.String(),
+		"bytes":  desc.Size,
+	}).Info("Wrote layer")
+	return desc, enc.DiffID(), nil
+}
+
+// layerEncoder compresses the tar of a layer
+type layerEncoder interface {
+	imageWriter
+	// DiffID is the digest of the uncompressed tar, valid after Close
+	DiffID() digest.Digest
+	// Annotations of the layer descriptor, valid after Close
+	Annotations() map[string]string
+}
+
+// layerWriter passes the entries of a walk to a layerEncoder with the names of a tar,
+// hardlinks follow the other entries so their targets are extracted first
+type layerWriter struct {
+	enc   layerEncoder
+	links []*tar.Header
+}
+
+func (lw *layerWriter) Add(th *tar.Header, r io.Reader) error {
+	// the root is implied
+	if th.Name == "" {
+		return nil
+	}
+	h := *th
+	switch th.Typeflag {
+	case tar.TypeDir:
+		h.Name += "/"
+	case tar.TypeLink:
+		lw.links = append(lw.links, &h)
+		return nil
+	}
+	return lw.enc.Add(&h, r)
+}
+
+func (lw *layerWriter) Close() error {
+	for _, th := range lw.links {
+		if err := lw.enc.Add(th, nil); err != nil {
+			lw.enc.Discard()
+			return err
+		}
+	}
+	return lw.enc.Close()
+}
+
+func (lw *layerWriter) Discard() error {
+	return lw.enc.Discard()
+}
+
+// tarLayer is a tar compressed with gzip or zstd in a single stream
+type tarLayer struct {
+	tw     *tar.Writer
+	c      io.WriteCloser
+	diffID digest.Digester
+}
+
+func newTarLayer(w io.Writer, compression string) (*tarLayer, error) {
+	c, err := compressor(w, compression)
+	if err != nil {
+		return nil, err
+	}
+	d := digest.Canonical.Digester()
+	return &tarLayer{tw: tar.NewWriter(io.MultiWriter(c, d.Hash())), c: c, diffID: d}, nil
+}
+
+func (tl *tarLayer) Add(th *tar.Header, r io.Reader) error {
+	if err := tl.tw.WriteHeader(th); err != nil {
+		return err
+	}
+	if th.Typeflag != tar.TypeReg {
+		return nil
+	}
+	_, err := io.Copy(tl.tw, r)
+	return err
+}
+
+func (tl *tarLayer) Close() error {
+	if err := tl.tw.Close(); err != nil {
+		tl.c.Close()
+		return err
+	}
+	return tl.c.Close()
+}
+
+func (tl *tarLayer) Discard() error {
+	return tl.c.Close()
+}
+
+func (tl *tarLayer) DiffID() digest.Digest {
+	return tl.diffID.Digest()
+}
+
+func (tl *tarLayer) Annotations() map[string]string {
+	return nil
+}
@@ -0,0 +1,117 @@
+package squash
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/mheers/docker-image-squash/chunked"
+	"github.com/opencontainers/go-digest"
+	"github.com/regclient/regclient"
+	"github.com/regclient/regclient/config"
+	"github.com/regclient/regclient/types"
+	"github.com/regclient/regclient/types/manifest"
+	"github.com/regclient/regclient/types/ref"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPush(t *testing.T) {
+	srv := httptest.NewServer(testRegistry(map[string][][]byte{"linux/amd64": testSquashfsLayers(t)}))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+	rc := regclient.New(regclient.WithConfigHost(config.Host{Name: host, TLS: config.TLSDisabled}))
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		compression string
+		mediaType   string
+		annotation  string
+	}{
+		{"", types.MediaTypeOCI1LayerGzip, ""},
+		{CompressionZstd, types.MediaTypeOCI1LayerZstd, ""},
+		{CompressionEStargz, types.MediaTypeOCI1LayerGzip, chunked.AnnotationTOCDigest},
+		{CompressionZstdChunked, types.MediaTypeOCI1LayerZstd, chunked.AnnotationManifestPosition},
+	} {
+		target := "ocidir://" + filepath.Join(t.TempDir(), "out") + ":squashed"
+		res, err := Push(ctx, host+"/test/app:latest", target, Options{
+			Platform:    "linux/amd64",
+			RegClient:   rc,
+			Compression: tc.compression,
+			WorkDir:     t.TempDir(),
+			Inspect: func(ctx context.Context, dir string) error {
+				_, err := os.Readlink(filepath.Join(dir, "usr/bin/sh"))
+				return err
+			},
+		})
+		require.NoError(t, err, tc.compression)
+		require.Equal(t, target, res.Target)
+
+		r, err := ref.New(target)
+		require.NoError(t, err)
+		m, err := rc.ManifestGet(ctx, r)
+		require.NoError(t, err)
+		require.Equal(t, res.Pushed.Digest, m.GetDescriptor().Digest)
+		mi := m.(manifest.Imager)
+		layers, err := mi.GetLayers()
+		require.NoError(t, err)
+		require.Len(t, layers, 1)
+		require.Equal(t, tc.mediaType, layers[0].MediaType, tc.compression)
+		require.Equal(t, res.OutputDigest, layers[0].Digest)
+		if tc.annotation != "" {
+			require.NotEmpty(t, layers[0].Annotations[tc.annotation], tc.compression)
+		}
+		cd, err := mi.GetConfig()
+		require.NoError(t, err)
+		conf, err := rc.BlobGetOCIConfig(ctx, r, cd)
+		require.NoError(t, err)
+		require.Equal(t, []string{"/usr/bin/app"}, conf.GetConfig().Config.Entrypoint)
+
+		// the layer decompresses to a tar with all entry types and the diffID of the config
+		br, err := rc.BlobGet(ctx, r, layers[0])
+		require.NoError(t, err)
+		var zr io.Reader
+		if tc.mediaType == types.MediaTypeOCI1LayerZstd {
+			d, err := zstd.NewReader(br)
+			require.NoError(t, err)
+			defer d.Close()
+			zr = d
+		} else {
+			zr, err = gzip.NewReader(br)
+			require.NoError(t, err)
+		}
+		digester := digest.Canonical.Digester()
+		tr := tar.NewReader(io.TeeReader(zr, digester.Hash()))
+		names := []string{}
+		headers := map[string]*tar.Header{}
+		for {
+			th, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			names = append(names, th.Name)
+			headers[th.Name] = th
+		}
+		io.Copy(digester.Hash(), zr)
+		br.Close()
+		require.Equal(t, []digest.Digest{digester.Digest()}, conf.GetConfig().RootFS.DiffIDs, tc.compression)
+		require.Contains(t, names, "etc/")
+		require.EqualValues(t, tar.TypeSymlink, headers["usr/bin/sh"].Typeflag)
+		require.EqualValues(t, tar.TypeChar, headers["dev/null"].Typeflag)
+		// hardlinks follow their targets
+		require.Less(t, slices.Index(names, "usr/bin/app"), slices.Index(names, "usr/bin/app2"))
+	}
+
+	_, err := Push(ctx, host+"/test/app:latest", "ocidir://"+t.TempDir()+":x", Options{RegClient: rc, Compression: CompressionNone})
+	require.ErrorIs(t, err, ErrInvalidOption)
+	_, err = Push(ctx, host+"/test/app:latest", "ocidir://"+t.TempDir()+":x", Options{RegClient: rc, Spill: SpillDisk})
+	require.ErrorIs(t, err, ErrInvalidOption)
+}
@@ -0,0 +1,321 @@
+package squash
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mheers/docker-image-squash/sign"
+	"github.com/opencontainers/go-digest"
+	"github.com/regclient/regclient/types"
+	"github.com/regclient/regclient/types/ref"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultRetries is the number of retries when Options.Retries is zero
+	DefaultRetries = 3
+	// DefaultRetryBackoff is the delay before the first retry when Options.RetryBackoff is zero
+	DefaultRetryBackoff = time.Second
+	// DefaultRetryMaxBackoff is the longest delay between retries when Options.RetryMaxBackoff is zero
+	DefaultRetryMaxBackoff = 30 * time.Second
+)
+
+// backoff returns the delay before retry n, starting at 0: RetryBackoff doubled for each retry
+// up to RetryMaxBackoff, with a random jitter of up to half of it so parallel clients spread out
+func (opts Options) backoff(n int) time.Duration {
+	d := opts.RetryMaxBackoff
+	if n < 32 && opts.RetryBackoff<<n > 0 && opts.RetryBackoff<<n < d {
+		d = opts.RetryBackoff << n
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// sleep waits for d, or returns early with the error of ctx
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// retryable returns false for errors a retry cannot fix and once ctx is done
+func retryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	for _, perm := range []error{types.ErrNotFound, types.ErrHTTPUnauthorized, types.ErrDigestMismatch, ErrNotImage, sign.ErrNoSignature} {
+		if errors.Is(err, perm) {
+			return false
+		}
+	}
+	// an unknown registry host
+	var dnsErr *net.DNSError
+	return !errors.As(err, &dnsErr) || !dnsErr.IsNotFound
+}
+
+// retry calls fn until it succeeds, fails permanently, or the retries are used up
+func (s *source) retry(ctx context.Context, fn func() error) error {
+	for n := 0; ; n++ {
+		err := fn()
+		if err == nil || n >= s.opts.Retries || !retryable(ctx, err) {
+			return err
+		}
+		d := s.opts.backoff(n)
+		s.opts.Logger.WithFields(logrus.Fields{
+			"ref":   s.ref.CommonName(),
+			"retry": n + 1,
+			"delay": d.String(),
+			"err":   err,
+		}).Warn("Request failed, retrying")
+		if err := sleep(ctx, d); err != nil {
+			return err
+		}
+	}
+}
+
+type rangeKey struct{}
+
+// RangeTransport lets resumed layer downloads request only the missing bytes with a Range header.
+// Use it as the transport of the http client of Options.RegClient, base defaults to http.DefaultTransport.
+// Without it a resumed download requests the whole blob again and skips the bytes it already read.
+func RangeTransport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &rangeTransport{base: base}
+}
+
+type rangeTransport struct {
+	base http.RoundTripper
+}
+
+func (t *rangeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	offset, ok := req.Context().Value(rangeKey{}).(int64)
+	if !ok || req.Method != http.MethodGet || req.Header.Get("Range") != "" || !rangeBlob(req) {
+		return t.base.RoundTrip(req)
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	resp, err := t.base.RoundTrip(req)
+	if err == nil && resp.StatusCode == http.StatusPartialContent {
+		// regclient only accepts a 200 for blobs, the blob reader checks the Content-Range
+		resp.StatusCode = http.StatusOK
+		resp.Status = "200 OK"
+	}
+	return resp, err
+}
+
+// rangeBlob returns true for a blob request, including redirects of one, e.g. to a CDN,
+// but not for the token requests made while authenticating it
+func rangeBlob(req *http.Request) bool {
+	for r := req; r != nil; {
+		if strings.Contains(r.URL.Path, "/blobs/") {
+			return true
+		}
+		if r.Response == nil {
+			break
+		}
+		r = r.Response.Request
+	}
+	return false
+}
+
+// blobReader reads a layer, resuming the download after network errors and stalls.
+// The digest of all bytes is verified since regclient only sees the resumed part.
+type blobReader struct {
+	ctx      context.Context
+	src      *source
+	layer    types.Descriptor
+	br       blobBody
+	rdr      io.Reader
+	attempt  context.Context // request context of br, cancelled by the idle timeout
+	cancel   context.CancelFunc
+	offset   int64
+	digester digest.Digester
+	failures int   // consecutive failures without receiving data
+	err      error // failure of the previous request, retried by the next read
+	final    error // returned by every read once the blob is complete or failed permanently
+}
+
+// blobBody is a blob response from the registry or an external URL
+type blobBody interface {
+	io.ReadCloser
+	Response() *http.Response
+}
+
+func newBlobReader(ctx context.Context, src *source, layer types.Descriptor) *blobReader {
+	return &blobReader{ctx: ctx, src: src, layer: layer, digester: digest.Canonical.Digester()}
+}
+
+func (r *blobReader) Read(p []byte) (int, error) {
+	if r.final != nil {
+		return 0, r.final
+	}
+	n, err := r.read(p)
+	if err != nil {
+		r.final = err
+	}
+	return n, err
+}
+
+func (r *blobReader) read(p []byte) (int, error) {
+	if r.br == nil {
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.rdr.Read(p)
+	if n > 0 {
+		r.digester.Hash().Write(p[:n])
+		r.offset += int64(n)
+		r.failures = 0
+	}
+	if err == nil {
+		return n, nil
+	}
+	if errors.Is(err, io.EOF) {
+		// regclient reports a digest mismatch for the resumed part of a blob, so all bytes are verified here
+		r.close()
+		if r.digester.Digest() != r.layer.Digest {
+			return n, fmt.Errorf("%w: expected %s, computed %s", types.ErrDigestMismatch, r.layer.Digest, r.digester.Digest())
+		}
+		return n, io.EOF
+	}
+	err = layerCause(r.attempt, err)
+	r.close()
+	if !retryable(r.ctx, err) {
+		return n, err
+	}
+	// retry on the next read, returning the data received so far
+	r.err = err
+	if n > 0 {
+		return n, nil
+	}
+	return r.read(p)
+}
+
+// open requests the blob from the current offset, waiting for the backoff after a failure
+func (r *blobReader) open() error {
+	for {
+		if r.err != nil {
+			if r.failures >= r.src.opts.Retries {
+				return r.err
+			}
+			d := r.src.opts.backoff(r.failures)
+			r.src.opts.Logger.WithFields(logrus.Fields{
+				"ref":    r.src.ref.CommonName(),
+				"digest": r.layer.Digest.String(),
+				"offset": r.offset,
+				"retry":  r.failures + 1,
+				"delay":  d.String(),
+				"err":    r.err,
+			}).Warn("Layer download failed, resuming")
+			r.failures++
+			if err := sleep(r.ctx, d); err != nil {
+				return err
+			}
+		}
+		ctx := r.ctx
+		if r.offset > 0 {
+			ctx = context.WithValue(ctx, rangeKey{}, r.offset)
+		}
+		ctx, idle, cancel := idleContext(ctx, r.src.opts.BlobIdleTimeout)
+		var br blobBody
+		err := r.src.try(func(ep ref.Ref) error {
+			b, err := r.src.opts.RegClient.BlobGet(ctx, ep, r.layer)
+			if err == nil {
+				br = b
+			}
+			return err
+		})
+		if errors.Is(err, types.ErrNotFound) && len(r.layer.URLs) > 0 {
+			br, err = externalGet(ctx, r.layer, r.offset)
+		}
+		if err == nil {
+			r.br, r.rdr, r.attempt, r.cancel = br, idle.reader(br), ctx, cancel
+			if err = r.seek(); err == nil {
+				r.err = nil
+				return nil
+			}
+		}
+		err = layerCause(ctx, err)
+		r.close()
+		cancel()
+		if !retryable(r.ctx, err) {
+			return err
+		}
+		r.err = err
+	}
+}
+
+// seek skips the bytes already read when the response is not a range starting at the offset
+func (r *blobReader) seek() error {
+	if r.offset == 0 {
+		return nil
+	}
+	var start int64
+	if resp := r.br.Response(); resp != nil {
+		if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-", &start); err == nil && start == r.offset {
+			return nil
+		}
+	}
+	_, err := io.CopyN(io.Discard, r.rdr, r.offset)
+	return err
+}
+
+func (r *blobReader) close() {
+	if r.br != nil {
+		r.br.Close()
+		r.cancel()
+		r.br = nil
+	}
+}
+
+// externalBody is a blob response from an external URL
+type externalBody struct {
+	resp *http.Response
+}
+
+func (b externalBody) Read(p []byte) (int, error) { return b.resp.Body.Read(p) }
+func (b externalBody) Close() error               { return b.resp.Body.Close() }
+func (b externalBody) Response() *http.Response   { return b.resp }
+
+// externalGet requests a layer from the first of its URLs that has it, starting at offset
+func externalGet(ctx context.Context, layer types.Descriptor, offset int64) (blobBody, error) {
+	var err error
+	for _, u := range layer.URLs {
+		var req *http.Request
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+		if err != nil {
+			continue
+		}
+		if offset > 0 {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		}
+		var resp *http.Response
+		resp, err = http.DefaultClient.Do(req)
+		if err != nil {
+			continue
+		}
+		if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusPartialContent {
+			return externalBody{resp}, nil
+		}
+		resp.Body.Close()
+		err = fmt.Errorf("failed to get external layer %s from %s: %s", layer.Digest, u, resp.Status)
+		if resp.StatusCode == http.StatusNotFound {
+			err = fmt.Errorf("%w: %v", types.ErrNotFound, err)
+		}
+	}
+	return nil, err
+}
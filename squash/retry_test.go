@@ -0,0 +1,204 @@
+package squash
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/regclient/regclient"
+	"github.com/regclient/regclient/config"
+	"github.com/regclient/regclient/scheme/reg"
+	"github.com/regclient/regclient/types"
+	"github.com/stretchr/testify/require"
+)
+
+// testFlakyRegistry fails the first manifest request and breaks the first blob download halfway,
+// the following blob requests are handled by resume
+type testFlakyRegistry struct {
+	next      http.Handler
+	layer     []byte
+	mu        sync.Mutex
+	manifests int
+	ranges    []string // Range header of each blob request
+}
+
+func (f *testFlakyRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case strings.Contains(r.URL.Path, "/manifests/") && r.Method == http.MethodGet:
+		f.manifests++
+		if f.manifests == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+	case strings.HasSuffix(r.URL.Path, "/blobs/"+digest.FromBytes(f.layer).String()):
+		f.ranges = append(f.ranges, r.Header.Get("Range"))
+		if len(f.ranges) == 1 {
+			// send half of the blob and reset the connection
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				panic(err)
+			}
+			fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\nContent-Type: application/octet-stream\r\nContent-Length: %d\r\n\r\n", len(f.layer))
+			conn.Write(f.layer[:len(f.layer)/2])
+			conn.(*net.TCPConn).SetLinger(0)
+			conn.Close()
+			return
+		}
+	}
+	f.next.ServeHTTP(w, r)
+}
+
+func testRandomLayer(t *testing.T) []byte {
+	t.Helper()
+	b := make([]byte, 256*1024)
+	rand.New(rand.NewSource(1)).Read(b)
+	return testGzipLayer(t, map[string]string{"opt/random": string(b)})
+}
+
+func TestRetry(t *testing.T) {
+	layer := testRandomLayer(t)
+	newRegistry := func() (*testFlakyRegistry, string, func()) {
+		f := &testFlakyRegistry{next: testRegistry(map[string][][]byte{"linux/amd64": {layer}}), layer: layer}
+		srv := httptest.NewServer(f)
+		return f, strings.TrimPrefix(srv.URL, "http://"), srv.Close
+	}
+	newClient := func(host string, transport http.RoundTripper) *regclient.RegClient {
+		return regclient.New(
+			regclient.WithConfigHost(config.Host{Name: host, TLS: config.TLSDisabled}),
+			regclient.WithRegOpts(reg.WithHTTPClient(&http.Client{Transport: transport})),
+			regclient.WithRetryDelay(time.Millisecond, 10*time.Millisecond),
+			regclient.WithRetryLimit(1),
+		)
+	}
+	opts := func(rc *regclient.RegClient) Options {
+		return Options{Platform: "linux/amd64", RegClient: rc, RetryBackoff: time.Millisecond, RetryMaxBackoff: 10 * time.Millisecond}
+	}
+
+	t.Run("range", func(t *testing.T) {
+		f, host, stop := newRegistry()
+		defer stop()
+		buf := &bytes.Buffer{}
+		res, err := Squash(context.Background(), host+"/test/app:latest", buf, opts(newClient(host, RangeTransport(nil))))
+		require.NoError(t, err)
+		require.Greater(t, f.manifests, 1)
+		// the offset is what was received before the reset
+		require.Len(t, f.ranges, 2)
+		var offset int
+		_, err = fmt.Sscanf(f.ranges[1], "bytes=%d-", &offset)
+		require.NoError(t, err)
+		require.Greater(t, offset, 0)
+		require.LessOrEqual(t, offset, len(layer)/2)
+		require.Equal(t, digest.FromBytes(layer), res.Layers[0].Digest)
+		require.Len(t, testTarFiles(t, buf)["opt/random"], 256*1024)
+	})
+
+	t.Run("without range", func(t *testing.T) {
+		// the whole blob is requested again and the received bytes are skipped
+		f, host, stop := newRegistry()
+		defer stop()
+		res, err := SquashDir(context.Background(), host+"/test/app:latest", t.TempDir(), opts(newClient(host, http.DefaultTransport)))
+		require.NoError(t, err)
+		require.Equal(t, []string{"", ""}, f.ranges)
+		require.Equal(t, digest.FromBytes(layer), res.Layers[0].Digest)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		f, host, stop := newRegistry()
+		defer stop()
+		f.manifests = 1
+		o := opts(newClient(host, RangeTransport(nil)))
+		o.Retries = -1
+		_, err := SquashDir(context.Background(), host+"/test/app:latest", t.TempDir(), o)
+		require.Error(t, err)
+		require.Len(t, f.ranges, 1)
+	})
+
+	t.Run("digest mismatch", func(t *testing.T) {
+		// the resumed bytes are verified with the digest of the descriptor
+		corrupt := append([]byte{}, layer...)
+		corrupt[len(corrupt)-100] ^= 0xff
+		f := &testFlakyRegistry{layer: layer, manifests: 1}
+		f.next = testRegistry(map[string][][]byte{"linux/amd64": {layer}})
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if strings.Contains(r.URL.Path, "/blobs/"+digest.FromBytes(layer).String()) && r.Header.Get("Range") != "" {
+				f.mu.Lock()
+				f.ranges = append(f.ranges, r.Header.Get("Range"))
+				f.mu.Unlock()
+				http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(corrupt))
+				return
+			}
+			f.ServeHTTP(w, r)
+		}))
+		defer srv.Close()
+		host := strings.TrimPrefix(srv.URL, "http://")
+		_, err := SquashDir(context.Background(), host+"/test/app:latest", t.TempDir(), opts(newClient(host, RangeTransport(nil))))
+		require.ErrorIs(t, err, types.ErrDigestMismatch)
+		require.Len(t, f.ranges, 2)
+	})
+
+	t.Run("stall", func(t *testing.T) {
+		// a stalled download is resumed after the idle timeout
+		var mu sync.Mutex
+		requests := 0
+		next := testRegistry(map[string][][]byte{"linux/amd64": {layer}})
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if strings.Contains(r.URL.Path, "/blobs/"+digest.FromBytes(layer).String()) {
+				mu.Lock()
+				requests++
+				first := requests == 1
+				mu.Unlock()
+				if first {
+					w.Header().Set("Content-Length", fmt.Sprint(len(layer)))
+					w.Write(layer[:len(layer)/2])
+					w.(http.Flusher).Flush()
+					<-r.Context().Done()
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+		}))
+		defer srv.Close()
+		host := strings.TrimPrefix(srv.URL, "http://")
+		o := opts(newClient(host, RangeTransport(nil)))
+		o.BlobIdleTimeout = 100 * time.Millisecond
+		_, err := SquashDir(context.Background(), host+"/test/app:latest", t.TempDir(), o)
+		require.NoError(t, err)
+		require.Equal(t, 2, requests)
+	})
+}
+
+func TestBackoff(t *testing.T) {
+	opts := Options{RetryBackoff: 100 * time.Millisecond, RetryMaxBackoff: time.Second}
+	for n, max := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second, time.Second} {
+		for i := 0; i < 20; i++ {
+			d := opts.backoff(n)
+			require.GreaterOrEqual(t, d, max/2)
+			require.LessOrEqual(t, d, max)
+		}
+	}
+	require.LessOrEqual(t, opts.backoff(100), time.Second)
+}
+
+func TestRetryable(t *testing.T) {
+	ctx := context.Background()
+	require.True(t, retryable(ctx, io.ErrUnexpectedEOF))
+	require.True(t, retryable(ctx, ErrBlobIdleTimeout))
+	require.False(t, retryable(ctx, fmt.Errorf("blob: %w", types.ErrNotFound)))
+	require.False(t, retryable(ctx, types.ErrHTTPUnauthorized))
+	require.False(t, retryable(ctx, &net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", Name: "registry.invalid", IsNotFound: true}}))
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	require.False(t, retryable(cancelled, io.ErrUnexpectedEOF))
+}
@@ -0,0 +1,252 @@
+package squash
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/regclient/regclient/pkg/archive"
+	"github.com/regclient/regclient/types"
+	"github.com/regclient/regclient/types/ref"
+	"github.com/sirupsen/logrus"
+)
+
+// source pulls an image from the first of its endpoints that works
+type source struct {
+	ref       ref.Ref
+	endpoints []ref.Ref
+	served    int // index of the endpoint that last succeeded
+	opts      Options
+}
+
+// Source pulls the manifests and layers of an image from the first of Options.Endpoints that works,
+// the layers with the retries, resumed downloads, idle timeout and limits of Squash, e.g. to read a few files of an image.
+// It is not safe for concurrent use.
+type Source struct {
+	src   *source
+	total int64 // file bytes extracted from all layers
+}
+
+// NewSource returns the source of r with the pull settings of opts, the other options are ignored
+func NewSource(r ref.Ref, opts Options) (*Source, error) {
+	opts.Format, opts.Compression = "", ""
+	opts, err := opts.defaults()
+	if err != nil {
+		return nil, err
+	}
+	return &Source{src: newSource(r, opts)}, nil
+}
+
+// Endpoint returns the location that last succeeded, the first one before any request
+func (s *Source) Endpoint() ref.Ref {
+	return s.src.endpoint()
+}
+
+// Served returns the index in Options.Endpoints of the location that last succeeded
+func (s *Source) Served() int {
+	return s.src.served
+}
+
+// Try calls fn with each endpoint until one succeeds, starting with the last successful endpoint.
+// The error of the last attempt is returned as an EndpointError when all fail.
+func (s *Source) Try(fn func(ep ref.Ref) error) error {
+	return s.src.try(fn)
+}
+
+// Layer pulls layer i of the image and calls fn with the uncompressed tar stream,
+// the rest of the blob is read after fn to verify its digest
+func (s *Source) Layer(ctx context.Context, layer types.Descriptor, i int, fn func(r io.Reader) error) error {
+	g := &guard{limits: s.src.opts.Limits, layer: i, digest: layer.Digest, total: &s.total}
+	_, err := s.src.layer(ctx, layer, i, g, fn)
+	return err
+}
+
+// Close releases the resources of the endpoints, e.g. ocidir locks
+func (s *Source) Close(ctx context.Context) {
+	s.src.close(ctx)
+}
+
+func newSource(r ref.Ref, opts Options) *source {
+	s := &source{ref: r, endpoints: opts.Endpoints, opts: opts}
+	if len(s.endpoints) == 0 {
+		s.endpoints = []ref.Ref{r}
+	}
+	return s
+}
+
+// endpoint returns the location that last succeeded, the first one before any request
+func (s *source) endpoint() ref.Ref {
+	return s.endpoints[s.served]
+}
+
+// close releases the resources of the endpoints, e.g. ocidir locks
+func (s *source) close(ctx context.Context) {
+	for _, ep := range s.endpoints {
+		_ = s.opts.RegClient.Close(ctx, ep)
+	}
+}
+
+// EndpointError is returned when a request failed at every endpoint of the source,
+// Endpoint is the one tried last, e.g. to name its registry when credentials are missing
+type EndpointError struct {
+	Endpoint ref.Ref
+	Err      error
+}
+
+func (e *EndpointError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *EndpointError) Unwrap() error {
+	return e.Err
+}
+
+// try calls fn with each endpoint until one succeeds, starting with the last successful endpoint.
+// The error of the last attempt is returned as an EndpointError when all fail.
+func (s *source) try(fn func(ep ref.Ref) error) error {
+	var err error
+	for i := range s.endpoints {
+		n := (s.served + i) % len(s.endpoints)
+		if err = fn(s.endpoints[n]); err == nil {
+			s.served = n
+			return nil
+		}
+		if i < len(s.endpoints)-1 {
+			s.opts.Logger.WithFields(logrus.Fields{
+				"ref":      s.ref.CommonName(),
+				"endpoint": s.endpoints[n].CommonName(),
+				"err":      err,
+			}).Info("Endpoint failed, trying the next one")
+		} else {
+			var ee *EndpointError
+			if !errors.As(err, &ee) {
+				err = &EndpointError{Endpoint: s.endpoints[n], Err: err}
+			}
+		}
+	}
+	return err
+}
+
+// layer pulls a layer and calls fn with the uncompressed tar stream,
+// the rest of the blob is read after fn to verify its digest.
+// The compression ratio is enforced by g, fn checks the entries.
+// The number of uncompressed bytes read is returned.
+func (s *source) layer(ctx context.Context, layer types.Descriptor, i int, g *guard, fn func(r io.Reader) error) (int64, error) {
+	br := newBlobReader(ctx, s, layer)
+	defer br.close()
+	lf := s.opts.Logger.WithFields(logrus.Fields{
+		"ref":    s.ref.CommonName(),
+		"layer":  i,
+		"digest": layer.Digest.String(),
+	})
+	lf.WithField("bytes", layer.Size).Debug("Pulling layer")
+	download := startTask(s.opts.Progress, PhaseDownload, i, layer.Digest.String(), layer.Size)
+	extract := startTask(s.opts.Progress, PhaseExtract, i, layer.Digest.String(), 0)
+	compressed := &readCounter{r: br, t: download}
+	dr, err := archive.Decompress(compressed)
+	if err != nil {
+		return 0, fmt.Errorf("failed pulling layer %d: %w", i, err)
+	}
+	uncompressed := &readCounter{r: g.reader(dr, compressed), t: extract}
+	if err := fn(uncompressed); err != nil {
+		var le *LimitError
+		if errors.As(err, &le) {
+			// already names the layer
+			return 0, err
+		}
+		return 0, fmt.Errorf("failed reading layer %d: %w", i, err)
+	}
+	extract.Done()
+	if _, err := io.Copy(io.Discard, compressed); err != nil {
+		return 0, fmt.Errorf("failed pulling layer %d: %w", i, err)
+	}
+	download.Done()
+	lf.WithFields(logrus.Fields{
+		"endpoint":     s.endpoint().CommonName(),
+		"bytes":        compressed.n,
+		"uncompressed": uncompressed.n,
+	}).Info("Pulled layer")
+	return uncompressed.n, nil
+}
+
+// startTask starts a progress task, a no-op without a Progress
+func startTask(p Progress, phase string, layer int, digest string, total int64) ProgressTask {
+	if p == nil {
+		return noProgress{}
+	}
+	return p.Start(phase, layer, digest, total)
+}
+
+type noProgress struct{}
+
+func (noProgress) Add(int64) {}
+func (noProgress) Done()     {}
+
+// readCounter counts the bytes read for the log and the progress
+type readCounter struct {
+	r io.Reader
+	t ProgressTask
+	n int64
+}
+
+func (rc *readCounter) Read(p []byte) (int, error) {
+	n, err := rc.r.Read(p)
+	rc.n += int64(n)
+	rc.t.Add(int64(n))
+	return n, err
+}
+
+// layerCause replaces the error of a cancelled request with the reason, e.g. the idle timeout
+func layerCause(ctx context.Context, err error) error {
+	if cause := context.Cause(ctx); cause != nil && !errors.Is(err, cause) {
+		return cause
+	}
+	return err
+}
+
+// idleTimeout cancels a blob request when no data is received within d, a zero d disables it
+type idleTimeout struct {
+	d     time.Duration
+	timer *time.Timer
+}
+
+// idleContext returns a context that is cancelled with ErrBlobIdleTimeout by the idle timer,
+// the returned cancel function must be called to stop the timer
+func idleContext(ctx context.Context, d time.Duration) (context.Context, *idleTimeout, context.CancelFunc) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	it := &idleTimeout{d: d}
+	if d > 0 {
+		it.timer = time.AfterFunc(d, func() {
+			cancel(fmt.Errorf("%w: no data received for %s", ErrBlobIdleTimeout, d))
+		})
+	}
+	return ctx, it, func() {
+		if it.timer != nil {
+			it.timer.Stop()
+		}
+		cancel(context.Canceled)
+	}
+}
+
+// reader restarts the idle timer whenever data is read from r
+func (it *idleTimeout) reader(r io.Reader) io.Reader {
+	if it.timer == nil {
+		return r
+	}
+	return &idleReader{r: r, it: it}
+}
+
+type idleReader struct {
+	r  io.Reader
+	it *idleTimeout
+}
+
+func (ir *idleReader) Read(p []byte) (int, error) {
+	n, err := ir.r.Read(p)
+	if n > 0 {
+		ir.it.timer.Reset(ir.it.d)
+	}
+	return n, err
+}
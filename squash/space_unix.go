@@ -0,0 +1,18 @@
+//go:build linux || darwin || freebsd
+
+package squash
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// freeSpace returns the bytes available to unprivileged users and an id of the filesystem of dir
+func freeSpace(dir string) (uint64, string, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, "", &os.PathError{Op: "statfs", Path: dir, Err: err}
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), fmt.Sprint(st.Fsid), nil
+}
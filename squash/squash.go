@@ -0,0 +1,643 @@
+// Package squash merges the layers of an image in a registry into a single filesystem.
+//
+// All settings are passed with Options, the package has no global state and
+// Squash may be called concurrently, e.g. from a build service.
+package squash
+
+import (
+	"archive/tar"
+	"context"
+	"crypto"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mheers/docker-image-squash/bundle"
+	"github.com/mheers/docker-image-squash/chunked"
+	"github.com/mheers/docker-image-squash/sign"
+	"github.com/opencontainers/go-digest"
+	"github.com/regclient/regclient"
+	"github.com/regclient/regclient/types"
+	"github.com/regclient/regclient/types/blob"
+	"github.com/regclient/regclient/types/manifest"
+	v1 "github.com/regclient/regclient/types/oci/v1"
+	"github.com/regclient/regclient/types/platform"
+	"github.com/regclient/regclient/types/ref"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// FormatTar writes the filesystem as a tar stream
+	FormatTar = "tar"
+	// FormatSquashfs writes the filesystem as a squashfs image, e.g. for a read-only root filesystem
+	FormatSquashfs = "squashfs"
+	// FormatExt4 writes the filesystem as an ext4 image without a journal, e.g. for the root disk of a microVM
+	FormatExt4 = "ext4"
+	// FormatCpio writes the filesystem as a cpio archive in the newc format with an /init, e.g. for an initramfs
+	FormatCpio = "cpio"
+	// FormatLXC writes the filesystem as the unified tarball of an LXC image, with metadata.yaml and the templates
+	FormatLXC = "lxc"
+
+	// CompressionNone writes the output uncompressed
+	CompressionNone = "none"
+	// CompressionGzip compresses the output with gzip, the blocks of a squashfs image with zlib
+	CompressionGzip = "gzip"
+	// CompressionZstd compresses a cpio archive, an LXC image or the blocks of a squashfs image with zstd
+	CompressionZstd = "zstd"
+	// CompressionEStargz pushes the layer as eStargz, a gzip layer with a table of contents for lazy pulling
+	CompressionEStargz = chunked.FormatEStargz
+	// CompressionZstdChunked pushes the layer as zstd:chunked, a zstd layer with a table of contents for lazy pulling
+	CompressionZstdChunked = chunked.FormatZstdChunked
+
+	// PhaseDownload is the progress of a layer download, in compressed bytes
+	PhaseDownload = "download"
+	// PhaseExtract is the progress of a layer extraction, in uncompressed bytes
+	PhaseExtract = "extract"
+	// PhaseWrite is the progress of the output, reported for layer -1
+	PhaseWrite = "write"
+	// PhaseUpload is the progress of the layer pushed by Push, reported for layer -1
+	PhaseUpload = "upload"
+)
+
+// Options configures a squash, the zero value squashes the image for the local platform
+// into an uncompressed tar using the docker credentials.
+type Options struct {
+	// Platform selects the image of a multi-platform index, e.g. linux/arm64, defaults to "local"
+	Platform string
+	// Include keeps only the paths matching one of these patterns (path.Match syntax, e.g. "usr/bin/*"),
+	// a matching directory includes everything below it. Empty includes everything.
+	Include []string
+	// Exclude removes the paths matching one of these patterns, applied after Include
+	Exclude []string
+	// Format of the output, FormatTar (default), FormatSquashfs, FormatExt4, FormatCpio or FormatLXC.
+	// All but a tar keep directories, symlinks, hardlinks, devices and xattrs, which needs the index or memory spill strategy,
+	// SpillAuto selects one of them and SpillDisk is rejected.
+	Format string
+	// Compression of the output, defaults to CompressionNone for a tar, an ext4 image is not compressed
+	// and the other formats default to CompressionGzip and support CompressionZstd.
+	// Push also supports CompressionEStargz and CompressionZstdChunked for the layer.
+	Compression string
+	// Size of an ext4 image in bytes, rounded up to a multiple of 4KiB.
+	// 0 sizes it to the content with 20% free space.
+	Size int64
+	// InitShim adds /sbin/init to an ext4 image, a shell script that mounts /proc, /sys and /dev
+	// and runs the Entrypoint and Cmd of the image with its Env and WorkingDir, e.g. to boot it in a microVM.
+	// It replaces an /sbin/init of the image and needs /bin/sh.
+	// A cpio archive always has the shim as /init, where the kernel runs it from an initramfs.
+	InitShim bool
+	// Logger receives the steps of the squash, defaults to discarding them
+	Logger logrus.FieldLogger
+	// RegClient pulls the image, defaults to a client with the docker credentials and certificates.
+	// Resumed layer downloads only request the missing bytes when its transport is wrapped with RangeTransport.
+	RegClient *regclient.RegClient
+	// Endpoints are the locations to pull the source from in order, e.g. mirrors, defaults to the source
+	Endpoints []ref.Ref
+	// BlobIdleTimeout aborts a layer download that receives no data for this long, zero disables it.
+	// The download is resumed if retries are left.
+	BlobIdleTimeout time.Duration
+	// Retries of a failed manifest request or layer download, defaults to DefaultRetries, negative disables them.
+	// Layer downloads resume where they failed and count the failures since data was last received.
+	Retries int
+	// RetryBackoff is the delay before the first retry, doubled for each retry up to RetryMaxBackoff
+	// with a random jitter, defaults to DefaultRetryBackoff and DefaultRetryMaxBackoff
+	RetryBackoff    time.Duration
+	RetryMaxBackoff time.Duration
+	// Progress receives the bytes downloaded, extracted and written, may be nil
+	Progress Progress
+	// WorkDir holds the extracted layers or the scratch file, defaults to os.TempDir(), e.g. the RAM backed /tmp of a runner
+	WorkDir string
+	// Spill selects where the merged filesystem is kept until it is written:
+	// SpillAuto (default), SpillDisk, SpillIndex or SpillMemory, see their docs for the memory and disk tradeoffs.
+	// Inspect reads a disk store in place, which SpillAuto then selects for a tar, and a copy of the index in the work dir.
+	Spill string
+	// MemoryMax is the largest estimated size that SpillAuto keeps in memory, defaults to DefaultMemoryMax
+	MemoryMax int64
+	// IncludeExternal pulls the layers with external URLs, e.g. the non-distributable base layers of Windows images,
+	// from the registry and else from the URLs. Without it they are skipped like by an image copy.
+	IncludeExternal bool
+	// WindowsHives handles the registry hives of Windows images: HivesKeep (default), HivesDrop or HivesReject
+	WindowsHives string
+	// Limits guard against decompression bombs and full disks, defaults to DefaultLimits
+	Limits *Limits
+	// SpaceDirs are checked for free space along with the extraction directory, e.g. the directory of the output file
+	SpaceDirs []string
+	// Inspect is called with a directory of the merged filesystem before the output is written, e.g. to scan it.
+	// For the index and memory spill strategies it is a copy without device nodes. An error aborts the squash.
+	Inspect func(ctx context.Context, dir string) error
+	// Bundle configures the config.json written by Unpack, e.g. a rootless container
+	Bundle bundle.Options
+	// Policy requires a signature of the source by one of the keys of the matching rule before the layers are pulled,
+	// of the digest the source resolved to or of the selected platform manifest. The signatures are looked up
+	// next to the image at the endpoint it is pulled from. A source without a valid signature fails with
+	// sign.ErrNoSignature, one that matches no rule with sign.ErrUntrusted. Nil pulls any image.
+	Policy *sign.Policy
+}
+
+// Progress is notified of each phase of each layer and of the output
+type Progress interface {
+	// Start begins a phase, layer is -1 for the output and total is 0 when unknown
+	Start(phase string, layer int, digest string, total int64) ProgressTask
+}
+
+// ProgressTask counts the bytes of a phase
+type ProgressTask interface {
+	Add(n int64)
+	Done()
+}
+
+// Result describes the squashed image
+type Result struct {
+	// Ref is the fully qualified source
+	Ref string
+	// Endpoint is the location the image was pulled from, it differs from Ref for mirrors
+	Endpoint string
+	// Digest of the manifest or index the source resolved to
+	Digest digest.Digest
+	// Manifest is the digest of the image manifest, the platform specific one for an index
+	Manifest digest.Digest
+	// Platform selected from an index, empty for a single image
+	Platform string
+	// OS of the image, e.g. linux or windows
+	OS string
+	// Config of the image
+	Config v1.Image
+	// Spill is the strategy used, SpillAuto is resolved to SpillDisk or SpillMemory
+	Spill string
+	// Layers in the order they were applied
+	Layers []Layer
+	// OutputDigest and OutputSize describe the bytes written by Squash or the layer pushed by Push
+	OutputDigest digest.Digest
+	OutputSize   int64
+	// Target is the fully qualified ref written by Push
+	Target string
+	// Pushed describes the image manifest written by Push
+	Pushed types.Descriptor
+}
+
+// Layer is a layer of the squashed image
+type Layer struct {
+	Digest       digest.Digest
+	Size         int64 // compressed size
+	Uncompressed int64
+	// External layers are not distributed with the image, e.g. the base layers of Windows images
+	External bool
+	// Skipped is set for an external layer without Options.IncludeExternal
+	Skipped bool
+}
+
+// Squash pulls source and writes its merged filesystem to w
+func Squash(ctx context.Context, source string, w io.Writer, opts Options) (*Result, error) {
+	opts, err := opts.defaults()
+	if err != nil {
+		return nil, err
+	}
+	// validate the filters before pulling anything
+	if _, err := newFilter(opts.Include, opts.Exclude); err != nil {
+		return nil, err
+	}
+	// the store is closed here, after the output is written
+	var st store
+	res, err := squashStore(ctx, source, opts, func(need int64, res *Result) (store, error) {
+		// check the command of the shim before pulling the layers
+		if opts.InitShim {
+			if _, err := initShim(res.Config.Config); err != nil {
+				return nil, fmt.Errorf("%w: %s needs an Entrypoint or Cmd for the init shim", err, res.Ref)
+			}
+		}
+		s, err := opts.newStore(need, res)
+		st = s
+		return s, err
+	})
+	if st != nil {
+		defer st.close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if opts.Inspect != nil {
+		if err := opts.inspect(ctx, st); err != nil {
+			return nil, err
+		}
+	}
+	if err := write(ctx, st, w, opts, res); err != nil {
+		return nil, err
+	}
+	opts.Logger.WithFields(logrus.Fields{
+		"ref":    res.Ref,
+		"digest": res.OutputDigest.String(),
+		"bytes":  res.OutputSize,
+	}).Info("Wrote output")
+	return res, nil
+}
+
+// SquashDir pulls source and merges its layers into dir, the output options are ignored
+func SquashDir(ctx context.Context, source, dir string, opts Options) (*Result, error) {
+	opts.Format, opts.Compression = "", ""
+	opts, err := opts.defaults()
+	if err != nil {
+		return nil, err
+	}
+	return squashStore(ctx, source, opts, func(need int64, res *Result) (store, error) {
+		if opts.Limits.SpaceCheck {
+			if err := checkSpace(append([]string{dir}, opts.SpaceDirs...), need); err != nil {
+				return nil, err
+			}
+		}
+		res.Spill = SpillDisk
+		return &diskStore{dir: dir}, nil
+	})
+}
+
+// defaults fills in the unset options and validates the others
+func (opts Options) defaults() (Options, error) {
+	if opts.Platform == "" {
+		opts.Platform = "local"
+	}
+	if _, err := platform.Parse(opts.Platform); err != nil {
+		return opts, fmt.Errorf("%w: platform %q: %v", ErrInvalidOption, opts.Platform, err)
+	}
+	if opts.Format == "" {
+		opts.Format = FormatTar
+	}
+	switch opts.Format {
+	case FormatTar:
+		switch opts.Compression {
+		case "":
+			opts.Compression = CompressionNone
+		case CompressionNone, CompressionGzip:
+		default:
+			return opts, fmt.Errorf("%w: compression %q, use %s or %s", ErrInvalidOption, opts.Compression, CompressionNone, CompressionGzip)
+		}
+	case FormatSquashfs, FormatCpio, FormatLXC:
+		switch opts.Compression {
+		case "":
+			opts.Compression = CompressionGzip
+		case CompressionNone, CompressionGzip, CompressionZstd:
+		default:
+			return opts, fmt.Errorf("%w: %s compression %q, use %s, %s or %s", ErrInvalidOption, opts.Format, opts.Compression, CompressionNone, CompressionGzip, CompressionZstd)
+		}
+	case FormatExt4:
+		switch opts.Compression {
+		case "":
+			opts.Compression = CompressionNone
+		case CompressionNone:
+		default:
+			return opts, fmt.Errorf("%w: ext4 compression %q, an ext4 image is not compressed", ErrInvalidOption, opts.Compression)
+		}
+	default:
+		return opts, fmt.Errorf("%w: format %q, use %s, %s, %s, %s or %s", ErrInvalidOption, opts.Format, FormatTar, FormatSquashfs, FormatExt4, FormatCpio, FormatLXC)
+	}
+	if opts.Size < 0 || (opts.Size != 0 && opts.Format != FormatExt4) {
+		return opts, fmt.Errorf("%w: size %d, it is set for an %s image only", ErrInvalidOption, opts.Size, FormatExt4)
+	}
+	opts.Size = (opts.Size + 4095) &^ 4095
+	if opts.Format == FormatCpio {
+		opts.InitShim = true
+	} else if opts.InitShim && opts.Format != FormatExt4 {
+		return opts, fmt.Errorf("%w: the init shim is added to an %s image or a %s archive only", ErrInvalidOption, FormatExt4, FormatCpio)
+	}
+	switch opts.Spill {
+	case "":
+		opts.Spill = SpillAuto
+	case SpillAuto, SpillDisk, SpillIndex, SpillMemory:
+	default:
+		return opts, fmt.Errorf("%w: spill %q, use %s, %s, %s or %s", ErrInvalidOption, opts.Spill, SpillAuto, SpillDisk, SpillIndex, SpillMemory)
+	}
+	if opts.Spill == SpillDisk && opts.fullTree() {
+		return opts, fmt.Errorf("%w: a %s image keeps all entry types, which needs the %s or %s spill strategy", ErrInvalidOption, opts.Format, SpillIndex, SpillMemory)
+	}
+	switch opts.WindowsHives {
+	case "":
+		opts.WindowsHives = HivesKeep
+	case HivesKeep, HivesDrop, HivesReject:
+	default:
+		return opts, fmt.Errorf("%w: windows hives %q, use %s, %s or %s", ErrInvalidOption, opts.WindowsHives, HivesKeep, HivesDrop, HivesReject)
+	}
+	if opts.WorkDir == "" {
+		opts.WorkDir = os.TempDir()
+	}
+	if opts.MemoryMax <= 0 {
+		opts.MemoryMax = DefaultMemoryMax
+	}
+	if opts.Retries == 0 {
+		opts.Retries = DefaultRetries
+	} else if opts.Retries < 0 {
+		opts.Retries = 0
+	}
+	if opts.RetryBackoff <= 0 {
+		opts.RetryBackoff = DefaultRetryBackoff
+	}
+	if opts.RetryMaxBackoff <= 0 {
+		opts.RetryMaxBackoff = DefaultRetryMaxBackoff
+	}
+	if opts.Limits == nil {
+		l := DefaultLimits
+		opts.Limits = &l
+	}
+	if opts.Logger == nil {
+		l := logrus.New()
+		l.SetOutput(io.Discard)
+		opts.Logger = l
+	}
+	if opts.RegClient == nil {
+		opts.RegClient = regclient.New(regclient.WithDockerCreds(), regclient.WithDockerCerts())
+	}
+	return opts, nil
+}
+
+// newStore returns the store of the spill strategy for an image of about need bytes
+// after checking the free space of the directories it uses
+func (opts Options) newStore(need int64, res *Result) (store, error) {
+	spill := opts.Spill
+	if spill == SpillAuto {
+		switch {
+		case opts.Inspect != nil && !opts.fullTree():
+			// inspected in place
+			spill = SpillDisk
+		case need <= opts.MemoryMax:
+			spill = SpillMemory
+		case opts.fullTree():
+			// only the index keeps all entry types
+			spill = SpillIndex
+		default:
+			spill = SpillDisk
+		}
+	}
+	dirs := opts.SpaceDirs
+	// the image writers spool the file content in the work dir
+	if spill != SpillMemory || opts.fullTree() {
+		dirs = append([]string{opts.WorkDir}, dirs...)
+	}
+	// and Inspect reads a copy of the index
+	if opts.Inspect != nil && spill != SpillDisk {
+		dirs = append(dirs, opts.WorkDir)
+	}
+	if opts.Limits.SpaceCheck {
+		if err := checkSpace(dirs, need); err != nil {
+			return nil, err
+		}
+	}
+	opts.Logger.WithFields(logrus.Fields{
+		"ref":      res.Ref,
+		"spill":    spill,
+		"estimate": need,
+	}).Debug("Selected spill strategy")
+	res.Spill = spill
+	switch spill {
+	case SpillIndex, SpillMemory:
+		workDir := opts.WorkDir
+		if spill == SpillMemory {
+			workDir = ""
+		}
+		s, err := newIndexStore(workDir, opts.fullTree())
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	default:
+		dir, err := os.MkdirTemp(opts.WorkDir, "squash")
+		if err != nil {
+			return nil, err
+		}
+		return &diskStore{dir: dir, temp: true}, nil
+	}
+}
+
+// inspect calls Inspect with the directory of a disk store, the entries of an index store
+// are written to a directory in the work dir for it, which is removed afterwards
+func (opts Options) inspect(ctx context.Context, st store) error {
+	if d, ok := st.(*diskStore); ok {
+		return opts.Inspect(ctx, d.dir)
+	}
+	f, err := newFilter(opts.Include, opts.Exclude)
+	if err != nil {
+		return err
+	}
+	files := map[string]bool{}
+	err = st.walk(func(th *tar.Header, _ func() (io.ReadCloser, error)) error {
+		if th.Typeflag == tar.TypeReg && f.keep(th.Name) {
+			files[th.Name] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	dir, err := os.MkdirTemp(opts.WorkDir, "inspect")
+	if err != nil {
+		return err
+	}
+	defer removeTree(dir)
+	// the device nodes and xattrs of the copy do not matter for a scan
+	l := logrus.New()
+	l.SetOutput(io.Discard)
+	dw := &dirWriter{dir: dir, dirs: map[string]bool{"": true}, t: noProgress{}, logger: l}
+	if err := writeImage(st, dw, opts, f, files, nil, nil); err != nil {
+		return err
+	}
+	return opts.Inspect(ctx, dir)
+}
+
+// removeTree removes dir after making its directories writable, an image may have read-only ones
+func removeTree(dir string) error {
+	filepath.WalkDir(dir, func(name string, d fs.DirEntry, err error) error {
+		if err == nil && d.IsDir() {
+			os.Chmod(name, 0700)
+		}
+		return nil
+	})
+	return os.RemoveAll(dir)
+}
+
+// fullTree returns true for the formats with all entry types, which the index store keeps
+func (opts Options) fullTree() bool {
+	return opts.Format != FormatTar
+}
+
+// squashStore pulls source and applies its layers to the store returned by newStore,
+// which is called with the estimated size of the filesystem
+func squashStore(ctx context.Context, source string, opts Options, newStore func(need int64, res *Result) (store, error)) (*Result, error) {
+	r, err := ref.New(source)
+	if err != nil {
+		return nil, err
+	}
+	// an untrusted source is refused before any request
+	var keys []crypto.PublicKey
+	if opts.Policy != nil {
+		if keys, err = opts.Policy.Keys(r); err != nil {
+			return nil, err
+		}
+	}
+	src := newSource(r, opts)
+	defer src.close(ctx)
+	res := &Result{Ref: r.CommonName()}
+
+	var m manifest.Manifest
+	err = src.retry(ctx, func() error {
+		return src.try(func(ep ref.Ref) (err error) {
+			m, err = opts.RegClient.ManifestGet(ctx, ep)
+			return err
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	res.Endpoint = src.endpoint().CommonName()
+	res.Digest = m.GetDescriptor().Digest
+	opts.Logger.WithFields(logrus.Fields{
+		"ref":      res.Ref,
+		"endpoint": res.Endpoint,
+		"digest":   res.Digest.String(),
+	}).Info("Resolved image")
+
+	// make it recursive for index of index scenarios
+	if m.IsList() {
+		plat, _ := platform.Parse(opts.Platform)
+		desc, err := manifest.GetPlatformDesc(m, &plat)
+		if err != nil {
+			pl, _ := manifest.GetPlatformList(m)
+			var ps []string
+			for _, p := range pl {
+				ps = append(ps, p.String())
+			}
+			opts.Logger.WithFields(logrus.Fields{
+				"platform":  plat,
+				"err":       err,
+				"platforms": strings.Join(ps, ", "),
+			}).Warn("Platform could not be found in manifest list")
+			return nil, err
+		}
+		err = src.retry(ctx, func() (err error) {
+			m, err = opts.RegClient.ManifestGet(ctx, src.endpoint(), regclient.WithManifestDesc(*desc))
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to pull platform specific digest: %w", err)
+		}
+		res.Platform = plat.String()
+		if desc.Platform != nil {
+			res.OS = desc.Platform.OS
+		}
+		opts.Logger.WithFields(logrus.Fields{
+			"ref":      res.Ref,
+			"platform": res.Platform,
+			"digest":   desc.Digest.String(),
+		}).Info("Selected platform")
+	}
+	res.Manifest = m.GetDescriptor().Digest
+	if opts.Policy != nil {
+		if err := verifySource(ctx, src, res, keys); err != nil {
+			return nil, err
+		}
+	}
+	mi, ok := m.(manifest.Imager)
+	if !ok {
+		return nil, ErrNotImage
+	}
+	layers, err := mi.GetLayers()
+	if err != nil {
+		return nil, err
+	}
+	cd, err := mi.GetConfig()
+	if err != nil {
+		return nil, err
+	}
+	var conf blob.OCIConfig
+	err = src.retry(ctx, func() (err error) {
+		conf, err = opts.RegClient.BlobGetOCIConfig(ctx, src.endpoint(), cd)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to pull config: %w", err)
+	}
+	res.Config = conf.GetConfig()
+	if res.OS == "" {
+		// a single image only has the platform in its config
+		res.OS = res.Config.OS
+	}
+
+	st, err := newStore(estimateSize(layers, opts.Limits), res)
+	if err != nil {
+		return nil, err
+	}
+
+	var size, total int64
+	hives := map[string]int{}
+	for i, layer := range layers {
+		external := len(layer.URLs) > 0
+		if external && !opts.IncludeExternal {
+			// like an image copy, layers that are not distributed with the image are skipped
+			opts.Logger.WithFields(logrus.Fields{
+				"ref":    res.Ref,
+				"layer":  i,
+				"digest": layer.Digest.String(),
+				"urls":   strings.Join(layer.URLs, ", "),
+			}).Warn("Skipping external layer")
+			res.Layers = append(res.Layers, Layer{Digest: layer.Digest, Size: layer.Size, External: true, Skipped: true})
+			continue
+		}
+		g := &guard{limits: opts.Limits, layer: i, digest: layer.Digest, total: &total}
+		check := func(th *tar.Header) error {
+			if err := g.check(th); err != nil {
+				return err
+			}
+			return whiteout(st, th)
+		}
+		if res.OS == osWindows {
+			wl := &windowsLayer{st: st, layer: i, opts: opts, hives: hives}
+			check = func(th *tar.Header) error {
+				if err := g.check(th); err != nil {
+					return err
+				}
+				return wl.check(th)
+			}
+		}
+		n, err := src.layer(ctx, layer, i, g, func(r io.Reader) error {
+			return st.extract(r, check)
+		})
+		if err != nil {
+			return nil, err
+		}
+		res.Layers = append(res.Layers, Layer{Digest: layer.Digest, Size: layer.Size, Uncompressed: n, External: external})
+		size += layer.Size
+	}
+	opts.Logger.WithFields(logrus.Fields{
+		"ref":    res.Ref,
+		"digest": res.Manifest.String(),
+		"layers": len(layers),
+		"bytes":  size,
+	}).Info("Squashed image")
+	return res, nil
+}
+
+// verifySource checks that the resolved source is signed by one of keys,
+// a signature of the index or of the platform manifest is accepted.
+// The signatures are read from the served endpoint, but must sign the requested repository.
+func verifySource(ctx context.Context, src *source, res *Result, keys []crypto.PublicKey) error {
+	opts := src.opts
+	var sigs []sign.Signature
+	var err error
+	for _, d := range []digest.Digest{res.Digest, res.Manifest} {
+		err = src.retry(ctx, func() (err error) {
+			sigs, err = sign.VerifyMirror(ctx, opts.RegClient, src.endpoint(), src.ref, d, keys)
+			return err
+		})
+		if err == nil || !errors.Is(err, sign.ErrNoSignature) || res.Digest == res.Manifest {
+			break
+		}
+	}
+	if err != nil {
+		return err
+	}
+	opts.Logger.WithFields(logrus.Fields{
+		"ref":        res.Ref,
+		"digest":     sigs[0].Payload.Critical.Image.DockerManifestDigest,
+		"signatures": len(sigs),
+	}).Info("Verified signature")
+	return nil
+}
@@ -0,0 +1,377 @@
+package squash
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mheers/docker-image-squash/sign"
+	"github.com/opencontainers/go-digest"
+	"github.com/regclient/regclient"
+	"github.com/regclient/regclient/config"
+	"github.com/regclient/regclient/types"
+	"github.com/regclient/regclient/types/manifest"
+	v1 "github.com/regclient/regclient/types/oci/v1"
+	"github.com/regclient/regclient/types/platform"
+	"github.com/regclient/regclient/types/ref"
+	"github.com/stretchr/testify/require"
+)
+
+func testGzipLayer(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+	names := []string{}
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	buf := bytes.Buffer{}
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for _, name := range names {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(files[name]))}))
+		_, err := tw.Write([]byte(files[name]))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, gw.Close())
+	return buf.Bytes()
+}
+
+// testRegistry is a stand-in registry serving test/app:latest as an index of an image per platform
+func testRegistry(images map[string][][]byte) http.Handler {
+	blobs := map[string][]byte{}
+	descs := map[string][]types.Descriptor{}
+	for plat, layers := range images {
+		descs[plat] = []types.Descriptor{}
+		for _, l := range layers {
+			blobs[digest.FromBytes(l).String()] = l
+			descs[plat] = append(descs[plat], types.Descriptor{MediaType: types.MediaTypeOCI1LayerGzip, Digest: digest.FromBytes(l), Size: int64(len(l))})
+		}
+	}
+	return testRegistryDescs(descs, blobs)
+}
+
+// testRegistryDescs serves an index of an image per platform with the layer descriptors, blobs holds the layers it has
+func testRegistryDescs(images map[string][]types.Descriptor, blobs map[string][]byte) http.Handler {
+	manifests := map[string][]byte{}
+	index := v1.Index{
+		Versioned: v1.IndexSchemaVersion,
+		MediaType: types.MediaTypeOCI1ManifestList,
+	}
+	for plat, layers := range images {
+		conf := []byte(fmt.Sprintf(`{"architecture":%q,"config":{"Env":["PATH=/usr/bin"],"Entrypoint":["/usr/bin/app"],"Cmd":["--name","it's"]}}`, plat))
+		blobs[digest.FromBytes(conf).String()] = conf
+		m := v1.Manifest{
+			Versioned: v1.ManifestSchemaVersion,
+			MediaType: types.MediaTypeOCI1Manifest,
+			Config:    types.Descriptor{MediaType: types.MediaTypeOCI1ImageConfig, Digest: digest.FromBytes(conf), Size: int64(len(conf))},
+			Layers:    layers,
+		}
+		mj, _ := json.Marshal(m)
+		manifests[digest.FromBytes(mj).String()] = mj
+		p, _ := platform.Parse(plat)
+		index.Manifests = append(index.Manifests, types.Descriptor{MediaType: types.MediaTypeOCI1Manifest, Digest: digest.FromBytes(mj), Size: int64(len(mj)), Platform: &p})
+	}
+	sort.Slice(index.Manifests, func(i, j int) bool {
+		return index.Manifests[i].Platform.String() < index.Manifests[j].Platform.String()
+	})
+	ij, _ := json.Marshal(index)
+	manifests["latest"] = ij
+	manifests[digest.FromBytes(ij).String()] = ij
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/", func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/v2/test/app/manifests/"):
+			mj, ok := manifests[strings.TrimPrefix(r.URL.Path, "/v2/test/app/manifests/")]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			mt := types.MediaTypeOCI1Manifest
+			if bytes.Equal(mj, ij) {
+				mt = types.MediaTypeOCI1ManifestList
+			}
+			w.Header().Set("Content-Type", mt)
+			w.Header().Set("Docker-Content-Digest", digest.FromBytes(mj).String())
+			if r.Method == http.MethodGet {
+				w.Write(mj)
+			}
+		case strings.HasPrefix(r.URL.Path, "/v2/test/app/blobs/"):
+			b, ok := blobs[strings.TrimPrefix(r.URL.Path, "/v2/test/app/blobs/")]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(b))
+		case r.URL.Path == "/v2/":
+			w.WriteHeader(http.StatusOK)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+	return mux
+}
+
+// testTarFiles returns the content of each file in a tar stream
+func testTarFiles(t *testing.T, r io.Reader) map[string]string {
+	t.Helper()
+	files := map[string]string{}
+	tr := tar.NewReader(r)
+	for {
+		th, err := tr.Next()
+		if err == io.EOF {
+			return files
+		}
+		require.NoError(t, err)
+		b, err := io.ReadAll(tr)
+		require.NoError(t, err)
+		files[th.Name] = string(b)
+	}
+}
+
+type testProgress struct {
+	mu    sync.Mutex
+	bytes map[string]int64
+	done  map[string]bool
+}
+
+func (p *testProgress) Start(phase string, layer int, digest string, total int64) ProgressTask {
+	return testTask{p: p, key: fmt.Sprintf("%s/%d", phase, layer)}
+}
+
+type testTask struct {
+	p   *testProgress
+	key string
+}
+
+func (t testTask) Add(n int64) {
+	t.p.mu.Lock()
+	defer t.p.mu.Unlock()
+	t.p.bytes[t.key] += n
+}
+
+func (t testTask) Done() {
+	t.p.mu.Lock()
+	defer t.p.mu.Unlock()
+	t.p.done[t.key] = true
+}
+
+func TestSquash(t *testing.T) {
+	amd64 := [][]byte{
+		testGzipLayer(t, map[string]string{"etc/os-release": "amd64\n", "usr/bin/app": "v1"}),
+		testGzipLayer(t, map[string]string{"usr/bin/app": "v2", "usr/share/doc/app": "docs"}),
+	}
+	arm64 := [][]byte{
+		testGzipLayer(t, map[string]string{"etc/os-release": "arm64\n", "usr/bin/app": "arm"}),
+	}
+	srv := httptest.NewServer(testRegistry(map[string][][]byte{"linux/amd64": amd64, "linux/arm64": arm64}))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+	source := host + "/test/app:latest"
+	rc := regclient.New(regclient.WithConfigHost(config.Host{Name: host, TLS: config.TLSDisabled}))
+
+	t.Run("platforms", func(t *testing.T) {
+		// squashes with different options do not interfere
+		for _, tc := range []struct {
+			platform string
+			layers   [][]byte
+			files    map[string]string
+		}{
+			{"linux/amd64", amd64, map[string]string{"etc/os-release": "amd64\n", "usr/bin/app": "v2", "usr/share/doc/app": "docs"}},
+			{"linux/arm64", arm64, map[string]string{"etc/os-release": "arm64\n", "usr/bin/app": "arm"}},
+		} {
+			tc := tc
+			t.Run(tc.platform, func(t *testing.T) {
+				t.Parallel()
+				for i := 0; i < 4; i++ {
+					buf := &bytes.Buffer{}
+					p := &testProgress{bytes: map[string]int64{}, done: map[string]bool{}}
+					res, err := Squash(context.Background(), source, buf, Options{Platform: tc.platform, RegClient: rc, Progress: p})
+					require.NoError(t, err)
+					require.Equal(t, tc.files, testTarFiles(t, bytes.NewReader(buf.Bytes())))
+					require.Equal(t, tc.platform, res.Platform)
+					require.Equal(t, source, res.Ref)
+					require.Equal(t, source, res.Endpoint)
+					require.NotEqual(t, res.Digest, res.Manifest)
+					require.Len(t, res.Layers, len(tc.layers))
+					for i, l := range tc.layers {
+						require.Equal(t, digest.FromBytes(l), res.Layers[i].Digest)
+						require.Equal(t, int64(len(l)), res.Layers[i].Size)
+						require.Greater(t, res.Layers[i].Uncompressed, int64(1024))
+						require.Equal(t, int64(len(l)), p.bytes[fmt.Sprintf("%s/%d", PhaseDownload, i)])
+					}
+					require.Equal(t, digest.FromBytes(buf.Bytes()), res.OutputDigest)
+					require.Equal(t, int64(buf.Len()), res.OutputSize)
+					require.Equal(t, res.OutputSize, p.bytes[PhaseWrite+"/-1"])
+					require.True(t, p.done[PhaseWrite+"/-1"])
+				}
+			})
+		}
+	})
+
+	t.Run("filters and gzip", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		var inspected []string
+		res, err := Squash(context.Background(), source, buf, Options{
+			Platform:    "linux/amd64",
+			Include:     []string{"/usr", "etc/*-release"},
+			Exclude:     []string{"usr/share/doc"},
+			Compression: CompressionGzip,
+			RegClient:   rc,
+			Inspect: func(ctx context.Context, dir string) error {
+				inspected = append(inspected, dir)
+				return nil
+			},
+		})
+		require.NoError(t, err)
+		require.Len(t, inspected, 1)
+		require.NoDirExists(t, inspected[0])
+		require.Equal(t, digest.FromBytes(buf.Bytes()), res.OutputDigest)
+		gr, err := gzip.NewReader(buf)
+		require.NoError(t, err)
+		require.Equal(t, map[string]string{"etc/os-release": "amd64\n", "usr/bin/app": "v2"}, testTarFiles(t, gr))
+	})
+
+	t.Run("endpoints", func(t *testing.T) {
+		down, err := ref.New("127.0.0.1:1/test/app:latest")
+		require.NoError(t, err)
+		up, err := ref.New(source)
+		require.NoError(t, err)
+		dir := t.TempDir()
+		res, err := SquashDir(context.Background(), "registry.example.com/test/app:latest", dir, Options{
+			Platform:  "linux/arm64",
+			RegClient: regclient.New(regclient.WithConfigHost(config.Host{Name: host, TLS: config.TLSDisabled}, config.Host{Name: "127.0.0.1:1", TLS: config.TLSDisabled})),
+			Endpoints: []ref.Ref{down, up},
+		})
+		require.NoError(t, err)
+		require.Equal(t, "registry.example.com/test/app:latest", res.Ref)
+		require.Equal(t, source, res.Endpoint)
+		require.FileExists(t, dir+"/usr/bin/app")
+		require.Empty(t, res.OutputDigest)
+
+		// the error of the endpoint tried last is returned with it
+		other, missing := up, up
+		other.Repository, missing.Repository = "test/other", "test/missing"
+		_, err = SquashDir(context.Background(), "registry.example.com/test/app:latest", t.TempDir(), Options{
+			RegClient: regclient.New(regclient.WithConfigHost(config.Host{Name: host, TLS: config.TLSDisabled})),
+			Endpoints: []ref.Ref{other, missing},
+		})
+		var ee *EndpointError
+		require.ErrorAs(t, err, &ee)
+		require.Equal(t, missing.CommonName(), ee.Endpoint.CommonName())
+		require.ErrorIs(t, err, types.ErrNotFound)
+	})
+
+	t.Run("invalid options", func(t *testing.T) {
+		for _, opts := range []Options{
+			{Format: "zip"},
+			{Compression: "lz4"},
+			{Exclude: []string{"usr/["}},
+			{Platform: "linux/amd 64"},
+		} {
+			_, err := Squash(context.Background(), source, io.Discard, opts)
+			require.ErrorIs(t, err, ErrInvalidOption, "%+v", opts)
+		}
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err := Squash(ctx, source, io.Discard, Options{RegClient: rc})
+		require.ErrorIs(t, err, context.Canceled)
+	})
+}
+
+func TestSquashPolicy(t *testing.T) {
+	srv := httptest.NewServer(testRegistry(map[string][][]byte{
+		"linux/amd64": {testGzipLayer(t, map[string]string{"etc/os-release": "amd64\n"})},
+		"linux/arm64": {testGzipLayer(t, map[string]string{"etc/os-release": "arm64\n"})},
+	}))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+	rc := regclient.New(regclient.WithConfigHost(config.Host{Name: host, TLS: config.TLSDisabled}))
+	ctx := context.Background()
+
+	// the index of the test registry in an ocidir
+	dir := t.TempDir()
+	src, err := ref.New(host + "/test/app:latest")
+	require.NoError(t, err)
+	r, err := ref.New("ocidir://" + filepath.Join(dir, "app") + ":latest")
+	require.NoError(t, err)
+	require.NoError(t, rc.ImageCopy(ctx, src, r))
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKIXPublicKey(key.Public())
+	require.NoError(t, err)
+	keys := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(keys, "build.pub"), pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(keys, "policy.yaml"), []byte(fmt.Sprintf("rules:\n  - match: %s/*\n    keys: [build.pub]\n  - match: %s\n    keys: [build.pub]\n", dir, host)), 0644))
+	policy, err := sign.LoadPolicy(filepath.Join(keys, "policy.yaml"))
+	require.NoError(t, err)
+
+	squash := func(source, plat string, p Progress) error {
+		_, err := Squash(ctx, source, io.Discard, Options{Platform: plat, RegClient: rc, Policy: policy, Progress: p, Retries: -1})
+		return err
+	}
+
+	// unsigned images are refused before the layers are pulled
+	for _, source := range []string{r.CommonName(), src.CommonName()} {
+		p := &testProgress{bytes: map[string]int64{}, done: map[string]bool{}}
+		require.ErrorIs(t, squash(source, "linux/amd64", p), sign.ErrNoSignature, source)
+		require.Empty(t, p.bytes, source)
+	}
+	other, err := ref.New("ocidir://" + filepath.Join(t.TempDir(), "app") + ":latest")
+	require.NoError(t, err)
+	require.NoError(t, rc.ImageCopy(ctx, src, other))
+	require.ErrorIs(t, squash(other.CommonName(), "linux/amd64", nil), sign.ErrUntrusted)
+
+	// a signature of the platform manifest
+	m, err := rc.ManifestGet(ctx, r)
+	require.NoError(t, err)
+	pm, err := manifest.GetPlatformDesc(m, &platform.Platform{OS: "linux", Architecture: "arm64"})
+	require.NoError(t, err)
+	rArm := r
+	rArm.Tag, rArm.Digest = "", pm.Digest.String()
+	require.NoError(t, sign.SignImage(ctx, rc, rArm, key, sign.ModeReferrer))
+	require.NoError(t, squash(r.CommonName(), "linux/arm64", nil))
+	require.ErrorIs(t, squash(r.CommonName(), "linux/amd64", nil), sign.ErrNoSignature)
+
+	// a signature of the index covers all platforms
+	rIndex := r
+	rIndex.Tag, rIndex.Digest = "", m.GetDescriptor().Digest.String()
+	require.NoError(t, sign.SignImage(ctx, rc, rIndex, key, sign.ModeTag))
+	require.NoError(t, squash(r.CommonName(), "linux/amd64", nil))
+
+	// by a key of the policy only
+	_, untrusted, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	require.NoError(t, sign.SignImage(ctx, rc, rIndex, untrusted, sign.ModeTag))
+	require.NoError(t, squash(r.CommonName(), "linux/amd64", nil))
+	om, err := rc.ManifestHead(ctx, other)
+	require.NoError(t, err)
+	other.Digest = om.GetDescriptor().Digest.String()
+	require.NoError(t, sign.SignImage(ctx, rc, other, untrusted, sign.ModeTag))
+	policy.Rules = append(policy.Rules, sign.Rule{Match: filepath.Dir(other.Path), PublicKeys: policy.Rules[0].PublicKeys})
+	require.ErrorIs(t, squash(other.CommonName(), "linux/amd64", nil), sign.ErrNoSignature)
+}
@@ -0,0 +1,202 @@
+package squash
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"io"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/regclient/regclient"
+	"github.com/regclient/regclient/config"
+	"github.com/stretchr/testify/require"
+)
+
+// testGzipEntries returns a gzipped layer with the entries in order, the content of a regular file is its Linkname
+func testGzipEntries(t *testing.T, entries []tar.Header) []byte {
+	t.Helper()
+	buf := bytes.Buffer{}
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for _, th := range entries {
+		content := ""
+		if th.Typeflag == tar.TypeReg {
+			content, th.Linkname = th.Linkname, ""
+			th.Size = int64(len(content))
+		}
+		require.NoError(t, tw.WriteHeader(&th))
+		_, err := tw.Write([]byte(content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, gw.Close())
+	return buf.Bytes()
+}
+
+func testSquashfsLayers(t *testing.T) [][]byte {
+	return [][]byte{
+		testGzipEntries(t, []tar.Header{
+			{Name: "./", Typeflag: tar.TypeDir, Mode: 0755},
+			{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0750, Gid: 42},
+			{Name: "etc/hosts", Typeflag: tar.TypeReg, Mode: 0644, Uid: 1000, Linkname: "127.0.0.1 localhost\n", PAXRecords: map[string]string{"SCHILY.xattr.user.test": "value"}},
+			{Name: "usr/bin/app", Typeflag: tar.TypeReg, Mode: 0755, Linkname: "v1"},
+			{Name: "usr/bin/sh", Typeflag: tar.TypeSymlink, Linkname: "app"},
+			{Name: "usr/bin/app2", Typeflag: tar.TypeLink, Linkname: "./usr/bin/app"},
+			{Name: "usr/bin/gone", Typeflag: tar.TypeLink, Linkname: "usr/share/doc/app"},
+			{Name: "usr/share/doc/app", Typeflag: tar.TypeReg, Mode: 0644, Linkname: "docs"},
+			{Name: "dev/null", Typeflag: tar.TypeChar, Mode: 0666, Devmajor: 1, Devminor: 3},
+		}),
+		testGzipEntries(t, []tar.Header{
+			// a file replaces a directory with everything below it
+			{Name: "usr/share", Typeflag: tar.TypeReg, Mode: 0644, Linkname: "file"},
+			{Name: "usr/bin/app", Typeflag: tar.TypeReg, Mode: 0755, Linkname: "v2"},
+		}),
+	}
+}
+
+func TestIndexStoreAll(t *testing.T) {
+	st, err := newIndexStore("", true)
+	require.NoError(t, err)
+	defer st.close()
+	for _, l := range testSquashfsLayers(t) {
+		zr, err := gzip.NewReader(bytes.NewReader(l))
+		require.NoError(t, err)
+		require.NoError(t, st.extract(zr, nil))
+	}
+	types := map[string]byte{}
+	err = st.walk(func(th *tar.Header, open func() (io.ReadCloser, error)) error {
+		types[th.Name] = th.Typeflag
+		switch th.Name {
+		case "etc/hosts":
+			require.Equal(t, "value", th.PAXRecords["SCHILY.xattr.user.test"])
+		case "usr/bin/app2":
+			require.Equal(t, "usr/bin/app", th.Linkname)
+		case "usr/bin/app":
+			r, err := open()
+			require.NoError(t, err)
+			b, err := io.ReadAll(r)
+			require.NoError(t, err)
+			require.Equal(t, "v2", string(b))
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, map[string]byte{
+		"":             tar.TypeDir,
+		"etc":          tar.TypeDir,
+		"etc/hosts":    tar.TypeReg,
+		"usr/bin/app":  tar.TypeReg,
+		"usr/bin/sh":   tar.TypeSymlink,
+		"usr/bin/app2": tar.TypeLink,
+		"usr/bin/gone": tar.TypeLink,
+		"usr/share":    tar.TypeReg,
+		"dev/null":     tar.TypeChar,
+	}, types)
+}
+
+func TestSquashfs(t *testing.T) {
+	srv := httptest.NewServer(testRegistry(map[string][][]byte{"linux/amd64": testSquashfsLayers(t)}))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+	source := host + "/test/app:latest"
+	rc := regclient.New(regclient.WithConfigHost(config.Host{Name: host, TLS: config.TLSDisabled}))
+
+	for _, tc := range []struct {
+		spill, compression string
+		memoryMax          int64
+		want               string
+	}{
+		{SpillAuto, "", 0, SpillMemory},
+		{SpillAuto, CompressionZstd, 1, SpillIndex},
+		{SpillIndex, CompressionNone, 0, SpillIndex},
+	} {
+		workDir := t.TempDir()
+		buf := &bytes.Buffer{}
+		res, err := Squash(context.Background(), source, buf, Options{
+			Platform:    "linux/amd64",
+			RegClient:   rc,
+			Format:      FormatSquashfs,
+			Compression: tc.compression,
+			Spill:       tc.spill,
+			MemoryMax:   tc.memoryMax,
+			WorkDir:     workDir,
+			// the copy of the index has the symlinks and hardlinks
+			Inspect: func(ctx context.Context, dir string) error {
+				target, err := os.Readlink(filepath.Join(dir, "usr/bin/sh"))
+				require.NoError(t, err)
+				require.Equal(t, "app", target)
+				app, err := os.Stat(filepath.Join(dir, "usr/bin/app"))
+				require.NoError(t, err)
+				app2, err := os.Stat(filepath.Join(dir, "usr/bin/app2"))
+				require.NoError(t, err)
+				require.True(t, os.SameFile(app, app2))
+				return nil
+			},
+		})
+		require.NoError(t, err, tc.spill)
+		require.Equal(t, tc.want, res.Spill)
+		require.EqualValues(t, buf.Len(), res.OutputSize)
+		require.Equal(t, uint32(0x73717368), binary.LittleEndian.Uint32(buf.Bytes()))
+		entries, err := os.ReadDir(workDir)
+		require.NoError(t, err)
+		require.Empty(t, entries)
+		testMountSquashfs(t, buf.Bytes())
+	}
+
+	_, err := Squash(context.Background(), source, &bytes.Buffer{}, Options{RegClient: rc, Compression: CompressionZstd})
+	require.ErrorIs(t, err, ErrInvalidOption)
+	_, err = Squash(context.Background(), source, &bytes.Buffer{}, Options{RegClient: rc, Format: FormatSquashfs, Compression: "xz"})
+	require.ErrorIs(t, err, ErrInvalidOption)
+	_, err = Squash(context.Background(), source, &bytes.Buffer{}, Options{RegClient: rc, Format: "erofs"})
+	require.ErrorIs(t, err, ErrInvalidOption)
+}
+
+// testMountSquashfs checks the content of the image with the squashfs driver of the kernel when it can be mounted
+func testMountSquashfs(t *testing.T, img []byte) {
+	t.Helper()
+	if os.Geteuid() != 0 {
+		return
+	}
+	file := filepath.Join(t.TempDir(), "image.sqfs")
+	require.NoError(t, os.WriteFile(file, img, 0644))
+	dir := t.TempDir()
+	if out, err := exec.Command("mount", "-t", "squashfs", "-o", "loop,ro", file, dir).CombinedOutput(); err != nil {
+		t.Logf("skipping mount check: %v: %s", err, out)
+		return
+	}
+	defer exec.Command("umount", dir).Run()
+
+	b, err := os.ReadFile(filepath.Join(dir, "usr/bin/app2"))
+	require.NoError(t, err)
+	require.Equal(t, "v2", string(b))
+	fi, err := os.Stat(filepath.Join(dir, "usr/bin/app"))
+	require.NoError(t, err)
+	require.EqualValues(t, 2, fi.Sys().(*syscall.Stat_t).Nlink)
+	target, err := os.Readlink(filepath.Join(dir, "usr/bin/sh"))
+	require.NoError(t, err)
+	require.Equal(t, "app", target)
+	require.NoFileExists(t, filepath.Join(dir, "usr/bin/gone"))
+	b, err = os.ReadFile(filepath.Join(dir, "usr/share"))
+	require.NoError(t, err)
+	require.Equal(t, "file", string(b))
+	fi, err = os.Stat(filepath.Join(dir, "etc"))
+	require.NoError(t, err)
+	require.EqualValues(t, 0750, fi.Mode().Perm())
+	require.EqualValues(t, 42, fi.Sys().(*syscall.Stat_t).Gid)
+	value := make([]byte, 16)
+	n, err := syscall.Getxattr(filepath.Join(dir, "etc/hosts"), "user.test", value)
+	require.NoError(t, err)
+	require.Equal(t, "value", string(value[:n]))
+	fi, err = os.Stat(filepath.Join(dir, "dev/null"))
+	require.NoError(t, err)
+	require.NotZero(t, fi.Mode()&os.ModeCharDevice)
+	require.NoError(t, exec.Command("umount", dir).Run())
+}
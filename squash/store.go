@@ -0,0 +1,360 @@
+package squash
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/mheers/docker-image-squash/helpers"
+)
+
+const (
+	// SpillAuto uses SpillMemory for images up to Options.MemoryMax and SpillDisk for larger ones, SpillIndex for all formats but tar.
+	// A tar with Options.Inspect always uses SpillDisk.
+	SpillAuto = "auto"
+	// SpillDisk extracts the layers into a directory below the work dir.
+	// Disk usage is the size of the final filesystem plus an inode per file, memory usage is constant.
+	SpillDisk = "disk"
+	// SpillIndex keeps an index of the files in memory and appends their content to a scratch file in the work dir.
+	// It avoids the per file overhead of the filesystem, but the content of overwritten files stays in the scratch file,
+	// so disk usage is the size of all layers. Memory usage is a few hundred bytes per file.
+	SpillIndex = "index"
+	// SpillMemory keeps the index and the content of the files in memory and does not use the work dir.
+	// Memory usage is the size of the final filesystem, use it for small images only.
+	SpillMemory = "memory"
+
+	// DefaultMemoryMax is the largest estimated image size that SpillAuto keeps in memory
+	DefaultMemoryMax = 256 << 20
+
+	paxXattr = "SCHILY.xattr."
+
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+// store holds the merged filesystem between extraction and output
+type store interface {
+	// extract applies a layer, check is called with each header before it is applied
+	// and may rename the entry or return helpers.ErrSkipEntry
+	extract(r io.Reader, check func(header *tar.Header) error) error
+	// remove deletes a path and everything below it, e.g. for a whiteout
+	remove(name string) error
+	// clear deletes everything below a directory and keeps the directory, e.g. for an opaque whiteout
+	clear(dir string) error
+	// walk calls fn with the header of each entry in the order of filepath.Walk,
+	// only regular files unless the store keeps all entry types
+	walk(fn func(th *tar.Header, open func() (io.ReadCloser, error)) error) error
+	// close removes the temporary files
+	close() error
+}
+
+// diskStore extracts into dir, a temporary dir is removed on close
+type diskStore struct {
+	dir  string
+	temp bool
+}
+
+func (d *diskStore) extract(r io.Reader, check func(header *tar.Header) error) error {
+	return helpers.UntarTarReaderCheck(tar.NewReader(r), d.dir, check)
+}
+
+func (d *diskStore) remove(name string) error {
+	name = strings.Trim(path.Clean("/"+name), "/")
+	if name != "" {
+		return os.RemoveAll(filepath.Join(d.dir, filepath.FromSlash(name)))
+	}
+	// the root itself is kept
+	return d.clear("")
+}
+
+func (d *diskStore) clear(dir string) error {
+	dir = filepath.Join(d.dir, filepath.FromSlash(strings.Trim(path.Clean("/"+dir), "/")))
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := os.RemoveAll(filepath.Join(dir, e.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *diskStore) walk(fn func(th *tar.Header, open func() (io.ReadCloser, error)) error) error {
+	return filepath.Walk(d.dir, func(file string, fi os.FileInfo, err error) error {
+		if err != nil || !fi.Mode().IsRegular() {
+			return err
+		}
+		th, err := tar.FileInfoHeader(fi, fi.Name())
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(d.dir, file)
+		if err != nil {
+			return err
+		}
+		th.Name = filepath.ToSlash(name)
+		return fn(th, func() (io.ReadCloser, error) {
+			return os.Open(file)
+		})
+	})
+}
+
+func (d *diskStore) close() error {
+	if d.temp {
+		return os.RemoveAll(d.dir)
+	}
+	return nil
+}
+
+// indexStore keeps the regular files in a map, their content is in memory or in a scratch file.
+// With all it also keeps directories, links, devices and fifos with their xattrs, e.g. for a squashfs image.
+type indexStore struct {
+	files   map[string]*indexFile
+	scratch *os.File // nil keeps the content in memory
+	size    int64    // bytes appended to scratch
+	all     bool
+	parents map[string]bool // directories with entries below them, including implicit ones
+}
+
+type indexFile struct {
+	header *tar.Header
+	data   []byte
+	offset int64
+}
+
+// newIndexStore returns a store with a scratch file in workDir, or in memory when workDir is empty
+func newIndexStore(workDir string, all bool) (*indexStore, error) {
+	s := &indexStore{files: map[string]*indexFile{}, all: all, parents: map[string]bool{}}
+	if workDir != "" {
+		f, err := os.CreateTemp(workDir, "squash-scratch")
+		if err != nil {
+			return nil, err
+		}
+		s.scratch = f
+	}
+	return s, nil
+}
+
+func (s *indexStore) extract(r io.Reader, check func(header *tar.Header) error) error {
+	tr := tar.NewReader(r)
+	for {
+		th, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if check != nil {
+			if err := check(th); errors.Is(err, helpers.ErrSkipEntry) {
+				continue
+			} else if err != nil {
+				return err
+			}
+		}
+		// like the disk store, only regular files are kept by default
+		if !s.keeps(th.Typeflag) {
+			continue
+		}
+		name := strings.Trim(path.Clean("/"+th.Name), "/")
+		if name == "" && th.Typeflag != tar.TypeDir {
+			continue
+		}
+		f := &indexFile{header: &tar.Header{
+			Typeflag: th.Typeflag,
+			Name:     name,
+			Size:     th.Size,
+			Mode:     th.Mode & 07777,
+			Uid:      th.Uid,
+			Gid:      th.Gid,
+			Uname:    th.Uname,
+			Gname:    th.Gname,
+			ModTime:  th.ModTime,
+		}}
+		if s.all {
+			f.header.PAXRecords = xattrRecords(th)
+			// a file replaces a directory with everything below it
+			if th.Typeflag != tar.TypeDir && s.parents[name] {
+				s.delete(name)
+				delete(s.parents, name)
+			}
+			for dir := path.Dir(name); dir != "." && !s.parents[dir]; dir = path.Dir(dir) {
+				s.parents[dir] = true
+			}
+		}
+		if th.Typeflag != tar.TypeReg {
+			f.header.Size = 0
+			f.header.Linkname = th.Linkname
+			if th.Typeflag == tar.TypeLink {
+				f.header.Linkname = strings.Trim(path.Clean("/"+th.Linkname), "/")
+			}
+			f.header.Devmajor, f.header.Devminor = th.Devmajor, th.Devminor
+			s.files[name] = f
+			continue
+		}
+		if s.scratch == nil {
+			if f.data, err = io.ReadAll(tr); err != nil {
+				return err
+			}
+		} else {
+			f.offset = s.size
+			n, err := io.Copy(s.scratch, tr)
+			s.size += n
+			if err != nil {
+				return err
+			}
+		}
+		s.files[name] = f
+	}
+}
+
+// keeps returns true for the entry types the store keeps
+func (s *indexStore) keeps(typ byte) bool {
+	switch typ {
+	case tar.TypeReg:
+		return true
+	case tar.TypeDir, tar.TypeSymlink, tar.TypeLink, tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		return s.all
+	}
+	return false
+}
+
+// xattrRecords returns the xattr PAX records of th, nil without xattrs
+func xattrRecords(th *tar.Header) map[string]string {
+	var x map[string]string
+	for k, v := range th.PAXRecords {
+		if strings.HasPrefix(k, paxXattr) {
+			if x == nil {
+				x = map[string]string{}
+			}
+			x[k] = v
+		}
+	}
+	return x
+}
+
+func (s *indexStore) remove(name string) error {
+	name = strings.Trim(path.Clean("/"+name), "/")
+	s.delete(name)
+	s.keepDir(path.Dir(name))
+	return nil
+}
+
+// delete deletes the entry name and everything below it
+func (s *indexStore) delete(name string) {
+	for n := range s.files {
+		if name == "" || n == name || strings.HasPrefix(n, name+"/") {
+			delete(s.files, n)
+		}
+	}
+}
+
+func (s *indexStore) clear(dir string) error {
+	dir = strings.Trim(path.Clean("/"+dir), "/")
+	for n := range s.files {
+		if n != dir && (dir == "" || strings.HasPrefix(n, dir+"/")) {
+			delete(s.files, n)
+		}
+	}
+	s.keepDir(dir)
+	return nil
+}
+
+// keepDir adds the implicit directory dir and its parents, which lose the entries they were created for
+func (s *indexStore) keepDir(dir string) {
+	if !s.all {
+		return
+	}
+	for ; dir != "." && dir != ""; dir = path.Dir(dir) {
+		if _, ok := s.files[dir]; ok || !s.parents[dir] {
+			return
+		}
+		s.files[dir] = &indexFile{header: &tar.Header{Typeflag: tar.TypeDir, Name: dir, Mode: 0755}}
+	}
+}
+
+func (s *indexStore) walk(fn func(th *tar.Header, open func() (io.ReadCloser, error)) error) error {
+	names := make([]string, 0, len(s.files))
+	for name := range s.files {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return walkLess(names[i], names[j])
+	})
+	for _, name := range names {
+		f := s.files[name]
+		th := *f.header
+		err := fn(&th, func() (io.ReadCloser, error) {
+			if s.scratch == nil {
+				return io.NopCloser(bytes.NewReader(f.data)), nil
+			}
+			return io.NopCloser(io.NewSectionReader(s.scratch, f.offset, f.header.Size)), nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *indexStore) close() error {
+	s.files = nil
+	if s.scratch == nil {
+		return nil
+	}
+	s.scratch.Close()
+	return os.Remove(s.scratch.Name())
+}
+
+// Whiteout parses the name of an OCI whiteout entry. ".wh.<name>" deletes target, the path of name,
+// and ".wh..wh..opq" is opaque and deletes everything below target, its directory.
+// target is relative to the image root, ok is false for the other entries.
+func Whiteout(name string) (target string, opaque, ok bool) {
+	dir, base := path.Split(strings.Trim(path.Clean("/"+name), "/"))
+	switch {
+	case base == whiteoutOpaque:
+		return strings.TrimSuffix(dir, "/"), true, true
+	case strings.HasPrefix(base, whiteoutPrefix):
+		return path.Join(dir, strings.TrimPrefix(base, whiteoutPrefix)), false, true
+	}
+	return "", false, false
+}
+
+// whiteout applies an OCI whiteout entry of a layer to the lower layers in st and returns helpers.ErrSkipEntry for it,
+// other entries are left alone. Layer writers put whiteouts before the other entries of their directory, so these are kept.
+func whiteout(st store, th *tar.Header) error {
+	target, opaque, ok := Whiteout(th.Name)
+	if !ok {
+		return nil
+	}
+	if opaque {
+		if err := st.clear(target); err != nil {
+			return err
+		}
+	} else if err := st.remove(target); err != nil {
+		return err
+	}
+	return helpers.ErrSkipEntry
+}
+
+// walkLess orders slash separated paths like filepath.Walk, by comparing each element
+func walkLess(a, b string) bool {
+	ae, be := strings.Split(a, "/"), strings.Split(b, "/")
+	for i := 0; i < len(ae) && i < len(be); i++ {
+		if ae[i] != be[i] {
+			return ae[i] < be[i]
+		}
+	}
+	return len(ae) < len(be)
+}
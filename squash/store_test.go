@@ -0,0 +1,174 @@
+package squash
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/regclient/regclient"
+	"github.com/regclient/regclient/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSpill(t *testing.T) {
+	layers := [][]byte{
+		testGzipLayer(t, map[string]string{"etc/os-release": "test\n", "usr/bin/app": "v1", "usr/bin-old": "old", "usr/bin/z/x": "x"}),
+		testGzipLayer(t, map[string]string{"usr/bin/app": "v2", "usr/share/doc/app": "docs"}),
+	}
+	files := map[string]string{"etc/os-release": "test\n", "usr/bin/app": "v2", "usr/bin-old": "old", "usr/bin/z/x": "x", "usr/share/doc/app": "docs"}
+	srv := httptest.NewServer(testRegistry(map[string][][]byte{"linux/amd64": layers}))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+	source := host + "/test/app:latest"
+	rc := regclient.New(regclient.WithConfigHost(config.Host{Name: host, TLS: config.TLSDisabled}))
+
+	var names []string
+	for _, tc := range []struct {
+		spill     string
+		memoryMax int64
+		inspect   bool
+		want      string
+	}{
+		{SpillDisk, 0, false, SpillDisk},
+		{SpillIndex, 0, false, SpillIndex},
+		{SpillMemory, 0, false, SpillMemory},
+		{SpillAuto, 0, false, SpillMemory},
+		{SpillAuto, 1, false, SpillDisk},
+		{SpillAuto, 0, true, SpillDisk},
+		{SpillMemory, 0, true, SpillMemory},
+		{SpillIndex, 0, true, SpillIndex},
+	} {
+		workDir := t.TempDir()
+		opts := Options{Platform: "linux/amd64", RegClient: rc, WorkDir: workDir, Spill: tc.spill, MemoryMax: tc.memoryMax}
+		if tc.inspect {
+			opts.Inspect = func(ctx context.Context, dir string) error {
+				b, err := os.ReadFile(filepath.Join(dir, "usr/bin/app"))
+				require.NoError(t, err)
+				require.Equal(t, "v2", string(b))
+				return nil
+			}
+		}
+		buf := &bytes.Buffer{}
+		res, err := Squash(context.Background(), source, buf, opts)
+		require.NoError(t, err, tc.spill)
+		require.Equal(t, tc.want, res.Spill)
+		require.Equal(t, files, testTarFiles(t, bytes.NewReader(buf.Bytes())), tc.spill)
+		// the files are written in the same order
+		order := testTarNames(t, buf)
+		if names == nil {
+			names = order
+		}
+		require.Equal(t, names, order, tc.spill)
+		// the work dir is cleaned up
+		entries, err := os.ReadDir(workDir)
+		require.NoError(t, err)
+		require.Empty(t, entries, tc.spill)
+	}
+
+	_, err := Squash(context.Background(), source, &bytes.Buffer{}, Options{RegClient: rc, Spill: "tmpfs"})
+	require.ErrorIs(t, err, ErrInvalidOption)
+	_, err = Squash(context.Background(), source, &bytes.Buffer{}, Options{RegClient: rc, Format: FormatSquashfs, Spill: SpillDisk})
+	require.ErrorIs(t, err, ErrInvalidOption)
+	_, err = Squash(context.Background(), source, &bytes.Buffer{}, Options{Platform: "linux/amd64", RegClient: rc, Spill: SpillIndex, WorkDir: t.TempDir() + "/missing"})
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func testWhiteoutLayers(t *testing.T) [][]byte {
+	return [][]byte{
+		testGzipLayer(t, map[string]string{"etc/passwd": "root", "etc/hosts": "localhost", "var/cache/a": "a", "var/cache/b/c": "c", "usr/share/doc": "docs"}),
+		// the whiteouts come first in their directory, the new entries are kept
+		testGzipLayer(t, map[string]string{"etc/.wh.passwd": "", "var/cache/.wh..wh..opq": "", "var/cache/c": "new", "usr/.wh.share": "", ".wh.missing": ""}),
+	}
+}
+
+func TestWhiteout(t *testing.T) {
+	layers := testWhiteoutLayers(t)
+	files := map[string]string{"etc/hosts": "localhost", "var/cache/c": "new"}
+	srv := httptest.NewServer(testRegistry(map[string][][]byte{"linux/amd64": layers}))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+	rc := regclient.New(regclient.WithConfigHost(config.Host{Name: host, TLS: config.TLSDisabled}))
+
+	for _, spill := range []string{SpillDisk, SpillIndex, SpillMemory} {
+		buf := &bytes.Buffer{}
+		_, err := Squash(context.Background(), host+"/test/app:latest", buf, Options{Platform: "linux/amd64", RegClient: rc, WorkDir: t.TempDir(), Spill: spill})
+		require.NoError(t, err, spill)
+		require.Equal(t, files, testTarFiles(t, bytes.NewReader(buf.Bytes())), spill)
+	}
+}
+
+func TestWhiteoutName(t *testing.T) {
+	for name, want := range map[string]struct {
+		target     string
+		opaque, ok bool
+	}{
+		"etc/.wh.passwd":         {"etc/passwd", false, true},
+		"./.wh.missing":          {"missing", false, true},
+		"var/cache/.wh..wh..opq": {"var/cache", true, true},
+		".wh..wh..opq":           {"", true, true},
+		"etc/passwd":             {"", false, false},
+		"etc/x.wh.y":             {"", false, false},
+	} {
+		target, opaque, ok := Whiteout(name)
+		require.Equal(t, want.target, target, name)
+		require.Equal(t, want.opaque, opaque, name)
+		require.Equal(t, want.ok, ok, name)
+	}
+}
+
+func TestWhiteoutImplicitDirs(t *testing.T) {
+	st, err := newIndexStore("", true)
+	require.NoError(t, err)
+	defer st.close()
+	for _, l := range testWhiteoutLayers(t) {
+		zr, err := gzip.NewReader(bytes.NewReader(l))
+		require.NoError(t, err)
+		require.NoError(t, st.extract(zr, func(th *tar.Header) error {
+			return whiteout(st, th)
+		}))
+	}
+	types := map[string]byte{}
+	err = st.walk(func(th *tar.Header, open func() (io.ReadCloser, error)) error {
+		types[th.Name] = th.Typeflag
+		return nil
+	})
+	require.NoError(t, err)
+	// usr was only implied by usr/share/doc, it stays after the whiteout of usr/share
+	require.Equal(t, map[string]byte{
+		"etc":         tar.TypeDir,
+		"etc/hosts":   tar.TypeReg,
+		"usr":         tar.TypeDir,
+		"var":         tar.TypeDir,
+		"var/cache":   tar.TypeDir,
+		"var/cache/c": tar.TypeReg,
+	}, types)
+}
+
+// testTarNames returns the names in a tar stream in order
+func testTarNames(t *testing.T, buf *bytes.Buffer) []string {
+	t.Helper()
+	names := []string{}
+	tr := tar.NewReader(bytes.NewReader(buf.Bytes()))
+	for {
+		th, err := tr.Next()
+		if err == io.EOF {
+			return names
+		}
+		require.NoError(t, err)
+		names = append(names, th.Name)
+	}
+}
+
+func TestWalkLess(t *testing.T) {
+	names := []string{"usr/bin/z/x", "usr/bin-old", "a", "usr/bin/app", "etc/os-release"}
+	sort.Slice(names, func(i, j int) bool { return walkLess(names[i], names[j]) })
+	require.Equal(t, []string{"a", "etc/os-release", "usr/bin/app", "usr/bin/z/x", "usr/bin-old"}, names)
+}
@@ -0,0 +1,282 @@
+package squash
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mheers/docker-image-squash/bundle"
+	"github.com/sirupsen/logrus"
+)
+
+// formatBundle is the format of Unpack, a directory with all entry types
+const formatBundle = "bundle"
+
+// Unpack pulls source and writes an OCI runtime bundle to dir for runc or crun:
+// the merged filesystem in dir/rootfs and a config.json from the image config and Options.Bundle.
+// dir/rootfs must not exist. Owners are kept and device nodes created when running as root only,
+// the files of a rootless container belong to its root. The output options are ignored.
+func Unpack(ctx context.Context, source, dir string, opts Options) (*Result, error) {
+	opts, err := opts.defaults()
+	if err != nil {
+		return nil, err
+	}
+	f, err := newFilter(opts.Include, opts.Exclude)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Spill == SpillDisk {
+		return nil, fmt.Errorf("%w: unpack keeps all entry types, which needs the %s or %s spill strategy", ErrInvalidOption, SpillIndex, SpillMemory)
+	}
+	opts.Format = formatBundle
+	// the rootfs is inspected instead of a disk store
+	inspect := opts.Inspect
+	opts.Inspect = nil
+	opts.SpaceDirs = append([]string{dir}, opts.SpaceDirs...)
+
+	rootfs := filepath.Join(dir, "rootfs")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	if err := os.Mkdir(rootfs, 0755); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidOption, err)
+	}
+	var st store
+	defer func() {
+		if st != nil {
+			st.close()
+		}
+		if err != nil {
+			os.RemoveAll(rootfs)
+			os.Remove(filepath.Join(dir, "config.json"))
+		}
+	}()
+	res, err := squashStore(ctx, source, opts, func(need int64, res *Result) (store, error) {
+		c := res.Config.Config
+		if len(c.Entrypoint)+len(c.Cmd) == 0 {
+			return nil, fmt.Errorf("%w: %s needs an Entrypoint or Cmd for the bundle", ErrNoCommand, res.Ref)
+		}
+		s, err := opts.newStore(need, res)
+		st = s
+		return s, err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	files := map[string]bool{}
+	err = st.walk(func(th *tar.Header, _ func() (io.ReadCloser, error)) error {
+		if th.Typeflag == tar.TypeReg && f.keep(th.Name) {
+			files[th.Name] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	t := startTask(opts.Progress, PhaseWrite, -1, "", 0)
+	dw := &dirWriter{dir: rootfs, owner: os.Geteuid() == 0, dirs: map[string]bool{"": true}, t: t, logger: opts.Logger}
+	if err = writeImage(st, dw, opts, f, files, nil, nil); err != nil {
+		return nil, err
+	}
+	t.Done()
+	if inspect != nil {
+		if err = inspect(ctx, rootfs); err != nil {
+			return nil, err
+		}
+	}
+
+	spec, err := bundle.NewSpec(res.Config, rootfs, opts.Bundle)
+	if err != nil {
+		return nil, err
+	}
+	b, err := json.MarshalIndent(spec, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+	if err = os.WriteFile(filepath.Join(dir, "config.json"), b, 0644); err != nil {
+		return nil, err
+	}
+	opts.Logger.WithFields(logrus.Fields{
+		"ref": res.Ref,
+		"dir": dir,
+	}).Info("Wrote bundle")
+	return res, nil
+}
+
+// dirWriter creates the entries below dir. Parents must be directories created by the writer,
+// so a symlink of the image is never followed out of dir.
+type dirWriter struct {
+	dir     string
+	owner   bool            // chown the entries and create device nodes, needs root
+	dirs    map[string]bool // directories created, their mode and mtime are set by Close
+	headers []*tar.Header   // of the directories
+	links   []*tar.Header
+	devices int // device nodes left out
+	t       ProgressTask
+	logger  logrus.FieldLogger
+}
+
+func (dw *dirWriter) Add(th *tar.Header, r io.Reader) error {
+	if err := dw.parent(th.Name); err != nil {
+		return err
+	}
+	target := dw.path(th.Name)
+	switch th.Typeflag {
+	case tar.TypeDir:
+		if !dw.dirs[th.Name] {
+			if err := os.Mkdir(target, 0700); err != nil {
+				return err
+			}
+			dw.dirs[th.Name] = true
+		}
+		dw.headers = append(dw.headers, th)
+		return nil
+	case tar.TypeReg:
+		f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		n, err := io.Copy(f, r)
+		dw.t.Add(n)
+		if err1 := f.Close(); err == nil {
+			err = err1
+		}
+		if err != nil {
+			return err
+		}
+	case tar.TypeSymlink:
+		if err := os.Symlink(th.Linkname, target); err != nil {
+			return err
+		}
+	case tar.TypeLink:
+		// the target may follow in the walk
+		dw.links = append(dw.links, th)
+		return nil
+	case tar.TypeChar, tar.TypeBlock:
+		if !dw.owner {
+			dw.devices++
+			return nil
+		}
+		if err := mknod(target, th); err != nil {
+			return err
+		}
+	case tar.TypeFifo:
+		if err := mknod(target, th); errors.Is(err, errors.ErrUnsupported) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	default:
+		return nil
+	}
+	return dw.attributes(target, th)
+}
+
+// parent creates the missing parents of name, it fails when one is not a directory
+func (dw *dirWriter) parent(name string) error {
+	if name == "" {
+		return nil
+	}
+	dir := path.Dir(name)
+	if dir == "." || dw.dirs[dir] {
+		return nil
+	}
+	if err := dw.parent(dir); err != nil {
+		return err
+	}
+	if err := os.Mkdir(dw.path(dir), 0755); err != nil {
+		if os.IsExist(err) {
+			return fmt.Errorf("%w: parent %s of %s is not a directory", ErrInvalidOption, dir, name)
+		}
+		return err
+	}
+	dw.dirs[dir] = true
+	return nil
+}
+
+func (dw *dirWriter) path(name string) string {
+	return filepath.Join(dw.dir, filepath.FromSlash(name))
+}
+
+// attributes sets the owner, mode, xattrs and mtime of an entry, symlinks only get an owner and xattrs
+func (dw *dirWriter) attributes(target string, th *tar.Header) error {
+	if dw.owner {
+		if err := os.Lchown(target, th.Uid, th.Gid); err != nil {
+			return err
+		}
+	}
+	if err := setXattrs(target, th); err != nil {
+		dw.logger.WithFields(logrus.Fields{
+			"path": th.Name,
+			"err":  err,
+		}).Debug("Skipping xattrs")
+	}
+	if th.Typeflag == tar.TypeSymlink {
+		return nil
+	}
+	// after chown, which clears the setuid bits
+	if err := os.Chmod(target, fileMode(th.Mode)); err != nil {
+		return err
+	}
+	return os.Chtimes(target, time.Now(), th.ModTime)
+}
+
+func (dw *dirWriter) Close() error {
+	for _, th := range dw.links {
+		if err := dw.parent(th.Name); err != nil {
+			return err
+		}
+		if err := os.Link(dw.path(th.Linkname), dw.path(th.Name)); err != nil {
+			return err
+		}
+	}
+	if dw.devices > 0 {
+		dw.logger.WithField("devices", dw.devices).Warn("Skipped device nodes, creating them needs root")
+	}
+	// the deepest directories first, so adding entries does not change the mtime of a parent again
+	depth := func(name string) int {
+		if name == "" {
+			return -1
+		}
+		return strings.Count(name, "/")
+	}
+	sort.SliceStable(dw.headers, func(i, j int) bool {
+		return depth(dw.headers[i].Name) > depth(dw.headers[j].Name)
+	})
+	for _, th := range dw.headers {
+		if err := dw.attributes(dw.path(th.Name), th); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Discard leaves the entries for Unpack to remove
+func (dw *dirWriter) Discard() error {
+	return nil
+}
+
+// fileMode converts the permission and setuid, setgid and sticky bits of a tar mode
+func fileMode(mode int64) os.FileMode {
+	m := os.FileMode(mode & 0777)
+	if mode&04000 != 0 {
+		m |= os.ModeSetuid
+	}
+	if mode&02000 != 0 {
+		m |= os.ModeSetgid
+	}
+	if mode&01000 != 0 {
+		m |= os.ModeSticky
+	}
+	return m
+}
@@ -0,0 +1,36 @@
+package squash
+
+import (
+	"archive/tar"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// mknod creates a device node or a fifo
+func mknod(target string, th *tar.Header) error {
+	mode := uint32(th.Mode & 07777)
+	switch th.Typeflag {
+	case tar.TypeChar:
+		mode |= unix.S_IFCHR
+	case tar.TypeBlock:
+		mode |= unix.S_IFBLK
+	default:
+		mode |= unix.S_IFIFO
+	}
+	return unix.Mknod(target, mode, int(unix.Mkdev(uint32(th.Devmajor), uint32(th.Devminor))))
+}
+
+// setXattrs sets the xattrs of the PAX records of th, the security and trusted namespaces need root
+func setXattrs(target string, th *tar.Header) error {
+	for k, v := range th.PAXRecords {
+		name, ok := strings.CutPrefix(k, paxXattr)
+		if !ok {
+			continue
+		}
+		if err := unix.Lsetxattr(target, name, []byte(v), 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
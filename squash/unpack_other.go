@@ -0,0 +1,18 @@
+//go:build !linux
+
+package squash
+
+import (
+	"archive/tar"
+	"errors"
+)
+
+// mknod is not implemented on this platform, the entry is left out
+func mknod(target string, th *tar.Header) error {
+	return errors.ErrUnsupported
+}
+
+// setXattrs is not implemented on this platform, the xattrs are left out
+func setXattrs(target string, th *tar.Header) error {
+	return nil
+}
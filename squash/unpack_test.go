@@ -0,0 +1,87 @@
+package squash
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mheers/docker-image-squash/bundle"
+	"github.com/regclient/regclient"
+	"github.com/regclient/regclient/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnpack(t *testing.T) {
+	layers := append(testSquashfsLayers(t), testGzipEntries(t, []tar.Header{
+		{Name: "etc/.wh.hosts", Typeflag: tar.TypeReg},
+		{Name: "dev/.wh..wh..opq", Typeflag: tar.TypeReg},
+		{Name: "dev/console", Typeflag: tar.TypeReg, Mode: 0644, Linkname: "console"},
+	}))
+	srv := httptest.NewServer(testRegistry(map[string][][]byte{"linux/amd64": layers}))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+	rc := regclient.New(regclient.WithConfigHost(config.Host{Name: host, TLS: config.TLSDisabled}))
+	opts := Options{
+		Platform:  "linux/amd64",
+		RegClient: rc,
+		WorkDir:   t.TempDir(),
+		Bundle:    bundle.Options{Rootless: true},
+	}
+
+	dir := filepath.Join(t.TempDir(), "bundle")
+	_, err := Unpack(context.Background(), host+"/test/app:latest", dir, opts)
+	require.NoError(t, err)
+	rootfs := filepath.Join(dir, "rootfs")
+
+	b, err := os.ReadFile(filepath.Join(rootfs, "usr/bin/app"))
+	require.NoError(t, err)
+	require.Equal(t, "v2", string(b))
+	target, err := os.Readlink(filepath.Join(rootfs, "usr/bin/sh"))
+	require.NoError(t, err)
+	require.Equal(t, "app", target)
+	app, err := os.Stat(filepath.Join(rootfs, "usr/bin/app"))
+	require.NoError(t, err)
+	app2, err := os.Stat(filepath.Join(rootfs, "usr/bin/app2"))
+	require.NoError(t, err)
+	require.True(t, os.SameFile(app, app2))
+	fi, err := os.Stat(filepath.Join(rootfs, "etc"))
+	require.NoError(t, err)
+	require.EqualValues(t, 0750, fi.Mode().Perm())
+	require.NoFileExists(t, filepath.Join(rootfs, "usr/bin/gone"))
+	// the whiteouts of the last layer
+	require.NoFileExists(t, filepath.Join(rootfs, "etc/hosts"))
+	require.NoFileExists(t, filepath.Join(rootfs, "etc/.wh.hosts"))
+	entries, err := os.ReadDir(filepath.Join(rootfs, "dev"))
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, "console", entries[0].Name())
+
+	var spec bundle.Spec
+	b, err = os.ReadFile(filepath.Join(dir, "config.json"))
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(b, &spec))
+	require.Equal(t, bundle.Version, spec.Version)
+	require.Equal(t, []string{"/usr/bin/app", "--name", "it's"}, spec.Process.Args)
+	require.Equal(t, "rootfs", spec.Root.Path)
+	require.NotEmpty(t, spec.Linux.UIDMappings)
+
+	// an existing rootfs is never overwritten
+	_, err = Unpack(context.Background(), host+"/test/app:latest", dir, opts)
+	require.ErrorIs(t, err, ErrInvalidOption)
+	require.FileExists(t, filepath.Join(rootfs, "usr/bin/app"))
+
+	// a failed unpack removes the rootfs
+	dir = filepath.Join(t.TempDir(), "bundle")
+	_, err = Unpack(context.Background(), host+"/test/missing:latest", dir, opts)
+	require.Error(t, err)
+	require.NoDirExists(t, filepath.Join(dir, "rootfs"))
+
+	opts.Spill = SpillDisk
+	_, err = Unpack(context.Background(), host+"/test/app:latest", t.TempDir(), opts)
+	require.ErrorIs(t, err, ErrInvalidOption)
+}
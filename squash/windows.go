@@ -0,0 +1,68 @@
+package squash
+
+import (
+	"archive/tar"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/mheers/docker-image-squash/helpers"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// HivesKeep keeps the registry hives of Windows layers, it fails when two layers change the same hive
+	HivesKeep = "keep"
+	// HivesDrop leaves the registry hives out of the output
+	HivesDrop = "drop"
+	// HivesReject fails on any registry hive
+	HivesReject = "reject"
+
+	windowsHives = "Hives"
+	osWindows    = "windows"
+)
+
+// windowsLayer applies a layer of a Windows image, which stores the filesystem below Files/
+// and registry hive deltas below Hives/. The output keeps this layout so it can be imported as a layer.
+// Whiteouts are applied like in the layers of other images after the names are normalized.
+type windowsLayer struct {
+	st    store
+	layer int
+	opts  Options
+	hives map[string]int // hive file and the layer that added it, shared by all layers
+}
+
+// check is called with each header of the layer after the limits, it renames or skips entries
+func (w *windowsLayer) check(th *tar.Header) error {
+	// backslashes are path separators on Windows
+	name := strings.Trim(path.Clean("/"+strings.ReplaceAll(th.Name, "\\", "/")), "/")
+	th.Name = name
+	if err := whiteout(w.st, th); err != nil {
+		return err
+	}
+	if name != windowsHives && !strings.HasPrefix(name, windowsHives+"/") {
+		return nil
+	}
+
+	switch w.opts.WindowsHives {
+	case HivesDrop:
+		if th.Typeflag == tar.TypeReg {
+			w.opts.Logger.WithFields(logrus.Fields{
+				"layer": w.layer,
+				"hive":  name,
+			}).Warn("Dropping registry hive")
+		}
+		return helpers.ErrSkipEntry
+	case HivesReject:
+		return fmt.Errorf("%w: %s is rejected", ErrWindowsHives, name)
+	}
+	if th.Typeflag != tar.TypeReg {
+		return nil
+	}
+	// a hive delta applies to the hive below it, so only one layer may change each hive
+	if prev, ok := w.hives[name]; ok && prev != w.layer {
+		return fmt.Errorf("%w: layers %d and %d both change %s, hive deltas cannot be merged, drop the hives to squash the files only", ErrWindowsHives, prev, w.layer, name)
+	}
+	w.hives[name] = w.layer
+	return nil
+}
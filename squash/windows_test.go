@@ -0,0 +1,124 @@
+package squash
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/regclient/regclient"
+	"github.com/regclient/regclient/config"
+	"github.com/regclient/regclient/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWindows(t *testing.T) {
+	// synthetic Windows layers, the base layer is only available from its URL
+	base := testGzipLayer(t, map[string]string{
+		"Files/Windows/System32/cmd.exe": "cmd",
+		"Files/Windows/notepad.exe":      "notepad",
+		"Files/Program Files/old/a.exe":  "old",
+		"Hives/Software_Delta":           "base software",
+	})
+	app := testGzipLayer(t, map[string]string{
+		"Files/app/app.exe":             "app",
+		"Files/Windows/.wh.notepad.exe": "",
+		"Files/Program Files/.wh.old":   "",
+		"Hives/System_Delta":            "app system",
+	})
+	software := testGzipLayer(t, map[string]string{"Hives/Software_Delta": "app software"})
+	ext := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/base.tar.gz" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(base))
+	}))
+	defer ext.Close()
+	baseDesc := types.Descriptor{MediaType: types.MediaTypeOCI1ForeignLayerGzip, Digest: digest.FromBytes(base), Size: int64(len(base)), URLs: []string{ext.URL + "/missing.tar.gz", ext.URL + "/base.tar.gz"}}
+	layerDesc := func(l []byte) types.Descriptor {
+		return types.Descriptor{MediaType: types.MediaTypeOCI1LayerGzip, Digest: digest.FromBytes(l), Size: int64(len(l))}
+	}
+	srv := httptest.NewServer(testRegistryDescs(
+		map[string][]types.Descriptor{"windows/amd64": {baseDesc, layerDesc(app)}},
+		map[string][]byte{digest.FromBytes(app).String(): app},
+	))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+	source := host + "/test/app:latest"
+	rc := regclient.New(regclient.WithConfigHost(config.Host{Name: host, TLS: config.TLSDisabled}))
+	opts := func(o Options) Options {
+		o.Platform = "windows/amd64"
+		o.RegClient = rc
+		return o
+	}
+
+	t.Run("include external", func(t *testing.T) {
+		for _, spill := range []string{SpillDisk, SpillIndex, SpillMemory} {
+			buf := &bytes.Buffer{}
+			res, err := Squash(context.Background(), source, buf, opts(Options{IncludeExternal: true, Spill: spill, WorkDir: t.TempDir()}))
+			require.NoError(t, err, spill)
+			require.Equal(t, osWindows, res.OS)
+			require.Equal(t, map[string]string{
+				"Files/Windows/System32/cmd.exe": "cmd",
+				"Files/app/app.exe":              "app",
+				"Hives/Software_Delta":           "base software",
+				"Hives/System_Delta":             "app system",
+			}, testTarFiles(t, buf), spill)
+			require.True(t, res.Layers[0].External)
+			require.False(t, res.Layers[0].Skipped)
+		}
+	})
+
+	t.Run("skip external", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		res, err := Squash(context.Background(), source, buf, opts(Options{}))
+		require.NoError(t, err)
+		require.True(t, res.Layers[0].Skipped)
+		require.Equal(t, map[string]string{
+			"Files/app/app.exe":  "app",
+			"Hives/System_Delta": "app system",
+		}, testTarFiles(t, buf))
+	})
+
+	t.Run("drop hives", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		_, err := Squash(context.Background(), source, buf, opts(Options{IncludeExternal: true, WindowsHives: HivesDrop}))
+		require.NoError(t, err)
+		require.Equal(t, map[string]string{
+			"Files/Windows/System32/cmd.exe": "cmd",
+			"Files/app/app.exe":              "app",
+		}, testTarFiles(t, buf))
+	})
+
+	t.Run("reject hives", func(t *testing.T) {
+		_, err := Squash(context.Background(), source, &bytes.Buffer{}, opts(Options{IncludeExternal: true, WindowsHives: HivesReject}))
+		require.ErrorIs(t, err, ErrWindowsHives)
+		require.Contains(t, err.Error(), "layer 0")
+		require.Contains(t, err.Error(), "Hives/Software_Delta")
+	})
+
+	t.Run("hive conflict", func(t *testing.T) {
+		srv := httptest.NewServer(testRegistryDescs(
+			map[string][]types.Descriptor{"windows/amd64": {layerDesc(base), layerDesc(software)}},
+			map[string][]byte{digest.FromBytes(base).String(): base, digest.FromBytes(software).String(): software},
+		))
+		defer srv.Close()
+		host := strings.TrimPrefix(srv.URL, "http://")
+		rc := regclient.New(regclient.WithConfigHost(config.Host{Name: host, TLS: config.TLSDisabled}))
+		_, err := Squash(context.Background(), host+"/test/app:latest", &bytes.Buffer{}, Options{Platform: "windows/amd64", RegClient: rc})
+		require.ErrorIs(t, err, ErrWindowsHives)
+		require.Contains(t, err.Error(), "layers 0 and 1")
+		_, err = Squash(context.Background(), host+"/test/app:latest", &bytes.Buffer{}, Options{Platform: "windows/amd64", RegClient: rc, WindowsHives: HivesDrop})
+		require.NoError(t, err)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		_, err := Squash(context.Background(), source, &bytes.Buffer{}, opts(Options{WindowsHives: "merge"}))
+		require.ErrorIs(t, err, ErrInvalidOption)
+	})
+}
@@ -0,0 +1,652 @@
+// Package squashfs writes a squashfs 4.0 filesystem image from tar entries, without mksquashfs.
+//
+// Files are stored in blocks without fragments and without an export table,
+// the image can be loop mounted read-only by Linux or unpacked with unsquashfs.
+package squashfs
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+const (
+	// CompressionGzip compresses the blocks with zlib, supported by every squashfs implementation
+	CompressionGzip = "gzip"
+	// CompressionZstd compresses the blocks with zstd, supported by Linux 4.14 and later
+	CompressionZstd = "zstd"
+	// CompressionNone stores the blocks uncompressed
+	CompressionNone = "none"
+
+	// DefaultBlockSize is the block size of mksquashfs
+	DefaultBlockSize = 128 << 10
+
+	magic          = 0x73717368
+	superblockSize = 96
+	padding        = 4096
+	noTable        = math.MaxUint64
+	noFragment     = math.MaxUint32
+	noXattr        = math.MaxUint32
+	maxIDs         = 1 << 16
+	maxNameLen     = 256
+	maxDirEntries  = 256
+
+	flagUncompressedInodes    = 0x0001
+	flagUncompressedData      = 0x0002
+	flagUncompressedFragments = 0x0008
+	flagNoFragments           = 0x0010
+	flagUncompressedXattrs    = 0x0100
+	flagNoXattrs              = 0x0200
+	flagUncompressedIDs       = 0x0800
+
+	typeDir     = 1
+	typeFile    = 2
+	typeSymlink = 3
+	typeBlock   = 4
+	typeChar    = 5
+	typeFifo    = 6
+	typeSocket  = 7
+	// extended inodes have the basic type plus extType
+	extType = 7
+)
+
+var (
+	// ErrInvalidOption is returned for an unknown compression or an invalid block size
+	ErrInvalidOption = errors.New("invalid squashfs option")
+	// ErrInvalidEntry is returned for an entry that cannot be stored, e.g. a hardlink to a missing file
+	ErrInvalidEntry = errors.New("invalid squashfs entry")
+)
+
+// Options configures the image
+type Options struct {
+	// Compression of the data and the tables, defaults to CompressionGzip
+	Compression string
+	// BlockSize is a power of two from 4KiB to 1MiB, defaults to DefaultBlockSize
+	BlockSize int
+	// TempDir holds the compressed data until Close writes the image, defaults to os.TempDir()
+	TempDir string
+}
+
+// Writer builds an image from tar entries, it is written to the underlying writer by Close
+type Writer struct {
+	w         io.Writer
+	opts      Options
+	comp      compressor
+	spool     *os.File // compressed data blocks, they follow the superblock
+	spoolSize uint64
+	root      *node
+	links     []link
+	modTime   uint32
+	block     []byte
+}
+
+type link struct {
+	name, target string
+}
+
+// node is an inode, a hardlinked file is the node of several directory entries
+type node struct {
+	typ      uint16 // basic type
+	mode     uint16
+	uid, gid uint32
+	mtime    uint32
+	xattrs   map[string]string
+	nlink    uint32
+	children map[string]*node // directories
+	// regular files
+	size   uint64
+	start  uint64
+	blocks []uint32
+	sparse uint64
+	// symlinks and devices
+	target string
+	rdev   uint32
+	// implicit directories get the newest mtime of the image
+	implicit bool
+	// set by Close
+	number  uint32
+	ref     uint64
+	written bool
+}
+
+// NewWriter returns a Writer for w, Close must be called to write the image
+func NewWriter(w io.Writer, opts Options) (*Writer, error) {
+	if opts.BlockSize == 0 {
+		opts.BlockSize = DefaultBlockSize
+	}
+	if opts.BlockSize < 4096 || opts.BlockSize > 1<<20 || opts.BlockSize&(opts.BlockSize-1) != 0 {
+		return nil, fmt.Errorf("%w: block size %d is not a power of two from 4KiB to 1MiB", ErrInvalidOption, opts.BlockSize)
+	}
+	sw := &Writer{w: w, opts: opts, block: make([]byte, opts.BlockSize)}
+	switch opts.Compression {
+	case "", CompressionGzip:
+		sw.opts.Compression = CompressionGzip
+		sw.comp = newGzipCompressor()
+	case CompressionZstd:
+		c, err := newZstdCompressor()
+		if err != nil {
+			return nil, err
+		}
+		sw.comp = c
+	case CompressionNone:
+		sw.comp = noCompressor{}
+	default:
+		return nil, fmt.Errorf("%w: compression %q, use %s, %s or %s", ErrInvalidOption, opts.Compression, CompressionGzip, CompressionZstd, CompressionNone)
+	}
+	f, err := os.CreateTemp(opts.TempDir, "squashfs")
+	if err != nil {
+		return nil, err
+	}
+	sw.spool = f
+	sw.root = &node{typ: typeDir, mode: 0755, children: map[string]*node{}, implicit: true}
+	return sw, nil
+}
+
+// Add stores an entry, r is read for regular files.
+// Missing parent directories are created, hardlinks are resolved by Close.
+// xattrs are read from the SCHILY.xattr PAX records, only the user, trusted and security namespaces are stored.
+func (w *Writer) Add(th *tar.Header, r io.Reader) error {
+	name := strings.Trim(path.Clean("/"+th.Name), "/")
+	n := &node{
+		mode:   uint16(th.Mode & 07777),
+		uid:    uint32(th.Uid),
+		gid:    uint32(th.Gid),
+		mtime:  clampTime(th.ModTime.Unix()),
+		xattrs: xattrs(th),
+		nlink:  1,
+	}
+	if n.mtime > w.modTime {
+		w.modTime = n.mtime
+	}
+	switch th.Typeflag {
+	case tar.TypeDir:
+		n.typ = typeDir
+		n.children = map[string]*node{}
+	case tar.TypeReg:
+		n.typ = typeFile
+		if err := w.data(n, r); err != nil {
+			return err
+		}
+	case tar.TypeSymlink:
+		n.typ = typeSymlink
+		n.target = th.Linkname
+	case tar.TypeLink:
+		if name == "" {
+			return fmt.Errorf("%w: hardlink to %s as the root", ErrInvalidEntry, th.Linkname)
+		}
+		w.links = append(w.links, link{name: name, target: strings.Trim(path.Clean("/"+th.Linkname), "/")})
+		return nil
+	case tar.TypeChar, tar.TypeBlock:
+		n.typ = typeChar
+		if th.Typeflag == tar.TypeBlock {
+			n.typ = typeBlock
+		}
+		n.rdev = encodeDev(uint32(th.Devmajor), uint32(th.Devminor))
+	case tar.TypeFifo:
+		n.typ = typeFifo
+	default:
+		// e.g. PAX global headers
+		return nil
+	}
+	if name == "" {
+		if n.typ != typeDir {
+			return fmt.Errorf("%w: the root is not a directory", ErrInvalidEntry)
+		}
+		n.children = w.root.children
+		w.root = n
+		return nil
+	}
+	parent, err := w.dir(path.Dir(name))
+	if err != nil {
+		return err
+	}
+	base := path.Base(name)
+	if len(base) > maxNameLen {
+		return fmt.Errorf("%w: name of %s is longer than %d bytes", ErrInvalidEntry, name, maxNameLen)
+	}
+	// a directory that exists keeps its content
+	if prev, ok := parent.children[base]; ok && prev.typ == typeDir && n.typ == typeDir {
+		n.children = prev.children
+	}
+	parent.children[base] = n
+	return nil
+}
+
+// dir returns the directory name, creating it and its parents when they are missing
+func (w *Writer) dir(name string) (*node, error) {
+	d := w.root
+	if name == "." {
+		return d, nil
+	}
+	for _, elem := range strings.Split(name, "/") {
+		c, ok := d.children[elem]
+		if !ok {
+			c = &node{typ: typeDir, mode: 0755, nlink: 1, children: map[string]*node{}, implicit: true}
+			d.children[elem] = c
+		} else if c.typ != typeDir {
+			return nil, fmt.Errorf("%w: parent %s of an entry is not a directory", ErrInvalidEntry, name)
+		}
+		d = c
+	}
+	return d, nil
+}
+
+// data compresses the content of a file into the spool
+func (w *Writer) data(n *node, r io.Reader) error {
+	n.start = superblockSize + w.spoolSize
+	for {
+		k, err := io.ReadFull(r, w.block)
+		if k > 0 {
+			if err := w.dataBlock(n, w.block[:k]); err != nil {
+				return err
+			}
+			n.size += uint64(k)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (w *Writer) dataBlock(n *node, b []byte) error {
+	if isZero(b) {
+		// a sparse block is not stored
+		n.blocks = append(n.blocks, 0)
+		n.sparse += uint64(len(b))
+		return nil
+	}
+	size := uint32(len(b)) | blockUncompBit
+	c, err := w.comp.compress(b)
+	if err != nil {
+		return err
+	}
+	if c != nil && len(c) < len(b) {
+		b, size = c, uint32(len(c))
+	}
+	if _, err := w.spool.Write(b); err != nil {
+		return err
+	}
+	w.spoolSize += uint64(len(b))
+	n.blocks = append(n.blocks, size)
+	return nil
+}
+
+// Close writes the image and removes the spooled data, the underlying writer is not closed
+func (w *Writer) Close() error {
+	defer os.Remove(w.spool.Name())
+	defer w.spool.Close()
+	for _, l := range w.links {
+		target, err := w.lookup(l.target)
+		if err != nil || target.typ == typeDir {
+			return fmt.Errorf("%w: hardlink %s to %s, which is not a file", ErrInvalidEntry, l.name, l.target)
+		}
+		parent, err := w.dir(path.Dir(l.name))
+		if err != nil {
+			return err
+		}
+		if prev, ok := parent.children[path.Base(l.name)]; ok && prev != target && prev.nlink > 1 {
+			prev.nlink--
+		}
+		parent.children[path.Base(l.name)] = target
+		target.nlink++
+	}
+
+	t := &tables{
+		inodes: &metaWriter{comp: w.comp},
+		dirs:   &metaWriter{comp: w.comp},
+		ids:    map[uint32]uint16{},
+		xattrs: map[string]uint32{},
+		kv:     &metaWriter{comp: w.comp},
+		xids:   &metaWriter{comp: w.comp},
+	}
+	var count uint32
+	number(w.root, &count, w.modTime)
+	if err := t.writeDir(w.root, count+1); err != nil {
+		return err
+	}
+	return w.writeImage(t, count)
+}
+
+// Discard removes the spooled data without writing the image, e.g. after an error
+func (w *Writer) Discard() error {
+	w.spool.Close()
+	return os.Remove(w.spool.Name())
+}
+
+// lookup returns the node of name
+func (w *Writer) lookup(name string) (*node, error) {
+	n := w.root
+	if name == "" {
+		return n, nil
+	}
+	for _, elem := range strings.Split(name, "/") {
+		c, ok := n.children[elem]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s not found", ErrInvalidEntry, name)
+		}
+		n = c
+	}
+	return n, nil
+}
+
+// number assigns the inode numbers in the order the inodes are written, the children before their directory
+func number(d *node, count *uint32, modTime uint32) {
+	if d.implicit {
+		d.mtime = modTime
+	}
+	for _, name := range sortedNames(d) {
+		c := d.children[name]
+		if c.typ == typeDir {
+			number(c, count, modTime)
+		} else if c.number == 0 {
+			*count++
+			c.number = *count
+		}
+	}
+	*count++
+	d.number = *count
+}
+
+func (w *Writer) writeImage(t *tables, count uint32) error {
+	var flags uint16 = flagNoFragments
+	if w.opts.Compression == CompressionNone {
+		flags |= flagUncompressedInodes | flagUncompressedData | flagUncompressedFragments | flagUncompressedXattrs | flagUncompressedIDs
+	}
+	compID := uint16(compressionIDGzip)
+	if w.opts.Compression == CompressionZstd {
+		compID = compressionIDZstd
+	}
+
+	pos := superblockSize + w.spoolSize
+	var tail []byte
+	appendTable := func(b []byte) uint64 {
+		start := pos
+		tail = append(tail, b...)
+		pos += uint64(len(b))
+		return start
+	}
+	inodes, err := t.inodes.finish()
+	if err != nil {
+		return err
+	}
+	inodeStart := appendTable(inodes)
+	dirs, err := t.dirs.finish()
+	if err != nil {
+		return err
+	}
+	dirStart := appendTable(dirs)
+	fragStart := pos
+
+	// the id table is a list of the locations of its metadata blocks
+	idMeta := &metaWriter{comp: w.comp}
+	for _, id := range t.idList {
+		idMeta.write(le{}.u32(id))
+	}
+	ids, err := idMeta.finish()
+	if err != nil {
+		return err
+	}
+	idBlocks := appendTable(ids)
+	idIndex := le{}
+	for _, s := range idMeta.starts {
+		idIndex = idIndex.u64(idBlocks + uint64(s))
+	}
+	idStart := appendTable(idIndex)
+
+	xattrStart := uint64(noTable)
+	if len(t.xattrList) == 0 {
+		flags |= flagNoXattrs
+	} else {
+		kv, err := t.kv.finish()
+		if err != nil {
+			return err
+		}
+		kvStart := appendTable(kv)
+		xids, err := t.xids.finish()
+		if err != nil {
+			return err
+		}
+		xidBlocks := appendTable(xids)
+		header := le{}.u64(kvStart).u32(uint32(len(t.xattrList))).u32(0)
+		for _, s := range t.xids.starts {
+			header = header.u64(xidBlocks + uint64(s))
+		}
+		xattrStart = appendTable(header)
+	}
+
+	sb := le{}.u32(magic).u32(count).u32(w.modTime).u32(uint32(w.opts.BlockSize)).u32(0).
+		u16(compID).u16(uint16(math.Log2(float64(w.opts.BlockSize)))).u16(flags).u16(uint16(len(t.idList))).u16(4).u16(0).
+		u64(w.root.ref).u64(pos).u64(idStart).u64(xattrStart).u64(inodeStart).u64(dirStart).u64(fragStart).u64(noTable)
+	if _, err := w.w.Write(sb); err != nil {
+		return err
+	}
+	if _, err := w.spool.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := io.Copy(w.w, w.spool); err != nil {
+		return err
+	}
+	// images are padded to 4KiB for loop devices
+	if pad := (padding - pos%padding) % padding; pad > 0 {
+		tail = append(tail, make([]byte, pad)...)
+	}
+	_, err = w.w.Write(tail)
+	return err
+}
+
+// tables collects the inode, directory, id and xattr tables
+type tables struct {
+	inodes, dirs *metaWriter
+	ids          map[uint32]uint16
+	idList       []uint32
+	xattrs       map[string]uint32
+	xattrList    []string
+	kv, xids     *metaWriter
+}
+
+func (t *tables) id(v uint32) (uint16, error) {
+	if i, ok := t.ids[v]; ok {
+		return i, nil
+	}
+	if len(t.idList) == maxIDs {
+		return 0, fmt.Errorf("%w: more than %d uids and gids", ErrInvalidEntry, maxIDs)
+	}
+	i := uint16(len(t.idList))
+	t.ids[v] = i
+	t.idList = append(t.idList, v)
+	return i, nil
+}
+
+// xattr returns the index of the xattr set of n, identical sets are stored once
+func (t *tables) xattr(n *node) uint32 {
+	if len(n.xattrs) == 0 {
+		return noXattr
+	}
+	keys := make([]string, 0, len(n.xattrs))
+	for k := range n.xattrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var set []byte
+	for _, k := range keys {
+		prefix := strings.SplitN(k, ".", 2)
+		set = le(set).u16(xattrPrefixes[prefix[0]+"."]).u16(uint16(len(prefix[1])))
+		set = append(set, prefix[1]...)
+		set = le(set).u32(uint32(len(n.xattrs[k])))
+		set = append(set, n.xattrs[k]...)
+	}
+	if i, ok := t.xattrs[string(set)]; ok {
+		return i
+	}
+	i := uint32(len(t.xattrList))
+	t.xattrs[string(set)] = i
+	t.xattrList = append(t.xattrList, string(set))
+	ref := t.kv.ref()
+	t.kv.write(set)
+	t.xids.write(le{}.u64(ref).u32(uint32(len(keys))).u32(uint32(len(set))))
+	return i
+}
+
+// writeDir writes the inodes below d, the listing of d and the inode of d
+func (t *tables) writeDir(d *node, parent uint32) error {
+	names := sortedNames(d)
+	subdirs := uint32(0)
+	for _, name := range names {
+		c := d.children[name]
+		if c.typ == typeDir {
+			subdirs++
+			if err := t.writeDir(c, d.number); err != nil {
+				return err
+			}
+		} else if !c.written {
+			if err := t.writeInode(c, 0, 0, 0); err != nil {
+				return err
+			}
+		}
+	}
+
+	// entries are grouped by the metadata block of their inode
+	var listing le
+	for i := 0; i < len(names); {
+		first := d.children[names[i]]
+		block := uint32(first.ref >> 16)
+		j := i
+		for j < len(names) && j-i < maxDirEntries {
+			c := d.children[names[j]]
+			delta := int64(c.number) - int64(first.number)
+			if uint32(c.ref>>16) != block || delta < math.MinInt16 || delta > math.MaxInt16 {
+				break
+			}
+			j++
+		}
+		listing = listing.u32(uint32(j - i - 1)).u32(block).u32(first.number)
+		for _, name := range names[i:j] {
+			c := d.children[name]
+			listing = listing.u16(uint16(c.ref & 0xffff)).u16(uint16(int16(int64(c.number) - int64(first.number)))).u16(c.typ).u16(uint16(len(name) - 1))
+			listing = append(listing, name...)
+		}
+		i = j
+	}
+	d.nlink = 2 + subdirs
+	ref := t.dirs.ref()
+	t.dirs.write(listing)
+	return t.writeInode(d, ref, uint32(len(listing)+3), parent)
+}
+
+// writeInode appends the inode of n, for a directory with the reference and size of its listing
+func (t *tables) writeInode(n *node, listing uint64, size, parent uint32) error {
+	uid, err := t.id(n.uid)
+	if err != nil {
+		return err
+	}
+	gid, err := t.id(n.gid)
+	if err != nil {
+		return err
+	}
+	xattr := t.xattr(n)
+	typ := n.typ
+	ext := xattr != noXattr
+	if typ == typeFile && (n.start > math.MaxUint32 || n.size > math.MaxUint32 || n.nlink > 1 || n.sparse > 0) {
+		ext = true
+	}
+	if typ == typeDir && size > math.MaxUint16 {
+		ext = true
+	}
+	if ext {
+		typ += extType
+	}
+	b := le{}.u16(typ).u16(n.mode).u16(uid).u16(gid).u32(n.mtime).u32(n.number)
+	switch typ {
+	case typeDir:
+		b = b.u32(uint32(listing >> 16)).u32(n.nlink).u16(uint16(size)).u16(uint16(listing & 0xffff)).u32(parent)
+	case typeDir + extType:
+		b = b.u32(n.nlink).u32(size).u32(uint32(listing >> 16)).u32(parent).u16(0).u16(uint16(listing & 0xffff)).u32(xattr)
+	case typeFile:
+		b = b.u32(uint32(n.start)).u32(noFragment).u32(0).u32(uint32(n.size))
+	case typeFile + extType:
+		b = b.u64(n.start).u64(n.size).u64(n.sparse).u32(n.nlink).u32(noFragment).u32(0).u32(xattr)
+	case typeSymlink, typeSymlink + extType:
+		b = b.u32(n.nlink).u32(uint32(len(n.target)))
+		b = append(b, n.target...)
+	case typeBlock, typeChar, typeBlock + extType, typeChar + extType:
+		b = b.u32(n.nlink).u32(n.rdev)
+	case typeFifo, typeSocket, typeFifo + extType, typeSocket + extType:
+		b = b.u32(n.nlink)
+	}
+	switch typ {
+	case typeFile, typeFile + extType:
+		for _, s := range n.blocks {
+			b = b.u32(s)
+		}
+	case typeSymlink + extType, typeBlock + extType, typeChar + extType, typeFifo + extType, typeSocket + extType:
+		b = b.u32(xattr)
+	}
+	n.ref = t.inodes.ref()
+	n.written = true
+	t.inodes.write(b)
+	return nil
+}
+
+var xattrPrefixes = map[string]uint16{"user.": 0, "trusted.": 1, "security.": 2}
+
+// xattrs returns the xattrs of th that squashfs can store
+func xattrs(th *tar.Header) map[string]string {
+	var x map[string]string
+	for k, v := range th.PAXRecords {
+		name, ok := strings.CutPrefix(k, "SCHILY.xattr.")
+		if !ok {
+			continue
+		}
+		prefix, rest, _ := strings.Cut(name, ".")
+		if _, ok := xattrPrefixes[prefix+"."]; !ok || rest == "" {
+			continue
+		}
+		if x == nil {
+			x = map[string]string{}
+		}
+		x[name] = v
+	}
+	return x
+}
+
+func sortedNames(d *node) []string {
+	names := make([]string, 0, len(d.children))
+	for name := range d.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// encodeDev encodes a device number like the Linux new_encode_dev
+func encodeDev(major, minor uint32) uint32 {
+	return minor&0xff | major<<8&0xfff00 | (minor&^0xff)<<12
+}
+
+func clampTime(t int64) uint32 {
+	if t < 0 {
+		return 0
+	}
+	if t > math.MaxUint32 {
+		return math.MaxUint32
+	}
+	return uint32(t)
+}
+
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
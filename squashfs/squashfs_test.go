@@ -0,0 +1,334 @@
+package squashfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/require"
+)
+
+var testTime = time.Date(2023, 5, 3, 8, 0, 0, 0, time.UTC)
+
+// testImage writes the entries of a small filesystem into an image
+func testImage(t *testing.T, opts Options, big string) []byte {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	opts.TempDir = t.TempDir()
+	w, err := NewWriter(buf, opts)
+	require.NoError(t, err)
+	add := func(th *tar.Header, content string) {
+		th.ModTime = testTime
+		th.Size = int64(len(content))
+		require.NoError(t, w.Add(th, strings.NewReader(content)))
+	}
+	add(&tar.Header{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0750, Uid: 0, Gid: 42}, "")
+	add(&tar.Header{Name: "etc/hosts", Typeflag: tar.TypeReg, Mode: 0644, Uid: 1000, Gid: 1000, PAXRecords: map[string]string{
+		"SCHILY.xattr.user.test":        "value",
+		"SCHILY.xattr.system.posix_acl": "skipped",
+	}}, "127.0.0.1 localhost\n")
+	add(&tar.Header{Name: "usr/bin/app", Typeflag: tar.TypeReg, Mode: 0755}, big)
+	add(&tar.Header{Name: "usr/bin/sh", Typeflag: tar.TypeSymlink, Linkname: "app", Mode: 0777}, "")
+	add(&tar.Header{Name: "usr/bin/app2", Typeflag: tar.TypeLink, Linkname: "usr/bin/app"}, "")
+	add(&tar.Header{Name: "dev/null", Typeflag: tar.TypeChar, Devmajor: 1, Devminor: 3, Mode: 0666}, "")
+	add(&tar.Header{Name: "run/fifo", Typeflag: tar.TypeFifo, Mode: 0600}, "")
+	for i := 0; i < 300; i++ {
+		add(&tar.Header{Name: path.Join("many", strings.Repeat("f", 1+i%200)+string(rune('a'+i/200))), Typeflag: tar.TypeReg, Mode: 0644}, "x")
+	}
+	require.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+func testBig() string {
+	return strings.Repeat("squashfs", 2*DefaultBlockSize/8) + strings.Repeat("\x00", 3*DefaultBlockSize) + "end"
+}
+
+func TestWriter(t *testing.T) {
+	big := testBig()
+	for _, comp := range []string{CompressionGzip, CompressionZstd, CompressionNone} {
+		t.Run(comp, func(t *testing.T) {
+			img := testImage(t, Options{Compression: comp}, big)
+			require.Zero(t, len(img)%padding)
+			r := newTestReader(t, img)
+			require.EqualValues(t, 17, r.sb.BlockLog)
+
+			root := r.dir(t, r.sb.Root)
+			require.Equal(t, []string{"dev", "etc", "many", "run", "usr"}, names(root))
+			etc := r.inode(t, root["etc"].ref)
+			require.EqualValues(t, 0750, etc.mode)
+			require.EqualValues(t, 42, r.ids[etc.gid])
+			require.EqualValues(t, testTime.Unix(), etc.mtime)
+
+			hosts := r.inode(t, r.dir(t, root["etc"].ref)["hosts"].ref)
+			require.EqualValues(t, typeFile+extType, hosts.typ)
+			require.EqualValues(t, 1000, r.ids[hosts.uid])
+			require.Equal(t, "127.0.0.1 localhost\n", r.read(t, hosts))
+			require.NotEqual(t, uint32(noXattr), hosts.xattr)
+
+			bin := r.dir(t, r.dir(t, root["usr"].ref)["bin"].ref)
+			require.Equal(t, []string{"app", "app2", "sh"}, names(bin))
+			app := r.inode(t, bin["app"].ref)
+			require.Equal(t, bin["app"].ref, bin["app2"].ref)
+			require.EqualValues(t, 2, app.nlink)
+			require.EqualValues(t, 3*DefaultBlockSize, app.sparse)
+			require.Equal(t, big, r.read(t, app))
+			require.Equal(t, "app", r.inode(t, bin["sh"].ref).target)
+
+			null := r.inode(t, r.dir(t, root["dev"].ref)["null"].ref)
+			require.EqualValues(t, typeChar, null.typ)
+			require.Equal(t, encodeDev(1, 3), null.rdev)
+
+			// more entries than a directory header holds
+			require.Len(t, r.dir(t, root["many"].ref), 300)
+		})
+	}
+
+	_, err := NewWriter(&bytes.Buffer{}, Options{Compression: "lzo"})
+	require.ErrorIs(t, err, ErrInvalidOption)
+	_, err = NewWriter(&bytes.Buffer{}, Options{BlockSize: 1000})
+	require.ErrorIs(t, err, ErrInvalidOption)
+
+	w, err := NewWriter(&bytes.Buffer{}, Options{TempDir: t.TempDir()})
+	require.NoError(t, err)
+	require.NoError(t, w.Add(&tar.Header{Name: "a", Typeflag: tar.TypeLink, Linkname: "missing"}, nil))
+	require.ErrorIs(t, w.Close(), ErrInvalidEntry)
+}
+
+// TestMount checks the image with the squashfs driver of the kernel, it needs root and loop devices
+func TestMount(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("mounting needs root")
+	}
+	big := testBig()
+	for _, comp := range []string{CompressionGzip, CompressionZstd} {
+		file := filepath.Join(t.TempDir(), "image.sqfs")
+		require.NoError(t, os.WriteFile(file, testImage(t, Options{Compression: comp}, big), 0644))
+		dir := t.TempDir()
+		if out, err := exec.Command("mount", "-t", "squashfs", "-o", "loop,ro", file, dir).CombinedOutput(); err != nil {
+			t.Skipf("mount failed: %v: %s", err, out)
+		}
+		defer exec.Command("umount", dir).Run()
+
+		b, err := os.ReadFile(filepath.Join(dir, "usr/bin/app"))
+		require.NoError(t, err)
+		require.Equal(t, big, string(b), comp)
+		target, err := os.Readlink(filepath.Join(dir, "usr/bin/sh"))
+		require.NoError(t, err)
+		require.Equal(t, "app", target)
+		fi, err := os.Stat(filepath.Join(dir, "usr/bin/app2"))
+		require.NoError(t, err)
+		require.EqualValues(t, 2, fi.Sys().(*syscall.Stat_t).Nlink)
+		fi, err = os.Stat(filepath.Join(dir, "etc/hosts"))
+		require.NoError(t, err)
+		require.EqualValues(t, 1000, fi.Sys().(*syscall.Stat_t).Uid)
+		value := make([]byte, 16)
+		n, err := syscall.Getxattr(filepath.Join(dir, "etc/hosts"), "user.test", value)
+		require.NoError(t, err)
+		require.Equal(t, "value", string(value[:n]))
+		entries, err := os.ReadDir(filepath.Join(dir, "many"))
+		require.NoError(t, err)
+		require.Len(t, entries, 300)
+		require.NoError(t, exec.Command("umount", dir).Run())
+	}
+}
+
+// testReader is a minimal squashfs reader for the images of the Writer
+type testReader struct {
+	img []byte
+	sb  testSuperblock
+	ids []uint32
+}
+
+type testSuperblock struct {
+	Inodes, ModTime, BlockSize, Fragments        uint32
+	Compression, BlockLog, Flags, IDCount        uint16
+	Major, Minor                                 uint16
+	Root, BytesUsed, IDTable, XattrTable         uint64
+	InodeTable, DirTable, FragTable, ExportTable uint64
+}
+
+type testInode struct {
+	typ, mode, uid, gid     uint16
+	mtime, number, nlink    uint32
+	start, size, sparse     uint64
+	blocks                  []uint32
+	target                  string
+	rdev, xattr             uint32
+	dirStart, dirOff, dsize uint32
+}
+
+type testEntry struct {
+	ref uint64
+	typ uint16
+}
+
+func newTestReader(t *testing.T, img []byte) *testReader {
+	t.Helper()
+	r := &testReader{img: img}
+	require.NoError(t, binary.Read(bytes.NewReader(img[4:]), binary.LittleEndian, &r.sb))
+	require.Equal(t, uint32(magic), binary.LittleEndian.Uint32(img))
+	require.EqualValues(t, 4, r.sb.Major)
+	require.EqualValues(t, flagNoFragments, r.sb.Flags&flagNoFragments)
+	require.LessOrEqual(t, r.sb.BytesUsed, uint64(len(img)))
+	for i := 0; i < int(r.sb.IDCount); i++ {
+		block := binary.LittleEndian.Uint64(img[r.sb.IDTable+uint64(i*4/metadataSize*8):])
+		b := r.meta(t, block, uint32(i*4%metadataSize), 4)
+		r.ids = append(r.ids, binary.LittleEndian.Uint32(b))
+	}
+	return r
+}
+
+// block returns the uncompressed block stored at off with the stored size
+func (r *testReader) block(t *testing.T, off uint64, size uint32, uncompressed bool) []byte {
+	t.Helper()
+	b := r.img[off : off+uint64(size)]
+	if uncompressed {
+		return b
+	}
+	var rd io.Reader
+	var err error
+	if r.sb.Compression == compressionIDZstd {
+		rd, err = zstd.NewReader(bytes.NewReader(b))
+	} else {
+		rd, err = zlib.NewReader(bytes.NewReader(b))
+	}
+	require.NoError(t, err)
+	out, err := io.ReadAll(rd)
+	require.NoError(t, err)
+	return out
+}
+
+// meta reads n bytes from the metadata blocks starting at the block at off
+func (r *testReader) meta(t *testing.T, off uint64, offset uint32, n int) []byte {
+	t.Helper()
+	var out []byte
+	for len(out) < int(offset)+n {
+		h := binary.LittleEndian.Uint16(r.img[off:])
+		size := uint32(h &^ metaUncompBit)
+		out = append(out, r.block(t, off+2, size, h&metaUncompBit != 0)...)
+		off += 2 + uint64(size)
+	}
+	return out[offset : int(offset)+n]
+}
+
+func (r *testReader) inode(t *testing.T, ref uint64) testInode {
+	t.Helper()
+	// inodes are shorter than this, except for the block list of large files
+	b := r.metaRest(t, r.sb.InodeTable+ref>>16, uint32(ref&0xffff), r.sb.DirTable)
+	in := testInode{}
+	d := bytes.NewReader(b)
+	read := func(v ...interface{}) {
+		for _, x := range v {
+			require.NoError(t, binary.Read(d, binary.LittleEndian, x))
+		}
+	}
+	var frag, fragOff, size32, start32, idx uint32
+	var size16, off16, idxCount uint16
+	read(&in.typ, &in.mode, &in.uid, &in.gid, &in.mtime, &in.number)
+	switch in.typ {
+	case typeDir:
+		read(&in.dirStart, &in.nlink, &size16, &off16, &idx)
+		in.dsize, in.dirOff, in.xattr = uint32(size16), uint32(off16), noXattr
+	case typeDir + extType:
+		read(&in.nlink, &in.dsize, &in.dirStart, &idx, &idxCount, &off16, &in.xattr)
+		in.dirOff = uint32(off16)
+	case typeFile:
+		read(&start32, &frag, &fragOff, &size32)
+		in.start, in.size, in.nlink, in.xattr = uint64(start32), uint64(size32), 1, noXattr
+	case typeFile + extType:
+		read(&in.start, &in.size, &in.sparse, &in.nlink, &frag, &fragOff, &in.xattr)
+	case typeSymlink:
+		read(&in.nlink, &size32)
+		target := make([]byte, size32)
+		read(target)
+		in.target = string(target)
+	case typeChar, typeBlock:
+		read(&in.nlink, &in.rdev)
+	case typeFifo, typeSocket:
+		read(&in.nlink)
+	default:
+		t.Fatalf("unexpected inode type %d", in.typ)
+	}
+	if in.typ == typeFile || in.typ == typeFile+extType {
+		require.Equal(t, uint32(noFragment), frag)
+		in.blocks = make([]uint32, (in.size+uint64(r.sb.BlockSize)-1)/uint64(r.sb.BlockSize))
+		read(in.blocks)
+	}
+	return in
+}
+
+// metaRest reads the metadata blocks from off up to end, starting at offset
+func (r *testReader) metaRest(t *testing.T, off uint64, offset uint32, end uint64) []byte {
+	t.Helper()
+	var out []byte
+	for off < end {
+		h := binary.LittleEndian.Uint16(r.img[off:])
+		size := uint32(h &^ metaUncompBit)
+		out = append(out, r.block(t, off+2, size, h&metaUncompBit != 0)...)
+		off += 2 + uint64(size)
+	}
+	return out[offset:]
+}
+
+func (r *testReader) dir(t *testing.T, ref uint64) map[string]testEntry {
+	t.Helper()
+	in := r.inode(t, ref)
+	require.EqualValues(t, typeDir, (in.typ-1)%extType+1)
+	b := r.metaRest(t, r.sb.DirTable+uint64(in.dirStart), in.dirOff, r.sb.FragTable)[:in.dsize-3]
+	entries := map[string]testEntry{}
+	for len(b) > 0 {
+		count := binary.LittleEndian.Uint32(b) + 1
+		block := binary.LittleEndian.Uint32(b[4:])
+		require.LessOrEqual(t, count, uint32(maxDirEntries))
+		b = b[12:]
+		for i := uint32(0); i < count; i++ {
+			off := binary.LittleEndian.Uint16(b)
+			typ := binary.LittleEndian.Uint16(b[4:])
+			size := int(binary.LittleEndian.Uint16(b[6:])) + 1
+			entries[string(b[8:8+size])] = testEntry{ref: uint64(block)<<16 | uint64(off), typ: typ}
+			b = b[8+size:]
+		}
+	}
+	return entries
+}
+
+func (r *testReader) read(t *testing.T, in testInode) string {
+	t.Helper()
+	var out []byte
+	off := in.start
+	for i, s := range in.blocks {
+		n := uint64(r.sb.BlockSize)
+		if rest := in.size - uint64(i)*n; rest < n {
+			n = rest
+		}
+		if s == 0 {
+			out = append(out, make([]byte, n)...)
+			continue
+		}
+		size := s &^ blockUncompBit
+		out = append(out, r.block(t, off, size, s&blockUncompBit != 0)...)
+		off += uint64(size)
+	}
+	return string(out)
+}
+
+func names(entries map[string]testEntry) []string {
+	n := []string{}
+	for name := range entries {
+		n = append(n, name)
+	}
+	sort.Strings(n)
+	return n
+}
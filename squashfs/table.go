@@ -0,0 +1,123 @@
+package squashfs
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	metadataSize   = 8192
+	metaUncompBit  = 0x8000
+	blockUncompBit = 1 << 24
+
+	compressionIDGzip = 1
+	compressionIDZstd = 6
+)
+
+// compressor compresses a data or metadata block, nil is returned when the block is stored uncompressed
+type compressor interface {
+	compress(b []byte) ([]byte, error)
+}
+
+type noCompressor struct{}
+
+func (noCompressor) compress(b []byte) ([]byte, error) { return nil, nil }
+
+// gzipCompressor writes zlib streams like mksquashfs -comp gzip
+type gzipCompressor struct {
+	buf bytes.Buffer
+	zw  *zlib.Writer
+}
+
+func newGzipCompressor() *gzipCompressor {
+	c := &gzipCompressor{}
+	c.zw, _ = zlib.NewWriterLevel(&c.buf, zlib.BestCompression)
+	return c
+}
+
+func (c *gzipCompressor) compress(b []byte) ([]byte, error) {
+	c.buf.Reset()
+	c.zw.Reset(&c.buf)
+	if _, err := c.zw.Write(b); err != nil {
+		return nil, err
+	}
+	if err := c.zw.Close(); err != nil {
+		return nil, err
+	}
+	return c.buf.Bytes(), nil
+}
+
+type zstdCompressor struct {
+	enc *zstd.Encoder
+	buf []byte
+}
+
+func newZstdCompressor() (*zstdCompressor, error) {
+	enc, err := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	return &zstdCompressor{enc: enc}, nil
+}
+
+func (c *zstdCompressor) compress(b []byte) ([]byte, error) {
+	c.buf = c.enc.EncodeAll(b, c.buf[:0])
+	return c.buf, nil
+}
+
+// metaWriter packs a table into metadata blocks of up to 8KiB, each prefixed with its stored size
+type metaWriter struct {
+	comp   compressor
+	out    []byte // stored blocks
+	buf    []byte // uncompressed content of the current block
+	starts []int  // offset of each stored block in out
+	err    error
+}
+
+// ref returns the reference of the next byte written: the offset of its block in the table and its offset in the block
+func (m *metaWriter) ref() uint64 {
+	return uint64(len(m.out))<<16 | uint64(len(m.buf))
+}
+
+func (m *metaWriter) write(p []byte) {
+	m.buf = append(m.buf, p...)
+	for len(m.buf) >= metadataSize {
+		m.flush(metadataSize)
+	}
+}
+
+// flush stores the first n bytes of buf as a block
+func (m *metaWriter) flush(n int) {
+	block := m.buf[:n]
+	m.starts = append(m.starts, len(m.out))
+	c, err := m.comp.compress(block)
+	if err != nil && m.err == nil {
+		m.err = err
+	}
+	if c != nil && len(c) < len(block) {
+		m.out = binary.LittleEndian.AppendUint16(m.out, uint16(len(c)))
+		m.out = append(m.out, c...)
+	} else {
+		m.out = binary.LittleEndian.AppendUint16(m.out, uint16(len(block))|metaUncompBit)
+		m.out = append(m.out, block...)
+	}
+	m.buf = append(m.buf[:0], m.buf[n:]...)
+}
+
+// finish stores the last block and returns the table
+func (m *metaWriter) finish() ([]byte, error) {
+	if len(m.buf) > 0 {
+		m.flush(len(m.buf))
+	}
+	return m.out, m.err
+}
+
+// le is a little endian encoder for the fixed size structures of the format
+type le []byte
+
+func (b le) u16(v uint16) le { return binary.LittleEndian.AppendUint16(b, v) }
+func (b le) u32(v uint32) le { return binary.LittleEndian.AppendUint32(b, v) }
+func (b le) u64(v uint64) le { return binary.LittleEndian.AppendUint64(b, v) }